@@ -0,0 +1,92 @@
+package messages
+
+import "time"
+
+// Event topic constants for RabbitMQ routing
+// Using hierarchical structure: <resource>.<event>
+// Consumers bind their own queues, e.g. with "file.*" for every file event or "#" for all of them.
+const (
+	// EventsExchange is the exchange name for lifecycle events published after successful operations
+	EventsExchange = "events"
+
+	// TopicStorageCreated is published when a storage location is created by an upload or copy
+	TopicStorageCreated = "storage.created"
+
+	// TopicFileUploaded is published for every file stored by an upload or copy, including overwrites
+	TopicFileUploaded = "file.uploaded"
+
+	// TopicFileDownloaded is published when a download starts; resumed ranges of it are not
+	TopicFileDownloaded = "file.downloaded"
+
+	// TopicFileDeleted is published when a file, or an older version of it, is deleted
+	TopicFileDeleted = "file.deleted"
+
+	// TopicStorageDeleted is published when a storage location is deleted with all its files
+	TopicStorageDeleted = "storage.deleted"
+
+	// TopicFileRestored is published when a deleted file is brought back from the trash
+	TopicFileRestored = "file.restored"
+
+	// TopicStorageRestored is published when a deleted storage location is brought back with all its files
+	TopicStorageRestored = "storage.restored"
+
+	// TopicVersionsPruned is published when older versions of a storage's files are pruned
+	TopicVersionsPruned = "storage.versions_pruned"
+)
+
+// Event holds the fields shared by every event
+type Event struct {
+	ID            string    `json:"id"`                       // Unique per event, lets consumers drop redeliveries
+	Type          string    `json:"type"`                     // Topic the event was published under
+	Source        string    `json:"source"`                   // Service that published it
+	TransactionID string    `json:"transaction_id,omitempty"` // Request that caused it
+	StorageID     string    `json:"storage_id"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+// StorageCreatedEvent is published under TopicStorageCreated
+type StorageCreatedEvent struct {
+	Event
+}
+
+// FileUploadedEvent is published under TopicFileUploaded
+type FileUploadedEvent struct {
+	Event
+	File FileInfo `json:"file"`
+}
+
+// FileDownloadedEvent is published under TopicFileDownloaded
+type FileDownloadedEvent struct {
+	Event
+	File   FileInfo `json:"file"`             // Version is set when an older version was downloaded
+	Length int64    `json:"length,omitempty"` // Bytes requested, if not the whole file
+}
+
+// FileDeletedEvent is published under TopicFileDeleted
+type FileDeletedEvent struct {
+	Event
+	File FileInfo `json:"file"` // As it was stored; Version is set when only that version was deleted
+}
+
+// StorageDeletedEvent is published under TopicStorageDeleted
+type StorageDeletedEvent struct {
+	Event
+}
+
+// FileRestoredEvent is published under TopicFileRestored
+type FileRestoredEvent struct {
+	Event
+	File FileInfo `json:"file"`
+}
+
+// StorageRestoredEvent is published under TopicStorageRestored
+type StorageRestoredEvent struct {
+	Event
+}
+
+// VersionsPrunedEvent is published under TopicVersionsPruned
+type VersionsPrunedEvent struct {
+	Event
+	Pruned int `json:"pruned"` // Older versions removed
+	Keep   int `json:"keep"`   // Older versions kept per file
+}
@@ -1,17 +1,47 @@
 package messages
 
+import "time"
+
 // FileInfo represents metadata about a stored file
 // This is a common representation used in messages
 type FileInfo struct {
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
+	Filename     string     `json:"filename"`       // Base name, e.g. "a.txt"
+	Path         string     `json:"path,omitempty"` // Relative path inside the storage, e.g. "docs/a.txt"
+	Size         int64      `json:"size"`
+	OriginalName string     `json:"original_name,omitempty"` // Path the file was uploaded as
+	ContentType  string     `json:"content_type,omitempty"`  // MIME type
+	SHA256       string     `json:"sha256,omitempty"`        // Hex-encoded SHA-256 of the content
+	UploadedAt   *time.Time `json:"uploaded_at,omitempty"`
+	Corrupted    bool       `json:"corrupted,omitempty"` // The content no longer matches SHA256 and can't be downloaded
+	Downloads    int64      `json:"downloads,omitempty"` // Set when the filemanager keeps a metadata index
+
+	// Set when the filemanager keeps versions of overwritten files
+	Version  int           `json:"version,omitempty"`  // Number of the current version
+	Versions []FileVersion `json:"versions,omitempty"` // Older versions still kept, newest first
+}
+
+// FileVersion describes an older version of a file
+type FileVersion struct {
+	Version    int        `json:"version"`
+	Size       int64      `json:"size"`
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
 }
 
 // FileManagerRequest represents a request for file operations
 type FileManagerRequest struct {
 	TransactionID string `json:"transaction_id"`
 	StorageID     string `json:"storage_id,omitempty"` // Optional, used for operations on existing storage
-	Filename      string `json:"filename,omitempty"`   // Optional, used for single file operations
+	Filename      string `json:"filename,omitempty"`   // Optional, used for single file operations (relative path, e.g. "docs/a.txt")
+	Offset        int64  `json:"offset,omitempty"`     // Optional, first byte to download for filemanager.get.file
+	Length        int64  `json:"length,omitempty"`     // Optional, bytes to download from Offset; 0 reads to the end
+	Version       int    `json:"version,omitempty"`    // Optional, version to download or delete; 0 means the current file
+	Keep          int    `json:"keep,omitempty"`       // Older versions per file to keep for filemanager.prune.versions
+	// For filemanager.copy.files: the files of StorageID to copy (all of them if empty)
+	// and the storage to copy them into (a new one if empty)
+	Filenames            []string `json:"filenames,omitempty"`
+	DestinationStorageID string   `json:"destination_storage_id,omitempty"`
+	// For filemanager.commit.upload and filemanager.abort.upload, TransactionID is the
+	// UploadTransactionID the files were sent with
 	// For file uploads, the file content should be sent as a separate message or via a different mechanism
 	// For now, we'll handle file content separately
 }
@@ -27,6 +57,8 @@ type FileUploadRequest struct {
 	IsChunked     bool   `json:"is_chunked,omitempty"`   // true if this is part of a chunked upload
 	ChunkIndex    int    `json:"chunk_index,omitempty"`  // chunk index (0-based)
 	TotalChunks   int    `json:"total_chunks,omitempty"` // total number of chunks
+	// Optional, stages the file in a multi-file upload until filemanager.commit.upload
+	UploadTransactionID string `json:"upload_transaction_id,omitempty"`
 }
 
 // FileChunkRequest represents a single chunk of a file
@@ -39,17 +71,34 @@ type FileChunkRequest struct {
 	ChunkSize     int64  `json:"chunk_size"`   // size of this chunk in bytes
 	TotalSize     int64  `json:"total_size"`   // total file size in bytes
 	Content       string `json:"content"`      // base64 encoded chunk content
+	// Optional, stages the file in a multi-file upload until filemanager.commit.upload
+	UploadTransactionID string `json:"upload_transaction_id,omitempty"`
 }
 
+// Error codes set in FileManagerResponse.ErrorCode so callers can react to specific failures
+const (
+	ErrorCodeQuotaExceeded       = "quota_exceeded"       // The upload would push its storage past the per-storage quota
+	ErrorCodeInsufficientStorage = "insufficient_storage" // The filemanager has no capacity left for the upload
+	ErrorCodeVersionNotFound     = "version_not_found"    // The requested version of the file isn't kept
+	ErrorCodeFileExists          = "file_exists"          // A file is already stored under the name being restored
+	ErrorCodeFileCorrupted       = "file_corrupted"       // The stored content failed its integrity check
+	ErrorCodeNotFound            = "not_found"            // The storage or file doesn't exist
+	ErrorCodeInvalidFilename     = "invalid_filename"     // The uploaded name is empty or tries to leave its storage
+	ErrorCodeUploadAborted       = "upload_aborted"       // The multi-file upload was aborted, e.g. after a timeout
+)
+
 // FileManagerResponse represents a response from filemanager service
 type FileManagerResponse struct {
 	TransactionID string                 `json:"transaction_id"`
 	Success       bool                   `json:"success"`
 	Error         string                 `json:"error,omitempty"`
+	ErrorCode     string                 `json:"error_code,omitempty"` // One of the ErrorCode constants, empty for other errors
 	StorageID     string                 `json:"storage_id,omitempty"`
 	Files         []FileInfo             `json:"files,omitempty"`
 	TotalSize     int64                  `json:"total_size,omitempty"`
-	Data          map[string]interface{} `json:"data,omitempty"` // For additional response data
+	CreatedAt     *time.Time             `json:"created_at,omitempty"` // Storage creation time, from its manifest
+	ExpiresAt     *time.Time             `json:"expires_at,omitempty"` // Storage expiry, nil if it never expires
+	Data          map[string]interface{} `json:"data,omitempty"`       // For additional response data
 }
 
 // FileChunkResponse represents a single chunk of a file being sent from filemanager
@@ -52,6 +52,24 @@ const (
 	// TopicFileManagerDeleteFolder is for deleting an entire storage folder and all its files
 	TopicFileManagerDeleteFolder = "filemanager.delete.folder"
 
+	// TopicFileManagerPruneVersions is for dropping older versions of the files in a storage location
+	TopicFileManagerPruneVersions = "filemanager.prune.versions"
+
+	// TopicFileManagerRestoreFile is for bringing back a deleted file from the trash
+	TopicFileManagerRestoreFile = "filemanager.restore.file"
+
+	// TopicFileManagerRestoreFolder is for bringing back a deleted storage folder from the trash
+	TopicFileManagerRestoreFolder = "filemanager.restore.folder"
+
+	// TopicFileManagerCopyFiles is for copying files of a storage location into another (creates new storage if the destination is empty)
+	TopicFileManagerCopyFiles = "filemanager.copy.files"
+
+	// TopicFileManagerCommitUpload is for storing the files staged by a multi-file upload
+	TopicFileManagerCommitUpload = "filemanager.commit.upload"
+
+	// TopicFileManagerAbortUpload is for discarding the files staged by a multi-file upload
+	TopicFileManagerAbortUpload = "filemanager.abort.upload"
+
 	// Response topics - responses from filemanager service
 	// TopicFileManagerResponse is the base topic for responses
 	// Format: filemanager.response.<operation>.<transaction-id>
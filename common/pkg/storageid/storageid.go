@@ -0,0 +1,134 @@
+// Package storageid generates and validates the storage IDs that make up share URLs
+// A share has no access control beyond its unguessable URL, so IDs are drawn from crypto/rand.
+package storageid
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/env"
+)
+
+// Alphabet holds the characters of an ID, in the order used by the check character
+const Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	// DefaultLength keeps IDs as long as the ones handed out before the length was configurable
+	DefaultLength = 10
+	// MinLength gives about 47 bits of entropy; anything shorter can be enumerated
+	MinLength = 8
+	// MaxLength keeps IDs usable as a single path segment
+	MaxLength = 64
+)
+
+// ErrInvalid is wrapped by every validation error
+var ErrInvalid = errors.New("invalid storage ID")
+
+// Format describes the IDs in use
+// The filemanager and the gateway must be configured with the same format. Changing it leaves
+// shares created under the old format unreachable; the default accepts the 10 lowercase hex
+// characters handed out before this package existed.
+type Format struct {
+	Length   int  // Random characters per ID
+	Checksum bool // Append a check character so typos are caught without a lookup
+}
+
+// Default is the format used when none is configured
+var Default = Format{Length: DefaultLength}
+
+// NewFormat returns the format for IDs of length random characters, optionally followed by a check character
+func NewFormat(length int, checksum bool) (Format, error) {
+	if length < MinLength || length > MaxLength {
+		return Format{}, fmt.Errorf("storage ID length must be between %d and %d, got %d", MinLength, MaxLength, length)
+	}
+	return Format{Length: length, Checksum: checksum}, nil
+}
+
+// Environment variables read by FormatFromEnv
+// Both services read the same ones, so a shared .env keeps their formats in step.
+const (
+	EnvLength   = "STORAGE_ID_LENGTH"   // Random base62 characters per ID
+	EnvChecksum = "STORAGE_ID_CHECKSUM" // "true" appends a check character
+)
+
+// FormatFromEnv returns the format configured by EnvLength and EnvChecksum
+// Unset variables keep the values of Default.
+func FormatFromEnv() (Format, error) {
+	length, err := strconv.Atoi(env.GetEnv(EnvLength, strconv.Itoa(Default.Length)))
+	if err != nil {
+		return Format{}, fmt.Errorf("invalid %s: %w", EnvLength, err)
+	}
+	checksum, err := strconv.ParseBool(env.GetEnv(EnvChecksum, strconv.FormatBool(Default.Checksum)))
+	if err != nil {
+		return Format{}, fmt.Errorf("invalid %s: %w", EnvChecksum, err)
+	}
+	return NewFormat(length, checksum)
+}
+
+// Size returns the length of an ID, including its check character
+func (f Format) Size() int {
+	if f.Checksum {
+		return f.Length + 1
+	}
+	return f.Length
+}
+
+// Generate returns a new random base62 ID
+func (f Format) Generate() (string, error) {
+	id := make([]byte, 0, f.Size())
+	// Bytes from 248 up are dropped so every character is equally likely
+	const limit = 256 - 256%len(Alphabet)
+	buf := make([]byte, f.Length+f.Length/4+1)
+	for len(id) < f.Length {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to generate storage ID: %w", err)
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(id) < f.Length {
+				id = append(id, Alphabet[int(b)%len(Alphabet)])
+			}
+		}
+	}
+
+	if f.Checksum {
+		id = append(id, checkCharacter(string(id)))
+	}
+	return string(id), nil
+}
+
+// Validate reports whether id could have been generated in this format
+func (f Format) Validate(id string) error {
+	if len(id) != f.Size() {
+		return fmt.Errorf("%w: must be exactly %d characters", ErrInvalid, f.Size())
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(Alphabet, c) {
+			return fmt.Errorf("%w: only letters and digits are allowed", ErrInvalid)
+		}
+	}
+	if f.Checksum && checkCharacter(id[:f.Length]) != id[f.Length] {
+		return fmt.Errorf("%w: check character doesn't match, the ID may be mistyped", ErrInvalid)
+	}
+	return nil
+}
+
+// checkCharacter computes the Luhn mod 62 check character of id
+// It catches every single mistyped character and most swaps of neighbouring ones.
+func checkCharacter(id string) byte {
+	n := len(Alphabet)
+	sum := 0
+	factor := 2
+	for i := len(id) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(Alphabet, id[i])
+		sum += addend/n + addend%n
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+	}
+	return Alphabet[(n-sum%n)%n]
+}
@@ -0,0 +1,131 @@
+package storageid_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
+)
+
+func mustFormat(t *testing.T, length int, checksum bool) storageid.Format {
+	t.Helper()
+	f, err := storageid.NewFormat(length, checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestGenerateValidates(t *testing.T) {
+	formats := []storageid.Format{
+		storageid.Default,
+		mustFormat(t, storageid.MinLength, true),
+		mustFormat(t, storageid.MaxLength, true),
+		mustFormat(t, 16, false),
+	}
+	for _, f := range formats {
+		seen := make(map[string]bool)
+		for range 200 {
+			id, err := f.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(id) != f.Size() {
+				t.Errorf("%+v: generated %q of %d characters, want %d", f, id, len(id), f.Size())
+			}
+			if err := f.Validate(id); err != nil {
+				t.Errorf("%+v: generated %q fails validation: %v", f, id, err)
+			}
+			if seen[id] {
+				t.Errorf("%+v: generated %q twice", f, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	f := mustFormat(t, 10, false)
+	for _, id := range []string{
+		"",
+		"abc123def",   // Too short
+		"abc123def45", // Too long
+		"abc123-ef4",
+		"abc 23def4",
+		"abc12/def4",
+		"abc12édef", // 10 bytes, but é isn't base62
+	} {
+		if err := f.Validate(id); !errors.Is(err, storageid.ErrInvalid) {
+			t.Errorf("Validate(%q) = %v, want ErrInvalid", id, err)
+		}
+	}
+
+	// IDs handed out before the format was configurable stay valid under the default
+	if err := storageid.Default.Validate("abc123def4"); err != nil {
+		t.Errorf("default format rejects a legacy ID: %v", err)
+	}
+	// A check character makes the ID one character longer
+	if err := mustFormat(t, 10, true).Validate("abc123def4"); !errors.Is(err, storageid.ErrInvalid) {
+		t.Errorf("checksummed format accepts an ID without check character: %v", err)
+	}
+}
+
+// Every single mistyped character, including in the check character itself, must be caught
+func TestChecksumCatchesSingleCharacterErrors(t *testing.T) {
+	f := mustFormat(t, storageid.MinLength, true)
+	for range 20 {
+		id, err := f.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range len(id) {
+			for _, c := range storageid.Alphabet {
+				if byte(c) == id[i] {
+					continue
+				}
+				typo := id[:i] + string(c) + id[i+1:]
+				if err := f.Validate(typo); !errors.Is(err, storageid.ErrInvalid) {
+					t.Fatalf("typo %q of %q passes validation", typo, id)
+				}
+			}
+		}
+	}
+}
+
+func TestNewFormat(t *testing.T) {
+	for _, length := range []int{0, storageid.MinLength - 1, storageid.MaxLength + 1} {
+		if _, err := storageid.NewFormat(length, false); err == nil {
+			t.Errorf("NewFormat accepted length %d", length)
+		}
+	}
+	f := mustFormat(t, 12, true)
+	if f.Size() != 13 {
+		t.Errorf("Size() = %d, want 13", f.Size())
+	}
+}
+
+func TestFormatFromEnv(t *testing.T) {
+	f, err := storageid.FormatFromEnv()
+	if err != nil || f != storageid.Default {
+		t.Errorf("unset variables: got %+v, %v; want the default format", f, err)
+	}
+
+	t.Setenv(storageid.EnvLength, "16")
+	t.Setenv(storageid.EnvChecksum, "true")
+	f, err = storageid.FormatFromEnv()
+	if err != nil || f != (storageid.Format{Length: 16, Checksum: true}) {
+		t.Errorf("got %+v, %v; want 16 characters with a check character", f, err)
+	}
+
+	for key, value := range map[string]string{
+		storageid.EnvLength:   "999",
+		storageid.EnvChecksum: "maybe",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := storageid.FormatFromEnv(); err == nil {
+				t.Errorf("%s=%s accepted", key, value)
+			}
+		})
+	}
+}
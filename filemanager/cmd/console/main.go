@@ -7,7 +7,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
 	"github.com/google/uuid"
@@ -25,16 +28,60 @@ Options:
   -f <filename>          Filename (required for download)
   -o <output-path>       Output path for download (default: current directory)
   -storage <dir>          Storage directory (default: /tmp/fileDump)
+  -backend <name>        Storage backend: local, cas or s3 configured by the S3_* variables (default: local)
+  -conflict <policy>     Existing filenames: overwrite, reject or rename (default: overwrite)
+  -compression <codec>   Compress new files: none, gzip or zstd (default: none)
+  -key <base64>          Master key enabling encryption at rest (default: $ENCRYPTION_MASTER_KEY)
+  -previous-keys <list>  Former master keys, comma-separated (default: $ENCRYPTION_PREVIOUS_KEYS)
+  -rotate-key            Re-wrap every storage's data key under -key
+  -usage                 Show logical vs physical storage usage
+  -list                  List storages with their creation time and size, one page at a time
+  -after <storage-id>    Start the listing after this storage ID (default: first storage)
+  -limit <n>             Storages per listing page (default: 100)
+  -versioning            Keep overwritten files as numbered versions (needs -conflict overwrite)
+  -prune-versions <n>    Keep only the n newest older versions of every file in storage -s
+  -trash <duration>      Keep deleted files and storages restorable this long (default: $TRASH_RETENTION)
+  -restore               Restore file -f of storage -s from the trash, or storage -s without -f
+  -purge-trash           Permanently remove trash older than -trash
+  -scrub                 Re-hash every stored file and mark the ones that no longer match their checksum
+  -index <path>          SQLite metadata index read by listings (default: $METADATA_INDEX_PATH, empty disables)
+  -reindex               Rebuild the metadata index at -index from the storage backend
+  -migrate               Copy every storage to the -to backend and verify sizes and checksums;
+                        rerun with the same -migrate-state to resume or pick up new uploads
+  -to <name>             Destination backend for -migrate: local, cas or s3
+  -to-storage <dir>      Destination directory for -migrate to local or cas
+  -migrate-state <path>  File recording verified files (default: migrate-state.jsonl)
+  -delete-source         Delete each source storage once it is verified at the destination
+  -id-length <n>         Random characters per new storage ID, 8 to 64 (default: $STORAGE_ID_LENGTH or 10)
+  -id-checksum           Append a check character to storage IDs (default: $STORAGE_ID_CHECKSUM)
 
 Examples:
   filemanager -u /path/to/file.txt
   filemanager -u /path/to/folder/
   filemanager -d -s abc123def4 -f file.txt
   filemanager -d -s abc123def4 -f file.txt -o /path/to/output/
+  filemanager -backend cas -usage
+  filemanager -list -limit 50 -after abc123def4
+  filemanager -compression zstd -u /path/to/logs/
+  filemanager -rotate-key -key NEW_KEY -previous-keys OLD_KEY
+  filemanager -versioning -prune-versions 2 -s abc123def4
+  filemanager -trash 72h -restore -s abc123def4 -f file.txt
+  filemanager -trash 72h -purge-trash
+  filemanager -backend cas -scrub
+  filemanager -index /tmp/fileDump-index.db -reindex
+  filemanager -migrate -to cas -to-storage /srv/cthulhu
+  filemanager -migrate -to s3 -delete-source
 `
 )
 
 func main() {
+	// The storage ID flags default to the format the filemanager reads from the environment
+	envIDs, err := storageid.FormatFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	var (
 		uploadPath = flag.String("u", "", "Path to file to upload")
 		download   = flag.Bool("d", false, "Download a file")
@@ -42,6 +89,31 @@ func main() {
 		filename   = flag.String("f", "", "Filename (required for download)")
 		outputPath = flag.String("o", "", "Output path for download")
 		storage    = flag.String("storage", defaultStorageDir, "Storage directory")
+		backend    = flag.String("backend", repository.BackendLocal, "Storage backend (local, cas or s3)")
+		showUsage  = flag.Bool("usage", false, "Show storage usage")
+		conflict   = flag.String("conflict", string(repository.ConflictOverwrite), "Policy for existing filenames")
+		compress   = flag.String("compression", repository.CompressionNone, "Compression codec for new files")
+		masterKey  = flag.String("key", os.Getenv("ENCRYPTION_MASTER_KEY"), "Base64 master key enabling encryption at rest")
+		oldKeys    = flag.String("previous-keys", os.Getenv("ENCRYPTION_PREVIOUS_KEYS"), "Former master keys, comma-separated")
+		rotateKey  = flag.Bool("rotate-key", false, "Re-wrap every storage's data key under -key")
+		list       = flag.Bool("list", false, "List storages")
+		after      = flag.String("after", "", "Start the listing after this storage ID")
+		limit      = flag.Int("limit", repository.DefaultStoragePageSize, "Storages per listing page")
+		versioning = flag.Bool("versioning", false, "Keep overwritten files as numbered versions")
+		prune      = flag.Int("prune-versions", -1, "Older versions to keep per file in storage -s")
+		trash      = flag.String("trash", os.Getenv("TRASH_RETENTION"), "How long deleted content stays restorable")
+		restore    = flag.Bool("restore", false, "Restore file -f of storage -s, or storage -s, from the trash")
+		purgeTrash = flag.Bool("purge-trash", false, "Permanently remove trash older than -trash")
+		scrub      = flag.Bool("scrub", false, "Verify every stored file against its checksum")
+		indexPath  = flag.String("index", os.Getenv("METADATA_INDEX_PATH"), "SQLite metadata index read by listings")
+		reindex    = flag.Bool("reindex", false, "Rebuild the metadata index from the storage backend")
+		migrate    = flag.Bool("migrate", false, "Copy every storage to the -to backend")
+		toBackend  = flag.String("to", "", "Destination backend for -migrate")
+		toStorage  = flag.String("to-storage", "", "Destination directory for -migrate")
+		stateFile  = flag.String("migrate-state", "migrate-state.jsonl", "File recording verified files")
+		deleteSrc  = flag.Bool("delete-source", false, "Delete source storages once verified")
+		idLength   = flag.Int("id-length", envIDs.Length, "Random characters per storage ID")
+		idChecksum = flag.Bool("id-checksum", envIDs.Checksum, "Append a check character to storage IDs")
 	)
 
 	flag.Usage = func() {
@@ -51,14 +123,103 @@ func main() {
 	flag.Parse()
 
 	// Initialize repository and service
-	repo, err := repository.NewLocalRepository(*storage)
+	conflictPolicy, err := repository.ParseConflictPolicy(*conflict)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	compression, err := repository.ParseCompression(*compress)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var key []byte
+	if *masterKey != "" {
+		key, err = repository.ParseMasterKey(*masterKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	previousKeys, err := repository.ParseMasterKeys(*oldKeys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var trashRetention time.Duration
+	if *trash != "" {
+		trashRetention, err = time.ParseDuration(*trash)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid trash retention: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	idFormat, err := storageid.NewFormat(*idLength, *idChecksum)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	s3Config, err := s3ConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	cfg := repository.Config{
+		Backend:            *backend,
+		LocalPath:          *storage,
+		S3:                 s3Config,
+		ConflictPolicy:     conflictPolicy,
+		Compression:        compression,
+		MasterKey:          key,
+		PreviousMasterKeys: previousKeys,
+		Versioning:         *versioning,
+		TrashRetention:     trashRetention,
+		IndexPath:          *indexPath,
+	}
+
+	// Handle key rotation
+	if *rotateKey {
+		if err := handleRotateKey(context.Background(), cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Key rotation failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Handle index rebuild
+	if *reindex {
+		if err := handleReindex(context.Background(), cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Reindex failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Handle backend migration
+	if *migrate {
+		if *toBackend == "" {
+			fmt.Fprintf(os.Stderr, "Error: Destination backend (-to) is required for migrate\n")
+			os.Exit(1)
+		}
+		dst := cfg
+		dst.Backend = *toBackend
+		dst.LocalPath = *toStorage
+		opts := repository.MigrationOptions{StatePath: *stateFile, DeleteSource: *deleteSrc}
+		if err := handleMigrate(context.Background(), cfg, dst, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	repo, err := repository.New(cfg)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: Failed to initialize repository: %v\n", err)
 		os.Exit(1)
 	}
 	defer repo.Close()
 
-	fileService := service.NewFileManagerService(repo)
+	fileService := service.NewFileManagerService(repo, service.WithStorageIDFormat(idFormat))
 	ctx := context.Background()
 
 	// Handle upload
@@ -87,6 +248,79 @@ func main() {
 		return
 	}
 
+	// Handle usage report
+	if *showUsage {
+		if err := handleUsage(ctx, fileService); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Usage report failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Handle storage listing
+	if *list {
+		if err := handleList(ctx, repo, *after, *limit); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Listing failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Handle version pruning
+	if *prune >= 0 {
+		if *storageID == "" {
+			fmt.Fprintf(os.Stderr, "Error: Storage ID (-s) is required for pruning versions\n")
+			os.Exit(1)
+		}
+		pruned, err := fileService.PruneVersions(ctx, uuid.New().String(), *storageID, *prune)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Pruning versions failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Pruned %d older version(s) in storage %s\n", pruned, *storageID)
+		return
+	}
+
+	// Handle restore from the trash
+	if *restore {
+		if *storageID == "" {
+			fmt.Fprintf(os.Stderr, "Error: Storage ID (-s) is required for restore\n")
+			os.Exit(1)
+		}
+		if err := handleRestore(ctx, fileService, *storageID, *filename); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Restore failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Handle trash purge
+	if *purgeTrash {
+		purged, err := fileService.PurgeTrash(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Purging trash failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Purged %d deleted file(s) and storage(s)\n", purged)
+		return
+	}
+
+	// Handle integrity scrub
+	if *scrub {
+		report, err := fileService.Scrub(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Integrity scrub failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Checked %d file(s), %d byte(s)\n", report.Checked, report.Bytes)
+		fmt.Printf("Corrupted:  %d new, %d already marked\n", report.Corrupted, report.Known)
+		fmt.Printf("Unreadable: %d\n", report.Failed)
+		if report.Corrupted > 0 || report.Known > 0 {
+			os.Exit(2)
+		}
+		return
+	}
+
 	// No operation specified
 	flag.Usage()
 	os.Exit(1)
@@ -150,11 +384,11 @@ func handleSingleFileUpload(ctx context.Context, fileService service.Service, fi
 	fmt.Printf("✅ File uploaded successfully!\n")
 	fmt.Printf("Transaction ID: %s\n", result.TransactionID)
 	fmt.Printf("Storage ID: %s\n", result.StorageID)
-	fmt.Printf("Filename: %s\n", result.Files[0].Filename)
+	fmt.Printf("Filename: %s\n", result.Files[0].Path)
 	fmt.Printf("Size: %d bytes\n", result.Files[0].Size)
 	fmt.Printf("Total size: %d bytes\n", result.TotalSize)
 	fmt.Printf("\nTo download this file, use:\n")
-	fmt.Printf("  filemanager -d -s %s -f %s\n", result.StorageID, filename)
+	fmt.Printf("  filemanager -d -s %s -f %q\n", result.StorageID, result.Files[0].Path)
 
 	return nil
 }
@@ -183,6 +417,8 @@ func handleDirectoryUpload(ctx context.Context, fileService service.Service, dir
 			// If relative path fails, just use the base filename
 			relPath = filepath.Base(path)
 		}
+		// Stored paths always use forward slashes
+		relPath = filepath.ToSlash(relPath)
 
 		filePaths = append(filePaths, struct {
 			path     string
@@ -263,11 +499,11 @@ func handleDirectoryUpload(ctx context.Context, fileService service.Service, dir
 	fmt.Printf("Total size: %d bytes\n", result.TotalSize)
 	fmt.Printf("\nUploaded files:\n")
 	for _, file := range result.Files {
-		fmt.Printf("  - %s (%d bytes)\n", file.Filename, file.Size)
+		fmt.Printf("  - %s (%d bytes)\n", file.Path, file.Size)
 	}
 	fmt.Printf("\nTo download files, use:\n")
 	for _, file := range result.Files {
-		fmt.Printf("  filemanager -d -s %s -f %s\n", result.StorageID, file.Filename)
+		fmt.Printf("  filemanager -d -s %s -f %q\n", result.StorageID, file.Path)
 	}
 
 	return nil
@@ -284,17 +520,20 @@ func handleDownload(ctx context.Context, fileService service.Service, storageID
 	}
 	defer fileReader.Close()
 
+	// Nested files keep their folders below the output location
+	localName := filepath.FromSlash(filename)
+
 	// Determine the output path
 	var finalOutputPath string
 	if outputPath == "" {
 		// Default to current directory with original filename
-		finalOutputPath = filename
+		finalOutputPath = localName
 	} else {
 		// Check if outputPath is a directory or a file path
 		info, err := os.Stat(outputPath)
 		if err == nil && info.IsDir() {
 			// It's a directory, append the filename
-			finalOutputPath = filepath.Join(outputPath, filename)
+			finalOutputPath = filepath.Join(outputPath, localName)
 		} else if err != nil && os.IsNotExist(err) {
 			// Path doesn't exist, check if it looks like a directory (ends with /)
 			if len(outputPath) > 0 && (outputPath[len(outputPath)-1] == '/' || outputPath[len(outputPath)-1] == filepath.Separator) {
@@ -302,7 +541,7 @@ func handleDownload(ctx context.Context, fileService service.Service, storageID
 				if err := os.MkdirAll(outputPath, 0755); err != nil {
 					return fmt.Errorf("failed to create output directory: %w", err)
 				}
-				finalOutputPath = filepath.Join(outputPath, filename)
+				finalOutputPath = filepath.Join(outputPath, localName)
 			} else {
 				// Treat as file path, create parent directory if needed
 				parentDir := filepath.Dir(outputPath)
@@ -325,6 +564,13 @@ func handleDownload(ctx context.Context, fileService service.Service, storageID
 		}
 	}
 
+	// Create folders for nested files
+	if parentDir := filepath.Dir(finalOutputPath); parentDir != "." {
+		if err := os.MkdirAll(parentDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
 	// Create output file
 	outputFile, err := os.Create(finalOutputPath)
 	if err != nil {
@@ -348,3 +594,148 @@ func handleDownload(ctx context.Context, fileService service.Service, storageID
 
 	return nil
 }
+
+func handleUsage(ctx context.Context, fileService service.Service) error {
+	usage, err := fileService.Usage(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Storages: %d\n", usage.Storages)
+	fmt.Printf("Files: %d\n", usage.Files)
+	fmt.Printf("Logical size: %d bytes\n", usage.LogicalBytes)
+	fmt.Printf("Physical size: %d bytes\n", usage.PhysicalBytes)
+	if usage.LogicalBytes > 0 {
+		saved := usage.LogicalBytes - usage.PhysicalBytes
+		fmt.Printf("Saved by deduplication and compression: %d bytes (%.1f%%)\n", saved, float64(saved)*100/float64(usage.LogicalBytes))
+	}
+
+	disk, err := fileService.DiskStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if disk != nil {
+		fmt.Printf("Disk free: %d of %d bytes\n", disk.FreeBytes, disk.TotalBytes)
+	}
+
+	return nil
+}
+
+func handleList(ctx context.Context, repo repository.Repository, after string, limit int) error {
+	page, err := repo.ListStorages(ctx, after, limit)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-12s %-20s %-20s %6s %12s\n", "STORAGE", "CREATED", "EXPIRES", "FILES", "BYTES")
+	for _, storage := range page.Storages {
+		created, expires := "-", "never"
+		if !storage.CreatedAt.IsZero() {
+			created = storage.CreatedAt.Local().Format("2006-01-02 15:04:05")
+		}
+		if storage.ExpiresAt != nil {
+			expires = storage.ExpiresAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-12s %-20s %-20s %6d %12d\n", storage.ID, created, expires, storage.Files, storage.Size)
+	}
+
+	if page.Next != "" {
+		fmt.Printf("\nMore storages: rerun with -after %s\n", page.Next)
+	}
+	return nil
+}
+
+func handleRotateKey(ctx context.Context, cfg repository.Config) error {
+	if cfg.MasterKey == nil {
+		return fmt.Errorf("the new master key (-key) is required")
+	}
+
+	rotated, err := repository.RotateMasterKey(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Re-wrapped %d data key(s) under the new master key\n", rotated)
+	fmt.Println("Previous master keys can be removed from the configuration")
+	return nil
+}
+
+func handleReindex(ctx context.Context, cfg repository.Config) error {
+	if cfg.IndexPath == "" {
+		return fmt.Errorf("the metadata index path (-index) is required")
+	}
+
+	indexed, err := repository.Reindex(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Indexed %d storage(s) in %s\n", indexed, cfg.IndexPath)
+	return nil
+}
+
+func handleMigrate(ctx context.Context, src, dst repository.Config, opts repository.MigrationOptions) error {
+	opts.Progress = func(storageID string, report repository.MigrationReport) {
+		fmt.Printf("%s: %d copied, %d already migrated, %d failed\n", storageID, report.Copied, report.Skipped, report.Failed)
+	}
+	opts.Failed = func(storageID, path string, err error) {
+		fmt.Fprintf(os.Stderr, "Failed to migrate %s in storage %s: %v\n", path, storageID, err)
+	}
+
+	report, err := repository.Migrate(ctx, src, dst, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nMigrated %d storage(s): %d file(s) copied (%d bytes), %d already migrated\n",
+		report.Storages, report.Copied, report.Bytes, report.Skipped)
+	if opts.DeleteSource {
+		fmt.Printf("Deleted %d source storage(s); %d changed during the migration and were kept\n", report.Deleted, report.Changed)
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d file(s) could not be migrated; their storages were kept, rerun to retry", report.Failed)
+	}
+	return nil
+}
+
+// s3ConfigFromEnv reads the S3 settings used when a backend flag selects s3
+func s3ConfigFromEnv() (repository.S3Config, error) {
+	cfg := repository.S3Config{
+		Endpoint:     os.Getenv("S3_ENDPOINT"),
+		Region:       os.Getenv("S3_REGION"),
+		Bucket:       os.Getenv("S3_BUCKET"),
+		Prefix:       os.Getenv("S3_PREFIX"),
+		AccessKey:    os.Getenv("S3_ACCESS_KEY"),
+		SecretKey:    os.Getenv("S3_SECRET_KEY"),
+		UsePathStyle: os.Getenv("S3_USE_PATH_STYLE") != "false",
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if partSize := os.Getenv("S3_PART_SIZE_MB"); partSize != "" {
+		partSizeMB, err := strconv.ParseInt(partSize, 10, 64)
+		if err != nil || partSizeMB <= 0 {
+			return cfg, fmt.Errorf("invalid S3_PART_SIZE_MB: %q", partSize)
+		}
+		cfg.PartSize = partSizeMB * 1024 * 1024
+	}
+	return cfg, nil
+}
+
+func handleRestore(ctx context.Context, fileService service.Service, storageID, filename string) error {
+	transactionID := uuid.New().String()
+	if filename == "" {
+		if err := fileService.RestoreFolder(ctx, transactionID, storageID); err != nil {
+			return err
+		}
+		fmt.Printf("Restored storage %s\n", storageID)
+		return nil
+	}
+
+	file, err := fileService.RestoreFile(ctx, transactionID, storageID, filename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s (%d bytes) in storage %s\n", file.Path, file.Size, storageID)
+	return nil
+}
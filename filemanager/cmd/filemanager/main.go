@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"log"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/edgarcoime/Cthulhu-common/pkg/env"
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/pkg"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/server"
@@ -18,14 +22,36 @@ func main() {
 	envPath := filepath.Join(".", ".env")
 	env.SetupEnvFile(envPath)
 	// Initialize repository
-	r, err := repository.NewLocalRepository(pkg.STORAGE_PATH)
+	repoCfg := repositoryConfig()
+	r, err := repository.New(repoCfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize repository: %v", err)
 	}
 	defer r.Close()
 
 	// Initialize service
-	s := service.NewFileManagerService(r)
+	scrubInterval, scrubRate := scrubConfig()
+	uploadTimeout := uploadTransactionTimeout()
+	s := service.NewFileManagerService(r,
+		service.WithQuota(quotaConfig()),
+		service.WithDiskReserve(diskReserve()),
+		service.WithScrubRate(scrubRate),
+		service.WithStorageIDFormat(storageIDFormat()),
+		service.WithUploadTimeout(uploadTimeout),
+	)
+
+	// Permanently remove trash past its retention in the background
+	if repoCfg.TrashRetention > 0 {
+		go purgeTrash(s, trashPurgeInterval())
+	}
+
+	// Discard the staged files of multi-file uploads that stopped receiving files
+	go abortStaleUploads(s, uploadTimeout)
+
+	// Verify stored files against their checksums in the background
+	if scrubInterval > 0 {
+		go scrub(s, scrubInterval)
+	}
 
 	// Configure RabbitMQ server
 	cfg := &server.RMQServerConfig{
@@ -35,8 +61,207 @@ func main() {
 		Port:           pkg.AMQP_PORT,
 		VHost:          pkg.AMQP_VHOST,
 		ConnectionName: "filemanager",
+
+		IdempotencyWindow: idempotencyWindow(),
 	}
 
 	// Start RabbitMQ server
 	server.ListenRMQ(s, cfg)
 }
+
+// repositoryConfig builds the repository configuration from environment variables
+func repositoryConfig() repository.Config {
+	partSizeMB, err := strconv.ParseInt(pkg.S3_PART_SIZE_MB, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid S3_PART_SIZE_MB: %v", err)
+	}
+
+	conflictPolicy, err := repository.ParseConflictPolicy(pkg.NAME_CONFLICT_POLICY)
+	if err != nil {
+		log.Fatalf("Invalid NAME_CONFLICT_POLICY: %v", err)
+	}
+
+	storageTTL, err := time.ParseDuration(pkg.STORAGE_TTL)
+	if err != nil {
+		log.Fatalf("Invalid STORAGE_TTL: %v", err)
+	}
+
+	compression, err := repository.ParseCompression(pkg.STORAGE_COMPRESSION)
+	if err != nil {
+		log.Fatalf("Invalid STORAGE_COMPRESSION: %v", err)
+	}
+
+	var masterKey []byte
+	if pkg.ENCRYPTION_MASTER_KEY != "" {
+		masterKey, err = repository.ParseMasterKey(pkg.ENCRYPTION_MASTER_KEY)
+		if err != nil {
+			log.Fatalf("Invalid ENCRYPTION_MASTER_KEY: %v", err)
+		}
+	}
+
+	previousKeys, err := repository.ParseMasterKeys(pkg.ENCRYPTION_PREVIOUS_KEYS)
+	if err != nil {
+		log.Fatalf("Invalid ENCRYPTION_PREVIOUS_KEYS: %v", err)
+	}
+
+	maxVersions, err := strconv.Atoi(pkg.MAX_VERSIONS)
+	if err != nil || maxVersions < 0 {
+		log.Fatalf("Invalid MAX_VERSIONS: %s", pkg.MAX_VERSIONS)
+	}
+
+	trashRetention, err := time.ParseDuration(pkg.TRASH_RETENTION)
+	if err != nil || trashRetention < 0 {
+		log.Fatalf("Invalid TRASH_RETENTION: %q", pkg.TRASH_RETENTION)
+	}
+
+	return repository.Config{
+		Backend:            pkg.STORAGE_BACKEND,
+		LocalPath:          pkg.STORAGE_PATH,
+		ConflictPolicy:     conflictPolicy,
+		StorageTTL:         storageTTL,
+		Compression:        compression,
+		MasterKey:          masterKey,
+		PreviousMasterKeys: previousKeys,
+		Versioning:         pkg.VERSIONING_ENABLED == "true",
+		MaxVersions:        maxVersions,
+		TrashRetention:     trashRetention,
+		IndexPath:          pkg.METADATA_INDEX_PATH,
+		S3: repository.S3Config{
+			Endpoint:     pkg.S3_ENDPOINT,
+			Region:       pkg.S3_REGION,
+			Bucket:       pkg.S3_BUCKET,
+			Prefix:       pkg.S3_PREFIX,
+			AccessKey:    pkg.S3_ACCESS_KEY,
+			SecretKey:    pkg.S3_SECRET_KEY,
+			UsePathStyle: pkg.S3_USE_PATH_STYLE == "true",
+			PartSize:     partSizeMB * 1024 * 1024,
+		},
+	}
+}
+
+// storageIDFormat builds the storage ID format from environment variables
+func storageIDFormat() storageid.Format {
+	format, err := storageid.FormatFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid storage ID format: %v", err)
+	}
+	return format
+}
+
+// quotaConfig builds the upload limits from environment variables
+func quotaConfig() service.Quota {
+	quotaMB, err := strconv.ParseInt(pkg.STORAGE_QUOTA_MB, 10, 64)
+	if err != nil || quotaMB < 0 {
+		log.Fatalf("Invalid STORAGE_QUOTA_MB: %q", pkg.STORAGE_QUOTA_MB)
+	}
+
+	capacityMB, err := strconv.ParseInt(pkg.STORAGE_CAPACITY_MB, 10, 64)
+	if err != nil || capacityMB < 0 {
+		log.Fatalf("Invalid STORAGE_CAPACITY_MB: %q", pkg.STORAGE_CAPACITY_MB)
+	}
+
+	return service.Quota{
+		StorageBytes:  quotaMB * 1024 * 1024,
+		CapacityBytes: capacityMB * 1024 * 1024,
+	}
+}
+
+// diskReserve parses the free space kept on the storage disk
+func diskReserve() int64 {
+	reserveMB, err := strconv.ParseInt(pkg.DISK_RESERVE_MB, 10, 64)
+	if err != nil || reserveMB < 0 {
+		log.Fatalf("Invalid DISK_RESERVE_MB: %q", pkg.DISK_RESERVE_MB)
+	}
+	return reserveMB * 1024 * 1024
+}
+
+// trashPurgeInterval parses how often the trash is purged
+func trashPurgeInterval() time.Duration {
+	interval, err := time.ParseDuration(pkg.TRASH_PURGE_INTERVAL)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid TRASH_PURGE_INTERVAL: %q", pkg.TRASH_PURGE_INTERVAL)
+	}
+	return interval
+}
+
+// purgeTrash permanently removes trash past its retention every interval
+func purgeTrash(s service.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := s.PurgeTrash(context.Background())
+		if err != nil {
+			log.Printf("Failed to purge trash: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted file(s) and storage(s) from the trash", purged)
+		}
+	}
+}
+
+// uploadTransactionTimeout parses how long a multi-file upload may wait for its next file
+func uploadTransactionTimeout() time.Duration {
+	timeout, err := time.ParseDuration(pkg.UPLOAD_TRANSACTION_TIMEOUT)
+	if err != nil || timeout <= 0 {
+		log.Fatalf("Invalid UPLOAD_TRANSACTION_TIMEOUT: %q", pkg.UPLOAD_TRANSACTION_TIMEOUT)
+	}
+	return timeout
+}
+
+// idempotencyWindow parses how long responses are replayed to duplicate requests
+func idempotencyWindow() time.Duration {
+	window, err := time.ParseDuration(pkg.IDEMPOTENCY_WINDOW)
+	if err != nil || window < 0 {
+		log.Fatalf("Invalid IDEMPOTENCY_WINDOW: %q", pkg.IDEMPOTENCY_WINDOW)
+	}
+	return window
+}
+
+// abortStaleUploads aborts multi-file uploads past their timeout, checking every timeout
+func abortStaleUploads(s service.Service, timeout time.Duration) {
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		aborted, err := s.AbortStaleUploads(context.Background())
+		if err != nil {
+			log.Printf("Failed to abort stale uploads: %v", err)
+		}
+		if aborted > 0 {
+			log.Printf("Aborted %d stale upload(s)", aborted)
+		}
+	}
+}
+
+// scrubConfig parses how often the integrity scrubber runs and how fast it reads
+func scrubConfig() (time.Duration, int64) {
+	interval, err := time.ParseDuration(pkg.SCRUB_INTERVAL)
+	if err != nil || interval < 0 {
+		log.Fatalf("Invalid SCRUB_INTERVAL: %q", pkg.SCRUB_INTERVAL)
+	}
+
+	rateMB, err := strconv.ParseInt(pkg.SCRUB_RATE_MB, 10, 64)
+	if err != nil || rateMB < 0 {
+		log.Fatalf("Invalid SCRUB_RATE_MB: %q", pkg.SCRUB_RATE_MB)
+	}
+
+	return interval, rateMB * 1024 * 1024
+}
+
+// scrub re-hashes every stored file every interval
+func scrub(s service.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := s.Scrub(context.Background())
+		if err != nil {
+			log.Printf("Integrity scrub failed: %v", err)
+			continue
+		}
+		log.Printf("Integrity scrub checked %d file(s), %d byte(s): %d corrupted, %d already known, %d unreadable",
+			report.Checked, report.Bytes, report.Corrupted, report.Known, report.Failed)
+	}
+}
@@ -7,7 +7,20 @@ replace github.com/edgarcoime/Cthulhu-common => ../common
 require (
 	github.com/edgarcoime/Cthulhu-common v0.0.0-00010101000000-000000000000
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.17.9
 	github.com/rabbitmq/amqp091-go v1.10.0
+	golang.org/x/text v0.40.0
+	modernc.org/sqlite v1.59.0
 )
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/joho/godotenv v1.5.1 // indirect
+	github.com/mattn/go-isatty v0.0.24 // indirect
+	github.com/ncruces/go-strftime v1.0.0 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	modernc.org/libc v1.75.7 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.12.1 // indirect
+)
@@ -6,6 +6,7 @@ import (
 	"log"
 
 	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -32,10 +33,7 @@ func (h *Handler) HandleDiagnoseMessages(msgs <-chan amqp.Delivery) {
 			Operation:     diagnoseMsg.Operation,
 			Status:        messages.DiagnoseStatusProcessed,
 			Message:       "Filemanager service is operational",
-			Data: map[string]interface{}{
-				"service": ServiceName,
-				"status":  "healthy",
-			},
+			Data:          h.diagnoseData(diagnoseMsg.Operation),
 		}
 
 		// Send response
@@ -49,6 +47,80 @@ func (h *Handler) HandleDiagnoseMessages(msgs <-chan amqp.Delivery) {
 	}
 }
 
+// diagnoseData builds the response payload for a diagnose operation
+// Status requests also report storage usage (logical vs physical bytes, as measured
+// within the last minute), free disk space and the integrity scrubber's findings.
+// Known corrupted files or a disk down to its reserve mark the service degraded.
+func (h *Handler) diagnoseData(operation string) map[string]interface{} {
+	data := map[string]interface{}{
+		"service": ServiceName,
+		"status":  "healthy",
+	}
+
+	if operation != "status" && operation != "all" {
+		return data
+	}
+
+	scrub := h.service.ScrubStatus()
+	data["integrity"] = integrityData(scrub)
+	if scrub.CorruptedFiles > 0 || (scrub.Last != nil && scrub.Last.Known > 0) {
+		data["status"] = "degraded"
+	}
+
+	if disk, err := h.service.DiskStatus(h.ctx); err != nil {
+		log.Printf("Failed to check free disk space: %v", err)
+		data["disk_error"] = err.Error()
+	} else if disk != nil {
+		data["disk"] = map[string]interface{}{
+			"total_bytes":   disk.TotalBytes,
+			"free_bytes":    disk.FreeBytes,
+			"reserve_bytes": disk.ReserveBytes,
+		}
+		if disk.FreeBytes <= disk.ReserveBytes {
+			data["status"] = "degraded"
+		}
+	}
+
+	usage, err := h.service.Usage(h.ctx)
+	if err != nil {
+		log.Printf("Failed to compute storage usage: %v", err)
+		data["storage_error"] = err.Error()
+		return data
+	}
+	data["storage"] = map[string]interface{}{
+		"storages":       usage.Storages,
+		"files":          usage.Files,
+		"logical_bytes":  usage.LogicalBytes,
+		"physical_bytes": usage.PhysicalBytes,
+	}
+
+	return data
+}
+
+// integrityData reports the integrity scrubber's counters
+func integrityData(status service.ScrubStatus) map[string]interface{} {
+	data := map[string]interface{}{
+		"running":         status.Running,
+		"passes":          status.Passes,
+		"corrupted_files": status.CorruptedFiles,
+	}
+	if last := status.Last; last != nil {
+		pass := map[string]interface{}{
+			"started_at": last.StartedAt,
+			"checked":    last.Checked,
+			"bytes":      last.Bytes,
+			"corrupted":  last.Corrupted,
+			"known":      last.Known,
+			"failed":     last.Failed,
+		}
+		if !last.FinishedAt.IsZero() {
+			pass["finished_at"] = last.FinishedAt
+		}
+		data["last_pass"] = pass
+	}
+	return data
+}
+
 // sendDiagnoseResponse publishes the diagnose response message
 func (h *Handler) sendDiagnoseResponse(response messages.DiagnoseResponse, msg *amqp.Delivery) error {
 	responseBody, err := json.Marshal(response)
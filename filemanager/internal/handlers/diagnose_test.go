@@ -0,0 +1,70 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/handlers"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// usageCounter is a memory repository counting how often its usage is computed
+type usageCounter struct {
+	repository.Repository
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *usageCounter) Usage(ctx context.Context) (repository.Usage, error) {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	return r.Repository.(repository.UsageReporter).Usage(ctx)
+}
+
+// diagnose sends the handler a diagnose request for operation and returns the response data
+func diagnose(t *testing.T, h *handlers.Handler, r *recorder, operation string) map[string]interface{} {
+	t.Helper()
+	body, _ := json.Marshal(messages.DiagnoseMessage{TransactionID: "tx", Operation: operation})
+	msgs := make(chan amqp.Delivery, 1)
+	msgs <- amqp.Delivery{Body: body}
+	close(msgs)
+	h.HandleDiagnoseMessages(msgs)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var response messages.DiagnoseResponse
+	if err := json.Unmarshal(r.messages[len(r.messages)-1].body, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Data
+}
+
+// Status requests don't walk every storage each time
+func TestStatusReusesUsage(t *testing.T) {
+	repo := &usageCounter{Repository: repository.NewMemoryRepository()}
+	s := service.NewFileManagerService(repo)
+	if _, err := s.PostFile(context.Background(), "upload", service.FileUpload{Filename: "a.txt", Content: strings.NewReader("alpha")}); err != nil {
+		t.Fatal(err)
+	}
+	r := &recorder{}
+	h := handlers.NewHandler(s, r, context.Background())
+
+	for range 3 {
+		data := diagnose(t, h, r, "status")
+		storage, ok := data["storage"].(map[string]interface{})
+		if !ok || storage["files"] != float64(1) || storage["logical_bytes"] != float64(5) {
+			t.Fatalf("status reports storage %v, want 1 file of 5 bytes", data["storage"])
+		}
+	}
+	if repo.calls != 1 {
+		t.Errorf("usage computed %d times for 3 status requests, want once", repo.calls)
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+	"github.com/google/uuid"
+)
+
+// eventSource names the filemanager as the publisher of its events
+const eventSource = "filemanager"
+
+// newEvent fills the fields shared by every event
+func newEvent(topic, transactionID, storageID string) messages.Event {
+	return messages.Event{
+		ID:            uuid.New().String(),
+		Type:          topic,
+		Source:        eventSource,
+		TransactionID: transactionID,
+		StorageID:     storageID,
+		OccurredAt:    time.Now().UTC(),
+	}
+}
+
+// publishEvent publishes an event to the events exchange under topic
+// Events are best-effort: the operation already succeeded, so a failure is only logged.
+func (h *Handler) publishEvent(topic string, event any) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", topic, err)
+		return
+	}
+
+	if err := h.manager.PublishMessage(
+		h.ctx,
+		messages.EventsExchange,
+		topic,
+		"application/json",
+		body,
+	); err != nil {
+		log.Printf("Failed to publish %s event: %v", topic, err)
+	}
+}
+
+// publishUploaded publishes the events of files stored by an upload, commit or copy
+func (h *Handler) publishUploaded(transactionID string, result *service.UploadResult) {
+	if result.Created {
+		h.publishEvent(messages.TopicStorageCreated, messages.StorageCreatedEvent{
+			Event: newEvent(messages.TopicStorageCreated, transactionID, result.StorageID),
+		})
+	}
+	for _, file := range toMessageFiles(result.Files) {
+		h.publishEvent(messages.TopicFileUploaded, messages.FileUploadedEvent{
+			Event: newEvent(messages.TopicFileUploaded, transactionID, result.StorageID),
+			File:  file,
+		})
+	}
+}
+
+// eventFile describes a file of an event by its path
+func eventFile(filePath string, version int) messages.FileInfo {
+	return messages.FileInfo{
+		Filename: path.Base(filePath),
+		Path:     filePath,
+		Version:  version,
+	}
+}
@@ -0,0 +1,204 @@
+package handlers_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/handlers"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// trashService restores, prunes and deletes storages, failing every operation with err if it is set
+type trashService struct {
+	service.Service
+	err error
+}
+
+func (s *trashService) RestoreFile(ctx context.Context, transactionID string, storageID string, filename string) (repository.FileInfo, error) {
+	if s.err != nil {
+		return repository.FileInfo{}, s.err
+	}
+	return repository.FileInfo{Filename: "a.txt", Path: filename, Size: 5, SHA256: "2cf24dba"}, nil
+}
+
+func (s *trashService) RestoreFolder(ctx context.Context, transactionID string, storageID string) error {
+	return s.err
+}
+
+func (s *trashService) PruneVersions(ctx context.Context, transactionID string, storageID string, keep int) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	return 3, nil
+}
+
+func (s *trashService) DeleteFolder(ctx context.Context, transactionID string, storageID string) error {
+	return s.err
+}
+
+func (s *trashService) GetFiles(ctx context.Context, transactionID string, storageID string) (*service.StorageListing, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &service.StorageListing{StorageID: storageID}, nil
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	request := messages.FileManagerRequest{TransactionID: "tx", StorageID: "abcdefghij", Filename: "docs/a.txt", Keep: 1}
+
+	for _, tc := range []struct {
+		queue string
+		topic string
+		check func(t *testing.T, body []byte)
+	}{
+		{"filemanager.restore.file", messages.TopicFileRestored, func(t *testing.T, body []byte) {
+			var event messages.FileRestoredEvent
+			checkEvent(t, body, &event, &event.Event, messages.TopicFileRestored)
+			if event.File.Path != "docs/a.txt" || event.File.Size != 5 || event.File.SHA256 != "2cf24dba" {
+				t.Errorf("restored file %+v, want docs/a.txt with its metadata", event.File)
+			}
+		}},
+		{"filemanager.restore.folder", messages.TopicStorageRestored, func(t *testing.T, body []byte) {
+			var event messages.StorageRestoredEvent
+			checkEvent(t, body, &event, &event.Event, messages.TopicStorageRestored)
+		}},
+		{"filemanager.prune.versions", messages.TopicVersionsPruned, func(t *testing.T, body []byte) {
+			var event messages.VersionsPrunedEvent
+			checkEvent(t, body, &event, &event.Event, messages.TopicVersionsPruned)
+			if event.Pruned != 3 || event.Keep != 1 {
+				t.Errorf("pruned %d keeping %d, want 3 keeping 1", event.Pruned, event.Keep)
+			}
+		}},
+		{"filemanager.delete.folder", messages.TopicStorageDeleted, func(t *testing.T, body []byte) {
+			var event messages.StorageDeletedEvent
+			checkEvent(t, body, &event, &event.Event, messages.TopicStorageDeleted)
+		}},
+	} {
+		t.Run(tc.queue, func(t *testing.T) {
+			r := &recorder{}
+			h := handlers.NewHandler(&trashService{}, r, context.Background())
+			deliver(h, tc.queue, request)
+
+			events := r.events()
+			if len(events) != 1 {
+				t.Fatalf("%d events published, want 1", len(events))
+			}
+			if events[0].routingKey != tc.topic {
+				t.Errorf("event published under %s, want %s", events[0].routingKey, tc.topic)
+			}
+			tc.check(t, events[0].body)
+		})
+	}
+}
+
+// checkEvent decodes body into event and checks the fields shared by every event
+func checkEvent(t *testing.T, body []byte, event any, shared *messages.Event, topic string) {
+	t.Helper()
+	if err := json.Unmarshal(body, event); err != nil {
+		t.Fatal(err)
+	}
+	if shared.ID == "" || shared.OccurredAt.IsZero() {
+		t.Errorf("event %+v lacks its ID or time", shared)
+	}
+	if shared.Type != topic || shared.Source != "filemanager" || shared.TransactionID != "tx" || shared.StorageID != "abcdefghij" {
+		t.Errorf("event %+v, want a %s event of the filemanager for tx in abcdefghij", shared, topic)
+	}
+}
+
+// Failed operations publish no event and tell why with an error code
+func TestFailuresPublishNoEvents(t *testing.T) {
+	request := messages.FileManagerRequest{TransactionID: "tx", StorageID: "abcdefghij", Filename: "docs/a.txt"}
+
+	for _, queue := range []string{
+		"filemanager.restore.file",
+		"filemanager.restore.folder",
+		"filemanager.prune.versions",
+		"filemanager.delete.folder",
+		"filemanager.get.files",
+	} {
+		t.Run(queue, func(t *testing.T) {
+			r := &recorder{}
+			h := handlers.NewHandler(&trashService{err: repository.ErrStorageNotFound}, r, context.Background())
+			deliver(h, queue, request)
+
+			if events := r.events(); len(events) != 0 {
+				t.Errorf("%d events published for a failed operation", len(events))
+			}
+			responses := r.responses(t, queue[len("filemanager."):], "tx")
+			if len(responses) != 1 || responses[0].ErrorCode != messages.ErrorCodeNotFound {
+				t.Errorf("responses %+v, want one with error code %s", responses, messages.ErrorCodeNotFound)
+			}
+		})
+	}
+}
+
+// Delete events describe the file as it was stored, looked up before it is gone
+func TestDeleteEventsDescribeFile(t *testing.T) {
+	ctx := context.Background()
+	manifest, err := repository.NewManifestRepository(repository.NewMemoryRepository(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := repository.NewVersioningRepository(manifest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := service.NewFileManagerService(repo)
+
+	var storageID string
+	for _, content := range []string{"%PDF-1.4 first", "second version"} {
+		result, err := s.PostFiles(ctx, "upload", storageID, []service.FileUpload{
+			{Filename: "docs/a.txt", Content: strings.NewReader(content)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storageID = result.StorageID
+	}
+
+	// deleted deletes version of docs/a.txt, or the whole file if it is 0, and returns the event
+	deleted := func(version int) messages.FileInfo {
+		t.Helper()
+		r := &recorder{}
+		h := handlers.NewHandler(s, r, ctx)
+		deliver(h, "filemanager.delete.file", messages.FileManagerRequest{
+			TransactionID: "tx", StorageID: storageID, Filename: "docs/a.txt", Version: version,
+		})
+		events := r.events()
+		if len(events) != 1 || events[0].routingKey != messages.TopicFileDeleted {
+			t.Fatalf("published %d events, want one %s event", len(events), messages.TopicFileDeleted)
+		}
+		var event messages.FileDeletedEvent
+		if err := json.Unmarshal(events[0].body, &event); err != nil {
+			t.Fatal(err)
+		}
+		return event.File
+	}
+	sum := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+
+	// The older version is described by its own content
+	file := deleted(1)
+	if file.Path != "docs/a.txt" || file.OriginalName != "docs/a.txt" || file.Version != 1 {
+		t.Errorf("deleted version %+v, want version 1 of docs/a.txt", file)
+	}
+	if file.Size != 14 || file.SHA256 != sum("%PDF-1.4 first") || file.ContentType != "application/pdf" {
+		t.Errorf("deleted version is %d bytes of %s hashing to %s, want the first upload", file.Size, file.ContentType, file.SHA256)
+	}
+
+	file = deleted(0)
+	if file.Path != "docs/a.txt" || file.OriginalName != "docs/a.txt" || file.Version != 0 {
+		t.Errorf("deleted file %+v, want docs/a.txt without a version", file)
+	}
+	if file.Size != 14 || file.SHA256 != sum("second version") || !strings.HasPrefix(file.ContentType, "text/plain") {
+		t.Errorf("deleted file is %d bytes of %s hashing to %s, want the second upload", file.Size, file.ContentType, file.SHA256)
+	}
+}
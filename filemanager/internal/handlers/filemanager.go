@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 
 	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -21,115 +23,182 @@ const ChunkSize = 1024 * 1024 // 1MB
 func (h *Handler) HandleFileManagerMessages(queueName string, msgs <-chan amqp.Delivery) {
 	for msg := range msgs {
 		log.Printf("Received filemanager message: queue=%s", queueName)
+		h.handleFileManagerMessage(queueName, &msg)
+	}
+}
 
-		// Route to appropriate handler based on queue name
-		var response messages.FileManagerResponse
-		var err error
-
-		switch queueName {
-		case "filemanager.post.file.chunk":
-			// Handle chunk message
-			var chunkRequest messages.FileChunkRequest
-			if err := json.Unmarshal(msg.Body, &chunkRequest); err != nil {
-				log.Printf("Failed to unmarshal chunk request: %v", err)
-				msg.Nack(false, false)
-				continue
-			}
-			response, err = h.handleFileChunk(chunkRequest, &msg)
-		case "filemanager.post.file":
-			// Try to unmarshal as FileUploadRequest (with content) first
-			var uploadRequest messages.FileUploadRequest
-			if unmarshalErr := json.Unmarshal(msg.Body, &uploadRequest); unmarshalErr == nil && uploadRequest.Content != "" {
-				// Successfully unmarshaled as FileUploadRequest with content
-				response, err = h.handlePostFileWithContent(uploadRequest)
-			} else {
-				// Fall back to FileManagerRequest (without content)
-				var request messages.FileManagerRequest
-				if unmarshalErr := json.Unmarshal(msg.Body, &request); unmarshalErr != nil {
-					log.Printf("Failed to unmarshal filemanager request: %v", unmarshalErr)
-					msg.Nack(false, false) // Don't requeue malformed messages
-					continue
-				}
-				response, err = h.handlePostFile(request)
-			}
-		case "filemanager.post.files":
-			var request messages.FileManagerRequest
-			if err := json.Unmarshal(msg.Body, &request); err != nil {
-				log.Printf("Failed to unmarshal filemanager request: %v", err)
-				msg.Nack(false, false)
-				continue
-			}
-			response, err = h.handlePostFiles(request)
-		case "filemanager.get.file":
-			var request messages.FileManagerRequest
-			if err := json.Unmarshal(msg.Body, &request); err != nil {
-				log.Printf("Failed to unmarshal filemanager request: %v", err)
-				msg.Nack(false, false)
-				continue
+// handleFileManagerMessage processes one filemanager operation message
+func (h *Handler) handleFileManagerMessage(queueName string, msg *amqp.Delivery) {
+	// A redelivered transaction gets the response it already produced instead of running again
+	key := idempotencyKey(queueName, msg.Body)
+	if key != "" {
+		if response, done := h.idempotency.begin(key); done {
+			log.Printf("Replaying response of transaction %s: queue=%s", response.TransactionID, queueName)
+			if err := h.sendResponse(queueName, response.TransactionID, response, msg); err == nil {
+				msg.Ack(false)
 			}
-			response, err = h.handleGetFile(request)
-		case "filemanager.get.files":
-			var request messages.FileManagerRequest
-			if err := json.Unmarshal(msg.Body, &request); err != nil {
-				log.Printf("Failed to unmarshal filemanager request: %v", err)
-				msg.Nack(false, false)
-				continue
-			}
-			response, err = h.handleGetFiles(request)
-		case "filemanager.delete.file":
-			var request messages.FileManagerRequest
-			if err := json.Unmarshal(msg.Body, &request); err != nil {
-				log.Printf("Failed to unmarshal filemanager request: %v", err)
-				msg.Nack(false, false)
-				continue
-			}
-			response, err = h.handleDeleteFile(request)
-		case "filemanager.delete.folder":
-			var request messages.FileManagerRequest
-			if err := json.Unmarshal(msg.Body, &request); err != nil {
-				log.Printf("Failed to unmarshal filemanager request: %v", err)
-				msg.Nack(false, false)
-				continue
-			}
-			response, err = h.handleDeleteFolder(request)
-		default:
-			err = fmt.Errorf("unknown queue: %s", queueName)
+			return
 		}
+		// Forget the transaction if it ends without a response, so a redelivery runs it
+		defer h.idempotency.release(key)
+	}
 
-		if err != nil {
-			// Get transaction ID from response if available, otherwise use empty string
-			transactionID := ""
-			if response.TransactionID != "" {
-				transactionID = response.TransactionID
-			}
-			response = messages.FileManagerResponse{
-				TransactionID: transactionID,
-				Success:       false,
-				Error:         err.Error(),
+	// Route to appropriate handler based on queue name
+	var response messages.FileManagerResponse
+	var err error
+
+	switch queueName {
+	case "filemanager.post.file.chunk":
+		// Handle chunk message
+		var chunkRequest messages.FileChunkRequest
+		if err := json.Unmarshal(msg.Body, &chunkRequest); err != nil {
+			log.Printf("Failed to unmarshal chunk request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleFileChunk(chunkRequest, msg)
+	case "filemanager.post.file":
+		// Try to unmarshal as FileUploadRequest (with content) first
+		var uploadRequest messages.FileUploadRequest
+		if unmarshalErr := json.Unmarshal(msg.Body, &uploadRequest); unmarshalErr == nil && uploadRequest.Content != "" {
+			// Successfully unmarshaled as FileUploadRequest with content
+			response, err = h.handlePostFileWithContent(uploadRequest)
+		} else {
+			// Fall back to FileManagerRequest (without content)
+			var request messages.FileManagerRequest
+			if unmarshalErr := json.Unmarshal(msg.Body, &request); unmarshalErr != nil {
+				log.Printf("Failed to unmarshal filemanager request: %v", unmarshalErr)
+				msg.Nack(false, false) // Don't requeue malformed messages
+				return
 			}
-			log.Printf("Error handling request: %v", err)
+			response, err = h.handlePostFile(request)
+		}
+	case "filemanager.post.files":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handlePostFiles(request)
+	case "filemanager.get.file":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleGetFile(request)
+	case "filemanager.get.files":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleGetFiles(request)
+	case "filemanager.delete.file":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleDeleteFile(request)
+	case "filemanager.delete.folder":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleDeleteFolder(request)
+	case "filemanager.prune.versions":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handlePruneVersions(request)
+	case "filemanager.restore.file":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleRestoreFile(request)
+	case "filemanager.restore.folder":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleRestoreFolder(request)
+	case "filemanager.copy.files":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleCopyFiles(request)
+	case "filemanager.commit.upload":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
+		}
+		response, err = h.handleCommitUpload(request)
+	case "filemanager.abort.upload":
+		var request messages.FileManagerRequest
+		if err := json.Unmarshal(msg.Body, &request); err != nil {
+			log.Printf("Failed to unmarshal filemanager request: %v", err)
+			msg.Nack(false, false)
+			return
 		}
+		response, err = h.handleAbortUpload(request)
+	default:
+		err = fmt.Errorf("unknown queue: %s", queueName)
+	}
 
-		// Send response (skip if empty - used for chunk intermediate responses)
+	if err != nil {
+		// Get transaction ID from response if available, otherwise use empty string
+		transactionID := ""
 		if response.TransactionID != "" {
-			transactionID := response.TransactionID
-			// For chunk responses, use "post.file" as the operation (not "post.file.chunk")
-			// so the response routing key matches what the gateway is listening for
-			responseQueueName := queueName
-			if queueName == "filemanager.post.file.chunk" {
-				responseQueueName = "filemanager.post.file"
-			}
-			if err := h.sendResponse(responseQueueName, transactionID, response, &msg); err != nil {
-				log.Printf("Failed to send response: %v", err)
-				continue
-			}
+			transactionID = response.TransactionID
 		}
+		response = messages.FileManagerResponse{
+			TransactionID: transactionID,
+			Success:       false,
+			Error:         err.Error(),
+		}
+		log.Printf("Error handling request: %v", err)
+	}
 
-		// Acknowledge the message (chunks are already acknowledged in handleFileChunk)
-		if queueName != "filemanager.post.file.chunk" {
-			msg.Ack(false)
+	// Send response (skip if empty - used for chunk intermediate responses)
+	if response.TransactionID != "" {
+		transactionID := response.TransactionID
+		h.idempotency.complete(key, response)
+		// For chunk responses, use "post.file" as the operation (not "post.file.chunk")
+		// so the response routing key matches what the gateway is listening for
+		responseQueueName := queueName
+		if queueName == "filemanager.post.file.chunk" {
+			responseQueueName = "filemanager.post.file"
+		}
+		if err := h.sendResponse(responseQueueName, transactionID, response, msg); err != nil {
+			log.Printf("Failed to send response: %v", err)
+			return
 		}
 	}
+
+	// Acknowledge the message (chunks are already acknowledged in handleFileChunk)
+	if queueName != "filemanager.post.file.chunk" {
+		msg.Ack(false)
+	}
 }
 
 // sendResponse publishes the response message
@@ -169,6 +238,30 @@ func getOperationFromQueue(queueName string) string {
 	return queueName
 }
 
+// errorCode maps service errors to the response codes the gateway turns into HTTP statuses
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, service.ErrQuotaExceeded):
+		return messages.ErrorCodeQuotaExceeded
+	case errors.Is(err, service.ErrInsufficientStorage):
+		return messages.ErrorCodeInsufficientStorage
+	case errors.Is(err, repository.ErrVersionNotFound):
+		return messages.ErrorCodeVersionNotFound
+	case errors.Is(err, repository.ErrFileExists):
+		return messages.ErrorCodeFileExists
+	case errors.Is(err, repository.ErrFileCorrupted):
+		return messages.ErrorCodeFileCorrupted
+	case errors.Is(err, repository.ErrFileNotFound), errors.Is(err, repository.ErrStorageNotFound), errors.Is(err, service.ErrUploadNotFound):
+		return messages.ErrorCodeNotFound
+	case errors.Is(err, service.ErrUploadAborted):
+		return messages.ErrorCodeUploadAborted
+	case errors.Is(err, repository.ErrInvalidFilename):
+		return messages.ErrorCodeInvalidFilename
+	default:
+		return ""
+	}
+}
+
 // Handler methods for each operation
 func (h *Handler) handlePostFile(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
 	// This method is called with FileManagerRequest, but we need to check if the message
@@ -197,14 +290,41 @@ func (h *Handler) handleFileChunk(chunkRequest messages.FileChunkRequest, msg *a
 	// Store chunk
 	h.chunkStorage.mu.Lock()
 
+	// Discard the remaining chunks of a rejected upload
+	if remaining, ok := h.chunkStorage.rejected[chunkRequest.TransactionID]; ok {
+		if remaining <= 1 {
+			delete(h.chunkStorage.rejected, chunkRequest.TransactionID)
+		} else {
+			h.chunkStorage.rejected[chunkRequest.TransactionID] = remaining - 1
+		}
+		h.chunkStorage.mu.Unlock()
+		msg.Ack(false)
+		return messages.FileManagerResponse{}, nil
+	}
+
 	// Initialize chunk map if needed
 	if h.chunkStorage.chunks[chunkRequest.TransactionID] == nil {
+		// Reject uploads that can't fit before buffering any of their chunks
+		if err := h.service.CheckQuota(h.ctx, chunkRequest.StorageID, chunkRequest.TotalSize); err != nil {
+			if chunkRequest.TotalChunks > 1 {
+				h.chunkStorage.rejected[chunkRequest.TransactionID] = chunkRequest.TotalChunks - 1
+			}
+			h.chunkStorage.mu.Unlock()
+			msg.Ack(false)
+			return messages.FileManagerResponse{
+				TransactionID: chunkRequest.TransactionID,
+				Success:       false,
+				Error:         err.Error(),
+				ErrorCode:     errorCode(err),
+			}, nil
+		}
 		h.chunkStorage.chunks[chunkRequest.TransactionID] = make(map[int][]byte)
 		h.chunkStorage.chunkCounts[chunkRequest.TransactionID] = chunkRequest.TotalChunks
 		h.chunkStorage.metadata[chunkRequest.TransactionID] = &chunkMetadata{
-			filename:  chunkRequest.Filename,
-			storageID: chunkRequest.StorageID,
-			totalSize: chunkRequest.TotalSize,
+			filename:            chunkRequest.Filename,
+			storageID:           chunkRequest.StorageID,
+			totalSize:           chunkRequest.TotalSize,
+			uploadTransactionID: chunkRequest.UploadTransactionID,
 		}
 	}
 
@@ -264,36 +384,27 @@ func (h *Handler) handleFileChunk(chunkRequest messages.FileChunkRequest, msg *a
 		Size:     chunkRequest.TotalSize,
 	}
 
-	// If storageID is provided, use PostFiles to add to existing storage
-	// Otherwise, use PostFile to create new storage
-	var result *service.UploadResult
-	if metadata.storageID != "" {
-		// Add file to existing storage
-		result, err = h.service.PostFiles(h.ctx, chunkRequest.TransactionID, metadata.storageID, []service.FileUpload{fileUpload})
-	} else {
-		// Create new storage
-		result, err = h.service.PostFile(h.ctx, chunkRequest.TransactionID, fileUpload)
-	}
+	result, err := h.uploadFile(chunkRequest.TransactionID, metadata.uploadTransactionID, metadata.storageID, fileUpload)
 
 	if err != nil {
 		return messages.FileManagerResponse{
 			TransactionID: chunkRequest.TransactionID,
 			Success:       false,
 			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
 		}, nil
 	}
 
-	// Convert repository.FileInfo to messages.FileInfo
-	files := make([]messages.FileInfo, len(result.Files))
-	for i, fi := range result.Files {
-		files[i] = messages.FileInfo{
-			Filename: fi.Filename,
-			Size:     fi.Size,
-		}
+	// Staged files are announced when their upload commits
+	if metadata.uploadTransactionID == "" {
+		h.publishUploaded(chunkRequest.TransactionID, result)
 	}
 
+	// Convert repository.FileInfo to messages.FileInfo
+	files := toMessageFiles(result.Files)
+
 	return messages.FileManagerResponse{
-		TransactionID: result.TransactionID,
+		TransactionID: chunkRequest.TransactionID,
 		Success:       true,
 		StorageID:     result.StorageID,
 		Files:         files,
@@ -301,6 +412,21 @@ func (h *Handler) handleFileChunk(chunkRequest messages.FileChunkRequest, msg *a
 	}, nil
 }
 
+// uploadFile stores an uploaded file, or stages it when it belongs to a multi-file upload
+// If storageID is provided, PostFiles adds the file to the existing storage; otherwise PostFile creates a new one.
+func (h *Handler) uploadFile(transactionID, uploadTransactionID, storageID string, fileUpload service.FileUpload) (*service.UploadResult, error) {
+	switch {
+	case uploadTransactionID != "":
+		return h.service.StageFile(h.ctx, uploadTransactionID, storageID, fileUpload)
+	case storageID != "":
+		// Add file to existing storage
+		return h.service.PostFiles(h.ctx, transactionID, storageID, []service.FileUpload{fileUpload})
+	default:
+		// Create new storage
+		return h.service.PostFile(h.ctx, transactionID, fileUpload)
+	}
+}
+
 // handlePostFileWithContent handles file upload with file content included in the message
 func (h *Handler) handlePostFileWithContent(uploadRequest messages.FileUploadRequest) (messages.FileManagerResponse, error) {
 	// Decode base64 content
@@ -320,36 +446,27 @@ func (h *Handler) handlePostFileWithContent(uploadRequest messages.FileUploadReq
 		Size:     uploadRequest.Size,
 	}
 
-	// If storageID is provided, use PostFiles to add to existing storage
-	// Otherwise, use PostFile to create new storage
-	var result *service.UploadResult
-	if uploadRequest.StorageID != "" {
-		// Add file to existing storage
-		result, err = h.service.PostFiles(h.ctx, uploadRequest.TransactionID, uploadRequest.StorageID, []service.FileUpload{fileUpload})
-	} else {
-		// Create new storage
-		result, err = h.service.PostFile(h.ctx, uploadRequest.TransactionID, fileUpload)
-	}
+	result, err := h.uploadFile(uploadRequest.TransactionID, uploadRequest.UploadTransactionID, uploadRequest.StorageID, fileUpload)
 
 	if err != nil {
 		return messages.FileManagerResponse{
 			TransactionID: uploadRequest.TransactionID,
 			Success:       false,
 			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
 		}, nil
 	}
 
-	// Convert repository.FileInfo to messages.FileInfo
-	files := make([]messages.FileInfo, len(result.Files))
-	for i, fi := range result.Files {
-		files[i] = messages.FileInfo{
-			Filename: fi.Filename,
-			Size:     fi.Size,
-		}
+	// Staged files are announced when their upload commits
+	if uploadRequest.UploadTransactionID == "" {
+		h.publishUploaded(uploadRequest.TransactionID, result)
 	}
 
+	// Convert repository.FileInfo to messages.FileInfo
+	files := toMessageFiles(result.Files)
+
 	return messages.FileManagerResponse{
-		TransactionID: result.TransactionID,
+		TransactionID: uploadRequest.TransactionID,
 		Success:       true,
 		StorageID:     result.StorageID,
 		Files:         files,
@@ -375,39 +492,40 @@ func (h *Handler) handleGetFile(request messages.FileManagerRequest) (messages.F
 		}, nil
 	}
 
-	// Get file from service
-	fileReader, err := h.service.GetFile(h.ctx, request.TransactionID, request.StorageID, request.Filename)
-	if err != nil {
-		return messages.FileManagerResponse{
-			TransactionID: request.TransactionID,
-			Success:       false,
-			Error:         err.Error(),
-		}, nil
+	// Get the requested range from the service; a request without one covers the whole file
+	var fileRange *repository.FileRange
+	var err error
+	if request.Version > 0 {
+		fileRange, err = h.service.GetFileVersion(h.ctx, request.TransactionID, request.StorageID, request.Filename, request.Version, request.Offset, request.Length)
+	} else {
+		fileRange, err = h.service.GetFileRange(h.ctx, request.TransactionID, request.StorageID, request.Filename, request.Offset, request.Length)
 	}
-	defer fileReader.Close()
-
-	// TODO: optimize to stream for bigger files maybe through websockets
-	// Read entire file into memory to get size and chunk it
-	// For very large files, this could be optimized to stream, but for now this is simpler
-	fileContent, err := io.ReadAll(fileReader)
 	if err != nil {
 		return messages.FileManagerResponse{
 			TransactionID: request.TransactionID,
 			Success:       false,
-			Error:         fmt.Sprintf("failed to read file: %v", err),
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
 		}, nil
 	}
+	defer fileRange.Close()
 
-	fileSize := int64(len(fileContent))
-	totalChunks := int((fileSize + ChunkSize - 1) / ChunkSize) // Ceiling division
+	// Stream the range chunk by chunk, so only one chunk is held in memory at a time
+	rangeSize := fileRange.Length
+	totalChunks := int((rangeSize + ChunkSize - 1) / ChunkSize) // Ceiling division
+	chunkData := make([]byte, ChunkSize)
 
 	// Send file in chunks
 	for chunkIndex := range totalChunks {
-		start := chunkIndex * ChunkSize
-		end := min(start+ChunkSize, len(fileContent))
-
-		chunkData := fileContent[start:end]
-		encodedChunk := base64.StdEncoding.EncodeToString(chunkData)
+		n, err := io.ReadFull(fileRange, chunkData[:min(int64(ChunkSize), rangeSize-int64(chunkIndex)*ChunkSize)])
+		if err != nil {
+			return messages.FileManagerResponse{
+				TransactionID: request.TransactionID,
+				Success:       false,
+				Error:         fmt.Sprintf("failed to read file: %v", err),
+			}, nil
+		}
+		encodedChunk := base64.StdEncoding.EncodeToString(chunkData[:n])
 
 		chunkResponse := messages.FileChunkResponse{
 			TransactionID: request.TransactionID,
@@ -415,8 +533,8 @@ func (h *Handler) handleGetFile(request messages.FileManagerRequest) (messages.F
 			Filename:      request.Filename,
 			ChunkIndex:    chunkIndex,
 			TotalChunks:   totalChunks,
-			ChunkSize:     int64(len(chunkData)),
-			TotalSize:     fileSize,
+			ChunkSize:     int64(n),
+			TotalSize:     rangeSize,
 			Content:       encodedChunk,
 			IsLastChunk:   chunkIndex == totalChunks-1,
 		}
@@ -449,16 +567,38 @@ func (h *Handler) handleGetFile(request messages.FileManagerRequest) (messages.F
 		}
 	}
 
+	// Like the download count, only the first range of a download is announced
+	if request.Offset == 0 {
+		file := eventFile(request.Filename, request.Version)
+		file.Size = fileRange.Size
+		file.OriginalName = fileRange.OriginalName
+		file.ContentType = fileRange.ContentType
+		file.SHA256 = fileRange.SHA256
+		event := messages.FileDownloadedEvent{
+			Event: newEvent(messages.TopicFileDownloaded, request.TransactionID, request.StorageID),
+			File:  file,
+		}
+		if request.Length > 0 {
+			event.Length = rangeSize
+		}
+		h.publishEvent(messages.TopicFileDownloaded, event)
+	}
+
 	// Return success response indicating file will be sent in chunks
 	return messages.FileManagerResponse{
 		TransactionID: request.TransactionID,
 		Success:       true,
 		StorageID:     request.StorageID,
 		Data: map[string]interface{}{
-			"filename":     request.Filename,
-			"total_size":   fileSize,
-			"total_chunks": totalChunks,
-			"note":         "File content is being sent in chunks",
+			"filename":      request.Filename,
+			"total_size":    rangeSize,
+			"total_chunks":  totalChunks,
+			"offset":        fileRange.Offset,
+			"file_size":     fileRange.Size,
+			"version":       request.Version,
+			"original_name": fileRange.OriginalName,
+			"content_type":  fileRange.ContentType,
+			"note":          "File content is being sent in chunks",
 		},
 	}, nil
 }
@@ -473,36 +613,173 @@ func (h *Handler) handleGetFiles(request messages.FileManagerRequest) (messages.
 	}
 
 	// Get files from service
-	fileInfos, err := h.service.GetFiles(h.ctx, request.TransactionID, request.StorageID)
+	listing, err := h.service.GetFiles(h.ctx, request.TransactionID, request.StorageID)
 	if err != nil {
 		return messages.FileManagerResponse{
 			TransactionID: request.TransactionID,
 			Success:       false,
 			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
 		}, nil
 	}
 
-	// Convert repository.FileInfo to messages.FileInfo
+	response := messages.FileManagerResponse{
+		TransactionID: request.TransactionID,
+		Success:       true,
+		StorageID:     request.StorageID,
+		Files:         toMessageFiles(listing.Files),
+		TotalSize:     listing.TotalSize,
+		ExpiresAt:     listing.ExpiresAt,
+	}
+	if !listing.CreatedAt.IsZero() {
+		response.CreatedAt = &listing.CreatedAt
+	}
+
+	return response, nil
+}
+
+// toMessageFiles converts repository.FileInfo to messages.FileInfo
+func toMessageFiles(fileInfos []repository.FileInfo) []messages.FileInfo {
 	files := make([]messages.FileInfo, len(fileInfos))
-	var totalSize int64
 	for i, fi := range fileInfos {
 		files[i] = messages.FileInfo{
-			Filename: fi.Filename,
-			Size:     fi.Size,
+			Filename:     fi.Filename,
+			Path:         fi.Path,
+			Size:         fi.Size,
+			OriginalName: fi.OriginalName,
+			ContentType:  fi.ContentType,
+			SHA256:       fi.SHA256,
+			Corrupted:    fi.Corrupted,
+			Downloads:    fi.Downloads,
+		}
+		if !fi.UploadedAt.IsZero() {
+			uploadedAt := fi.UploadedAt
+			files[i].UploadedAt = &uploadedAt
 		}
-		totalSize += fi.Size
+		// Only versioned repositories number their files
+		if fi.Version > 0 {
+			files[i].Version = fi.Version
+			for _, v := range fi.Versions {
+				version := messages.FileVersion{Version: v.Version, Size: v.Size}
+				if !v.UploadedAt.IsZero() {
+					uploadedAt := v.UploadedAt
+					version.UploadedAt = &uploadedAt
+				}
+				files[i].Versions = append(files[i].Versions, version)
+			}
+		}
+	}
+	return files
+}
+
+func (h *Handler) handleDeleteFile(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+	if request.StorageID == "" || request.Filename == "" {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         "storage_id and filename are required",
+		}, nil
+	}
+
+	var deleted repository.FileInfo
+	var err error
+	if request.Version > 0 {
+		deleted, err = h.service.DeleteFileVersion(h.ctx, request.TransactionID, request.StorageID, request.Filename, request.Version)
+	} else {
+		deleted, err = h.service.DeleteFile(h.ctx, request.TransactionID, request.StorageID, request.Filename)
+		// Every version went with the file, so the event names none
+		deleted.Version = 0
+	}
+	if err != nil {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
+		}, nil
 	}
 
+	h.publishEvent(messages.TopicFileDeleted, messages.FileDeletedEvent{
+		Event: newEvent(messages.TopicFileDeleted, request.TransactionID, request.StorageID),
+		File:  toMessageFiles([]repository.FileInfo{deleted})[0],
+	})
+
 	return messages.FileManagerResponse{
 		TransactionID: request.TransactionID,
 		Success:       true,
 		StorageID:     request.StorageID,
-		Files:         files,
-		TotalSize:     totalSize,
 	}, nil
 }
 
-func (h *Handler) handleDeleteFile(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+func (h *Handler) handleDeleteFolder(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+	if request.StorageID == "" {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         "storage_id is required",
+		}, nil
+	}
+
+	err := h.service.DeleteFolder(h.ctx, request.TransactionID, request.StorageID)
+	if err != nil {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
+		}, nil
+	}
+
+	h.publishEvent(messages.TopicStorageDeleted, messages.StorageDeletedEvent{
+		Event: newEvent(messages.TopicStorageDeleted, request.TransactionID, request.StorageID),
+	})
+
+	return messages.FileManagerResponse{
+		TransactionID: request.TransactionID,
+		Success:       true,
+		StorageID:     request.StorageID,
+	}, nil
+}
+
+func (h *Handler) handlePruneVersions(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+	if request.StorageID == "" {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         "storage_id is required",
+		}, nil
+	}
+
+	pruned, err := h.service.PruneVersions(h.ctx, request.TransactionID, request.StorageID, request.Keep)
+	if err != nil {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
+		}, nil
+	}
+
+	if pruned > 0 {
+		h.publishEvent(messages.TopicVersionsPruned, messages.VersionsPrunedEvent{
+			Event:  newEvent(messages.TopicVersionsPruned, request.TransactionID, request.StorageID),
+			Pruned: pruned,
+			Keep:   request.Keep,
+		})
+	}
+
+	return messages.FileManagerResponse{
+		TransactionID: request.TransactionID,
+		Success:       true,
+		StorageID:     request.StorageID,
+		Data: map[string]interface{}{
+			"pruned": pruned,
+			"keep":   request.Keep,
+		},
+	}, nil
+}
+
+func (h *Handler) handleRestoreFile(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
 	if request.StorageID == "" || request.Filename == "" {
 		return messages.FileManagerResponse{
 			TransactionID: request.TransactionID,
@@ -511,23 +788,32 @@ func (h *Handler) handleDeleteFile(request messages.FileManagerRequest) (message
 		}, nil
 	}
 
-	err := h.service.DeleteFile(h.ctx, request.TransactionID, request.StorageID, request.Filename)
+	file, err := h.service.RestoreFile(h.ctx, request.TransactionID, request.StorageID, request.Filename)
 	if err != nil {
 		return messages.FileManagerResponse{
 			TransactionID: request.TransactionID,
 			Success:       false,
 			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
 		}, nil
 	}
 
+	restored := toMessageFiles([]repository.FileInfo{file})
+	h.publishEvent(messages.TopicFileRestored, messages.FileRestoredEvent{
+		Event: newEvent(messages.TopicFileRestored, request.TransactionID, request.StorageID),
+		File:  restored[0],
+	})
+
 	return messages.FileManagerResponse{
 		TransactionID: request.TransactionID,
 		Success:       true,
 		StorageID:     request.StorageID,
+		Files:         restored,
+		TotalSize:     file.Size,
 	}, nil
 }
 
-func (h *Handler) handleDeleteFolder(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+func (h *Handler) handleRestoreFolder(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
 	if request.StorageID == "" {
 		return messages.FileManagerResponse{
 			TransactionID: request.TransactionID,
@@ -536,18 +822,89 @@ func (h *Handler) handleDeleteFolder(request messages.FileManagerRequest) (messa
 		}, nil
 	}
 
-	err := h.service.DeleteFolder(h.ctx, request.TransactionID, request.StorageID)
+	err := h.service.RestoreFolder(h.ctx, request.TransactionID, request.StorageID)
 	if err != nil {
 		return messages.FileManagerResponse{
 			TransactionID: request.TransactionID,
 			Success:       false,
 			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
 		}, nil
 	}
 
+	h.publishEvent(messages.TopicStorageRestored, messages.StorageRestoredEvent{
+		Event: newEvent(messages.TopicStorageRestored, request.TransactionID, request.StorageID),
+	})
+
 	return messages.FileManagerResponse{
 		TransactionID: request.TransactionID,
 		Success:       true,
 		StorageID:     request.StorageID,
 	}, nil
 }
+
+func (h *Handler) handleCopyFiles(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+	if request.StorageID == "" {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         "storage_id is required",
+		}, nil
+	}
+
+	result, err := h.service.CopyFiles(h.ctx, request.TransactionID, request.StorageID, request.Filenames, request.DestinationStorageID)
+	if err != nil {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
+		}, nil
+	}
+	h.publishUploaded(request.TransactionID, result)
+
+	return messages.FileManagerResponse{
+		TransactionID: request.TransactionID,
+		Success:       true,
+		StorageID:     result.StorageID,
+		Files:         toMessageFiles(result.Files),
+		TotalSize:     result.TotalSize,
+	}, nil
+}
+
+func (h *Handler) handleCommitUpload(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+	result, err := h.service.CommitUpload(h.ctx, request.TransactionID)
+	if err != nil {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
+		}, nil
+	}
+	h.publishUploaded(request.TransactionID, result)
+
+	return messages.FileManagerResponse{
+		TransactionID: request.TransactionID,
+		Success:       true,
+		StorageID:     result.StorageID,
+		Files:         toMessageFiles(result.Files),
+		TotalSize:     result.TotalSize,
+	}, nil
+}
+
+func (h *Handler) handleAbortUpload(request messages.FileManagerRequest) (messages.FileManagerResponse, error) {
+	if err := h.service.AbortUpload(h.ctx, request.TransactionID); err != nil {
+		return messages.FileManagerResponse{
+			TransactionID: request.TransactionID,
+			Success:       false,
+			Error:         err.Error(),
+			ErrorCode:     errorCode(err),
+		}, nil
+	}
+
+	return messages.FileManagerResponse{
+		TransactionID: request.TransactionID,
+		Success:       true,
+	}, nil
+}
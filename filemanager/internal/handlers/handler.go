@@ -3,8 +3,8 @@ package handlers
 import (
 	"context"
 	"sync"
+	"time"
 
-	"github.com/edgarcoime/Cthulhu-common/pkg/rabbitmq/manager"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
 )
 
@@ -14,25 +14,45 @@ type chunkStorage struct {
 	chunks      map[string]map[int][]byte // transactionID -> chunkIndex -> data
 	chunkCounts map[string]int            // transactionID -> total chunks expected
 	metadata    map[string]*chunkMetadata // transactionID -> metadata
+	rejected    map[string]int            // transactionID -> chunks still to discard after an early rejection
 }
 
 type chunkMetadata struct {
-	filename  string
-	storageID string
-	totalSize int64
+	filename            string
+	storageID           string
+	totalSize           int64
+	uploadTransactionID string // Set when the file is staged in a multi-file upload
+}
+
+// Publisher publishes messages to an exchange
+// Satisfied by *manager.Manager; tests can substitute an in-memory recorder
+type Publisher interface {
+	PublishMessage(ctx context.Context, exchange, routingKey string, contentType string, message []byte) error
 }
 
 // Handler holds dependencies for message handlers
 type Handler struct {
 	service      service.Service
-	manager      *manager.Manager
+	manager      Publisher
 	ctx          context.Context
 	chunkStorage *chunkStorage
+	idempotency  *idempotencyStore
+}
+
+// Option configures a Handler
+type Option func(*Handler)
+
+// WithIdempotencyWindow sets how long the response of a completed transaction is replayed
+// to redelivered duplicates instead of running them again; 0 disables it
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(h *Handler) {
+		h.idempotency = newIdempotencyStore(window)
+	}
 }
 
 // NewHandler creates a new handler instance
-func NewHandler(service service.Service, manager *manager.Manager, ctx context.Context) *Handler {
-	return &Handler{
+func NewHandler(service service.Service, manager Publisher, ctx context.Context, opts ...Option) *Handler {
+	h := &Handler{
 		service: service,
 		manager: manager,
 		ctx:     ctx,
@@ -40,6 +60,12 @@ func NewHandler(service service.Service, manager *manager.Manager, ctx context.C
 			chunks:      make(map[string]map[int][]byte),
 			chunkCounts: make(map[string]int),
 			metadata:    make(map[string]*chunkMetadata),
+			rejected:    make(map[string]int),
 		},
+		idempotency: newIdempotencyStore(DefaultIdempotencyWindow),
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	return h
 }
@@ -0,0 +1,75 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/handlers"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recorder is a Publisher keeping every published message
+type recorder struct {
+	mu       sync.Mutex
+	messages []published
+}
+
+// published is a message sent through a recorder
+type published struct {
+	exchange   string
+	routingKey string
+	body       []byte
+}
+
+func (r *recorder) PublishMessage(ctx context.Context, exchange, routingKey string, contentType string, message []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, published{exchange: exchange, routingKey: routingKey, body: message})
+	return nil
+}
+
+// responses decodes the responses published for the operation of transactionID
+func (r *recorder) responses(t *testing.T, operation, transactionID string) []messages.FileManagerResponse {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := fmt.Sprintf("%s.%s.%s", messages.TopicFileManagerResponse, operation, transactionID)
+	var responses []messages.FileManagerResponse
+	for _, msg := range r.messages {
+		if msg.routingKey != key {
+			continue
+		}
+		var response messages.FileManagerResponse
+		if err := json.Unmarshal(msg.body, &response); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+// events returns the messages published to the events exchange
+func (r *recorder) events() []published {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []published
+	for _, msg := range r.messages {
+		if msg.exchange == messages.EventsExchange {
+			events = append(events, msg)
+		}
+	}
+	return events
+}
+
+// deliver hands the handler one message for queue and waits until it is handled
+func deliver(h *handlers.Handler, queue string, request any) {
+	body, _ := json.Marshal(request)
+	msgs := make(chan amqp.Delivery, 1)
+	msgs <- amqp.Delivery{Body: body}
+	close(msgs)
+	h.HandleFileManagerMessages(queue, msgs)
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+)
+
+// DefaultIdempotencyWindow is how long the response of a completed transaction is replayed to duplicates
+const DefaultIdempotencyWindow = time.Hour
+
+// idempotentQueues are the queues whose operations change storages and must not run twice
+// Reads are safe to repeat, and their responses can be large. Chunks are acknowledged as they
+// arrive, and a duplicate of the last one would only replay its upload's response.
+var idempotentQueues = map[string]bool{
+	"filemanager.post.file":      true,
+	"filemanager.post.files":     true,
+	"filemanager.delete.file":    true,
+	"filemanager.delete.folder":  true,
+	"filemanager.prune.versions": true,
+	"filemanager.restore.file":   true,
+	"filemanager.restore.folder": true,
+	"filemanager.copy.files":     true,
+	"filemanager.commit.upload":  true,
+	"filemanager.abort.upload":   true,
+}
+
+// terminalErrorCodes are the failures a transaction meets again however often it runs,
+// so their responses are replayed like successes. Other failures, like running out of space
+// or an I/O error, may pass on a retry.
+var terminalErrorCodes = map[string]bool{
+	messages.ErrorCodeNotFound:        true,
+	messages.ErrorCodeInvalidFilename: true,
+	messages.ErrorCodeVersionNotFound: true,
+	messages.ErrorCodeFileExists:      true,
+	messages.ErrorCodeFileCorrupted:   true,
+	messages.ErrorCodeUploadAborted:   true,
+}
+
+// final reports whether a response settles its transaction, so duplicates get it replayed
+func final(response messages.FileManagerResponse) bool {
+	return response.Success || terminalErrorCodes[response.ErrorCode]
+}
+
+// idempotencyKey returns the key a message's transaction is remembered under, or "" if it isn't
+func idempotencyKey(queueName string, body []byte) string {
+	if !idempotentQueues[queueName] {
+		return ""
+	}
+	var request struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil || request.TransactionID == "" {
+		return ""
+	}
+	return queueName + "/" + request.TransactionID
+}
+
+// idempotencyStore remembers the final responses of completed transactions for a window
+// Responses live in memory, so a transaction redelivered after a restart runs again.
+type idempotencyStore struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	changed *sync.Cond // Broadcast when a transaction completes or is released
+	entries map[string]*idempotencyEntry
+	swept   time.Time
+}
+
+// idempotencyEntry is a transaction being handled, or completed if done is set
+type idempotencyEntry struct {
+	done        bool
+	response    messages.FileManagerResponse
+	completedAt time.Time
+}
+
+// newIdempotencyStore creates a store remembering responses for window; 0 disables it
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	s := &idempotencyStore{
+		window:  window,
+		entries: make(map[string]*idempotencyEntry),
+		swept:   time.Now(),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	return s
+}
+
+// begin claims the transaction key, waiting while a duplicate of it is handled
+// It returns the stored response and true if the transaction already completed.
+func (s *idempotencyStore) begin(key string) (messages.FileManagerResponse, bool) {
+	if s.window <= 0 {
+		return messages.FileManagerResponse{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		s.sweep()
+		entry, ok := s.entries[key]
+		if !ok || (entry.done && time.Since(entry.completedAt) >= s.window) {
+			s.entries[key] = &idempotencyEntry{}
+			return messages.FileManagerResponse{}, false
+		}
+		if entry.done {
+			return entry.response, true
+		}
+		s.changed.Wait()
+	}
+}
+
+// complete stores the response of the transaction key for the window if it is final
+// Otherwise the key is released, so a redelivery runs the transaction again.
+func (s *idempotencyStore) complete(key string, response messages.FileManagerResponse) {
+	if key == "" || s.window <= 0 {
+		return
+	}
+	if !final(response) {
+		s.release(key)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = &idempotencyEntry{done: true, response: response, completedAt: time.Now()}
+	s.changed.Broadcast()
+}
+
+// release gives up the claim on the transaction key if it didn't complete,
+// letting the next duplicate handle it
+func (s *idempotencyStore) release(key string) {
+	if s.window <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && !entry.done {
+		delete(s.entries, key)
+		s.changed.Broadcast()
+	}
+}
+
+// sweep forgets the transactions completed before the window, at most once a minute
+// The caller holds s.mu.
+func (s *idempotencyStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+
+	for key, entry := range s.entries {
+		if entry.done && now.Sub(entry.completedAt) >= s.window {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package handlers_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/handlers"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// fakeService deletes files through deleteFile and counts the calls
+// Operations the tests don't use panic through the nil embedded Service.
+type fakeService struct {
+	service.Service
+
+	mu         sync.Mutex
+	calls      int
+	deleteFile func(call int) error // call counts from 1
+}
+
+func (s *fakeService) DeleteFile(ctx context.Context, transactionID string, storageID string, filename string) (repository.FileInfo, error) {
+	s.mu.Lock()
+	s.calls++
+	call := s.calls
+	s.mu.Unlock()
+	file := repository.FileInfo{Filename: filename, Path: filename}
+	if s.deleteFile == nil {
+		return file, nil
+	}
+	return file, s.deleteFile(call)
+}
+
+// callCount returns how many times the service ran
+func (s *fakeService) callCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// deleteRequest deletes a.txt from a storage in the transaction transactionID
+func deleteRequest(transactionID string) messages.FileManagerRequest {
+	return messages.FileManagerRequest{TransactionID: transactionID, StorageID: "abcdefghij", Filename: "a.txt"}
+}
+
+// assertResponses checks the success of every response published for a delete of transactionID
+func assertResponses(t *testing.T, r *recorder, transactionID string, want ...bool) {
+	t.Helper()
+	responses := r.responses(t, "delete.file", transactionID)
+	if len(responses) != len(want) {
+		t.Fatalf("%d responses published for %s, want %d", len(responses), transactionID, len(want))
+	}
+	for i, response := range responses {
+		if response.Success != want[i] {
+			t.Errorf("response %d for %s: success %v (%s), want %v", i+1, transactionID, response.Success, response.Error, want[i])
+		}
+	}
+}
+
+func TestIdempotencyReplaysFinalResponses(t *testing.T) {
+	for name, err := range map[string]error{
+		"success":  nil,
+		"terminal": repository.ErrFileNotFound, // Deleting again would fail the same way
+	} {
+		t.Run(name, func(t *testing.T) {
+			svc := &fakeService{deleteFile: func(int) error { return err }}
+			r := &recorder{}
+			h := handlers.NewHandler(svc, r, context.Background())
+
+			deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+			deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+
+			if svc.callCount() != 1 {
+				t.Errorf("service ran %d times for a redelivered transaction, want once", svc.callCount())
+			}
+			assertResponses(t, r, "tx", err == nil, err == nil)
+
+			// Another transaction runs
+			deliver(h, "filemanager.delete.file", deleteRequest("tx2"))
+			if svc.callCount() != 2 {
+				t.Errorf("service ran %d times for two transactions, want twice", svc.callCount())
+			}
+		})
+	}
+}
+
+func TestIdempotencyRetriesFailures(t *testing.T) {
+	for name, err := range map[string]error{
+		"insufficient storage": service.ErrInsufficientStorage,
+		"uncoded":              fmt.Errorf("disk failure"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			svc := &fakeService{deleteFile: func(call int) error {
+				if call == 1 {
+					return err
+				}
+				return nil
+			}}
+			r := &recorder{}
+			h := handlers.NewHandler(svc, r, context.Background())
+
+			deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+			deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+
+			if svc.callCount() != 2 {
+				t.Errorf("service ran %d times, want the redelivery to retry the failed transaction", svc.callCount())
+			}
+			assertResponses(t, r, "tx", false, true)
+
+			// The retry that passed is final
+			deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+			if svc.callCount() != 2 {
+				t.Errorf("service ran %d times after the retry passed, want twice", svc.callCount())
+			}
+		})
+	}
+}
+
+// A duplicate arriving while its transaction runs waits for it instead of running too
+func TestIdempotencyConcurrentDuplicates(t *testing.T) {
+	for name, first := range map[string]error{
+		"success": nil,
+		"failure": service.ErrInsufficientStorage, // The waiting duplicate takes over
+	} {
+		t.Run(name, func(t *testing.T) {
+			started, finish := make(chan struct{}), make(chan struct{})
+			svc := &fakeService{deleteFile: func(call int) error {
+				if call > 1 {
+					return nil
+				}
+				close(started)
+				<-finish
+				return first
+			}}
+			r := &recorder{}
+			h := handlers.NewHandler(svc, r, context.Background())
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+			}()
+			<-started
+			duplicateDone := make(chan struct{})
+			go func() {
+				defer wg.Done()
+				defer close(duplicateDone)
+				deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+			}()
+
+			select {
+			case <-duplicateDone:
+				t.Fatal("duplicate was handled while its transaction was still running")
+			case <-time.After(50 * time.Millisecond):
+			}
+			if svc.callCount() != 1 {
+				t.Fatalf("service ran %d times while the first delivery was running, want once", svc.callCount())
+			}
+
+			close(finish)
+			wg.Wait()
+
+			if first == nil {
+				if svc.callCount() != 1 {
+					t.Errorf("service ran %d times, want the duplicate to get the stored response", svc.callCount())
+				}
+				assertResponses(t, r, "tx", true, true)
+				return
+			}
+			if svc.callCount() != 2 {
+				t.Errorf("service ran %d times, want the duplicate to run after the failure", svc.callCount())
+			}
+			// The failure and the duplicate's success are published in either order
+			succeeded := 0
+			for _, response := range r.responses(t, "delete.file", "tx") {
+				if response.Success {
+					succeeded++
+				}
+			}
+			if succeeded != 1 {
+				t.Errorf("%d successful responses, want the duplicate's only", succeeded)
+			}
+		})
+	}
+}
+
+func TestIdempotencyWindow(t *testing.T) {
+	t.Run("expiry", func(t *testing.T) {
+		svc := &fakeService{}
+		h := handlers.NewHandler(svc, &recorder{}, context.Background(), handlers.WithIdempotencyWindow(20*time.Millisecond))
+
+		deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+		deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+		if svc.callCount() != 1 {
+			t.Fatalf("service ran %d times within the window, want once", svc.callCount())
+		}
+
+		time.Sleep(30 * time.Millisecond)
+		deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+		if svc.callCount() != 2 {
+			t.Errorf("service ran %d times, want the transaction to run again after the window", svc.callCount())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		svc := &fakeService{}
+		h := handlers.NewHandler(svc, &recorder{}, context.Background(), handlers.WithIdempotencyWindow(0))
+
+		deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+		deliver(h, "filemanager.delete.file", deleteRequest("tx"))
+		if svc.callCount() != 2 {
+			t.Errorf("service ran %d times with idempotency disabled, want twice", svc.callCount())
+		}
+	})
+}
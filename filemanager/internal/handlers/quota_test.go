@@ -0,0 +1,42 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/handlers"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// A full storage and a full repository are told apart by their error codes
+func TestQuotaErrorCodes(t *testing.T) {
+	s := service.NewFileManagerService(repository.NewMemoryRepository(),
+		service.WithQuota(service.Quota{StorageBytes: 5, CapacityBytes: 8}))
+	r := &recorder{}
+	h := handlers.NewHandler(s, r, context.Background())
+
+	for _, tc := range []struct {
+		transactionID string
+		content       string
+		code          string
+	}{
+		{"tx1", "123456", messages.ErrorCodeQuotaExceeded},
+		{"tx2", "1234", ""},
+		{"tx3", "1234", ""},
+		{"tx4", "1", messages.ErrorCodeInsufficientStorage},
+	} {
+		deliver(h, "filemanager.post.file", messages.FileUploadRequest{
+			TransactionID: tc.transactionID,
+			Filename:      "a.txt",
+			Content:       base64.StdEncoding.EncodeToString([]byte(tc.content)),
+			Size:          int64(len(tc.content)),
+		})
+		responses := r.responses(t, "post.file", tc.transactionID)
+		if len(responses) != 1 || responses[0].Success != (tc.code == "") || responses[0].ErrorCode != tc.code {
+			t.Errorf("upload of %d bytes: responses %+v, want error code %q", len(tc.content), responses, tc.code)
+		}
+	}
+}
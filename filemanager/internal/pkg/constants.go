@@ -6,7 +6,65 @@ import (
 
 var (
 	// Storage Configuration
-	STORAGE_PATH = env.GetEnv("STORAGE_PATH", "/tmp/fileDump")
+	STORAGE_BACKEND = env.GetEnv("STORAGE_BACKEND", "local") // local, memory, s3 or cas
+	STORAGE_PATH    = env.GetEnv("STORAGE_PATH", "/tmp/fileDump")
+
+	// What happens when an uploaded filename already exists: overwrite, reject or rename
+	NAME_CONFLICT_POLICY = env.GetEnv("NAME_CONFLICT_POLICY", "overwrite")
+
+	// How long a storage lives after creation, recorded as expires_at in its manifest (e.g. 168h); 0 means never
+	STORAGE_TTL = env.GetEnv("STORAGE_TTL", "0")
+
+	// At-rest compression of new files: none, gzip or zstd
+	STORAGE_COMPRESSION = env.GetEnv("STORAGE_COMPRESSION", "none")
+
+	// Upload limits in MB, counted as uploaded: per storage and across all storages; 0 means unlimited
+	STORAGE_QUOTA_MB    = env.GetEnv("STORAGE_QUOTA_MB", "1024")
+	STORAGE_CAPACITY_MB = env.GetEnv("STORAGE_CAPACITY_MB", "0")
+
+	// Free space in MB kept on the storage disk (local and cas backends); uploads are refused below it
+	DISK_RESERVE_MB = env.GetEnv("DISK_RESERVE_MB", "512")
+
+	// Encryption at rest: base64 32 byte master key wrapping per-storage data keys; empty disables it
+	// Previous master keys (comma-separated) can still unwrap data keys until they are rotated
+	// The cas backend refuses a master key, since encrypted files can't be deduplicated
+	ENCRYPTION_MASTER_KEY    = env.GetEnv("ENCRYPTION_MASTER_KEY", "")
+	ENCRYPTION_PREVIOUS_KEYS = env.GetEnv("ENCRYPTION_PREVIOUS_KEYS", "")
+
+	// Keep the previous content of overwritten files as numbered versions (requires the overwrite policy)
+	// MAX_VERSIONS caps the older versions kept per file; 0 means unlimited
+	VERSIONING_ENABLED = env.GetEnv("VERSIONING_ENABLED", "false")
+	MAX_VERSIONS       = env.GetEnv("MAX_VERSIONS", "10")
+
+	// How long deleted files and storages stay restorable (e.g. 72h); 0 deletes immediately
+	// TRASH_PURGE_INTERVAL is how often content past that window is permanently removed
+	TRASH_RETENTION      = env.GetEnv("TRASH_RETENTION", "0")
+	TRASH_PURGE_INTERVAL = env.GetEnv("TRASH_PURGE_INTERVAL", "1h")
+
+	// How often every stored file is re-hashed against its recorded SHA-256 (e.g. 24h); 0 disables it
+	// SCRUB_RATE_MB caps how many MB per second the scrubber reads; 0 means unlimited
+	SCRUB_INTERVAL = env.GetEnv("SCRUB_INTERVAL", "24h")
+	SCRUB_RATE_MB  = env.GetEnv("SCRUB_RATE_MB", "10")
+
+	// How long a multi-file upload may go without a new file before its staged files are discarded
+	UPLOAD_TRANSACTION_TIMEOUT = env.GetEnv("UPLOAD_TRANSACTION_TIMEOUT", "15m")
+
+	// How long the response of a completed request is replayed to redeliveries with its transaction ID (e.g. 1h); 0 disables it
+	IDEMPOTENCY_WINDOW = env.GetEnv("IDEMPOTENCY_WINDOW", "1h")
+
+	// SQLite database indexing storages and files, read by listings instead of the backend; empty disables it
+	// Keep it outside STORAGE_PATH; it is built from the backend when empty
+	METADATA_INDEX_PATH = env.GetEnv("METADATA_INDEX_PATH", "/tmp/fileDump-index.db")
+
+	// S3 Configuration (used when STORAGE_BACKEND=s3)
+	S3_ENDPOINT       = env.GetEnv("S3_ENDPOINT", "")
+	S3_REGION         = env.GetEnv("S3_REGION", "us-east-1")
+	S3_BUCKET         = env.GetEnv("S3_BUCKET", "")
+	S3_PREFIX         = env.GetEnv("S3_PREFIX", "")
+	S3_ACCESS_KEY     = env.GetEnv("S3_ACCESS_KEY", "")
+	S3_SECRET_KEY     = env.GetEnv("S3_SECRET_KEY", "")
+	S3_USE_PATH_STYLE = env.GetEnv("S3_USE_PATH_STYLE", "true")
+	S3_PART_SIZE_MB   = env.GetEnv("S3_PART_SIZE_MB", "8")
 
 	// RabbitMQ Configuration
 	AMQP_USER  = env.GetEnv("AMQP_USER", "guest")
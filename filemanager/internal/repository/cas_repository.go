@@ -0,0 +1,569 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// casRepository stores file bytes once per SHA-256 digest
+// Storages only hold small reference files pointing at a blob, and a blob is
+// garbage-collected as soon as its last reference is deleted.
+//
+// Layout under dirPath:
+//
+//	blobs/<first 2 hex chars>/<sha256>   file content
+//	refs/<ab>/<cd>/<storageID>/<path>    JSON casRef, sharded like the local backend
+//	refs/<ab>/<cd>/<storageID>/.cthulhu/ metadata documents
+//	tmp/                                 in-flight uploads
+type casRepository struct {
+	dirPath string
+	opts    options
+
+	// mu guards refCounts, blobSizes and every blob/ref create or delete
+	mu        sync.RWMutex
+	refCounts map[string]int   // digest -> number of refs pointing at it
+	blobSizes map[string]int64 // digest -> blob size on disk
+}
+
+// casRef is the content of a reference file
+type casRef struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// NewCASRepository creates a new content-addressed file repository instance
+// Reference counts are rebuilt from disk and orphaned blobs left by crashes are removed
+func NewCASRepository(dirPath string, opts ...Option) (*casRepository, error) {
+	for _, dir := range []string{"blobs", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dirPath, dir), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create %s directory: %w", dir, err)
+		}
+	}
+
+	if _, err := migrateFlatLayout(filepath.Join(dirPath, "refs")); err != nil {
+		return nil, err
+	}
+
+	r := &casRepository{
+		dirPath:   dirPath,
+		opts:      newOptions(opts),
+		refCounts: make(map[string]int),
+		blobSizes: make(map[string]int64),
+	}
+	if err := r.rebuild(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close implements the Repository interface
+// For the content-addressed repository, this is a no-op but kept for interface compliance
+func (r *casRepository) Close() {
+	// No cleanup needed for local file storage
+}
+
+func (r *casRepository) blobPath(digest string) string {
+	return filepath.Join(r.dirPath, "blobs", digest[:2], digest)
+}
+
+func (r *casRepository) refsDir() string {
+	return filepath.Join(r.dirPath, "refs")
+}
+
+func (r *casRepository) refDir(storageID string) string {
+	return shardDir(r.refsDir(), storageID)
+}
+
+func (r *casRepository) refPath(storageID, filename string) string {
+	return filepath.Join(r.refDir(storageID), filepath.FromSlash(filename))
+}
+
+// readStorageRef reads the reference for filename, mapping anything that isn't a
+// reference file (missing, a folder, a path through a file) to ErrFileNotFound
+func (r *casRepository) readStorageRef(storageID, filename string) (casRef, error) {
+	refPath := r.refPath(storageID, filename)
+	if info, err := os.Stat(refPath); isMissingFile(info, err) {
+		return casRef{}, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	ref, err := readCASRef(refPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ref, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	if err != nil {
+		return ref, fmt.Errorf("failed to read file reference: %w", err)
+	}
+	return ref, nil
+}
+
+// walkRefs calls fn for every reference in a storage with its relative path
+// Unreadable references are skipped
+func (r *casRepository) walkRefs(storageID string, fn func(relPath string, ref casRef)) error {
+	return walkFiles(r.refDir(storageID), func(relPath string, d fs.DirEntry) error {
+		ref, err := readCASRef(r.refPath(storageID, relPath))
+		if err != nil {
+			return nil // Skip references we can't read
+		}
+		fn(relPath, ref)
+		return nil
+	})
+}
+
+// rebuild scans refs and blobs to restore reference counts after a restart
+func (r *casRepository) rebuild() error {
+	// Anything in tmp is an upload that never finished
+	tmpDir := filepath.Join(r.dirPath, "tmp")
+	if entries, err := os.ReadDir(tmpDir); err == nil {
+		for _, entry := range entries {
+			os.Remove(filepath.Join(tmpDir, entry.Name()))
+		}
+	}
+
+	refsDir := r.refsDir()
+	err := filepath.WalkDir(refsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(refsDir, path)
+		if err != nil {
+			return err
+		}
+		// Below refs/ab/cd/<id>, the metadata folder holds documents rather than
+		// references, except for the files decorators keep in reservedDirs
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) > 4 && parts[3] == metaDirName && !isReservedPath(strings.Join(parts[3:5], "/")+"/") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		ref, err := readCASRef(path)
+		if err != nil {
+			log.Printf("Skipping unreadable reference %s: %v", path, err)
+			return nil
+		}
+		r.refCounts[ref.Digest]++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan references: %w", err)
+	}
+
+	err = filepath.WalkDir(filepath.Join(r.dirPath, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		digest := d.Name()
+		if r.refCounts[digest] == 0 {
+			// Orphaned by a crash between writing the blob and its reference
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		r.blobSizes[digest] = info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan blobs: %w", err)
+	}
+
+	// Drop references whose blob is gone so reads fail cleanly
+	for digest := range r.refCounts {
+		if _, ok := r.blobSizes[digest]; !ok {
+			log.Printf("Blob %s is referenced but missing", digest)
+			delete(r.refCounts, digest)
+		}
+	}
+
+	return nil
+}
+
+func readCASRef(path string) (casRef, error) {
+	var ref casRef
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ref, err
+	}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return ref, fmt.Errorf("invalid reference: %w", err)
+	}
+	if _, err := hex.DecodeString(ref.Digest); err != nil || len(ref.Digest) != sha256.Size*2 {
+		return ref, fmt.Errorf("invalid reference digest: %q", ref.Digest)
+	}
+	return ref, nil
+}
+
+// writeCASRef atomically writes a reference file via a temp file and rename
+func (r *casRepository) writeCASRef(path string, ref casRef) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(r.dirPath, "tmp"), "ref-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// release drops one reference to digest and deletes the blob when none remain
+// Caller must hold r.mu
+func (r *casRepository) release(digest string) {
+	r.refCounts[digest]--
+	if r.refCounts[digest] > 0 {
+		return
+	}
+	delete(r.refCounts, digest)
+	delete(r.blobSizes, digest)
+	if err := os.Remove(r.blobPath(digest)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to garbage-collect blob %s: %v", digest, err)
+	}
+}
+
+// SaveFile hashes content into a blob and records a reference to it in the storage
+// Content already stored under the same digest is not written again
+func (r *casRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return FileInfo{}, err
+	}
+
+	// Stream to a temp file while hashing, outside the lock
+	tmp, err := os.CreateTemp(filepath.Join(r.dirPath, "tmp"), "blob-*")
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once renamed into place
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to write file content: %w", err)
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	finalName, err := resolveFilename(r.opts.conflictPolicy, filename, func(name string) (bool, error) {
+		_, err := os.Stat(r.refPath(storageID, name))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	refPath := r.refPath(storageID, finalName)
+
+	// Created under the lock so a concurrent delete can't remove it underneath us
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	// Publish the blob unless an identical one already exists
+	if _, exists := r.blobSizes[digest]; !exists {
+		blobPath := r.blobPath(digest)
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			return FileInfo{}, fmt.Errorf("failed to create blob directory: %w", err)
+		}
+		if err := os.Rename(tmpPath, blobPath); err != nil {
+			return FileInfo{}, fmt.Errorf("failed to store blob: %w", err)
+		}
+		r.blobSizes[digest] = size
+	}
+	r.refCounts[digest]++
+
+	// An overwrite releases the reference to the previous content
+	previous, prevErr := readCASRef(refPath)
+
+	if err := r.writeCASRef(refPath, casRef{Digest: digest, Size: size}); err != nil {
+		r.release(digest)
+		return FileInfo{}, fmt.Errorf("failed to write file reference: %w", err)
+	}
+
+	if prevErr == nil {
+		r.release(previous.Digest)
+	}
+
+	return newFileInfo(finalName, size), nil
+}
+
+// GetFile resolves a reference and opens the blob it points at
+// Returns a ReadCloser that must be closed by the caller
+func (r *casRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return nil, err
+	}
+
+	// Hold the read lock until the blob is open so it cannot be collected in between
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ref, err := r.readStorageRef(storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(r.blobPath(ref.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return file, nil
+}
+
+// GetFileRange opens the file's blob and seeks to offset, so only the range is read
+func (r *casRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	file, err := r.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+	return seekFileRange(file.(*os.File), offset, length)
+}
+
+// GetFilesByStorage retrieves all files referenced by a storage, including nested ones
+func (r *casRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, err := os.Stat(r.refDir(storageID)); os.IsNotExist(err) {
+		return []FileInfo{}, nil // Return empty slice if storage doesn't exist
+	}
+
+	files := []FileInfo{}
+	err := r.walkRefs(storageID, func(relPath string, ref casRef) {
+		files = append(files, newFileInfo(relPath, ref.Size))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+	sortFileInfos(files)
+
+	return files, nil
+}
+
+// DeleteFile removes a reference and collects the blob if it was the last one
+// Folders left empty by the delete are removed as well
+func (r *casRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ref, err := r.readStorageRef(storageID, filename)
+	if err != nil {
+		return err
+	}
+
+	refPath := r.refPath(storageID, filename)
+	if err := os.Remove(refPath); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	pruneEmptyDirs(r.refDir(storageID), filepath.Dir(refPath))
+	r.release(ref.Digest)
+
+	return nil
+}
+
+// moveFile implements fileMover by moving the reference; the blob stays where it is
+func (r *casRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, from); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, to); err != nil {
+		return FileInfo{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ref, err := r.readStorageRef(storageID, from)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fromPath, toPath := r.refPath(storageID, from), r.refPath(storageID, to)
+	if err := os.MkdirAll(filepath.Dir(toPath), 0755); err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	// A replaced file releases its reference like an overwrite
+	previous, prevErr := readCASRef(toPath)
+	if err := os.Rename(fromPath, toPath); err != nil {
+		return FileInfo{}, fmt.Errorf("failed to move file reference: %w", err)
+	}
+	pruneEmptyDirs(r.refDir(storageID), filepath.Dir(fromPath))
+	if prevErr == nil {
+		r.release(previous.Digest)
+	}
+
+	return newFileInfo(to, ref.Size), nil
+}
+
+// DeleteStorage removes every reference in a storage and collects unreferenced blobs
+func (r *casRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	refDir := r.refDir(storageID)
+	if _, err := os.Stat(refDir); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+
+	var digests []string
+	err := r.walkRefs(storageID, func(relPath string, ref casRef) {
+		digests = append(digests, ref.Digest)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	if err := os.RemoveAll(refDir); err != nil {
+		return fmt.Errorf("failed to delete storage folder: %w", err)
+	}
+	pruneEmptyDirs(r.refsDir(), filepath.Dir(refDir))
+	for _, digest := range digests {
+		r.release(digest)
+	}
+
+	return nil
+}
+
+// readMetadata implements metadataStore
+func (r *casRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data, err := os.ReadFile(filepath.Join(r.refDir(storageID), metaDirName, metadataFilename(name)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+	return data, err
+}
+
+// writeMetadata implements metadataStore
+// Held under the lock so a concurrent DeleteStorage removes the document with the storage
+func (r *casRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(r.refDir(storageID), metaDirName, metadataFilename(name)), data)
+}
+
+// listStorageIDs implements storageLister
+func (r *casRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids, _, err := shardedStorageIDs(r.refsDir(), "", -1)
+	return ids, err
+}
+
+// ListStorages walks the shard folders of refs in order, reporting logical sizes
+func (r *casRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	limit, err := checkStoragePage(cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids, more, err := shardedStorageIDs(r.refsDir(), cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+	return describeStorages(ctx, ids, more, func(ctx context.Context, storageID string) (StorageInfo, error) {
+		return describeDir(storageID, r.refDir(storageID), func(relPath string, info fs.FileInfo) int64 {
+			ref, err := readCASRef(r.refPath(storageID, relPath))
+			if err != nil {
+				return 0 // Unreadable references count as empty
+			}
+			return ref.Size
+		})
+	})
+}
+
+// Usage reports logical bytes (sum of every reference) against physical bytes (unique blobs)
+func (r *casRepository) Usage(ctx context.Context) (Usage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var usage Usage
+	for _, size := range r.blobSizes {
+		usage.PhysicalBytes += size
+	}
+
+	ids, _, err := shardedStorageIDs(r.refsDir(), "", -1)
+	if err != nil {
+		return usage, err
+	}
+	for _, id := range ids {
+		usage.Storages++
+		// Skip storages we can't read
+		r.walkRefs(id, func(relPath string, ref casRef) {
+			usage.Files++
+			usage.LogicalBytes += ref.Size
+		})
+	}
+
+	return usage, nil
+}
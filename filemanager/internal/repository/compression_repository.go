@@ -0,0 +1,448 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs supported by the compression decorator
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// compressionName is the size index recording logical sizes of compressed files
+const compressionName = "compression"
+
+// Every file written by the decorator starts with compressionMagic followed by one codec byte
+// Files without the header, e.g. stored before compression was enabled, are served as-is.
+var compressionMagic = []byte("CTHC")
+
+// compressionHeaderSize is the length of the magic and codec byte
+const compressionHeaderSize = 5
+
+// compressionCodec returns the codec recorded in a file's header, if it has one
+func compressionCodec(header []byte) (byte, bool) {
+	if len(header) < compressionHeaderSize || !bytes.Equal(header[:len(compressionMagic)], compressionMagic) {
+		return 0, false
+	}
+	return header[len(compressionMagic)], true
+}
+
+const (
+	codecStored byte = iota // Content kept as-is, e.g. because it was already compressed
+	codecGzip
+	codecZstd
+)
+
+// sniffLength is how much of an upload is inspected for compressed-format magic bytes
+const sniffLength = 16
+
+// compressedSignatures lists magic bytes of formats that don't benefit from compression
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b},                         // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},             // zstd
+	{0x50, 0x4b, 0x03, 0x04},             // zip, docx, xlsx, jar, apk
+	{0x42, 0x5a, 0x68},                   // bzip2
+	{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, // xz
+	{0x37, 0x7a, 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x52, 0x61, 0x72, 0x21, 0x1a, 0x07}, // rar
+	{0x04, 0x22, 0x4d, 0x18},             // lz4
+	{0x89, 0x50, 0x4e, 0x47},             // png
+	{0xff, 0xd8, 0xff},                   // jpeg
+	{0x47, 0x49, 0x46, 0x38},             // gif
+	{0x4f, 0x67, 0x67, 0x53},             // ogg
+	{0x49, 0x44, 0x33},                   // mp3 (ID3)
+	{0x1a, 0x45, 0xdf, 0xa3},             // mkv, webm
+}
+
+// isCompressed reports whether head starts like an already compressed format
+func isCompressed(head []byte) bool {
+	for _, signature := range compressedSignatures {
+		if bytes.HasPrefix(head, signature) {
+			return true
+		}
+	}
+	// RIFF containers (webp, avi, wav) and ISO media (mp4, mov, heic)
+	if len(head) >= 12 && string(head[:4]) == "RIFF" && (string(head[8:12]) == "WEBP" || string(head[8:12]) == "AVI ") {
+		return true
+	}
+	return len(head) >= 8 && string(head[4:8]) == "ftyp"
+}
+
+// ParseCompression validates a configured codec name
+// An empty value disables compression
+func ParseCompression(s string) (string, error) {
+	switch codec := strings.ToLower(strings.TrimSpace(s)); codec {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return codec, nil
+	default:
+		return "", fmt.Errorf("unknown compression codec: %s", s)
+	}
+}
+
+// compressionRepository compresses files on SaveFile and decompresses them on GetFile
+// Listings and SaveFile report logical sizes, recorded per storage in a metadata document.
+type compressionRepository struct {
+	Repository
+	store metadataStore
+	codec byte
+	locks storageLocks
+}
+
+// NewCompressionRepository wraps inner so new files are stored compressed with codec
+// inner must be one of the repositories of this package.
+func NewCompressionRepository(inner Repository, codec string) (*compressionRepository, error) {
+	store, ok := inner.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot store compression metadata", inner)
+	}
+
+	r := &compressionRepository{
+		Repository: inner,
+		store:      store,
+	}
+	switch codec {
+	case CompressionGzip:
+		r.codec = codecGzip
+	case CompressionZstd:
+		r.codec = codecZstd
+	default:
+		return nil, fmt.Errorf("unsupported compression codec: %s", codec)
+	}
+	return r, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// encode writes the header and the content of src to w using codec
+func encode(w io.Writer, codec byte, src io.Reader) error {
+	if _, err := w.Write(append(append([]byte(nil), compressionMagic...), codec)); err != nil {
+		return err
+	}
+
+	var enc io.WriteCloser
+	switch codec {
+	case codecGzip:
+		enc = gzip.NewWriter(w)
+	case codecZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		enc = zw
+	default:
+		_, err := io.Copy(w, src)
+		return err
+	}
+
+	if _, err := io.Copy(enc, src); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// SaveFile compresses content while streaming it to the wrapped repository
+// Content that already looks compressed is stored as-is behind the header.
+func (r *compressionRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := loadSizeIndex(ctx, r.store, storageID, compressionName)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	src := &countingReader{r: content}
+	br := bufio.NewReader(src)
+	codec := r.codec
+	head, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return FileInfo{}, fmt.Errorf("failed to read file content: %w", err)
+	}
+	if isCompressed(head) {
+		codec = codecStored
+	}
+
+	// Compress in a goroutine feeding the wrapped repository through a pipe
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(encode(pw, codec, br))
+	}()
+
+	info, err := r.Repository.SaveFile(ctx, storageID, filename, pr)
+	// Unblock the encoder if the wrapped repository stopped reading early
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info.Size = src.n
+	index.Sizes[info.Path] = info.Size
+	if err := saveSizeIndex(ctx, r.store, storageID, compressionName, index); err != nil {
+		return FileInfo{}, err
+	}
+
+	return info, nil
+}
+
+// decodingReader closes both the decoder and the underlying file
+type decodingReader struct {
+	io.Reader
+	closeDecoder func()
+	file         io.Closer
+}
+
+func (d *decodingReader) Close() error {
+	if d.closeDecoder != nil {
+		d.closeDecoder()
+	}
+	return d.file.Close()
+}
+
+// GetFile returns a reader yielding the original, uncompressed content
+func (r *compressionRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	file, err := r.Repository.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(file)
+	header, err := br.Peek(compressionHeaderSize)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	codec, ok := compressionCodec(header)
+	if !ok {
+		// Written without the decorator
+		return &decodingReader{Reader: br, file: file}, nil
+	}
+	br.Discard(len(header))
+
+	switch codec {
+	case codecStored:
+		return &decodingReader{Reader: br, file: file}, nil
+	case codecGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%w: failed to open compressed file: %v", ErrFileCorrupted, err)
+		}
+		return &decodingReader{Reader: zr, closeDecoder: func() { zr.Close() }, file: file}, nil
+	case codecZstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%w: failed to open compressed file: %v", ErrFileCorrupted, err)
+		}
+		return &decodingReader{Reader: zr, closeDecoder: zr.Close, file: file}, nil
+	default:
+		file.Close()
+		return nil, fmt.Errorf("failed to open compressed file: unknown codec %d", codec)
+	}
+}
+
+// GetFileRange returns a range of the original content
+// Content stored as-is is read with a ranged read; compressed content has to be
+// decompressed from the start, discarding everything before offset.
+func (r *compressionRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	head, err := r.Repository.GetFileRange(ctx, storageID, filename, 0, compressionHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	header, err := io.ReadAll(head)
+	head.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+
+	codec, ok := compressionCodec(header)
+	if !ok {
+		// Written without the decorator
+		return r.Repository.GetFileRange(ctx, storageID, filename, offset, length)
+	}
+
+	if codec == codecStored {
+		if head.Size == compressionHeaderSize {
+			// Empty content has no range to read below the header
+			if _, err := checkRange(offset, length, 0); err != nil {
+				return nil, err
+			}
+			return newFileRange(io.NopCloser(bytes.NewReader(nil)), offset, 0, 0), nil
+		}
+		if offset < 0 {
+			return nil, fmt.Errorf("%w: negative offset %d", ErrInvalidRange, offset)
+		}
+		fr, err := r.Repository.GetFileRange(ctx, storageID, filename, offset+compressionHeaderSize, length)
+		if err != nil {
+			return nil, err
+		}
+		fr.Offset -= compressionHeaderSize
+		fr.Size -= compressionHeaderSize
+		return fr, nil
+	}
+
+	index, err := loadSizeIndex(ctx, r.store, storageID, compressionName)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := index.Sizes[filename]
+	if !ok {
+		return nil, fmt.Errorf("failed to open compressed file: unknown size of %s", filename)
+	}
+	length, err = checkRange(offset, length, size)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := r.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, file, offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to skip to offset: %w", err)
+	}
+	return newFileRange(file, offset, length, size), nil
+}
+
+// GetFilesByStorage lists the wrapped repository, reporting logical sizes
+func (r *compressionRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	files, err := r.Repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadSizeIndex(ctx, r.store, storageID, compressionName)
+	if err != nil {
+		return nil, err
+	}
+	index.apply(files)
+
+	return files, nil
+}
+
+// DeleteFile removes the file and its logical size record
+func (r *compressionRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	if err := r.Repository.DeleteFile(ctx, storageID, filename); err != nil {
+		return err
+	}
+
+	index, err := loadSizeIndex(ctx, r.store, storageID, compressionName)
+	if err != nil {
+		return err
+	}
+	if _, ok := index.Sizes[filename]; !ok {
+		return nil
+	}
+	delete(index.Sizes, filename)
+
+	return saveSizeIndex(ctx, r.store, storageID, compressionName, index)
+}
+
+// moveFile implements fileMover when the wrapped repository does, moving the file's size record
+func (r *compressionRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	info, err := forwardMove(ctx, r.Repository, storageID, from, to)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	index, err := loadSizeIndex(ctx, r.store, storageID, compressionName)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !index.move(from, to, &info) {
+		return info, nil
+	}
+	return info, saveSizeIndex(ctx, r.store, storageID, compressionName, index)
+}
+
+// DeleteStorage removes the storage; its size records go with it
+func (r *compressionRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	return r.Repository.DeleteStorage(ctx, storageID)
+}
+
+// ListStorages reports the sizes of files as uploaded rather than compressed
+func (r *compressionRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	page, err := r.Repository.ListStorages(ctx, cursor, limit)
+	return withLogicalSizes(ctx, r, page, err)
+}
+
+// Usage reports logical bytes before compression against what the wrapped repository stores
+func (r *compressionRepository) Usage(ctx context.Context) (Usage, error) {
+	return logicalUsage(ctx, r, r.Repository)
+}
+
+// DiskSpace forwards to the wrapped repository when it stores files on a local filesystem
+func (r *compressionRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return forwardDiskSpace(ctx, r.Repository)
+}
+
+// readMetadata implements metadataStore so other decorators can be stacked on top
+func (r *compressionRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	return r.store.readMetadata(ctx, storageID, name)
+}
+
+// writeMetadata implements metadataStore so other decorators can be stacked on top
+func (r *compressionRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return r.store.writeMetadata(ctx, storageID, name, data)
+}
+
+// listStorageIDs implements storageLister so other decorators can be stacked on top
+func (r *compressionRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	return lister.listStorageIDs(ctx)
+}
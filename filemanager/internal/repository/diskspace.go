@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// DiskSpace describes the filesystem holding a repository's files
+type DiskSpace struct {
+	TotalBytes int64
+	FreeBytes  int64 // Available to this process, excluding blocks reserved for the superuser
+}
+
+// SpaceReporter is implemented by repositories that store files on a local filesystem
+type SpaceReporter interface {
+	// DiskSpace reports the size and free space of the filesystem holding the repository
+	// Decorators wrapping other backends fail with errors.ErrUnsupported.
+	DiskSpace(ctx context.Context) (DiskSpace, error)
+}
+
+// DiskSpace implements SpaceReporter
+func (r *localRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return statDisk(r.dirPath)
+}
+
+// DiskSpace implements SpaceReporter
+func (r *casRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return statDisk(r.dirPath)
+}
+
+// forwardDiskSpace reports the disk space of inner when it stores files on a local filesystem
+func forwardDiskSpace(ctx context.Context, inner Repository) (DiskSpace, error) {
+	reporter, ok := inner.(SpaceReporter)
+	if !ok {
+		return DiskSpace{}, fmt.Errorf("repository %T does not report disk space: %w", inner, errors.ErrUnsupported)
+	}
+	return reporter.DiskSpace(ctx)
+}
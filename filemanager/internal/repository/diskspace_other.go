@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package repository
+
+import (
+	"errors"
+	"fmt"
+)
+
+// statDisk reports the filesystem holding path
+func statDisk(path string) (DiskSpace, error) {
+	return DiskSpace{}, fmt.Errorf("failed to stat filesystem of %s: %w", path, errors.ErrUnsupported)
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin
+
+package repository
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statDisk reports the filesystem holding path
+func statDisk(path string) (DiskSpace, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return DiskSpace{}, fmt.Errorf("failed to stat filesystem of %s: %w", path, err)
+	}
+	return DiskSpace{
+		TotalBytes: int64(st.Blocks) * int64(st.Bsize),
+		FreeBytes:  int64(st.Bavail) * int64(st.Bsize),
+	}, nil
+}
@@ -0,0 +1,838 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+)
+
+// MasterKeySize is the length of a master key in bytes (AES-256)
+const MasterKeySize = 32
+
+// keyName is the metadata document holding a storage's wrapped data key
+// It is the only document of an encrypted storage that is not itself encrypted.
+const keyName = "key"
+
+// encryptionName is the size index recording plaintext sizes of encrypted files
+const encryptionName = "encryption"
+
+// Every file written by the decorator starts with encryptionMagic, a version byte,
+// the salt its file key is derived from and the nonce prefix of its segments.
+// Files without the header, e.g. stored before encryption was enabled, are served as-is.
+var encryptionMagic = []byte("CTHE")
+
+// Metadata documents sealed by the decorator start with metadataMagic followed by their nonce
+var metadataMagic = []byte("CTHM")
+
+const (
+	encryptionVersion    byte = 1
+	saltSize                  = 16
+	noncePrefixSize           = 7 // Followed by a 4 byte segment counter and a last-segment flag
+	encryptionHeaderSize      = 4 + 1 + saltSize + noncePrefixSize
+	segmentSize               = 64 * 1024
+)
+
+// errTampered is returned when encrypted content fails authentication; it matches ErrFileCorrupted
+var errTampered = fmt.Errorf("%w: encrypted content was damaged or tampered with", ErrFileCorrupted)
+
+// ParseMasterKey decodes a base64 master key from configuration
+func ParseMasterKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	if len(key) != MasterKeySize {
+		return nil, fmt.Errorf("invalid master key: must be %d bytes, got %d", MasterKeySize, len(key))
+	}
+	return key, nil
+}
+
+// ParseMasterKeys decodes a comma-separated list of base64 master keys
+// An empty value yields no keys
+func ParseMasterKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, err := ParseMasterKey(part)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// masterKeyID identifies a master key without revealing it
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// newGCM returns AES-GCM for a 256-bit key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrappedKey is the stored form of a storage's data key
+// An empty Key marks a destroyed data key.
+type wrappedKey struct {
+	MasterKeyID string `json:"master_key_id,omitempty"`
+	Key         []byte `json:"key,omitempty"` // Nonce followed by the sealed data key
+}
+
+// encryptionRepository encrypts files on SaveFile and decrypts them on GetFile
+// Every storage has its own random data key, stored wrapped by the master key next to
+// the storage's files. Metadata documents of decorators stacked on top are encrypted too.
+// Each file is encrypted under a key derived from a random salt, so identical content
+// never produces identical bytes and the content-addressed backend can't deduplicate it.
+type encryptionRepository struct {
+	Repository
+	store   metadataStore
+	current string                 // ID of the master key new data keys are wrapped with
+	masters map[string]cipher.AEAD // Master keys by ID, including previous ones
+	locks   storageLocks
+
+	mu   sync.Mutex
+	keys map[string][]byte // Unwrapped data keys by storage ID
+}
+
+// NewEncryptionRepository wraps inner so files are encrypted at rest
+// masterKey wraps new data keys; previous master keys can still unwrap existing ones
+// until RotateMasterKey re-wraps them. inner must be one of the repositories of this package.
+func NewEncryptionRepository(inner Repository, masterKey []byte, previous ...[]byte) (*encryptionRepository, error) {
+	store, ok := inner.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot store encryption keys", inner)
+	}
+
+	r := &encryptionRepository{
+		Repository: inner,
+		store:      store,
+		current:    masterKeyID(masterKey),
+		masters:    make(map[string]cipher.AEAD),
+		keys:       make(map[string][]byte),
+	}
+	for _, key := range append([][]byte{masterKey}, previous...) {
+		if len(key) != MasterKeySize {
+			return nil, fmt.Errorf("invalid master key: must be %d bytes, got %d", MasterKeySize, len(key))
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key: %w", err)
+		}
+		r.masters[masterKeyID(key)] = aead
+	}
+	return r, nil
+}
+
+// wrap seals a data key under the current master key, bound to its storage
+func (r *encryptionRepository) wrap(storageID string, dataKey []byte) (wrappedKey, error) {
+	aead := r.masters[r.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return wrappedKey{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return wrappedKey{
+		MasterKeyID: r.current,
+		Key:         aead.Seal(nonce, nonce, dataKey, []byte(storageID)),
+	}, nil
+}
+
+// unwrap opens a wrapped data key with the master key it was sealed with
+func (r *encryptionRepository) unwrap(storageID string, wrapped wrappedKey) ([]byte, error) {
+	aead, ok := r.masters[wrapped.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("data key of storage %s is wrapped by unknown master key %s", storageID, wrapped.MasterKeyID)
+	}
+	if len(wrapped.Key) < aead.NonceSize() {
+		return nil, fmt.Errorf("failed to unwrap data key of storage %s: %w", storageID, errTampered)
+	}
+	nonce, sealed := wrapped.Key[:aead.NonceSize()], wrapped.Key[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(storageID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of storage %s: %w", storageID, errTampered)
+	}
+	return dataKey, nil
+}
+
+// loadWrappedKey reads a storage's key document, reporting whether it exists
+func (r *encryptionRepository) loadWrappedKey(ctx context.Context, storageID string) (wrappedKey, bool, error) {
+	data, err := r.store.readMetadata(ctx, storageID, keyName)
+	if errors.Is(err, ErrFileNotFound) {
+		return wrappedKey{}, false, nil
+	}
+	if err != nil {
+		return wrappedKey{}, false, fmt.Errorf("failed to read data key: %w", err)
+	}
+
+	var wrapped wrappedKey
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return wrappedKey{}, false, fmt.Errorf("invalid data key document: %w", err)
+	}
+	return wrapped, true, nil
+}
+
+func (r *encryptionRepository) saveWrappedKey(ctx context.Context, storageID string, wrapped wrappedKey) error {
+	data, err := json.Marshal(wrapped)
+	if err != nil {
+		return fmt.Errorf("failed to encode data key: %w", err)
+	}
+	if err := r.store.writeMetadata(ctx, storageID, keyName, data); err != nil {
+		return fmt.Errorf("failed to write data key: %w", err)
+	}
+	return nil
+}
+
+// dataKey returns the data key of a storage, creating it first if create is set
+// It returns nil if the storage has no data key and create isn't set.
+func (r *encryptionRepository) dataKey(ctx context.Context, storageID string, create bool) ([]byte, error) {
+	r.mu.Lock()
+	key, ok := r.keys[storageID]
+	r.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+	return r.loadDataKey(ctx, storageID, create)
+}
+
+// loadDataKey is dataKey for callers holding the storage's lock
+func (r *encryptionRepository) loadDataKey(ctx context.Context, storageID string, create bool) ([]byte, error) {
+	r.mu.Lock()
+	key, ok := r.keys[storageID]
+	r.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	wrapped, exists, err := r.loadWrappedKey(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case exists && len(wrapped.Key) == 0:
+		return nil, fmt.Errorf("data key of storage %s was destroyed", storageID)
+	case exists:
+		key, err = r.unwrap(storageID, wrapped)
+		if err != nil {
+			return nil, err
+		}
+	case !create:
+		return nil, nil
+	default:
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate data key: %w", err)
+		}
+		wrapped, err := r.wrap(storageID, key)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.saveWrappedKey(ctx, storageID, wrapped); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	r.keys[storageID] = key
+	r.mu.Unlock()
+	return key, nil
+}
+
+// sealedStore seals metadata documents with a storage's data key
+// Documents written before encryption was enabled are read as-is.
+type sealedStore struct {
+	store   metadataStore
+	dataKey []byte // nil if the storage has no data key
+}
+
+func (s sealedStore) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	data, err := s.store.readMetadata(ctx, storageID, name)
+	if err != nil || !bytes.HasPrefix(data, metadataMagic) {
+		return data, err
+	}
+	if s.dataKey == nil {
+		return nil, fmt.Errorf("failed to open %s: storage %s has no data key", name, storageID)
+	}
+
+	aead, err := newGCM(s.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := data[len(metadataMagic):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("failed to open %s: %w", name, errTampered)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, errTampered)
+	}
+	return plain, nil
+}
+
+func (s sealedStore) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	if s.dataKey == nil {
+		return fmt.Errorf("failed to seal %s: storage %s has no data key", name, storageID)
+	}
+	aead, err := newGCM(s.dataKey)
+	if err != nil {
+		return err
+	}
+
+	sealed := make([]byte, len(metadataMagic)+aead.NonceSize(), len(metadataMagic)+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(sealed, metadataMagic)
+	nonce := sealed[len(metadataMagic):]
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed = aead.Seal(sealed, nonce, data, []byte(name))
+
+	return s.store.writeMetadata(ctx, storageID, name, sealed)
+}
+
+// fileCipher derives the AEAD of one file from the storage's data key and the file's salt
+func fileCipher(dataKey, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, dataKey, salt, "cthulhu file key", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive file key: %w", err)
+	}
+	return newGCM(key)
+}
+
+// segmentNonce builds the nonce of a segment from the file's prefix, its index and
+// whether it is the last one, so segments can't be reordered or the file truncated
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptingReader yields the header followed by the content of src sealed in segments
+// Every file has at least one segment; the last one may be empty.
+type encryptingReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	sealed  []byte
+	out     []byte // Pending output
+	done    bool
+}
+
+func newEncryptingReader(dataKey []byte, src io.Reader) (*encryptingReader, error) {
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	header[len(encryptionMagic)] = encryptionVersion
+	if _, err := rand.Read(header[len(encryptionMagic)+1:]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	salt := header[len(encryptionMagic)+1 : len(encryptionMagic)+1+saltSize]
+
+	aead, err := fileCipher(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{
+		src:    bufio.NewReaderSize(src, segmentSize),
+		aead:   aead,
+		prefix: header[len(header)-noncePrefixSize:],
+		plain:  make([]byte, segmentSize),
+		sealed: make([]byte, 0, segmentSize+aead.Overhead()),
+		out:    header,
+	}, nil
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// next seals the following segment of src
+func (e *encryptingReader) next() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one if nothing follows it
+		if _, err := e.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if !last && e.counter == math.MaxUint32 {
+		return errors.New("file is too large to encrypt")
+	}
+
+	e.out = e.aead.Seal(e.sealed[:0], segmentNonce(e.prefix, e.counter, last), e.plain[:n], nil)
+	e.counter++
+	e.done = last
+	return nil
+}
+
+// decryptingReader authenticates and decrypts the segments following a file's header
+type decryptingReader struct {
+	src     *bufio.Reader
+	file    io.Closer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	final   int64 // Index of the last segment, or -1 to detect it at the end of src
+	sealed  []byte
+	out     []byte // Pending output
+	done    bool
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// next opens the following segment of src
+func (d *decryptingReader) next() error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	last := false
+	switch {
+	case d.final >= 0:
+		// src may end right after the segments being read
+		last = int64(d.counter) == d.final
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && !last) {
+			return fmt.Errorf("failed to decrypt file: %w", errTampered)
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	case err == io.EOF:
+		// The previous segment wasn't marked last, so the file was truncated
+		return fmt.Errorf("failed to decrypt file: %w", errTampered)
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := d.aead.Open(d.sealed[:0], segmentNonce(d.prefix, d.counter, last), d.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt file: %w", errTampered)
+	}
+	d.out = plain
+	d.counter++
+	d.done = last
+	return nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.file.Close()
+}
+
+// SaveFile encrypts content while streaming it to the wrapped repository
+// The storage's data key is created on its first upload.
+func (r *encryptionRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	dataKey, err := r.loadDataKey(ctx, storageID, true)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	store := sealedStore{store: r.store, dataKey: dataKey}
+	index, err := loadSizeIndex(ctx, store, storageID, encryptionName)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	src := &countingReader{r: content}
+	enc, err := newEncryptingReader(dataKey, src)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := r.Repository.SaveFile(ctx, storageID, filename, enc)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info.Size = src.n
+	index.Sizes[info.Path] = info.Size
+	if err := saveSizeIndex(ctx, store, storageID, encryptionName, index); err != nil {
+		return FileInfo{}, err
+	}
+
+	return info, nil
+}
+
+// GetFile returns a reader yielding the decrypted content
+// Reads fail once a segment doesn't authenticate.
+func (r *encryptionRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	file, err := r.Repository.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(file, segmentSize)
+	header, err := br.Peek(encryptionHeaderSize)
+	if err != nil && err != io.EOF {
+		file.Close()
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	if len(header) < encryptionHeaderSize || !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		// Written without the decorator
+		return &decodingReader{Reader: br, file: file}, nil
+	}
+	if version := header[len(encryptionMagic)]; version != encryptionVersion {
+		file.Close()
+		return nil, fmt.Errorf("failed to open encrypted file: unknown version %d", version)
+	}
+	header = append([]byte(nil), header...)
+	br.Discard(encryptionHeaderSize)
+
+	dataKey, err := r.dataKey(ctx, storageID, false)
+	if err == nil && dataKey == nil {
+		err = fmt.Errorf("storage %s has no data key", storageID)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open encrypted file: %w", err)
+	}
+	salt := header[len(encryptionMagic)+1 : len(encryptionMagic)+1+saltSize]
+	aead, err := fileCipher(dataKey, salt)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &decryptingReader{
+		src:    br,
+		file:   file,
+		aead:   aead,
+		prefix: header[len(header)-noncePrefixSize:],
+		final:  -1,
+		sealed: make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+// GetFileRange decrypts only the segments overlapping the range
+func (r *encryptionRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	head, err := r.Repository.GetFileRange(ctx, storageID, filename, 0, encryptionHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	header, err := io.ReadAll(head)
+	head.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file header: %w", err)
+	}
+	if len(header) < encryptionHeaderSize || !bytes.Equal(header[:len(encryptionMagic)], encryptionMagic) {
+		// Written without the decorator
+		return r.Repository.GetFileRange(ctx, storageID, filename, offset, length)
+	}
+	if version := header[len(encryptionMagic)]; version != encryptionVersion {
+		return nil, fmt.Errorf("failed to open encrypted file: unknown version %d", version)
+	}
+
+	dataKey, err := r.dataKey(ctx, storageID, false)
+	if err == nil && dataKey == nil {
+		err = fmt.Errorf("storage %s has no data key", storageID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open encrypted file: %w", err)
+	}
+	salt := header[len(encryptionMagic)+1 : len(encryptionMagic)+1+saltSize]
+	aead, err := fileCipher(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	// The plaintext size follows from the stored size: every segment adds one tag
+	sealedSegment := int64(segmentSize + aead.Overhead())
+	body := head.Size - encryptionHeaderSize
+	segments := (body + sealedSegment - 1) / sealedSegment
+	if segments == 0 {
+		return nil, fmt.Errorf("failed to open encrypted file: %w", errTampered)
+	}
+	size := body - segments*int64(aead.Overhead())
+
+	length, err = checkRange(offset, length, size)
+	if err != nil {
+		return nil, err
+	}
+	first, last := offset/segmentSize, offset/segmentSize
+	if length > 0 {
+		last = (offset + length - 1) / segmentSize
+	}
+
+	sealed, err := r.Repository.GetFileRange(ctx, storageID, filename,
+		encryptionHeaderSize+first*sealedSegment, (last-first+1)*sealedSegment)
+	if err != nil {
+		return nil, err
+	}
+	dec := &decryptingReader{
+		src:     bufio.NewReaderSize(sealed, int(sealedSegment)),
+		file:    sealed,
+		aead:    aead,
+		prefix:  header[len(header)-noncePrefixSize:],
+		counter: uint32(first),
+		final:   segments - 1,
+		sealed:  make([]byte, sealedSegment),
+	}
+	if _, err := io.CopyN(io.Discard, dec, offset-first*segmentSize); err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return newFileRange(dec, offset, length, size), nil
+}
+
+// GetFilesByStorage lists the wrapped repository, reporting plaintext sizes
+func (r *encryptionRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	files, err := r.Repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return files, nil
+	}
+
+	index, err := loadSizeIndex(ctx, r, storageID, encryptionName)
+	if err != nil {
+		return nil, err
+	}
+	index.apply(files)
+
+	return files, nil
+}
+
+// DeleteFile removes the file and its plaintext size record
+func (r *encryptionRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	if err := r.Repository.DeleteFile(ctx, storageID, filename); err != nil {
+		return err
+	}
+
+	dataKey, err := r.loadDataKey(ctx, storageID, false)
+	if err != nil {
+		return err
+	}
+	store := sealedStore{store: r.store, dataKey: dataKey}
+	index, err := loadSizeIndex(ctx, store, storageID, encryptionName)
+	if err != nil {
+		return err
+	}
+	if _, ok := index.Sizes[filename]; !ok {
+		return nil
+	}
+	delete(index.Sizes, filename)
+
+	return saveSizeIndex(ctx, store, storageID, encryptionName, index)
+}
+
+// moveFile implements fileMover when the wrapped repository does, moving the file's size record
+// The ciphertext doesn't depend on the path, so it stays readable under its new name.
+func (r *encryptionRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	info, err := forwardMove(ctx, r.Repository, storageID, from, to)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	dataKey, err := r.loadDataKey(ctx, storageID, false)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	store := sealedStore{store: r.store, dataKey: dataKey}
+	index, err := loadSizeIndex(ctx, store, storageID, encryptionName)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !index.move(from, to, &info) {
+		return info, nil
+	}
+	return info, saveSizeIndex(ctx, store, storageID, encryptionName, index)
+}
+
+// DeleteStorage destroys the storage's data key before removing its files, so any
+// bytes that outlive the deletion (backups, snapshots, object versions, a failed
+// delete) can no longer be decrypted
+func (r *encryptionRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	r.mu.Lock()
+	delete(r.keys, storageID)
+	r.mu.Unlock()
+
+	_, exists, err := r.loadWrappedKey(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := r.saveWrappedKey(ctx, storageID, wrappedKey{}); err != nil {
+			return fmt.Errorf("failed to destroy data key: %w", err)
+		}
+	}
+
+	return r.Repository.DeleteStorage(ctx, storageID)
+}
+
+// RotateMasterKey re-wraps every data key that isn't wrapped by the current master key
+// Data keys and file contents are unchanged. It returns the number of re-wrapped keys.
+func (r *encryptionRepository) RotateMasterKey(ctx context.Context) (int, error) {
+	ids, err := r.listStorageIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, id := range ids {
+		ok, err := r.rotateStorageKey(ctx, id)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to rotate data key of storage %s: %w", id, err)
+		}
+		if ok {
+			rotated++
+		}
+	}
+	return rotated, nil
+}
+
+// rotateStorageKey re-wraps one storage's data key, reporting whether it changed
+func (r *encryptionRepository) rotateStorageKey(ctx context.Context, storageID string) (bool, error) {
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	wrapped, exists, err := r.loadWrappedKey(ctx, storageID)
+	if err != nil {
+		return false, err
+	}
+	if !exists || len(wrapped.Key) == 0 || wrapped.MasterKeyID == r.current {
+		return false, nil
+	}
+
+	dataKey, err := r.unwrap(storageID, wrapped)
+	if err != nil {
+		return false, err
+	}
+	defer clear(dataKey)
+	rewrapped, err := r.wrap(storageID, dataKey)
+	if err != nil {
+		return false, err
+	}
+	return true, r.saveWrappedKey(ctx, storageID, rewrapped)
+}
+
+// ListStorages reports the sizes of files as uploaded rather than encrypted
+func (r *encryptionRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	page, err := r.Repository.ListStorages(ctx, cursor, limit)
+	return withLogicalSizes(ctx, r, page, err)
+}
+
+// Usage reports plaintext bytes against what the wrapped repository stores
+func (r *encryptionRepository) Usage(ctx context.Context) (Usage, error) {
+	return logicalUsage(ctx, r, r.Repository)
+}
+
+// DiskSpace forwards to the wrapped repository when it stores files on a local filesystem
+func (r *encryptionRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return forwardDiskSpace(ctx, r.Repository)
+}
+
+// readMetadata implements metadataStore, decrypting documents sealed by writeMetadata
+func (r *encryptionRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	dataKey, err := r.dataKey(ctx, storageID, false)
+	if err != nil {
+		return nil, err
+	}
+	return sealedStore{store: r.store, dataKey: dataKey}.readMetadata(ctx, storageID, name)
+}
+
+// writeMetadata implements metadataStore, sealing documents with the storage's data key
+func (r *encryptionRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	dataKey, err := r.dataKey(ctx, storageID, true)
+	if err != nil {
+		return err
+	}
+	return sealedStore{store: r.store, dataKey: dataKey}.writeMetadata(ctx, storageID, name, data)
+}
+
+// listStorageIDs implements storageLister so other decorators can be stacked on top
+func (r *encryptionRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	return lister.listStorageIDs(ctx)
+}
@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Supported storage backends
+const (
+	BackendLocal  = "local"
+	BackendMemory = "memory"
+	BackendS3     = "s3"
+	BackendCAS    = "cas"
+)
+
+// Config selects and configures a Repository backend
+type Config struct {
+	Backend   string // One of BackendLocal, BackendMemory, BackendS3, BackendCAS
+	LocalPath string // Base directory for the local and content-addressed backends
+	S3        S3Config
+
+	// ConflictPolicy decides how SaveFile treats existing filenames (default: overwrite)
+	ConflictPolicy ConflictPolicy
+
+	// StorageTTL sets each storage's manifest expiry after creation; 0 means never
+	StorageTTL time.Duration
+
+	// Compression stores new files compressed: CompressionNone (default), CompressionGzip or CompressionZstd
+	Compression string
+
+	// MasterKey enables encryption at rest; it wraps the per-storage data keys (nil: disabled)
+	// Every file is encrypted under its own key, so it can't be combined with BackendCAS.
+	MasterKey []byte
+	// PreviousMasterKeys can still unwrap data keys until RotateMasterKey re-wraps them
+	PreviousMasterKeys [][]byte
+
+	// Versioning keeps the previous content of overwritten files as numbered versions
+	// It requires the overwrite conflict policy.
+	Versioning bool
+	// MaxVersions caps the older versions kept per file; 0 means unlimited
+	MaxVersions int
+
+	// TrashRetention keeps deleted files and storages restorable for this long; 0 deletes immediately
+	TrashRetention time.Duration
+
+	// IndexPath is the SQLite database indexing storages and files; listings read from it
+	// instead of the backend. Empty disables the index.
+	IndexPath string
+}
+
+// New creates the Repository selected by cfg.Backend
+// Every backend is wrapped so its storages keep a manifest, and optionally encrypts
+// and compresses content, indexes metadata, keeps deleted content in a trash and keeps
+// older versions of files. Content is compressed before it is encrypted.
+func New(cfg Config) (Repository, error) {
+	if cfg.Versioning && cfg.ConflictPolicy != "" && cfg.ConflictPolicy != ConflictOverwrite {
+		return nil, fmt.Errorf("versioning requires the %s conflict policy, not %s", ConflictOverwrite, cfg.ConflictPolicy)
+	}
+
+	r, err := newManifestStack(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.IndexPath != "" {
+		// Below the trash and versions, so restores and purges reach the index like uploads and deletes
+		index, err := NewIndexRepository(context.Background(), r, cfg.IndexPath)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = index
+	}
+
+	if cfg.TrashRetention > 0 {
+		trash, err := NewTrashRepository(r, cfg.TrashRetention)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = trash
+	}
+
+	if cfg.Versioning {
+		// Outermost, so restoring a version updates the manifest like an upload
+		versioned, err := NewVersioningRepository(r, cfg.MaxVersions)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return versioned, nil
+	}
+	return r, nil
+}
+
+// Reindex rebuilds the metadata index at cfg.IndexPath from cfg's backend
+// It returns the number of indexed storages.
+func Reindex(ctx context.Context, cfg Config) (int, error) {
+	if cfg.IndexPath == "" {
+		return 0, fmt.Errorf("no metadata index configured")
+	}
+
+	r, err := newManifestStack(cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	index, err := openIndex(ctx, r, cfg.IndexPath)
+	if err != nil {
+		r.Close()
+		return 0, err
+	}
+	defer index.Close()
+	return index.Rebuild(ctx)
+}
+
+// newManifestStack creates the backend of cfg wrapped for encryption, compression and manifests
+func newManifestStack(cfg Config) (Repository, error) {
+	if err := checkEncryption(cfg); err != nil {
+		return nil, err
+	}
+
+	base, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MasterKey != nil {
+		encrypted, err := NewEncryptionRepository(base, cfg.MasterKey, cfg.PreviousMasterKeys...)
+		if err != nil {
+			base.Close()
+			return nil, err
+		}
+		base = encrypted
+	}
+
+	if cfg.Compression != "" && cfg.Compression != CompressionNone {
+		compressed, err := NewCompressionRepository(base, cfg.Compression)
+		if err != nil {
+			base.Close()
+			return nil, err
+		}
+		base = compressed
+	}
+
+	manifest, err := NewManifestRepository(base, cfg.StorageTTL)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// RotateMasterKey re-wraps the data keys of every storage of cfg's backend under
+// cfg.MasterKey, unwrapping them with cfg.PreviousMasterKeys. File contents are untouched.
+// It returns the number of re-wrapped keys.
+func RotateMasterKey(ctx context.Context, cfg Config) (int, error) {
+	if cfg.MasterKey == nil {
+		return 0, fmt.Errorf("no master key configured")
+	}
+	if err := checkEncryption(cfg); err != nil {
+		return 0, err
+	}
+
+	base, err := newBackend(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer base.Close()
+
+	r, err := NewEncryptionRepository(base, cfg.MasterKey, cfg.PreviousMasterKeys...)
+	if err != nil {
+		return 0, err
+	}
+	return r.RotateMasterKey(ctx)
+}
+
+// checkEncryption refuses encryption at rest on the content-addressed backend
+// Files are encrypted under keys derived from random salts, so identical files never share a
+// blob and the backend would store every copy while still paying for its deduplication.
+func checkEncryption(cfg Config) error {
+	if cfg.MasterKey != nil && cfg.Backend == BackendCAS {
+		return fmt.Errorf("encryption at rest defeats the deduplication of the %s backend; use the %s backend or unset the master key", BackendCAS, BackendLocal)
+	}
+	return nil
+}
+
+// newBackend creates the bare storage backend selected by cfg.Backend
+func newBackend(cfg Config) (Repository, error) {
+	opts := []Option{
+		WithConflictPolicy(cfg.ConflictPolicy),
+	}
+
+	switch cfg.Backend {
+	case BackendLocal, "":
+		return NewLocalRepository(cfg.LocalPath, opts...)
+	case BackendMemory:
+		return NewMemoryRepository(opts...), nil
+	case BackendS3:
+		return NewS3Repository(cfg.S3, opts...)
+	case BackendCAS:
+		return NewCASRepository(cfg.LocalPath, opts...)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.Backend)
+	}
+}
@@ -0,0 +1,652 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure-Go SQLite driver registered as "sqlite"
+)
+
+// MetadataIndex is implemented by repositories that keep storage and file metadata in an index
+// Decorators wrapping a repository without one fail with errors.ErrUnsupported.
+type MetadataIndex interface {
+	// Storage describes one storage from the index, or fails with ErrStorageNotFound
+	Storage(ctx context.Context, storageID string) (StorageInfo, error)
+	// RecordDownload counts one download of a file
+	RecordDownload(ctx context.Context, storageID string, filename string) error
+}
+
+// indexMigrations upgrade the index schema; entry i brings it to version i+1
+// Released migrations must never change, new ones are appended.
+// Times are stored as Unix nanoseconds.
+var indexMigrations = []string{
+	`CREATE TABLE storages (
+		id         TEXT PRIMARY KEY,
+		owner      TEXT NOT NULL DEFAULT '', -- Empty until uploads carry an owner
+		created_at INTEGER,
+		expires_at INTEGER
+	);
+	CREATE INDEX storages_expires_at ON storages (expires_at) WHERE expires_at IS NOT NULL;
+	CREATE TABLE files (
+		storage_id    TEXT NOT NULL,
+		path          TEXT NOT NULL,
+		size          INTEGER NOT NULL,
+		original_name TEXT NOT NULL DEFAULT '',
+		content_type  TEXT NOT NULL DEFAULT '',
+		sha256        TEXT NOT NULL DEFAULT '',
+		uploaded_at   INTEGER,
+		corrupted_at  INTEGER,
+		downloads     INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (storage_id, path)
+	) WITHOUT ROWID;`,
+}
+
+// indexRepository keeps an SQLite index of the storages and files of the wrapped repository
+// Listings are answered from the index instead of the backend. Every write holds a
+// per-storage lock across the backend write and the index update, and files kept by
+// decorators under reservedDirs are not indexed. The index assumes it sees every write;
+// after changing the backend behind its back, rebuild it with Reindex.
+type indexRepository struct {
+	Repository
+	store metadataStore
+	db    *sql.DB
+	now   func() time.Time
+	locks storageLocks
+}
+
+// NewIndexRepository wraps inner with an index kept in the SQLite database at dbPath
+// The database is created and migrated as needed. An empty index is built from inner,
+// so enabling it on a repository that already holds storages lists them all.
+func NewIndexRepository(ctx context.Context, inner Repository, dbPath string) (*indexRepository, error) {
+	r, err := openIndex(ctx, inner, dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var storages int
+	if err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM storages`).Scan(&storages); err != nil {
+		r.db.Close()
+		return nil, fmt.Errorf("failed to count indexed storages: %w", err)
+	}
+	if storages == 0 {
+		if _, err := r.Rebuild(ctx); err != nil {
+			r.db.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// openIndex opens and migrates the index database without building it
+func openIndex(ctx context.Context, inner Repository, dbPath string) (*indexRepository, error) {
+	store, ok := inner.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot be indexed", inner)
+	}
+	if dbPath == "" {
+		return nil, fmt.Errorf("index database path cannot be empty")
+	}
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index database: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids busy errors between our own writes
+	db.SetMaxOpenConns(1)
+
+	if err := migrateIndex(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	r := &indexRepository{
+		Repository: inner,
+		store:      store,
+		db:         db,
+		now:        time.Now,
+	}
+	return r, nil
+}
+
+// migrateIndex applies the migrations the database hasn't seen yet, each in its own transaction
+func migrateIndex(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read index schema version: %w", err)
+	}
+	if version > len(indexMigrations) {
+		return fmt.Errorf("index schema version %d is newer than the %d this build supports", version, len(indexMigrations))
+	}
+
+	for i := version; i < len(indexMigrations); i++ {
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, indexMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, i+1, time.Now().UnixNano())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate index to version %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullTime stores t as Unix nanoseconds, or NULL if t is nil or zero
+func nullTime(t *time.Time) sql.NullInt64 {
+	if t == nil || t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+// timeOf converts a stored time back, returning nil for NULL
+func timeOf(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(0, v.Int64).UTC()
+	return &t
+}
+
+// Close closes the index and the wrapped repository
+func (r *indexRepository) Close() {
+	r.db.Close()
+	r.Repository.Close()
+}
+
+// upsertFile records info in the index, keeping the download count of an existing entry
+func upsertFile(ctx context.Context, tx *sql.Tx, storageID string, info FileInfo, corruptedAt *time.Time) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO files
+		(storage_id, path, size, original_name, content_type, sha256, uploaded_at, corrupted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (storage_id, path) DO UPDATE SET
+			size = excluded.size,
+			original_name = excluded.original_name,
+			content_type = excluded.content_type,
+			sha256 = excluded.sha256,
+			uploaded_at = excluded.uploaded_at,
+			corrupted_at = excluded.corrupted_at`,
+		storageID, info.Path, info.Size, info.OriginalName, info.ContentType, info.SHA256,
+		nullTime(&info.UploadedAt), nullTime(corruptedAt))
+	return err
+}
+
+// storageTimes returns the creation and expiry of a storage from its manifest
+// Without one, the storage is taken to be created now.
+func (r *indexRepository) storageTimes(ctx context.Context, storageID string) (time.Time, *time.Time, error) {
+	if reader, ok := r.Repository.(ManifestReader); ok {
+		manifest, err := reader.Manifest(ctx, storageID)
+		if err == nil {
+			return manifest.CreatedAt, manifest.ExpiresAt, nil
+		}
+		if !errors.Is(err, ErrStorageNotFound) {
+			return time.Time{}, nil, err
+		}
+	}
+	return r.now().UTC(), nil, nil
+}
+
+// SaveFile stores the file in the wrapped repository and records it in the index
+func (r *indexRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if isReservedPath(filename) {
+		return r.Repository.SaveFile(ctx, storageID, filename, content)
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	info, err := r.Repository.SaveFile(ctx, storageID, filename, content)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if err := r.indexFile(ctx, storageID, info, nil); err != nil {
+		return FileInfo{}, err
+	}
+
+	return info, nil
+}
+
+// indexFile records info in the index, adding its storage if the index doesn't hold it yet
+// The caller holds the storage's lock.
+func (r *indexRepository) indexFile(ctx context.Context, storageID string, info FileInfo, corruptedAt *time.Time) error {
+	var indexed bool
+	err := r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM storages WHERE id = ?)`, storageID).Scan(&indexed)
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %w", info.Path, err)
+	}
+	var createdAt time.Time
+	var expiresAt *time.Time
+	if !indexed {
+		if createdAt, expiresAt, err = r.storageTimes(ctx, storageID); err != nil {
+			return fmt.Errorf("failed to index %s: %w", info.Path, err)
+		}
+	}
+
+	err = inTx(ctx, r.db, func(tx *sql.Tx) error {
+		if !indexed {
+			_, err := tx.ExecContext(ctx, `INSERT INTO storages (id, created_at, expires_at) VALUES (?, ?, ?)`,
+				storageID, nullTime(&createdAt), nullTime(expiresAt))
+			if err != nil {
+				return err
+			}
+		}
+		return upsertFile(ctx, tx, storageID, info, corruptedAt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index %s: %w", info.Path, err)
+	}
+	return nil
+}
+
+// GetFilesByStorage lists the storage from the index
+func (r *indexRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, `SELECT path, size, original_name, content_type, sha256, uploaded_at, corrupted_at, downloads
+		FROM files WHERE storage_id = ? ORDER BY path`, storageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query index: %w", err)
+	}
+	defer rows.Close()
+
+	files := []FileInfo{}
+	for rows.Next() {
+		var info FileInfo
+		var uploadedAt, corruptedAt sql.NullInt64
+		err := rows.Scan(&info.Path, &info.Size, &info.OriginalName, &info.ContentType, &info.SHA256,
+			&uploadedAt, &corruptedAt, &info.Downloads)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index: %w", err)
+		}
+		info.Filename = path.Base(info.Path)
+		if t := timeOf(uploadedAt); t != nil {
+			info.UploadedAt = *t
+		}
+		info.Corrupted = corruptedAt.Valid
+		files = append(files, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	return files, nil
+}
+
+// DeleteFile removes the file and its index entry
+// A file already missing from the wrapped repository is dropped from the index too.
+func (r *indexRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if isReservedPath(filename) {
+		return r.Repository.DeleteFile(ctx, storageID, filename)
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	err := r.Repository.DeleteFile(ctx, storageID, filename)
+	if err != nil && !errors.Is(err, ErrFileNotFound) {
+		return err
+	}
+	if _, dbErr := r.db.ExecContext(ctx, `DELETE FROM files WHERE storage_id = ? AND path = ?`, storageID, filename); dbErr != nil {
+		return fmt.Errorf("failed to remove %s from the index: %w", filename, dbErr)
+	}
+	return err
+}
+
+// moveFile implements fileMover when the wrapped repository does, moving the file's index entry
+// Files moved into or out of reservedDirs leave or join the index.
+func (r *indexRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if isReservedPath(from) && isReservedPath(to) {
+		return forwardMove(ctx, r.Repository, storageID, from, to)
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	info, err := forwardMove(ctx, r.Repository, storageID, from, to)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	if !isReservedPath(from) {
+		if _, err := r.db.ExecContext(ctx, `DELETE FROM files WHERE storage_id = ? AND path = ?`, storageID, from); err != nil {
+			return FileInfo{}, fmt.Errorf("failed to remove %s from the index: %w", from, err)
+		}
+	}
+	if !isReservedPath(to) {
+		var corruptedAt *time.Time
+		if info.Corrupted {
+			now := r.now().UTC()
+			corruptedAt = &now
+		}
+		if err := r.indexFile(ctx, storageID, info, corruptedAt); err != nil {
+			return FileInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+// DeleteStorage removes the storage and everything the index holds about it
+func (r *indexRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	err := r.Repository.DeleteStorage(ctx, storageID)
+	if err != nil && !errors.Is(err, ErrStorageNotFound) {
+		return err
+	}
+	if dbErr := inTx(ctx, r.db, func(tx *sql.Tx) error { return deleteIndexedStorage(ctx, tx, storageID) }); dbErr != nil {
+		return fmt.Errorf("failed to remove storage %s from the index: %w", storageID, dbErr)
+	}
+	return err
+}
+
+// deleteIndexedStorage removes a storage and its files from the index
+func deleteIndexedStorage(ctx context.Context, tx *sql.Tx, storageID string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM files WHERE storage_id = ?`, storageID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM storages WHERE id = ?`, storageID)
+	return err
+}
+
+// storageQuery selects the StorageInfo fields of storages, to be completed by a WHERE clause
+const storageQuery = `SELECT s.id, s.created_at, s.expires_at, COUNT(f.path), COALESCE(SUM(f.size), 0)
+	FROM storages s LEFT JOIN files f ON f.storage_id = s.id `
+
+// scanStorage reads one row of storageQuery
+func scanStorage(row interface{ Scan(dest ...any) error }) (StorageInfo, error) {
+	var info StorageInfo
+	var createdAt, expiresAt sql.NullInt64
+	if err := row.Scan(&info.ID, &createdAt, &expiresAt, &info.Files, &info.Size); err != nil {
+		return StorageInfo{}, err
+	}
+	if t := timeOf(createdAt); t != nil {
+		info.CreatedAt = *t
+	}
+	info.ExpiresAt = timeOf(expiresAt)
+	return info, nil
+}
+
+// ListStorages pages through the storages of the index
+func (r *indexRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	limit, err := checkStoragePage(cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+
+	// One extra row tells whether another page follows
+	rows, err := r.db.QueryContext(ctx, storageQuery+`WHERE s.id > ? GROUP BY s.id ORDER BY s.id LIMIT ?`, cursor, limit+1)
+	if err != nil {
+		return StoragePage{}, fmt.Errorf("failed to query index: %w", err)
+	}
+	defer rows.Close()
+
+	page := StoragePage{Storages: make([]StorageInfo, 0, limit)}
+	for rows.Next() {
+		info, err := scanStorage(rows)
+		if err != nil {
+			return StoragePage{}, fmt.Errorf("failed to read index: %w", err)
+		}
+		page.Storages = append(page.Storages, info)
+	}
+	if err := rows.Err(); err != nil {
+		return StoragePage{}, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	if len(page.Storages) > limit {
+		page.Storages = page.Storages[:limit]
+		page.Next = page.Storages[limit-1].ID
+	}
+	return page, nil
+}
+
+// Storage implements MetadataIndex
+func (r *indexRepository) Storage(ctx context.Context, storageID string) (StorageInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return StorageInfo{}, err
+	}
+
+	info, err := scanStorage(r.db.QueryRowContext(ctx, storageQuery+`WHERE s.id = ? GROUP BY s.id`, storageID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return StorageInfo{}, fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+	if err != nil {
+		return StorageInfo{}, fmt.Errorf("failed to query index: %w", err)
+	}
+	return info, nil
+}
+
+// RecordDownload implements MetadataIndex
+func (r *indexRepository) RecordDownload(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	result, err := r.db.ExecContext(ctx, `UPDATE files SET downloads = downloads + 1 WHERE storage_id = ? AND path = ?`, storageID, filename)
+	if err != nil {
+		return fmt.Errorf("failed to record download: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	return nil
+}
+
+// forwardIndex returns the metadata index of inner, failing with errors.ErrUnsupported if it keeps none
+func forwardIndex(inner Repository) (MetadataIndex, error) {
+	index, ok := inner.(MetadataIndex)
+	if !ok {
+		return nil, fmt.Errorf("repository %T does not keep a metadata index: %w", inner, errors.ErrUnsupported)
+	}
+	return index, nil
+}
+
+// MarkCorrupted forwards to the wrapped repository and flags the file in the index
+func (r *indexRepository) MarkCorrupted(ctx context.Context, storageID string, filename string, sha256 string) (bool, error) {
+	marker, ok := r.Repository.(IntegrityMarker)
+	if !ok {
+		return false, fmt.Errorf("repository %T cannot mark corrupted files", r.Repository)
+	}
+	marked, err := marker.MarkCorrupted(ctx, storageID, filename, sha256)
+	if err != nil || !marked {
+		return marked, err
+	}
+
+	_, err = r.db.ExecContext(ctx, `UPDATE files SET corrupted_at = ? WHERE storage_id = ? AND path = ? AND sha256 = ? AND corrupted_at IS NULL`,
+		r.now().UnixNano(), storageID, filename, sha256)
+	if err != nil {
+		return true, fmt.Errorf("failed to mark %s corrupted in the index: %w", filename, err)
+	}
+	return true, nil
+}
+
+// Rebuild replaces the index with the storages and files of the wrapped repository
+// Download counts of files that are still there are kept. It returns the number of storages indexed.
+func (r *indexRepository) Rebuild(ctx context.Context) (int, error) {
+	reader, _ := r.Repository.(ManifestReader)
+
+	seen := make(map[string]bool)
+	for storage, err := range AllStorages(ctx, r.Repository, maxStoragePageSize) {
+		if err != nil {
+			return len(seen), fmt.Errorf("failed to list storages: %w", err)
+		}
+		if err := r.reindexStorage(ctx, reader, storage); err != nil {
+			return len(seen), fmt.Errorf("failed to index storage %s: %w", storage.ID, err)
+		}
+		seen[storage.ID] = true
+	}
+
+	// Drop storages that no longer exist
+	rows, err := r.db.QueryContext(ctx, `SELECT id FROM storages`)
+	if err != nil {
+		return len(seen), fmt.Errorf("failed to query index: %w", err)
+	}
+	var stale []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return len(seen), fmt.Errorf("failed to read index: %w", err)
+		}
+		if !seen[id] {
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range stale {
+		if err := inTx(ctx, r.db, func(tx *sql.Tx) error { return deleteIndexedStorage(ctx, tx, id) }); err != nil {
+			return len(seen), fmt.Errorf("failed to remove storage %s from the index: %w", id, err)
+		}
+	}
+	return len(seen), nil
+}
+
+// reindexStorage replaces the index entries of one storage with its listing in the wrapped repository
+func (r *indexRepository) reindexStorage(ctx context.Context, reader ManifestReader, storage StorageInfo) error {
+	unlock := r.locks.lock(storage.ID)
+	defer unlock()
+
+	files, err := r.Repository.GetFilesByStorage(ctx, storage.ID)
+	if err != nil {
+		return err
+	}
+	var manifest Manifest
+	if reader != nil {
+		manifest, err = reader.Manifest(ctx, storage.ID)
+		if err != nil && !errors.Is(err, ErrStorageNotFound) {
+			return err
+		}
+	}
+
+	return inTx(ctx, r.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO storages (id, created_at, expires_at) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET created_at = excluded.created_at, expires_at = excluded.expires_at`,
+			storage.ID, nullTime(&storage.CreatedAt), nullTime(storage.ExpiresAt))
+		if err != nil {
+			return err
+		}
+
+		listed := make(map[string]bool, len(files))
+		for _, file := range files {
+			if err := upsertFile(ctx, tx, storage.ID, file, manifest.Files[file.Path].CorruptedAt); err != nil {
+				return err
+			}
+			listed[file.Path] = true
+		}
+
+		// Drop files that are gone; the rest kept their download counts
+		rows, err := tx.QueryContext(ctx, `SELECT path FROM files WHERE storage_id = ?`, storage.ID)
+		if err != nil {
+			return err
+		}
+		var gone []string
+		for rows.Next() {
+			var filePath string
+			if err := rows.Scan(&filePath); err != nil {
+				rows.Close()
+				return err
+			}
+			if !listed[filePath] {
+				gone = append(gone, filePath)
+			}
+		}
+		rows.Close()
+		for _, filePath := range gone {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM files WHERE storage_id = ? AND path = ?`, storage.ID, filePath); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// Manifest forwards to the wrapped repository when it keeps manifests
+func (r *indexRepository) Manifest(ctx context.Context, storageID string) (Manifest, error) {
+	reader, ok := r.Repository.(ManifestReader)
+	if !ok {
+		return Manifest{}, fmt.Errorf("repository %T does not keep manifests", r.Repository)
+	}
+	return reader.Manifest(ctx, storageID)
+}
+
+// Usage forwards to the wrapped repository when it reports usage
+func (r *indexRepository) Usage(ctx context.Context) (Usage, error) {
+	reporter, ok := r.Repository.(UsageReporter)
+	if !ok {
+		return Usage{}, fmt.Errorf("repository %T does not report usage", r.Repository)
+	}
+	return reporter.Usage(ctx)
+}
+
+// DiskSpace forwards to the wrapped repository when it stores files on a local filesystem
+func (r *indexRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return forwardDiskSpace(ctx, r.Repository)
+}
+
+// readMetadata implements metadataStore so other decorators can be stacked on top
+func (r *indexRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	return r.store.readMetadata(ctx, storageID, name)
+}
+
+// writeMetadata implements metadataStore so other decorators can be stacked on top
+func (r *indexRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return r.store.writeMetadata(ctx, storageID, name, data)
+}
+
+// listStorageIDs implements storageLister so other decorators can be stacked on top
+func (r *indexRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	return lister.listStorageIDs(ctx)
+}
@@ -2,31 +2,51 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 )
 
+// tempFilePrefix marks in-flight uploads inside a storage directory
+// Files with this prefix are never listed or counted
+const tempFilePrefix = ".upload-"
+
 type localRepository struct {
 	// Db connection can be put here but since not needed leave open
 	dirPath string
+	opts    options
 }
 
 // NewLocalRepository creates a new local file repository instance
-// dirPath is the base directory where all session folders will be stored
-func NewLocalRepository(dirPath string) (*localRepository, error) {
+// dirPath is the base directory where all session folders will be stored, sharded
+// as ab/cd/abcd123456. Storages left directly under dirPath by older versions are
+// moved into their shard folders.
+func NewLocalRepository(dirPath string, opts ...Option) (*localRepository, error) {
 	// Create the base directory if it doesn't exist
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create base directory: %w", err)
 	}
+	if _, err := migrateFlatLayout(dirPath); err != nil {
+		return nil, err
+	}
 
 	r := &localRepository{
 		dirPath: dirPath,
+		opts:    newOptions(opts),
 	}
 	return r, nil
 }
 
+// storageDir returns the folder holding a storage's files
+func (r *localRepository) storageDir(storageID string) string {
+	return shardDir(r.dirPath, storageID)
+}
+
 // Close implements the Repository interface
 // For local repository, this is a no-op but kept for interface compliance
 func (r *localRepository) Close() {
@@ -35,57 +55,209 @@ func (r *localRepository) Close() {
 
 // SaveFile saves a file to the storage ID folder
 // storageID: 10-character UUID storage identifier
-// filename: name of the file to save
+// filename: relative path of the file to save, e.g. "docs/a.txt"; folders are created as needed
 // content: reader containing the file content
-func (r *localRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) error {
+//
+// Content is written to a temp file in the storage directory, fsynced and then
+// moved into place atomically, so readers never observe a partially written file.
+// Existing names are handled according to the configured ConflictPolicy.
+func (r *localRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
 	// Validate storage ID length (10 characters as per requirements)
-	if len(storageID) != 10 {
-		return fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return FileInfo{}, err
 	}
 
 	// Create storage directory path
-	storageDir := filepath.Join(r.dirPath, storageID)
+	storageDir := r.storageDir(storageID)
 
 	// Create storage directory if it doesn't exist
-	if err := os.MkdirAll(storageDir, 0755); err != nil {
-		return fmt.Errorf("failed to create storage directory: %w", err)
+	if err := mkdirAll(storageDir); err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
-	// Create full file path
-	filePath := filepath.Join(storageDir, filename)
+	// Write into a temp file next to the final path so the rename stays on one filesystem
+	tmp, err := os.CreateTemp(storageDir, tempFilePrefix+"*")
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to create file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // No-op once the temp file has been renamed
 
-	// Create the file
-	file, err := os.Create(filePath)
+	// Copy content to file and flush it to disk before it becomes visible
+	size, err := io.Copy(tmp, content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to write file content: %w", err)
+	}
+
+	finalName, err := r.publish(tmpPath, storageDir, filename)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return FileInfo{}, err
+	}
+
+	// Persist the directory entry so the new name survives a crash
+	syncDir(filepath.Dir(filepath.Join(storageDir, filepath.FromSlash(finalName))))
+
+	return newFileInfo(finalName, size), nil
+}
+
+// publish moves a fully written temp file to its final name according to the conflict policy
+// Returns the name the file was stored under
+func (r *localRepository) publish(tmpPath, storageDir, filename string) (string, error) {
+	if r.opts.conflictPolicy == ConflictOverwrite {
+		// Rename atomically replaces any existing file
+		err := placeFile(filepath.Join(storageDir, filepath.FromSlash(filename)), func(target string) error {
+			return os.Rename(tmpPath, target)
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to store file: %w", err)
+		}
+		return filename, nil
+	}
+
+	// Link fails if the target exists, which makes reject/rename race-free
+	for n := 0; n < maxRenameAttempts; n++ {
+		candidate := renamedFilename(filename, n)
+		err := placeFile(filepath.Join(storageDir, filepath.FromSlash(candidate)), func(target string) error {
+			return os.Link(tmpPath, target)
+		})
+		if err == nil {
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("failed to store file: %w", err)
+		}
+		if r.opts.conflictPolicy == ConflictReject {
+			return "", fmt.Errorf("%w: %s", ErrFileExists, filename)
+		}
+	}
+
+	return "", fmt.Errorf("%w: no free name for %s", ErrFileExists, filename)
+}
+
+// placeFile creates the parent folders of target and runs place to put the file there
+// A concurrent delete may prune a folder that just became empty, so a missing
+// parent is recreated and place retried a few times.
+func placeFile(target string, place func(target string) error) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err = place(target); !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// pruneEmptyDirs removes now-empty folders from dir up to, but not including, root
+func pruneEmptyDirs(root, dir string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		// Remove fails on non-empty directories, which ends the walk
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
 	}
-	defer file.Close()
+}
+
+// walkFiles calls fn for every regular file below dir with its slash-separated relative path
+// In-flight uploads and the metadata folder are skipped
+func walkFiles(dir string, fn func(relPath string, d fs.DirEntry) error) error {
+	metaDir := filepath.Join(dir, metaDirName)
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Removed by a concurrent delete
+			}
+			return err
+		}
+		if d.IsDir() && p == metaDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempFilePrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), d)
+	})
+}
 
-	// Copy content to file
-	_, err = io.Copy(file, content)
+// writeFileAtomic writes data to a temp file in the target's folder, fsyncs it and renames it into place
+func writeFileAtomic(target string, data []byte) error {
+	dir := filepath.Dir(target)
+	if err := mkdirAll(dir); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+"*")
 	if err != nil {
-		// Clean up the file if copy fails
-		os.Remove(filePath)
-		return fmt.Errorf("failed to write file content: %w", err)
+		return err
 	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
 
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	syncDir(dir)
 	return nil
 }
 
+// isMissingFile reports whether a stat error or result means there is no file at the path
+// A path through an existing file ("a.txt/b") fails with ENOTDIR, and folders are not files
+func isMissingFile(info os.FileInfo, err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) || (err == nil && info.IsDir())
+}
+
+// syncDir fsyncs a directory so renames and links inside it are durable
+// Errors are ignored: some platforms and filesystems don't support directory sync
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
 // GetFile retrieves a file by storage ID and filename
 // Returns a ReadCloser that must be closed by the caller
 func (r *localRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
 	// Validate storage ID length
-	if len(storageID) != 10 {
-		return nil, fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return nil, err
 	}
 
 	// Create full file path
-	filePath := filepath.Join(r.dirPath, storageID, filename)
+	filePath := filepath.Join(r.storageDir(storageID), filepath.FromSlash(filename))
 
 	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("file not found: %s", filename)
+	if info, err := os.Stat(filePath); isMissingFile(info, err) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
 	}
 
 	// Open and return the file
@@ -97,91 +269,259 @@ func (r *localRepository) GetFile(ctx context.Context, storageID string, filenam
 	return file, nil
 }
 
-// GetFilesByStorage retrieves all files in a storage folder
+// GetFileRange opens the file and seeks to offset, so only the range is read
+func (r *localRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	file, err := r.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+	return seekFileRange(file.(*os.File), offset, length)
+}
+
+// seekFileRange positions an open file at offset and limits it to the range
+// The file is closed if the range is invalid.
+func seekFileRange(file *os.File, offset, length int64) (*FileRange, error) {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+	length, err = checkRange(offset, length, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek file: %w", err)
+	}
+	return newFileRange(file, offset, length, info.Size()), nil
+}
+
+// GetFilesByStorage retrieves all files in a storage folder, walking nested folders
 func (r *localRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
 	// Validate storage ID length
-	if len(storageID) != 10 {
-		return nil, fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
 	}
 
 	// Create storage directory path
-	storageDir := filepath.Join(r.dirPath, storageID)
+	storageDir := r.storageDir(storageID)
 
 	// Check if storage directory exists
 	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
 		return []FileInfo{}, nil // Return empty slice if storage doesn't exist
 	}
 
-	// Read directory contents
-	entries, err := os.ReadDir(storageDir)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read storage directory: %w", err)
-	}
-
-	var files []FileInfo
-	for _, entry := range entries {
-		// Skip directories
-		if entry.IsDir() {
-			continue
-		}
-
+	files := []FileInfo{}
+	err := walkFiles(storageDir, func(relPath string, d fs.DirEntry) error {
 		// Get file info
-		info, err := entry.Info()
+		info, err := d.Info()
 		if err != nil {
-			continue // Skip files we can't get info for
+			return nil // Skip files we can't get info for
 		}
 
-		files = append(files, FileInfo{
-			Filename: entry.Name(),
-			Size:     info.Size(),
-		})
+		files = append(files, newFileInfo(relPath, info.Size()))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
 	}
+	sortFileInfos(files)
 
 	return files, nil
 }
 
 // DeleteFile deletes a specific file from a storage folder
+// Folders left empty by the delete are removed as well
 func (r *localRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
 	// Validate storage ID length
-	if len(storageID) != 10 {
-		return fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return err
 	}
 
 	// Create full file path
-	filePath := filepath.Join(r.dirPath, storageID, filename)
+	storageDir := r.storageDir(storageID)
+	filePath := filepath.Join(storageDir, filepath.FromSlash(filename))
 
 	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file not found: %s", filename)
+	if info, err := os.Stat(filePath); isMissingFile(info, err) {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, filename)
 	}
 
 	// Delete the file
 	if err := os.Remove(filePath); err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
+	pruneEmptyDirs(storageDir, filepath.Dir(filePath))
 
 	return nil
 }
 
+// moveFile implements fileMover by renaming the file
+func (r *localRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, from); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, to); err != nil {
+		return FileInfo{}, err
+	}
+
+	storageDir := r.storageDir(storageID)
+	fromPath := filepath.Join(storageDir, filepath.FromSlash(from))
+	info, err := os.Stat(fromPath)
+	if isMissingFile(info, err) {
+		return FileInfo{}, fmt.Errorf("%w: %s", ErrFileNotFound, from)
+	}
+
+	err = placeFile(filepath.Join(storageDir, filepath.FromSlash(to)), func(target string) error {
+		return os.Rename(fromPath, target)
+	})
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to move file: %w", err)
+	}
+	pruneEmptyDirs(storageDir, filepath.Dir(fromPath))
+
+	return newFileInfo(to, info.Size()), nil
+}
+
 // DeleteStorage deletes an entire storage folder and all its contents
 func (r *localRepository) DeleteStorage(ctx context.Context, storageID string) error {
 	// Validate storage ID length
-	if len(storageID) != 10 {
-		return fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := validateStorageID(storageID); err != nil {
+		return err
 	}
 
 	// Create storage directory path
-	storageDir := filepath.Join(r.dirPath, storageID)
+	storageDir := r.storageDir(storageID)
 
 	// Check if storage directory exists
 	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
-		return fmt.Errorf("storage not found: %s", storageID)
+		return fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
 	}
 
-	// Remove the entire storage directory
+	// Remove the entire storage directory and any shard folders it leaves empty
 	if err := os.RemoveAll(storageDir); err != nil {
 		return fmt.Errorf("failed to delete storage folder: %w", err)
 	}
+	pruneEmptyDirs(r.dirPath, filepath.Dir(storageDir))
 
 	return nil
 }
+
+// metadataPath returns where a metadata document of a storage is kept
+func (r *localRepository) metadataPath(storageID, name string) string {
+	return filepath.Join(r.storageDir(storageID), metaDirName, metadataFilename(name))
+}
+
+// readMetadata implements metadataStore
+func (r *localRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	data, err := os.ReadFile(r.metadataPath(storageID, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+	return data, err
+}
+
+// writeMetadata implements metadataStore
+func (r *localRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return writeFileAtomic(r.metadataPath(storageID, name), data)
+}
+
+// listStorageIDs implements storageLister
+func (r *localRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	ids, _, err := shardedStorageIDs(r.dirPath, "", -1)
+	return ids, err
+}
+
+// ListStorages walks the shard folders in order, reading only those past the cursor
+func (r *localRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	limit, err := checkStoragePage(cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+	ids, more, err := shardedStorageIDs(r.dirPath, cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+	return describeStorages(ctx, ids, more, r.describeStorage)
+}
+
+// describeStorage sums a storage's files and dates it by the oldest one
+func (r *localRepository) describeStorage(ctx context.Context, storageID string) (StorageInfo, error) {
+	return describeDir(storageID, r.storageDir(storageID), func(relPath string, info fs.FileInfo) int64 {
+		return info.Size()
+	})
+}
+
+// describeDir builds the StorageInfo of a storage folder
+// size returns the logical size of a file; files it can't size are skipped.
+func describeDir(storageID, dir string, size func(relPath string, info fs.FileInfo) int64) (StorageInfo, error) {
+	storage := StorageInfo{ID: storageID}
+	err := walkFiles(dir, func(relPath string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return nil // Skip files we can't get info for
+		}
+		storage.Files++
+		storage.Size += size(relPath, info)
+		if storage.CreatedAt.IsZero() || info.ModTime().Before(storage.CreatedAt) {
+			storage.CreatedAt = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return StorageInfo{}, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+	if storage.Files == 0 {
+		// Empty storages are dated by their folder
+		if info, err := os.Stat(dir); err == nil {
+			storage.CreatedAt = info.ModTime()
+		}
+	}
+	return storage, nil
+}
+
+// Usage walks every storage folder and reports the size of every stored file
+// Local storage keeps a full copy per file, so logical and physical bytes are equal
+// except for the files decorators keep in reservedDirs, which are only physical.
+func (r *localRepository) Usage(ctx context.Context) (Usage, error) {
+	var usage Usage
+
+	ids, err := r.listStorageIDs(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	for _, id := range ids {
+		usage.Storages++
+
+		// Skip storages we can't read
+		walkFiles(r.storageDir(id), func(relPath string, d fs.DirEntry) error {
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			usage.Files++
+			usage.LogicalBytes += info.Size()
+			return nil
+		})
+		for _, dir := range reservedDirs {
+			walkFiles(filepath.Join(r.storageDir(id), filepath.FromSlash(dir)), func(relPath string, d fs.DirEntry) error {
+				if info, err := d.Info(); err == nil {
+					usage.PhysicalBytes += info.Size()
+				}
+				return nil
+			})
+		}
+	}
+	usage.PhysicalBytes += usage.LogicalBytes
+
+	return usage, nil
+}
@@ -0,0 +1,439 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// manifestName is the metadata document holding a storage's manifest
+const manifestName = "manifest"
+
+// Manifest describes a storage and every file uploaded to it
+type Manifest struct {
+	CreatedAt time.Time                `json:"created_at"`
+	ExpiresAt *time.Time               `json:"expires_at,omitempty"` // nil if the storage never expires
+	Files     map[string]ManifestEntry `json:"files"`                // Keyed by relative path
+}
+
+// ManifestEntry holds the metadata recorded for one file
+type ManifestEntry struct {
+	OriginalName string     `json:"original_name"`
+	ContentType  string     `json:"content_type"`
+	SHA256       string     `json:"sha256"`
+	Size         int64      `json:"size"`
+	UploadedAt   time.Time  `json:"uploaded_at"`
+	CorruptedAt  *time.Time `json:"corrupted_at,omitempty"` // When the content was found not to match SHA256
+}
+
+// ManifestReader is implemented by repositories that keep a manifest per storage
+type ManifestReader interface {
+	// Manifest returns the manifest of a storage, or ErrStorageNotFound if it has none
+	Manifest(ctx context.Context, storageID string) (Manifest, error)
+}
+
+// IntegrityMarker is implemented by repositories that refuse to serve files found corrupted
+type IntegrityMarker interface {
+	// MarkCorrupted flags a file whose content no longer hashes to sha256, so reads fail with
+	// ErrFileCorrupted until it is replaced. It reports false if the file was replaced or
+	// removed since sha256 was recorded.
+	MarkCorrupted(ctx context.Context, storageID string, filename string, sha256 string) (bool, error)
+}
+
+// manifestRepository records a manifest for every storage of the wrapped repository
+// Each write holds a per-storage lock across the file write and the manifest update,
+// so the manifest always describes the content that was stored last.
+type manifestRepository struct {
+	Repository
+	store metadataStore
+	ttl   time.Duration
+	now   func() time.Time
+	locks storageLocks
+}
+
+// NewManifestRepository wraps inner so every storage keeps a manifest
+// ttl sets the manifest's expires_at relative to the storage's creation; 0 means never.
+// inner must be one of the repositories of this package.
+func NewManifestRepository(inner Repository, ttl time.Duration) (*manifestRepository, error) {
+	store, ok := inner.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot store manifests", inner)
+	}
+
+	r := &manifestRepository{
+		Repository: inner,
+		store:      store,
+		ttl:        ttl,
+		now:        time.Now,
+	}
+	return r, nil
+}
+
+// loadManifest reads the manifest of a storage, reporting whether it exists
+func (r *manifestRepository) loadManifest(ctx context.Context, storageID string) (Manifest, bool, error) {
+	data, err := r.store.readMetadata(ctx, storageID, manifestName)
+	if errors.Is(err, ErrFileNotFound) {
+		return Manifest{Files: make(map[string]ManifestEntry)}, false, nil
+	}
+	if err != nil {
+		return Manifest{}, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, false, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = make(map[string]ManifestEntry)
+	}
+	return manifest, true, nil
+}
+
+func (r *manifestRepository) saveManifest(ctx context.Context, storageID string, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := r.store.writeMetadata(ctx, storageID, manifestName, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// withMetadata copies the manifest fields of entry into info
+func withMetadata(info FileInfo, entry ManifestEntry) FileInfo {
+	info.OriginalName = entry.OriginalName
+	info.ContentType = entry.ContentType
+	info.SHA256 = entry.SHA256
+	info.UploadedAt = entry.UploadedAt
+	info.Corrupted = entry.CorruptedAt != nil
+	return info
+}
+
+// sniffLen is how many leading bytes content sniffing looks at
+const sniffLen = 512
+
+// contentType determines a file's MIME type from its first bytes, as browsers do
+// The extension only decides when the bytes match no specific format (plain text or unknown
+// binary), so a renamed file is labeled by what it contains rather than by its name.
+func contentType(filename string, head []byte) string {
+	sniffed := http.DetectContentType(head)
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	if t := mime.TypeByExtension(path.Ext(filename)); t != "" {
+		return t
+	}
+	return sniffed
+}
+
+// hashingReader computes the SHA-256 of everything read through it
+// and keeps the first sniffLen bytes for content sniffing
+type hashingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	head []byte
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	if missing := sniffLen - len(hr.head); missing > 0 {
+		hr.head = append(hr.head, p[:min(n, missing)]...)
+	}
+	return n, err
+}
+
+// SaveFile stores the file in the wrapped repository and records it in the manifest
+func (r *manifestRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	// Load first so a broken manifest fails the upload before any content is written
+	manifest, exists, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	hr := &hashingReader{r: content, h: sha256.New()}
+	info, err := r.Repository.SaveFile(ctx, storageID, filename, hr)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	now := r.now().UTC()
+	if !exists {
+		manifest.CreatedAt = now
+		if r.ttl > 0 {
+			expiresAt := now.Add(r.ttl)
+			manifest.ExpiresAt = &expiresAt
+		}
+	}
+	entry := ManifestEntry{
+		OriginalName: originalName(ctx, filename),
+		ContentType:  contentType(info.Path, hr.head),
+		SHA256:       hex.EncodeToString(hr.h.Sum(nil)),
+		Size:         info.Size,
+		UploadedAt:   now,
+	}
+	manifest.Files[info.Path] = entry
+
+	if err := r.saveManifest(ctx, storageID, manifest); err != nil {
+		return FileInfo{}, err
+	}
+
+	return withMetadata(info, entry), nil
+}
+
+// checkIntegrity fails with ErrFileCorrupted if filename was marked corrupted
+// It returns the file's manifest entry, which is empty for files the manifest doesn't know.
+func (r *manifestRepository) checkIntegrity(ctx context.Context, storageID, filename string) (ManifestEntry, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return ManifestEntry{}, err
+	}
+
+	manifest, _, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	entry := manifest.Files[filename]
+	if entry.CorruptedAt != nil {
+		return entry, fmt.Errorf("%w: %s failed verification at %s", ErrFileCorrupted, filename, entry.CorruptedAt.Format(time.RFC3339))
+	}
+	return entry, nil
+}
+
+// GetFile retrieves the file unless it was marked corrupted
+func (r *manifestRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	if _, err := r.checkIntegrity(ctx, storageID, filename); err != nil {
+		return nil, err
+	}
+	return r.Repository.GetFile(ctx, storageID, filename)
+}
+
+// GetFileRange retrieves part of the file unless it was marked corrupted, along with
+// the name it was uploaded as, its content type and its hash
+func (r *manifestRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	entry, err := r.checkIntegrity(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+	fileRange, err := r.Repository.GetFileRange(ctx, storageID, filename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	fileRange.OriginalName = entry.OriginalName
+	fileRange.ContentType = entry.ContentType
+	fileRange.SHA256 = entry.SHA256
+	return fileRange, nil
+}
+
+// MarkCorrupted implements IntegrityMarker
+func (r *manifestRepository) MarkCorrupted(ctx context.Context, storageID string, filename string, sha256 string) (bool, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return false, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	manifest, _, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return false, err
+	}
+	entry, ok := manifest.Files[filename]
+	if !ok || entry.SHA256 != sha256 {
+		return false, nil
+	}
+	if entry.CorruptedAt == nil {
+		corruptedAt := r.now().UTC()
+		entry.CorruptedAt = &corruptedAt
+		manifest.Files[filename] = entry
+		if err := r.saveManifest(ctx, storageID, manifest); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// GetFilesByStorage lists the wrapped repository and adds the manifest fields
+// Files without a manifest entry, e.g. stored before manifests existed, are listed without them
+func (r *manifestRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	files, err := r.Repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, _, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		if entry, ok := manifest.Files[file.Path]; ok {
+			files[i] = withMetadata(file, entry)
+		}
+	}
+
+	return files, nil
+}
+
+// DeleteFile removes the file and its manifest entry
+func (r *manifestRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	if err := r.Repository.DeleteFile(ctx, storageID, filename); err != nil {
+		return err
+	}
+
+	manifest, exists, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if _, ok := manifest.Files[filename]; !exists || !ok {
+		return nil
+	}
+	delete(manifest.Files, filename)
+
+	return r.saveManifest(ctx, storageID, manifest)
+}
+
+// moveFile implements fileMover when the wrapped repository does, moving the file's manifest entry
+func (r *manifestRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	manifest, exists, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := forwardMove(ctx, r.Repository, storageID, from, to)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	entry, ok := manifest.Files[from]
+	_, replaced := manifest.Files[to]
+	if !exists || (!ok && !replaced) {
+		return info, nil
+	}
+	delete(manifest.Files, from)
+	delete(manifest.Files, to)
+	if ok {
+		manifest.Files[to] = entry
+		info = withMetadata(info, entry)
+	}
+
+	return info, r.saveManifest(ctx, storageID, manifest)
+}
+
+// DeleteStorage removes the storage; its manifest goes with it
+func (r *manifestRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	return r.Repository.DeleteStorage(ctx, storageID)
+}
+
+// Manifest implements ManifestReader
+func (r *manifestRepository) Manifest(ctx context.Context, storageID string) (Manifest, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return Manifest{}, err
+	}
+
+	manifest, exists, err := r.loadManifest(ctx, storageID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if !exists {
+		return Manifest{}, fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+	// Files kept by decorators in reservedDirs, such as older versions, are not files of the storage
+	for path := range manifest.Files {
+		if isReservedPath(path) {
+			delete(manifest.Files, path)
+		}
+	}
+	return manifest, nil
+}
+
+// ListStorages takes each storage's creation and expiry from its manifest, when it has one
+func (r *manifestRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	page, err := r.Repository.ListStorages(ctx, cursor, limit)
+	if err != nil {
+		return page, err
+	}
+
+	for i, storage := range page.Storages {
+		manifest, exists, err := r.loadManifest(ctx, storage.ID)
+		if err != nil {
+			return StoragePage{}, err
+		}
+		if exists {
+			page.Storages[i].CreatedAt = manifest.CreatedAt
+			page.Storages[i].ExpiresAt = manifest.ExpiresAt
+		}
+	}
+	return page, nil
+}
+
+// Usage forwards to the wrapped repository when it reports usage
+func (r *manifestRepository) Usage(ctx context.Context) (Usage, error) {
+	reporter, ok := r.Repository.(UsageReporter)
+	if !ok {
+		return Usage{}, fmt.Errorf("repository %T does not report usage", r.Repository)
+	}
+	return reporter.Usage(ctx)
+}
+
+// DiskSpace forwards to the wrapped repository when it stores files on a local filesystem
+func (r *manifestRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return forwardDiskSpace(ctx, r.Repository)
+}
+
+// readMetadata implements metadataStore so other decorators can be stacked on top
+func (r *manifestRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	return r.store.readMetadata(ctx, storageID, name)
+}
+
+// writeMetadata implements metadataStore so other decorators can be stacked on top
+func (r *manifestRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return r.store.writeMetadata(ctx, storageID, name, data)
+}
+
+// listStorageIDs implements storageLister so other decorators can be stacked on top
+func (r *manifestRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	return lister.listStorageIDs(ctx)
+}
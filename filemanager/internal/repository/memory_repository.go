@@ -0,0 +1,325 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryRepository struct {
+	opts options
+
+	mu sync.RWMutex
+	// storages maps storageID -> relative file path -> file content
+	// A storage with no files is kept until DeleteStorage, matching a local empty folder
+	storages map[string]map[string][]byte
+	// metadata maps storageID -> document name -> content
+	metadata map[string]map[string][]byte
+	// created maps storageID -> time the storage was first written
+	created map[string]time.Time
+}
+
+// NewMemoryRepository creates a new in-memory file repository instance
+// Nothing is persisted, which makes it suitable for tests and local experiments
+func NewMemoryRepository(opts ...Option) *memoryRepository {
+	return &memoryRepository{
+		opts:     newOptions(opts),
+		storages: make(map[string]map[string][]byte),
+		metadata: make(map[string]map[string][]byte),
+		created:  make(map[string]time.Time),
+	}
+}
+
+// Close implements the Repository interface
+// Drops all stored content
+func (r *memoryRepository) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.storages = make(map[string]map[string][]byte)
+	r.metadata = make(map[string]map[string][]byte)
+	r.created = make(map[string]time.Time)
+}
+
+// storage returns the files of a storage, creating it if needed
+// Caller must hold r.mu for writing
+func (r *memoryRepository) storage(storageID string) map[string][]byte {
+	files, ok := r.storages[storageID]
+	if !ok {
+		files = make(map[string][]byte)
+		r.storages[storageID] = files
+		r.created[storageID] = time.Now().UTC()
+	}
+	return files
+}
+
+// SaveFile saves a file to the storage ID namespace
+// Content is fully read before the file becomes visible, so readers never see partial files
+func (r *memoryRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return FileInfo{}, err
+	}
+
+	// Read outside the lock so slow uploads don't block other callers
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to write file content: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := r.storage(storageID)
+
+	finalName, err := resolveFilename(r.opts.conflictPolicy, filename, func(name string) (bool, error) {
+		_, taken := files[name]
+		return taken, nil
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	// Replace the slice rather than mutating it so open readers keep the old content
+	files[finalName] = data
+
+	return newFileInfo(finalName, int64(len(data))), nil
+}
+
+// GetFile retrieves a file by storage ID and filename
+// Returns a ReadCloser that must be closed by the caller
+func (r *memoryRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data, ok := r.storages[storageID][filename]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// GetFileRange returns the requested slice of the file
+func (r *memoryRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data, ok := r.storages[storageID][filename]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	size := int64(len(data))
+	length, err := checkRange(offset, length, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileRange{
+		ReadCloser: io.NopCloser(bytes.NewReader(data[offset : offset+length])),
+		Offset:     offset,
+		Length:     length,
+		Size:       size,
+	}, nil
+}
+
+// GetFilesByStorage retrieves all files in a storage namespace, sorted by path
+func (r *memoryRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	files, ok := r.storages[storageID]
+	if !ok {
+		return []FileInfo{}, nil // Return empty slice if storage doesn't exist
+	}
+
+	infos := make([]FileInfo, 0, len(files))
+	for name, data := range files {
+		if isReservedPath(name) {
+			continue
+		}
+		infos = append(infos, newFileInfo(name, int64(len(data))))
+	}
+	sortFileInfos(infos)
+
+	return infos, nil
+}
+
+// DeleteFile deletes a specific file from a storage namespace
+func (r *memoryRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := r.storages[storageID]
+	if _, ok := files[filename]; !ok {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	delete(files, filename)
+
+	return nil
+}
+
+// moveFile implements fileMover by moving the content to its new key
+func (r *memoryRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, from); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, to); err != nil {
+		return FileInfo{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := r.storages[storageID]
+	data, ok := files[from]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("%w: %s", ErrFileNotFound, from)
+	}
+	delete(files, from)
+	files[to] = data
+
+	return newFileInfo(to, int64(len(data))), nil
+}
+
+// DeleteStorage deletes an entire storage namespace and all its contents
+func (r *memoryRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.storages[storageID]; !ok {
+		return fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+	delete(r.storages, storageID)
+	delete(r.metadata, storageID)
+	delete(r.created, storageID)
+
+	return nil
+}
+
+// readMetadata implements metadataStore
+func (r *memoryRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	data, ok := r.metadata[storageID][name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+	return data, nil
+}
+
+// writeMetadata implements metadataStore
+// Like a local metadata folder, a document keeps its storage alive
+func (r *memoryRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.storage(storageID)
+	docs, ok := r.metadata[storageID]
+	if !ok {
+		docs = make(map[string][]byte)
+		r.metadata[storageID] = docs
+	}
+	docs[name] = append([]byte(nil), data...)
+	return nil
+}
+
+// listStorageIDs implements storageLister
+func (r *memoryRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.storages))
+	for id := range r.storages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ListStorages pages through the storage IDs in order
+func (r *memoryRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	limit, err := checkStoragePage(cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.storages))
+	for id := range r.storages {
+		ids = append(ids, id)
+	}
+	ids, more := pageStorageIDs(ids, cursor, limit)
+	return describeStorages(ctx, ids, more, func(ctx context.Context, storageID string) (StorageInfo, error) {
+		storage := StorageInfo{ID: storageID, CreatedAt: r.created[storageID]}
+		for name, data := range r.storages[storageID] {
+			if isReservedPath(name) {
+				continue
+			}
+			storage.Files++
+			storage.Size += int64(len(data))
+		}
+		return storage, nil
+	})
+}
+
+// Usage reports the number of stored bytes; memory keeps one copy per file
+// Files kept by decorators in reservedDirs only count as physical bytes.
+func (r *memoryRepository) Usage(ctx context.Context) (Usage, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	usage := Usage{Storages: len(r.storages)}
+	for _, files := range r.storages {
+		for name, data := range files {
+			usage.PhysicalBytes += int64(len(data))
+			if isReservedPath(name) {
+				continue
+			}
+			usage.Files++
+			usage.LogicalBytes += int64(len(data))
+		}
+	}
+
+	return usage, nil
+}
@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// metaDirName is the folder at the root of every storage reserved for repository metadata
+// It never shows up in listings and cannot be used as an uploaded path.
+const metaDirName = ".cthulhu"
+
+// reservedDirs lists the folders inside metaDirName where decorators and staged uploads keep whole files,
+// each stored as <dir>/<number>/<path>, rather than metadata documents
+var reservedDirs = []string{versionsDir, trashDir, stagingDir}
+
+// reservedPathsKey marks a context whose operations may address files under reservedDirs
+type reservedPathsKey struct{}
+
+// withReservedPaths lets the repositories below a decorator store, read and delete the
+// files it keeps under reservedDirs, which are otherwise rejected like any path inside metaDirName
+func withReservedPaths(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reservedPathsKey{}, true)
+}
+
+// originalNameKey carries the name a file was uploaded as, when it differs from its stored path
+type originalNameKey struct{}
+
+// WithOriginalName makes repositories that keep a manifest record name as the original name
+// of the files saved with the returned context, instead of the path they are stored under
+func WithOriginalName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, originalNameKey{}, name)
+}
+
+// originalName returns the name to record for a file saved under filename
+// Copies decorators keep under reservedDirs are recorded under their own path.
+func originalName(ctx context.Context, filename string) string {
+	if name, ok := ctx.Value(originalNameKey{}).(string); ok && name != "" && !isReservedPath(filename) {
+		return name
+	}
+	return filename
+}
+
+// isReservedPath reports whether a path relative to a storage is inside one of reservedDirs
+// Such files are never listed, but count as stored bytes.
+func isReservedPath(name string) bool {
+	for _, dir := range reservedDirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataStore is implemented by backends that can keep small metadata documents
+// next to a storage's files. Documents are replaced atomically and removed together
+// with their storage by DeleteStorage.
+type metadataStore interface {
+	// readMetadata returns the named document, or an error wrapping ErrFileNotFound if it doesn't exist
+	readMetadata(ctx context.Context, storageID, name string) ([]byte, error)
+	// writeMetadata atomically creates or replaces the named document
+	writeMetadata(ctx context.Context, storageID, name string, data []byte) error
+}
+
+// storageLister is implemented by backends that can enumerate their storages
+type storageLister interface {
+	listStorageIDs(ctx context.Context) ([]string, error)
+}
+
+// fileMover is implemented by repositories that can move a file within a storage without
+// copying its content, e.g. by renaming it on disk
+type fileMover interface {
+	// moveFile moves the file stored at from to to, replacing any file stored there, and
+	// returns the info of the moved file. It fails with an error wrapping errors.ErrUnsupported
+	// if the content has to be copied instead.
+	moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error)
+}
+
+// forwardMove moves a file within inner, failing with errors.ErrUnsupported if inner can't
+func forwardMove(ctx context.Context, inner Repository, storageID, from, to string) (FileInfo, error) {
+	mover, ok := inner.(fileMover)
+	if !ok {
+		return FileInfo{}, fmt.Errorf("repository %T cannot move files: %w", inner, errors.ErrUnsupported)
+	}
+	return mover.moveFile(ctx, storageID, from, to)
+}
+
+// metadataFilename returns the file name a document is stored under inside metaDirName
+func metadataFilename(name string) string {
+	return name + ".json"
+}
+
+// sizeIndex records the logical size of files a decorator stores in another form,
+// e.g. compressed or encrypted, keyed by relative path
+type sizeIndex struct {
+	Sizes map[string]int64 `json:"sizes"`
+}
+
+// loadSizeIndex reads the named size index of a storage; a missing index is empty
+func loadSizeIndex(ctx context.Context, store metadataStore, storageID, name string) (sizeIndex, error) {
+	index := sizeIndex{Sizes: make(map[string]int64)}
+	data, err := store.readMetadata(ctx, storageID, name)
+	if errors.Is(err, ErrFileNotFound) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("failed to read %s index: %w", name, err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("invalid %s index: %w", name, err)
+	}
+	if index.Sizes == nil {
+		index.Sizes = make(map[string]int64)
+	}
+	return index, nil
+}
+
+// saveSizeIndex atomically replaces the named size index of a storage
+func saveSizeIndex(ctx context.Context, store metadataStore, storageID, name string, index sizeIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s index: %w", name, err)
+	}
+	if err := store.writeMetadata(ctx, storageID, name, data); err != nil {
+		return fmt.Errorf("failed to write %s index: %w", name, err)
+	}
+	return nil
+}
+
+// apply replaces the stored sizes in files with the recorded logical sizes
+// Files missing from the index, e.g. written before the decorator was enabled, keep their size
+func (index sizeIndex) apply(files []FileInfo) {
+	for i, file := range files {
+		if size, ok := index.Sizes[file.Path]; ok {
+			files[i].Size = size
+		}
+	}
+}
+
+// move moves the size recorded for from to to, setting info, the moved file, to that size
+// It reports whether the index changed.
+func (index sizeIndex) move(from, to string, info *FileInfo) bool {
+	size, ok := index.Sizes[from]
+	if !ok {
+		// A stale record of a replaced file must not apply to the moved one
+		_, replaced := index.Sizes[to]
+		delete(index.Sizes, to)
+		return replaced
+	}
+	delete(index.Sizes, from)
+	index.Sizes[to] = size
+	info.Size = size
+	return true
+}
+
+// logicalUsage reports inner's usage with LogicalBytes recounted from the listings of r,
+// for decorators whose stored sizes differ from the logical ones
+func logicalUsage(ctx context.Context, r Repository, inner Repository) (Usage, error) {
+	reporter, ok := inner.(UsageReporter)
+	if !ok {
+		return Usage{}, fmt.Errorf("repository %T does not report usage", inner)
+	}
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	lister, ok := inner.(storageLister)
+	if !ok {
+		return usage, nil
+	}
+	ids, err := lister.listStorageIDs(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	usage.LogicalBytes = 0
+	for _, id := range ids {
+		files, err := r.GetFilesByStorage(ctx, id)
+		if err != nil {
+			continue // Skip storages we can't read
+		}
+		for _, file := range files {
+			usage.LogicalBytes += file.Size
+		}
+	}
+
+	return usage, nil
+}
+
+// storageLocks hands out one mutex per storage ID
+// Entries are dropped once nobody holds or waits for them.
+type storageLocks struct {
+	mu    sync.Mutex
+	locks map[string]*storageLock
+}
+
+type storageLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until the storage is free and returns the matching unlock function
+func (l *storageLocks) lock(storageID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*storageLock)
+	}
+	entry, ok := l.locks[storageID]
+	if !ok {
+		entry = &storageLock{}
+		l.locks[storageID] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		l.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, storageID)
+		}
+		l.mu.Unlock()
+	}
+}
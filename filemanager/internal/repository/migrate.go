@@ -0,0 +1,341 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MigrationOptions tunes Migrate
+type MigrationOptions struct {
+	// StatePath is a file recording every verified file, so an interrupted migration
+	// resumes where it stopped instead of copying everything again
+	StatePath string
+	// DeleteSource deletes each source storage once all its files are verified at the destination
+	DeleteSource bool
+	// Progress, if set, is called after each storage with the report so far
+	Progress func(storageID string, report MigrationReport)
+	// Failed, if set, is called for each file that could not be copied or verified
+	Failed func(storageID string, path string, err error)
+}
+
+// MigrationReport summarizes a migration
+type MigrationReport struct {
+	Storages int   // Storages whose files were all verified at the destination
+	Copied   int   // Files copied and verified by this run
+	Skipped  int   // Files verified by an earlier run
+	Bytes    int64 // Bytes copied by this run
+	Failed   int   // Files that could not be copied or verified; their storage is kept at the source
+	Deleted  int   // Source storages deleted after verification
+	Changed  int   // Storages not deleted because they changed while being migrated
+}
+
+// migratedFile is one line of the migration state file
+type migratedFile struct {
+	Storage string `json:"storage"`
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+}
+
+// migrationState records the files verified at the destination, keyed by storage and path
+type migrationState struct {
+	verified map[[2]string]migratedFile
+	file     *os.File
+}
+
+// openMigrationState loads the state file at path, creating it if needed
+// A line cut short by an interruption is ignored.
+func openMigrationState(path string) (*migrationState, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open migration state: %w", err)
+	}
+
+	state := &migrationState{verified: make(map[[2]string]migratedFile), file: file}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry migratedFile
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		state.verified[[2]string{entry.Storage, entry.Path}] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read migration state: %w", err)
+	}
+	return state, nil
+}
+
+// done reports whether file was already verified with its current content
+func (s *migrationState) done(storageID string, file FileInfo) bool {
+	entry, ok := s.verified[[2]string{storageID, file.Path}]
+	return ok && file.SHA256 != "" && entry.SHA256 == file.SHA256 && entry.Size == file.Size
+}
+
+// record durably appends a verified file
+func (s *migrationState) record(entry migratedFile) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write migration state: %w", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write migration state: %w", err)
+	}
+	s.verified[[2]string{entry.Storage, entry.Path}] = entry
+	return nil
+}
+
+// Migrate copies every storage of the src backend to the dst backend and verifies each
+// copied file's size and SHA-256 by reading it back. Manifests keep their creation, expiry,
+// original names and upload times. Storages in the source's trash and older versions of
+// files are not copied; the destination is written without a trash, versions or index.
+//
+// Files already verified according to opts.StatePath are skipped, so the source can keep
+// serving while a migration runs and the migration can be rerun until nothing changes.
+func Migrate(ctx context.Context, src, dst Config, opts MigrationOptions) (MigrationReport, error) {
+	if src.Backend == dst.Backend && src.LocalPath == dst.LocalPath && src.S3 == dst.S3 {
+		return MigrationReport{}, fmt.Errorf("source and destination are the same backend")
+	}
+
+	source, err := New(src)
+	if err != nil {
+		return MigrationReport{}, fmt.Errorf("failed to open source: %w", err)
+	}
+	defer source.Close()
+
+	return MigrateRepository(ctx, source, dst, opts)
+}
+
+// MigrateRepository is Migrate from a source repository that is already open
+func MigrateRepository(ctx context.Context, source Repository, dst Config, opts MigrationOptions) (MigrationReport, error) {
+	var report MigrationReport
+	if opts.StatePath == "" {
+		return report, fmt.Errorf("a migration state file is required")
+	}
+
+	// Files changed at the source since an earlier run replace their previous copy
+	dst.ConflictPolicy = ConflictOverwrite
+
+	state, err := openMigrationState(opts.StatePath)
+	if err != nil {
+		return report, err
+	}
+	defer state.file.Close()
+
+	target, err := newManifestStack(dst)
+	if err != nil {
+		return report, fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer target.Close()
+
+	m := &migration{source: source, target: target.(*manifestRepository), state: state, report: &report, opts: opts}
+	for storage, err := range AllStorages(ctx, source, 0) {
+		if err != nil {
+			return report, fmt.Errorf("failed to list source storages: %w", err)
+		}
+		if err := m.storage(ctx, storage.ID); err != nil {
+			return report, fmt.Errorf("failed to migrate storage %s: %w", storage.ID, err)
+		}
+		if opts.Progress != nil {
+			opts.Progress(storage.ID, report)
+		}
+	}
+	return report, nil
+}
+
+// migration holds the repositories and progress of one Migrate run
+type migration struct {
+	source Repository
+	target *manifestRepository
+	state  *migrationState
+	report *MigrationReport
+	opts   MigrationOptions
+}
+
+// storage migrates one storage, failing only on errors that stop the whole migration
+func (m *migration) storage(ctx context.Context, storageID string) error {
+	files, err := m.source.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if m.state.done(storageID, file) {
+			m.report.Skipped++
+			continue
+		}
+
+		entry, copied, err := m.file(ctx, storageID, file)
+		if err != nil {
+			failed++
+			m.report.Failed++
+			if m.opts.Failed != nil {
+				m.opts.Failed(storageID, file.Path, err)
+			}
+			continue
+		}
+		if err := m.state.record(entry); err != nil {
+			return err
+		}
+		if copied {
+			m.report.Copied++
+			m.report.Bytes += entry.Size
+		} else {
+			m.report.Skipped++
+		}
+	}
+
+	if err := m.adoptManifest(ctx, storageID, files); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return nil
+	}
+	m.report.Storages++
+
+	if !m.opts.DeleteSource {
+		return nil
+	}
+	// Only delete what was verified: a storage written to since it was listed waits for the next run
+	current, err := m.source.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if !sameFiles(files, current) {
+		m.report.Changed++
+		return nil
+	}
+	if err := m.source.DeleteStorage(ctx, storageID); err != nil && !errors.Is(err, ErrStorageNotFound) {
+		return err
+	}
+	m.report.Deleted++
+	return nil
+}
+
+// file copies one file unless the destination already holds the same content, then verifies it
+// It reports whether the file was copied.
+func (m *migration) file(ctx context.Context, storageID string, file FileInfo) (migratedFile, bool, error) {
+	entry := migratedFile{Storage: storageID, Path: file.Path, SHA256: file.SHA256, Size: file.Size}
+
+	// Copied by an interrupted run that didn't get to record it
+	copied := true
+	if manifest, _, err := m.target.loadManifest(ctx, storageID); err == nil {
+		if existing, ok := manifest.Files[file.Path]; ok && file.SHA256 != "" && existing.SHA256 == file.SHA256 {
+			copied = false
+		}
+	}
+
+	if copied {
+		content, err := m.source.GetFile(ctx, storageID, file.Path)
+		if err != nil {
+			return entry, false, err
+		}
+		hr := &hashingReader{r: content, h: sha256.New()}
+		saved, err := m.target.SaveFile(ctx, storageID, file.Path, hr)
+		content.Close()
+		if err != nil {
+			return entry, false, err
+		}
+
+		// The source may have been damaged or replaced while it was copied; drop the bad copy
+		sum := hex.EncodeToString(hr.h.Sum(nil))
+		if entry.SHA256 != "" && sum != entry.SHA256 {
+			m.target.DeleteFile(ctx, storageID, saved.Path)
+			return entry, false, fmt.Errorf("%w: source %s hashed to %s, expected %s", ErrFileCorrupted, file.Path, sum, entry.SHA256)
+		}
+		entry.SHA256 = sum
+		if saved.Size != entry.Size {
+			return entry, false, fmt.Errorf("source %s copied %d bytes, expected %d", file.Path, saved.Size, entry.Size)
+		}
+	}
+
+	if err := m.verify(ctx, entry); err != nil {
+		return entry, false, err
+	}
+	return entry, copied, nil
+}
+
+// verify reads a file back from the destination and checks its size and SHA-256
+func (m *migration) verify(ctx context.Context, entry migratedFile) error {
+	content, err := m.target.GetFile(ctx, entry.Storage, entry.Path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, content)
+	if err != nil {
+		return fmt.Errorf("failed to read back %s: %w", entry.Path, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); n != entry.Size || sum != entry.SHA256 {
+		return fmt.Errorf("%w: %s reads back as %d bytes with sha256 %s, expected %d bytes with %s",
+			ErrFileCorrupted, entry.Path, n, sum, entry.Size, entry.SHA256)
+	}
+	return nil
+}
+
+// adoptManifest carries the source's storage times, original names and upload times over
+// to the destination manifest, which otherwise dates everything to the migration
+func (m *migration) adoptManifest(ctx context.Context, storageID string, files []FileInfo) error {
+	reader, ok := m.source.(ManifestReader)
+	if !ok {
+		return nil
+	}
+	source, err := reader.Manifest(ctx, storageID)
+	if errors.Is(err, ErrStorageNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	unlock := m.target.locks.lock(storageID)
+	defer unlock()
+
+	manifest, exists, err := m.target.loadManifest(ctx, storageID)
+	if err != nil || !exists {
+		return err
+	}
+	manifest.CreatedAt = source.CreatedAt
+	manifest.ExpiresAt = source.ExpiresAt
+	for _, file := range files {
+		from, ok := source.Files[file.Path]
+		to, copied := manifest.Files[file.Path]
+		if !ok || !copied || from.SHA256 != to.SHA256 {
+			continue
+		}
+		to.OriginalName = from.OriginalName
+		to.UploadedAt = from.UploadedAt
+		manifest.Files[file.Path] = to
+	}
+	return m.target.saveManifest(ctx, storageID, manifest)
+}
+
+// sameFiles reports whether two listings hold the same paths with the same content
+func sameFiles(a, b []FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || a[i].Size != b[i].Size || a[i].SHA256 != b[i].SHA256 {
+			return false
+		}
+	}
+	return true
+}
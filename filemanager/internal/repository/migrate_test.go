@@ -0,0 +1,141 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository/repotest"
+)
+
+// flakySource is a migration source counting the reads of each file
+// Once limit files were read, the next read cancels the migration instead.
+// The file at damaged reads back with different content.
+type flakySource struct {
+	repository.Repository
+
+	mu      sync.Mutex
+	reads   map[string]int // By storage ID and path
+	limit   int            // 0 for no limit
+	cancel  context.CancelFunc
+	damaged string
+}
+
+func (r *flakySource) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	key := storageID + "/" + filename
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit > 0 && r.total() == r.limit {
+		r.cancel()
+		return nil, ctx.Err()
+	}
+	r.reads[key]++
+	if key == r.damaged {
+		return io.NopCloser(strings.NewReader("damaged")), nil
+	}
+	return r.Repository.GetFile(ctx, storageID, filename)
+}
+
+// total returns how many files were read; the caller holds mu
+func (r *flakySource) total() int {
+	n := 0
+	for _, reads := range r.reads {
+		n += reads
+	}
+	return n
+}
+
+func TestMigrateResumes(t *testing.T) {
+	source, err := repository.NewManifestRepository(repository.NewMemoryRepository(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc"} {
+		repotest.MustSave(t, source, id, "a.txt", "alpha "+id)
+		repotest.MustSave(t, source, id, "docs/b.txt", "beta "+id)
+	}
+	src := &flakySource{Repository: source, reads: make(map[string]int)}
+	dst := repository.Config{Backend: repository.BackendLocal, LocalPath: t.TempDir()}
+	opts := repository.MigrationOptions{StatePath: filepath.Join(t.TempDir(), "state"), DeleteSource: true}
+
+	// storages lists the storages left at the source
+	storages := func() []string {
+		t.Helper()
+		var ids []string
+		for storage, err := range repository.AllStorages(context.Background(), source, 0) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, storage.ID)
+		}
+		return ids
+	}
+
+	// The first run is interrupted after copying one file of the second storage
+	ctx, cancel := context.WithCancel(context.Background())
+	src.limit, src.cancel = 3, cancel
+	report, err := repository.MigrateRepository(ctx, src, dst, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted migration: got %v, want context.Canceled", err)
+	}
+	if report.Copied != 3 || report.Storages != 1 || report.Deleted != 1 {
+		t.Errorf("interrupted run %+v, want 3 files copied and the first storage deleted", report)
+	}
+	if got := strings.Join(storages(), ","); got != "bbbbbbbbbb,cccccccccc" {
+		t.Errorf("source holds %s after the interrupted run, want the storages not fully verified", got)
+	}
+
+	// The resumed run skips what was verified; a file damaged in transit keeps its storage at the source
+	src.limit, src.damaged = 0, "cccccccccc/a.txt"
+	report, err = repository.MigrateRepository(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 1 || report.Copied != 2 || report.Failed != 1 || report.Deleted != 1 {
+		t.Errorf("resumed run %+v, want 1 file skipped, 2 copied, 1 failed and 1 storage deleted", report)
+	}
+	if got := strings.Join(storages(), ","); got != "cccccccccc" {
+		t.Errorf("source holds %s after the resumed run, want only the storage with the damaged file", got)
+	}
+
+	src.damaged = ""
+	report, err = repository.MigrateRepository(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Skipped != 1 || report.Copied != 1 || report.Failed != 0 || report.Deleted != 1 {
+		t.Errorf("last run %+v, want 1 file skipped, 1 copied and the last storage deleted", report)
+	}
+	if ids := storages(); len(ids) != 0 {
+		t.Errorf("source still holds %v after the migration", ids)
+	}
+
+	// Every file was read once, but for the one damaged in transit
+	for key, reads := range src.reads {
+		if want := map[bool]int{true: 2, false: 1}[key == "cccccccccc/a.txt"]; reads != want {
+			t.Errorf("%s read %d times, want %d", key, reads, want)
+		}
+	}
+	if len(src.reads) != 6 {
+		t.Errorf("%d files read, want 6", len(src.reads))
+	}
+
+	migrated, err := repository.New(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	for _, id := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc"} {
+		if got := repotest.MustRead(t, migrated, id, "a.txt"); got != "alpha "+id {
+			t.Errorf("%s/a.txt migrated as %q", id, got)
+		}
+		if got := repotest.MustRead(t, migrated, id, "docs/b.txt"); got != "beta "+id {
+			t.Errorf("%s/docs/b.txt migrated as %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ConflictPolicy decides what SaveFile does when the filename already exists in the storage
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite atomically replaces the existing file
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictReject fails the save with ErrFileExists
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictRename stores the file as "name (1).ext", "name (2).ext", ...
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// maxRenameAttempts bounds the search for a free "name (n).ext"
+const maxRenameAttempts = 10000
+
+// ParseConflictPolicy converts a configuration value into a ConflictPolicy
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case ConflictOverwrite, ConflictReject, ConflictRename:
+		return p, nil
+	case "":
+		return ConflictOverwrite, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy: %s", s)
+	}
+}
+
+// options holds settings shared by every Repository implementation
+type options struct {
+	conflictPolicy ConflictPolicy
+}
+
+// Option configures a Repository at construction time
+type Option func(*options)
+
+// WithConflictPolicy sets how SaveFile handles existing filenames (default: overwrite)
+// An empty policy keeps the default
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(o *options) {
+		if policy != "" {
+			o.conflictPolicy = policy
+		}
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		conflictPolicy: ConflictOverwrite,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// renamedFilename returns the n-th alternative for filename, e.g. "report (2).pdf"
+// n == 0 returns filename unchanged
+func renamedFilename(filename string, n int) string {
+	if n == 0 {
+		return filename
+	}
+
+	dir, base := path.Split(filename)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if stem == "" {
+		// Dotfiles like ".env" have no extension to preserve
+		stem, ext = base, ""
+	}
+
+	return fmt.Sprintf("%s%s (%d)%s", dir, stem, n, ext)
+}
+
+// resolveFilename applies policy to pick the name a new file should be stored under
+// exists reports whether a candidate name is already taken
+func resolveFilename(policy ConflictPolicy, filename string, exists func(name string) (bool, error)) (string, error) {
+	if policy == ConflictOverwrite {
+		return filename, nil
+	}
+
+	for n := 0; n < maxRenameAttempts; n++ {
+		candidate := renamedFilename(filename, n)
+		taken, err := exists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+		if policy == ConflictReject {
+			return "", fmt.Errorf("%w: %s", ErrFileExists, filename)
+		}
+	}
+
+	return "", fmt.Errorf("%w: no free name for %s", ErrFileExists, filename)
+}
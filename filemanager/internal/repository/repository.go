@@ -2,22 +2,214 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
+)
+
+// Errors shared by every Repository implementation
+// Implementations wrap these so callers can match them with errors.Is
+var (
+	ErrInvalidStorageID = errors.New("invalid storage ID")
+	ErrFileNotFound     = errors.New("file not found")
+	ErrStorageNotFound  = errors.New("storage not found")
+	ErrFileExists       = errors.New("file already exists")
+	ErrInvalidFilename  = errors.New("invalid filename")
+	ErrInvalidRange     = errors.New("invalid range")
+	ErrVersionNotFound  = errors.New("version not found")
+	ErrFileCorrupted    = errors.New("file corrupted")
 )
 
+// maxFilePathLength caps the length of a relative file path inside a storage
+const maxFilePathLength = 1024
+
+// Repository stores files grouped by storage ID
+// Filenames are relative slash-separated paths such as "docs/a.txt", so a storage
+// can hold a whole folder tree. Paths are validated with the same rules by every backend.
 type Repository interface {
 	Close()
-	SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) error
+	// SaveFile stores content and returns the file as stored
+	// The stored Path may differ from the requested one depending on the ConflictPolicy
+	SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error)
 	GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error)
+	// GetFileRange returns length bytes of the file starting at offset, reading only that range
+	// length <= 0 reads to the end of the file; a longer length is clamped to it.
+	// An offset past the last byte fails with ErrInvalidRange.
+	GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error)
+	// GetFilesByStorage lists every file in the storage, including nested ones, sorted by Path
 	GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error)
 	DeleteFile(ctx context.Context, storageID string, filename string) error
 	DeleteStorage(ctx context.Context, storageID string) error
+	// ListStorages returns up to limit storages ordered by ID, starting after cursor
+	// An empty cursor starts at the first storage; pass the page's Next to get the following one.
+	// limit <= 0 uses DefaultStoragePageSize.
+	ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error)
 }
 
 // FileInfo represents metadata about a stored file
-// Note: Path is intentionally omitted as it's implementation-specific.
-// The repository abstraction should hide storage details (filesystem paths vs S3 keys).
+// Path is relative to the storage and never a filesystem path or S3 key,
+// so the repository abstraction still hides storage details.
+//
+// The remaining fields come from the storage manifest and are empty for backends
+// used without one (see NewManifestRepository).
 type FileInfo struct {
-	Filename string
+	Filename string // Base name, e.g. "a.txt"
+	Path     string // Relative path inside the storage, e.g. "docs/a.txt"
 	Size     int64
+
+	OriginalName string    // Path the file was uploaded as, before conflict renames
+	ContentType  string    // MIME type
+	SHA256       string    // Hex-encoded SHA-256 of the content
+	UploadedAt   time.Time // Zero if unknown
+	Corrupted    bool      // The stored content no longer matches SHA256 (see IntegrityMarker)
+	Downloads    int64     // Downloads counted by repositories that keep a MetadataIndex
+
+	// Filled by repositories that keep versions (see Versioner), empty otherwise
+	Version  int           // Number of the current version
+	Versions []FileVersion // Older versions still kept, newest first
+}
+
+// FileRange is an open byte range of a stored file
+type FileRange struct {
+	io.ReadCloser
+	Offset int64 // Position of the first byte in the file
+	Length int64 // Number of bytes the reader yields
+	Size   int64 // Size of the whole file
+
+	// Filled by repositories that keep a manifest, empty otherwise
+	OriginalName string // Path the file was uploaded as
+	ContentType  string // MIME type
+	SHA256       string // Hex-encoded SHA-256 of the whole file
+}
+
+// checkRange validates offset for a file of size and returns the length to read
+// Only offset 0 is valid for an empty file.
+func checkRange(offset, length, size int64) (int64, error) {
+	if offset < 0 || offset > size || (offset == size && size > 0) {
+		return 0, fmt.Errorf("%w: offset %d of %d bytes", ErrInvalidRange, offset, size)
+	}
+	if length <= 0 || length > size-offset {
+		length = size - offset
+	}
+	return length, nil
+}
+
+// readCloser pairs a reader with the closer of its underlying file
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newFileRange limits rc, already positioned at offset, to length bytes
+func newFileRange(rc io.ReadCloser, offset, length, size int64) *FileRange {
+	return &FileRange{
+		ReadCloser: readCloser{Reader: io.LimitReader(rc, length), Closer: rc},
+		Offset:     offset,
+		Length:     length,
+		Size:       size,
+	}
+}
+
+// newFileInfo builds a FileInfo from a relative path
+func newFileInfo(filePath string, size int64) FileInfo {
+	return FileInfo{
+		Filename: path.Base(filePath),
+		Path:     filePath,
+		Size:     size,
+	}
+}
+
+// sortFileInfos orders files by Path so every backend lists in the same order
+func sortFileInfos(files []FileInfo) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+}
+
+// Usage summarizes how much data a repository holds
+// LogicalBytes counts every file as uploaded; PhysicalBytes is what the backend actually stores
+type Usage struct {
+	Storages      int
+	Files         int
+	LogicalBytes  int64
+	PhysicalBytes int64
+}
+
+// UsageReporter is implemented by repositories that can report their usage
+type UsageReporter interface {
+	Usage(ctx context.Context) (Usage, error)
+}
+
+// validateStorageID checks that a storage ID is as long as some storageid.Format makes them
+// The exact format is the service's concern. Only letters, digits, - and _ are allowed, so an
+// ID is always a single safe path segment and its leading characters can name shard folders.
+func validateStorageID(storageID string) error {
+	if len(storageID) < storageid.MinLength || len(storageID) > storageid.MaxLength+1 {
+		return fmt.Errorf("%w: must be %d to %d characters", ErrInvalidStorageID, storageid.MinLength, storageid.MaxLength+1)
+	}
+	for _, c := range storageID {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("%w: %q contains characters other than letters, digits, - and _", ErrInvalidStorageID, storageID)
+		}
+	}
+	return nil
+}
+
+// validatePath is validateFilePath for the paths a backend is asked to store, read or delete
+// Decorators keep files such as older versions under reservedDirs, which only they
+// may address (see withReservedPaths).
+func validatePath(ctx context.Context, filename string) error {
+	if ctx.Value(reservedPathsKey{}) == nil {
+		return validateFilePath(filename)
+	}
+	for _, dir := range reservedDirs {
+		rest, ok := strings.CutPrefix(filename, dir+"/")
+		if !ok {
+			continue
+		}
+		number, filePath, _ := strings.Cut(rest, "/")
+		if _, err := strconv.Atoi(number); err != nil {
+			return fmt.Errorf("%w: %q is not a reserved path", ErrInvalidFilename, filename)
+		}
+		return validateFilePath(filePath)
+	}
+	return validateFilePath(filename)
+}
+
+// validateFilePath checks that filename is a clean relative path inside a storage
+// Absolute paths, "." and ".." segments, empty segments and backslashes are rejected,
+// so a path can never escape its storage on any backend.
+func validateFilePath(filename string) error {
+	if filename == "" {
+		return fmt.Errorf("%w: filename cannot be empty", ErrInvalidFilename)
+	}
+	if len(filename) > maxFilePathLength {
+		return fmt.Errorf("%w: path longer than %d bytes", ErrInvalidFilename, maxFilePathLength)
+	}
+	if strings.ContainsAny(filename, "\\\x00") {
+		return fmt.Errorf("%w: %q contains a backslash or NUL byte", ErrInvalidFilename, filename)
+	}
+
+	segments := strings.Split(filename, "/")
+	if segments[0] == metaDirName {
+		return fmt.Errorf("%w: %q is reserved for repository metadata", ErrInvalidFilename, metaDirName)
+	}
+
+	for _, segment := range segments {
+		switch {
+		case segment == "":
+			return fmt.Errorf("%w: %q has an empty path segment", ErrInvalidFilename, filename)
+		case segment == "." || segment == "..":
+			return fmt.Errorf("%w: %q must not contain . or .. segments", ErrInvalidFilename, filename)
+		case strings.HasPrefix(segment, tempFilePrefix):
+			return fmt.Errorf("%w: %q uses the reserved prefix %s", ErrInvalidFilename, filename, tempFilePrefix)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,324 @@
+package repository_test
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository/repotest"
+)
+
+// backends creates every bare backend that runs without external services
+var backends = map[string]repotest.Factory{
+	repository.BackendMemory: func(t *testing.T, opts ...repository.Option) repository.Repository {
+		return repository.NewMemoryRepository(opts...)
+	},
+	repository.BackendLocal: func(t *testing.T, opts ...repository.Option) repository.Repository {
+		r, err := repository.NewLocalRepository(t.TempDir(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	},
+	repository.BackendCAS: func(t *testing.T, opts ...repository.Option) repository.Repository {
+		r, err := repository.NewCASRepository(t.TempDir(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	},
+}
+
+// stack selects the decorators wrapped around a backend
+type stack struct {
+	encrypted  bool
+	retention  time.Duration // Trash retention; 0 leaves the trash out
+	versioning bool
+}
+
+// newStack wraps the backend newBackend creates in the decorators New builds, in the same order
+func newStack(t *testing.T, newBackend repotest.Factory, s stack, opts ...repository.Option) repository.Repository {
+	t.Helper()
+	r := newBackend(t, opts...)
+
+	if s.encrypted {
+		encrypted, err := repository.NewEncryptionRepository(r, bytes.Repeat([]byte{1}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = encrypted
+	}
+
+	compressed, err := repository.NewCompressionRepository(r, repository.CompressionZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := repository.NewManifestRepository(compressed, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = repository.NewIndexRepository(context.Background(), manifest, filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.retention > 0 {
+		r, err = repository.NewTrashRepository(r, s.retention)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.versioning {
+		r, err = repository.NewVersioningRepository(r, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func TestBackends(t *testing.T) {
+	for name, newRepo := range backends {
+		t.Run(name, func(t *testing.T) {
+			repotest.Run(t, newRepo)
+		})
+	}
+}
+
+func TestDecoratedStack(t *testing.T) {
+	for name, newBackend := range backends {
+		// Encryption defeats the deduplication of the content-addressed backend, so New refuses it
+		s := stack{encrypted: name != repository.BackendCAS}
+
+		t.Run(name, func(t *testing.T) {
+			repotest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+				return newStack(t, newBackend, s, opts...)
+			})
+		})
+
+		t.Run(name+"/trash", func(t *testing.T) {
+			s := s
+			s.retention = time.Hour
+			repotest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+				return newStack(t, newBackend, s, opts...)
+			})
+
+			// Retention short enough for PurgeTrash to remove everything
+			s.retention = time.Nanosecond
+			repotest.RunTrash(t, func(t *testing.T) repository.Repository {
+				return newStack(t, newBackend, s)
+			})
+		})
+
+		t.Run(name+"/versioning", func(t *testing.T) {
+			s := s
+			s.retention, s.versioning = time.Nanosecond, true
+			repotest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+				if len(opts) > 0 {
+					// Versioning requires the overwrite conflict policy
+					t.Skip("versioning keeps overwritten files instead of applying a conflict policy")
+				}
+				return newStack(t, newBackend, s)
+			})
+			repotest.RunVersioning(t, func(t *testing.T) repository.Repository {
+				return newStack(t, newBackend, s)
+			})
+			repotest.RunTrash(t, func(t *testing.T) repository.Repository {
+				return newStack(t, newBackend, s)
+			})
+		})
+	}
+}
+
+// findFile returns the file stored on disk below dir whose path ends in name
+func findFile(t *testing.T, dir, name string) os.FileInfo {
+	t.Helper()
+	var found os.FileInfo
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(filepath.ToSlash(p), "/"+name) {
+			found, _ = d.Info()
+		}
+		return nil
+	})
+	if found == nil {
+		t.Fatalf("%s not found below %s", name, dir)
+	}
+	return found
+}
+
+func TestTrashMovesFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := newStack(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+		r, err := repository.NewLocalRepository(dir, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}, stack{encrypted: true, retention: time.Hour})
+	defer r.Close()
+
+	repotest.MustSave(t, r, "abcdefghij", "docs/a.txt", "hello")
+	stored := findFile(t, dir, "docs/a.txt")
+
+	if err := r.DeleteFile(ctx, "abcdefghij", "docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(stored, findFile(t, dir, ".cthulhu/trash/1/docs/a.txt")) {
+		t.Error("deleted file was copied into the trash instead of moved")
+	}
+
+	info, err := r.(repository.Trash).RestoreFile(ctx, "abcdefghij", "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 || info.SHA256 == "" {
+		t.Errorf("restored %+v, want 5 bytes with the manifest's metadata", info)
+	}
+	if !os.SameFile(stored, findFile(t, dir, "docs/a.txt")) {
+		t.Error("restored file was copied out of the trash instead of moved")
+	}
+	if got := repotest.MustRead(t, r, "abcdefghij", "docs/a.txt"); got != "hello" {
+		t.Errorf("read %q after restoring, want hello", got)
+	}
+}
+
+// readStored returns the bytes stored on disk below dir for the file whose path ends in name
+func readStored(t *testing.T, dir, name string) []byte {
+	t.Helper()
+	var content []byte
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(filepath.ToSlash(p), "/"+name) {
+			content, err = os.ReadFile(p)
+		}
+		return err
+	})
+	if content == nil {
+		t.Fatalf("%s not found below %s", name, dir)
+	}
+	return content
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyA, keyB := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	const plaintext = "the launch codes are 0000"
+
+	// encrypted opens the files in dir with masterKey, falling back to previous
+	encrypted := func(masterKey []byte, previous ...[]byte) interface {
+		repository.Repository
+		RotateMasterKey(ctx context.Context) (int, error)
+	} {
+		t.Helper()
+		local, err := repository.NewLocalRepository(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := repository.NewEncryptionRepository(local, masterKey, previous...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	repotest.MustSave(t, encrypted(keyA), "abcdefghij", "docs/a.txt", plaintext)
+	stored := readStored(t, dir, "docs/a.txt")
+	if bytes.Contains(stored, []byte(plaintext)) {
+		t.Fatal("file stored in plaintext")
+	}
+
+	r := encrypted(keyB, keyA)
+	if n, err := r.RotateMasterKey(ctx); err != nil || n != 1 {
+		t.Fatalf("RotateMasterKey re-wrapped %d keys (%v), want 1", n, err)
+	}
+	if n, err := r.RotateMasterKey(ctx); err != nil || n != 0 {
+		t.Errorf("second RotateMasterKey re-wrapped %d keys (%v), want 0", n, err)
+	}
+
+	// Only the data key was re-wrapped: the content is untouched and still encrypted
+	if !bytes.Equal(readStored(t, dir, "docs/a.txt"), stored) {
+		t.Error("rotation rewrote the file content")
+	}
+	if got := repotest.MustRead(t, encrypted(keyB), "abcdefghij", "docs/a.txt"); got != plaintext {
+		t.Errorf("read %q with only the new master key, want the original content", got)
+	}
+	if _, err := encrypted(keyA).GetFile(ctx, "abcdefghij", "docs/a.txt"); err == nil {
+		t.Error("the retired master key still opens the storage")
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg := repository.Config{
+		Backend:        repository.BackendLocal,
+		LocalPath:      t.TempDir(),
+		Compression:    repository.CompressionGzip,
+		MasterKey:      bytes.Repeat([]byte{2}, 32),
+		Versioning:     true,
+		MaxVersions:    2,
+		TrashRetention: time.Nanosecond,
+		IndexPath:      filepath.Join(t.TempDir(), "index.db"),
+	}
+	repotest.RunVersioning(t, func(t *testing.T) repository.Repository {
+		cfg := cfg
+		cfg.LocalPath = t.TempDir()
+		cfg.IndexPath = filepath.Join(t.TempDir(), "index.db")
+		r, err := repository.New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	})
+
+	cfg.ConflictPolicy = repository.ConflictReject
+	if _, err := repository.New(cfg); err == nil {
+		t.Error("New accepted versioning with the reject conflict policy")
+	}
+
+	cas := repository.Config{Backend: repository.BackendCAS, LocalPath: t.TempDir(), MasterKey: cfg.MasterKey}
+	if _, err := repository.New(cas); err == nil {
+		t.Error("New accepted encryption on the content-addressed backend")
+	}
+	if _, err := repository.RotateMasterKey(context.Background(), cas); err == nil {
+		t.Error("RotateMasterKey accepted the content-addressed backend")
+	}
+}
+
+// The manifest records the type the content sniffs as; the name only refines text and unknown binaries
+func TestManifestContentType(t *testing.T) {
+	ctx := context.Background()
+	r, err := repository.NewManifestRepository(repository.NewMemoryRepository(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filename string
+		content  string
+		want     string
+	}{
+		{"photo.png", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png"},
+		{"photo.txt", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png"},
+		{"notes.txt", "hello", "text/plain; charset=utf-8"},
+		{"data.bin", "\x00\x01\x02\x03", "application/octet-stream"},
+
+		// Markup named as an image is recorded as markup, which the gateway never previews
+		{"evil.png", "<!DOCTYPE html><html><script>alert(1)</script></html>", "text/html; charset=utf-8"},
+		{"evil.png", "<?xml version=\"1.0\"?><svg onload=\"alert(1)\"/>", "text/xml; charset=utf-8"},
+		{"page.html", "hello", "text/html; charset=utf-8"},
+	} {
+		info, err := r.SaveFile(ctx, "abcdefghij", tc.filename, strings.NewReader(tc.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.ContentType != tc.want {
+			t.Errorf("%s holding %q recorded as %s, want %s", tc.filename, tc.content, info.ContentType, tc.want)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+// Package repotest provides a conformance suite that every repository.Repository
+// implementation must pass. Backends call Run from their own tests:
+//
+//	func TestLocalRepository(t *testing.T) {
+//		repotest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+//			r, err := repository.NewLocalRepository(t.TempDir(), opts...)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return r
+//		})
+//	}
+package repotest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// Storage IDs used throughout the suite
+const (
+	storageA = "aaaaaaaaaa"
+	storageB = "bbbbbbbbbb"
+	storageC = "cccccccccc"
+)
+
+// Factory returns a fresh, empty repository for a single subtest, built with opts
+// The suite closes the repository when the subtest finishes
+type Factory func(t *testing.T, opts ...repository.Option) repository.Repository
+
+// Run executes the full conformance suite against repositories produced by newRepo
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		opts []repository.Option
+		fn   func(t *testing.T, r repository.Repository)
+	}{
+		{"InvalidStorageID", nil, testInvalidStorageID},
+		{"SaveAndGet", nil, testSaveAndGet},
+		{"Overwrite", nil, testOverwrite},
+		{"GetMissing", nil, testGetMissing},
+		{"ListEmpty", nil, testListEmpty},
+		{"ListFiles", nil, testListFiles},
+		{"DeleteFile", nil, testDeleteFile},
+		{"DeleteStorage", nil, testDeleteStorage},
+		{"FailedWrite", nil, testFailedWrite},
+		{"StorageIsolation", nil, testStorageIsolation},
+		{"Concurrent", nil, testConcurrent},
+		{"NestedPaths", nil, testNestedPaths},
+		{"InvalidPaths", nil, testInvalidPaths},
+		{"Range", nil, testRange},
+		{"ListStorages", nil, testListStorages},
+		{"ConflictReject", []repository.Option{repository.WithConflictPolicy(repository.ConflictReject)}, testConflictReject},
+		{"ConflictRename", []repository.Option{repository.WithConflictPolicy(repository.ConflictRename)}, testConflictRename},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRepo(t, tt.opts...)
+			t.Cleanup(r.Close)
+			tt.fn(t, r)
+		})
+	}
+}
+
+// MustSave saves content and fails the test on error
+func MustSave(t *testing.T, r repository.Repository, storageID, filename, content string) {
+	t.Helper()
+	if _, err := r.SaveFile(context.Background(), storageID, filename, strings.NewReader(content)); err != nil {
+		t.Fatalf("SaveFile(%s, %s): %v", storageID, filename, err)
+	}
+}
+
+// MustRead reads a whole file and fails the test on error
+func MustRead(t *testing.T, r repository.Repository, storageID, filename string) string {
+	t.Helper()
+	rc, err := r.GetFile(context.Background(), storageID, filename)
+	if err != nil {
+		t.Fatalf("GetFile(%s, %s): %v", storageID, filename, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %s/%s: %v", storageID, filename, err)
+	}
+	return string(data)
+}
+
+func testInvalidStorageID(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	for _, id := range []string{"", "short", strings.Repeat("waytoolong", 7), "../abcdefg", "..abcdefgh"} {
+		if _, err := r.SaveFile(ctx, id, "a.txt", strings.NewReader("x")); !errors.Is(err, repository.ErrInvalidStorageID) {
+			t.Errorf("SaveFile(%q): got %v, want ErrInvalidStorageID", id, err)
+		}
+		if _, err := r.GetFile(ctx, id, "a.txt"); !errors.Is(err, repository.ErrInvalidStorageID) {
+			t.Errorf("GetFile(%q): got %v, want ErrInvalidStorageID", id, err)
+		}
+		if _, err := r.GetFilesByStorage(ctx, id); !errors.Is(err, repository.ErrInvalidStorageID) {
+			t.Errorf("GetFilesByStorage(%q): got %v, want ErrInvalidStorageID", id, err)
+		}
+		if err := r.DeleteFile(ctx, id, "a.txt"); !errors.Is(err, repository.ErrInvalidStorageID) {
+			t.Errorf("DeleteFile(%q): got %v, want ErrInvalidStorageID", id, err)
+		}
+		if err := r.DeleteStorage(ctx, id); !errors.Is(err, repository.ErrInvalidStorageID) {
+			t.Errorf("DeleteStorage(%q): got %v, want ErrInvalidStorageID", id, err)
+		}
+	}
+}
+
+func testSaveAndGet(t *testing.T, r repository.Repository) {
+	info, err := r.SaveFile(context.Background(), storageA, "hello.txt", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	if info.Filename != "hello.txt" || info.Path != "hello.txt" || info.Size != int64(len("hello world")) {
+		t.Errorf("SaveFile returned %+v, want hello.txt of size %d", info, len("hello world"))
+	}
+
+	if got := MustRead(t, r, storageA, "hello.txt"); got != "hello world" {
+		t.Errorf("content = %q, want %q", got, "hello world")
+	}
+
+	// Binary and empty content must round-trip unchanged
+	binary := string([]byte{0, 1, 2, 0xff, 0xfe})
+	MustSave(t, r, storageA, "bin.dat", binary)
+	if got := MustRead(t, r, storageA, "bin.dat"); got != binary {
+		t.Errorf("binary content = %v, want %v", []byte(got), []byte(binary))
+	}
+
+	MustSave(t, r, storageA, "empty.txt", "")
+	if got := MustRead(t, r, storageA, "empty.txt"); got != "" {
+		t.Errorf("empty content = %q, want empty", got)
+	}
+}
+
+func testOverwrite(t *testing.T, r repository.Repository) {
+	MustSave(t, r, storageA, "a.txt", "first version, longer")
+	MustSave(t, r, storageA, "a.txt", "second")
+
+	if got := MustRead(t, r, storageA, "a.txt"); got != "second" {
+		t.Errorf("content = %q, want %q", got, "second")
+	}
+
+	files, err := r.GetFilesByStorage(context.Background(), storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	if len(files) != 1 || files[0].Size != int64(len("second")) {
+		t.Errorf("files = %+v, want a single file of size %d", files, len("second"))
+	}
+}
+
+func testGetMissing(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+
+	// Missing storage
+	if _, err := r.GetFile(ctx, storageA, "nope.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile on missing storage: got %v, want ErrFileNotFound", err)
+	}
+
+	// Missing file in an existing storage
+	MustSave(t, r, storageA, "a.txt", "a")
+	if _, err := r.GetFile(ctx, storageA, "nope.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile on missing file: got %v, want ErrFileNotFound", err)
+	}
+}
+
+func testListEmpty(t *testing.T, r repository.Repository) {
+	files, err := r.GetFilesByStorage(context.Background(), storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage on missing storage: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files = %+v, want none", files)
+	}
+}
+
+func testListFiles(t *testing.T, r repository.Repository) {
+	MustSave(t, r, storageA, "b.txt", "bb")
+	MustSave(t, r, storageA, "a.txt", "a")
+	MustSave(t, r, storageA, "c.txt", "ccc")
+
+	files, err := r.GetFilesByStorage(context.Background(), storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+
+	want := []repository.FileInfo{
+		{Filename: "a.txt", Path: "a.txt", Size: 1},
+		{Filename: "b.txt", Path: "b.txt", Size: 2},
+		{Filename: "c.txt", Path: "c.txt", Size: 3},
+	}
+	assertFiles(t, files, want)
+}
+
+// assertFiles compares the Filename, Path and Size of a listing against want, including order
+// Metadata fields are optional for repositories and not compared
+func assertFiles(t *testing.T, files, want []repository.FileInfo) {
+	t.Helper()
+	if len(files) != len(want) {
+		t.Fatalf("files = %+v, want %+v", files, want)
+	}
+	for i := range want {
+		got := files[i]
+		if got.Filename != want[i].Filename || got.Path != want[i].Path || got.Size != want[i].Size {
+			t.Errorf("files[%d] = %+v, want %+v", i, files[i], want[i])
+		}
+	}
+}
+
+func testDeleteFile(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "a.txt", "a")
+	MustSave(t, r, storageA, "b.txt", "b")
+
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if _, err := r.GetFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile after delete: got %v, want ErrFileNotFound", err)
+	}
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("second DeleteFile: got %v, want ErrFileNotFound", err)
+	}
+	if got := MustRead(t, r, storageA, "b.txt"); got != "b" {
+		t.Errorf("sibling content = %q, want %q", got, "b")
+	}
+}
+
+func testDeleteStorage(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+
+	if err := r.DeleteStorage(ctx, storageA); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("DeleteStorage on missing storage: got %v, want ErrStorageNotFound", err)
+	}
+
+	MustSave(t, r, storageA, "a.txt", "a")
+	MustSave(t, r, storageA, "b.txt", "b")
+
+	if err := r.DeleteStorage(ctx, storageA); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+	files, err := r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage after delete: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files after delete = %+v, want none", files)
+	}
+	if _, err := r.GetFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile after DeleteStorage: got %v, want ErrFileNotFound", err)
+	}
+}
+
+// errReader fails after yielding some bytes, simulating a dropped upload
+type errReader struct {
+	sent bool
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	if !e.sent {
+		e.sent = true
+		return copy(p, "partial"), nil
+	}
+	return 0, errors.New("connection reset")
+}
+
+func testFailedWrite(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+
+	if _, err := r.SaveFile(ctx, storageA, "broken.txt", &errReader{}); err == nil {
+		t.Fatal("SaveFile with failing reader: got nil error")
+	}
+	if _, err := r.GetFile(ctx, storageA, "broken.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile after failed write: got %v, want ErrFileNotFound", err)
+	}
+
+	// A failed overwrite must leave the previous content intact
+	MustSave(t, r, storageA, "keep.txt", "original")
+	if _, err := r.SaveFile(ctx, storageA, "keep.txt", &errReader{}); err == nil {
+		t.Fatal("overwrite with failing reader: got nil error")
+	}
+	if got := MustRead(t, r, storageA, "keep.txt"); got != "original" {
+		t.Errorf("content after failed overwrite = %q, want %q", got, "original")
+	}
+
+	// No temporary files may leak into listings
+	files, err := r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	if len(files) != 1 || files[0].Filename != "keep.txt" {
+		t.Errorf("files = %+v, want only keep.txt", files)
+	}
+}
+
+func testStorageIsolation(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "same.txt", "from A")
+	MustSave(t, r, storageB, "same.txt", "from B")
+
+	if got := MustRead(t, r, storageA, "same.txt"); got != "from A" {
+		t.Errorf("storage A content = %q", got)
+	}
+	if got := MustRead(t, r, storageB, "same.txt"); got != "from B" {
+		t.Errorf("storage B content = %q", got)
+	}
+
+	if err := r.DeleteStorage(ctx, storageA); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+	if got := MustRead(t, r, storageB, "same.txt"); got != "from B" {
+		t.Errorf("storage B content after deleting A = %q", got)
+	}
+}
+
+func testConcurrent(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	const workers = 8
+	const rounds = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds*2)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("file-%d.txt", w)
+			for i := range rounds {
+				content := bytes.Repeat([]byte{byte('a' + w)}, 100+i)
+				if _, err := r.SaveFile(ctx, storageA, name, bytes.NewReader(content)); err != nil {
+					errs <- fmt.Errorf("save %s: %w", name, err)
+					return
+				}
+				rc, err := r.GetFile(ctx, storageA, name)
+				if err != nil {
+					errs <- fmt.Errorf("get %s: %w", name, err)
+					return
+				}
+				got, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					errs <- fmt.Errorf("read %s: %w", name, err)
+					return
+				}
+				if !bytes.Equal(got, content) {
+					errs <- fmt.Errorf("%s: read %d bytes, want %d", name, len(got), len(content))
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	files, err := r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	if len(files) != workers {
+		t.Errorf("got %d files, want %d", len(files), workers)
+	}
+}
+
+func testConflictReject(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "a.txt", "original")
+
+	if _, err := r.SaveFile(ctx, storageA, "a.txt", strings.NewReader("replacement")); !errors.Is(err, repository.ErrFileExists) {
+		t.Errorf("SaveFile over existing name: got %v, want ErrFileExists", err)
+	}
+	if got := MustRead(t, r, storageA, "a.txt"); got != "original" {
+		t.Errorf("content = %q, want %q", got, "original")
+	}
+
+	// The same name in another storage is not a conflict
+	MustSave(t, r, storageB, "a.txt", "other storage")
+}
+
+func testConflictRename(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+
+	tests := []struct {
+		filename string
+		content  string
+		want     string
+	}{
+		{"report.pdf", "v1", "report.pdf"},
+		{"report.pdf", "v2", "report (1).pdf"},
+		{"report.pdf", "v3", "report (2).pdf"},
+		{".env", "a", ".env"},
+		{".env", "b", ".env (1)"},
+		{"README", "a", "README"},
+		{"README", "b", "README (1)"},
+		{"docs/report.pdf", "a", "docs/report.pdf"},
+		{"docs/report.pdf", "b", "docs/report (1).pdf"},
+	}
+	for _, tt := range tests {
+		info, err := r.SaveFile(ctx, storageA, tt.filename, strings.NewReader(tt.content))
+		if err != nil {
+			t.Fatalf("SaveFile(%s): %v", tt.filename, err)
+		}
+		if info.Path != tt.want {
+			t.Errorf("SaveFile(%s) stored as %q, want %q", tt.filename, info.Path, tt.want)
+		}
+		if got := MustRead(t, r, storageA, info.Path); got != tt.content {
+			t.Errorf("content of %s = %q, want %q", info.Path, got, tt.content)
+		}
+	}
+}
+
+func testNestedPaths(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "docs/a.txt", "a")
+	MustSave(t, r, storageA, "docs/sub/b.txt", "bb")
+	MustSave(t, r, storageA, "docs.txt", "ccc")
+	MustSave(t, r, storageA, "z.txt", "dddd")
+
+	files, err := r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	assertFiles(t, files, []repository.FileInfo{
+		{Filename: "docs.txt", Path: "docs.txt", Size: 3},
+		{Filename: "a.txt", Path: "docs/a.txt", Size: 1},
+		{Filename: "b.txt", Path: "docs/sub/b.txt", Size: 2},
+		{Filename: "z.txt", Path: "z.txt", Size: 4},
+	})
+
+	if got := MustRead(t, r, storageA, "docs/sub/b.txt"); got != "bb" {
+		t.Errorf("content = %q, want %q", got, "bb")
+	}
+
+	// Folders are not files
+	if _, err := r.GetFile(ctx, storageA, "docs"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile on a folder: got %v, want ErrFileNotFound", err)
+	}
+	if _, err := r.GetFile(ctx, storageA, "docs/a.txt/x"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile below a file: got %v, want ErrFileNotFound", err)
+	}
+
+	// Deleting the last file of a folder removes the folder from listings
+	if err := r.DeleteFile(ctx, storageA, "docs/sub/b.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if err := r.DeleteFile(ctx, storageA, "docs/a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	files, err = r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	assertFiles(t, files, []repository.FileInfo{
+		{Filename: "docs.txt", Path: "docs.txt", Size: 3},
+		{Filename: "z.txt", Path: "z.txt", Size: 4},
+	})
+
+	// The folder can be recreated after it was emptied
+	MustSave(t, r, storageA, "docs/again.txt", "e")
+
+	// Nested files go with their storage
+	if err := r.DeleteStorage(ctx, storageA); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+	if _, err := r.GetFile(ctx, storageA, "docs/again.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile after DeleteStorage: got %v, want ErrFileNotFound", err)
+	}
+}
+
+func testInvalidPaths(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "ok.txt", "x")
+
+	invalid := []string{
+		"",
+		"/etc/passwd",
+		"../escape.txt",
+		"docs/../../escape.txt",
+		"docs/./a.txt",
+		"docs//a.txt",
+		"docs/",
+		".",
+		"..",
+		`docs\a.txt`,
+		".cthulhu/manifest.json",
+		"nul\x00byte",
+		strings.Repeat("a/", 600) + "a",
+	}
+	for _, name := range invalid {
+		if _, err := r.SaveFile(ctx, storageA, name, strings.NewReader("x")); !errors.Is(err, repository.ErrInvalidFilename) {
+			t.Errorf("SaveFile(%q): got %v, want ErrInvalidFilename", name, err)
+		}
+		if _, err := r.GetFile(ctx, storageA, name); !errors.Is(err, repository.ErrInvalidFilename) {
+			t.Errorf("GetFile(%q): got %v, want ErrInvalidFilename", name, err)
+		}
+		if err := r.DeleteFile(ctx, storageA, name); !errors.Is(err, repository.ErrInvalidFilename) {
+			t.Errorf("DeleteFile(%q): got %v, want ErrInvalidFilename", name, err)
+		}
+	}
+
+	files, err := r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	assertFiles(t, files, []repository.FileInfo{{Filename: "ok.txt", Path: "ok.txt", Size: 1}})
+}
+
+func testRange(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "digits.txt", "0123456789")
+	MustSave(t, r, storageA, "empty.txt", "")
+
+	cases := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 0, "0123456789"},
+		{0, -1, "0123456789"},
+		{2, 3, "234"},
+		{7, 0, "789"},
+		{8, 100, "89"},
+		{9, 1, "9"},
+	}
+	for _, tc := range cases {
+		fr, err := r.GetFileRange(ctx, storageA, "digits.txt", tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("GetFileRange(%d, %d): %v", tc.offset, tc.length, err)
+		}
+		data, err := io.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			t.Fatalf("reading range (%d, %d): %v", tc.offset, tc.length, err)
+		}
+		if string(data) != tc.want {
+			t.Errorf("range (%d, %d) = %q, want %q", tc.offset, tc.length, data, tc.want)
+		}
+		if fr.Offset != tc.offset || fr.Length != int64(len(tc.want)) || fr.Size != 10 {
+			t.Errorf("range (%d, %d): got offset %d, length %d, size %d", tc.offset, tc.length, fr.Offset, fr.Length, fr.Size)
+		}
+	}
+
+	fr, err := r.GetFileRange(ctx, storageA, "empty.txt", 0, 0)
+	if err != nil {
+		t.Fatalf("GetFileRange on empty file: %v", err)
+	}
+	if data, _ := io.ReadAll(fr); len(data) != 0 || fr.Size != 0 {
+		t.Errorf("range of empty file = %q, size %d", data, fr.Size)
+	}
+	fr.Close()
+
+	for _, offset := range []int64{-1, 10, 11} {
+		if _, err := r.GetFileRange(ctx, storageA, "digits.txt", offset, 0); !errors.Is(err, repository.ErrInvalidRange) {
+			t.Errorf("GetFileRange at offset %d: got %v, want ErrInvalidRange", offset, err)
+		}
+	}
+	if _, err := r.GetFileRange(ctx, storageA, "empty.txt", 1, 0); !errors.Is(err, repository.ErrInvalidRange) {
+		t.Errorf("GetFileRange past empty file: got %v, want ErrInvalidRange", err)
+	}
+	if _, err := r.GetFileRange(ctx, storageA, "nope.txt", 0, 0); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFileRange on missing file: got %v, want ErrFileNotFound", err)
+	}
+}
+
+func testListStorages(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+
+	page, err := r.ListStorages(ctx, "", 0)
+	if err != nil {
+		t.Fatalf("ListStorages on empty repository: %v", err)
+	}
+	if len(page.Storages) != 0 || page.Next != "" {
+		t.Fatalf("ListStorages on empty repository: got %+v, want no storages", page)
+	}
+
+	MustSave(t, r, storageC, "c.txt", "c")
+	MustSave(t, r, storageA, "a.txt", "hello")
+	MustSave(t, r, storageB, "one.txt", "1")
+	MustSave(t, r, storageB, "docs/two.txt", "22")
+
+	page, err = r.ListStorages(ctx, "", 2)
+	if err != nil {
+		t.Fatalf("ListStorages: %v", err)
+	}
+	if len(page.Storages) != 2 || page.Next != storageB {
+		t.Fatalf("first page: got %+v, want %s and %s with next %s", page, storageA, storageB, storageB)
+	}
+	want := []repository.StorageInfo{{ID: storageA, Files: 1, Size: 5}, {ID: storageB, Files: 2, Size: 3}}
+	for i, got := range page.Storages {
+		if got.ID != want[i].ID || got.Files != want[i].Files || got.Size != want[i].Size {
+			t.Errorf("storage %d: got %+v, want %+v", i, got, want[i])
+		}
+		if got.CreatedAt.IsZero() {
+			t.Errorf("storage %s: CreatedAt is zero", got.ID)
+		}
+	}
+
+	page, err = r.ListStorages(ctx, page.Next, 2)
+	if err != nil {
+		t.Fatalf("ListStorages(%s): %v", storageB, err)
+	}
+	if len(page.Storages) != 1 || page.Storages[0].ID != storageC || page.Next != "" {
+		t.Fatalf("last page: got %+v, want only %s", page, storageC)
+	}
+
+	if _, err := r.ListStorages(ctx, "../bad/id", 1); !errors.Is(err, repository.ErrInvalidStorageID) {
+		t.Errorf("ListStorages with invalid cursor: got %v, want ErrInvalidStorageID", err)
+	}
+
+	if err := r.DeleteStorage(ctx, storageB); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+	var ids []string
+	for storage, err := range repository.AllStorages(ctx, r, 1) {
+		if err != nil {
+			t.Fatalf("AllStorages: %v", err)
+		}
+		ids = append(ids, storage.ID)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint([]string{storageA, storageC}) {
+		t.Errorf("AllStorages after delete: got %v, want [%s %s]", ids, storageA, storageC)
+	}
+}
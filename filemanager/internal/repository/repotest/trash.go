@@ -0,0 +1,229 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// TrashFactory returns a fresh, empty repository implementing repository.Trash
+// whose retention is short enough that PurgeTrash removes everything in the trash
+type TrashFactory func(t *testing.T) repository.Repository
+
+// RunTrash executes the trash suite against repositories produced by newRepo
+func RunTrash(t *testing.T, newRepo TrashFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, r repository.Repository)
+	}{
+		{"RestoreFile", testRestoreFile},
+		{"RestoreNewest", testRestoreNewest},
+		{"RestoreConflict", testRestoreConflict},
+		{"RestoreStorage", testRestoreStorage},
+		{"PurgeTrash", testPurgeTrash},
+		{"TrashUsage", testTrashUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRepo(t)
+			t.Cleanup(r.Close)
+			if _, ok := r.(repository.Trash); !ok {
+				t.Fatalf("repository %T does not implement Trash", r)
+			}
+			tt.fn(t, r)
+		})
+	}
+}
+
+func testRestoreFile(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	trash := r.(repository.Trash)
+	MustSave(t, r, storageA, "docs/a.txt", "hello")
+	MustSave(t, r, storageA, "b.txt", "b")
+
+	if err := r.DeleteFile(ctx, storageA, "docs/a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if _, err := r.GetFile(ctx, storageA, "docs/a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile of a trashed file: got %v, want ErrFileNotFound", err)
+	}
+	files, err := r.GetFilesByStorage(ctx, storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "b.txt" {
+		t.Errorf("trashed files must not be listed: got %+v", files)
+	}
+
+	info, err := trash.RestoreFile(ctx, storageA, "docs/a.txt")
+	if err != nil {
+		t.Fatalf("RestoreFile: %v", err)
+	}
+	if info.Path != "docs/a.txt" || info.Size != 5 {
+		t.Errorf("RestoreFile: got %+v", info)
+	}
+	if got := MustRead(t, r, storageA, "docs/a.txt"); got != "hello" {
+		t.Errorf("restored content = %q, want %q", got, "hello")
+	}
+	if _, err := trash.RestoreFile(ctx, storageA, "docs/a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("restoring twice: got %v, want ErrFileNotFound", err)
+	}
+	if _, err := trash.RestoreFile(ctx, storageA, "never.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("restoring a file never deleted: got %v, want ErrFileNotFound", err)
+	}
+}
+
+func testRestoreNewest(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "a.txt", "first")
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	MustSave(t, r, storageA, "a.txt", "second")
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+
+	if _, err := r.(repository.Trash).RestoreFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("RestoreFile: %v", err)
+	}
+	if got := MustRead(t, r, storageA, "a.txt"); got != "second" {
+		t.Errorf("restored content = %q, want the newest deleted %q", got, "second")
+	}
+}
+
+func testRestoreConflict(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "a.txt", "old")
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	MustSave(t, r, storageA, "a.txt", "new")
+
+	if _, err := r.(repository.Trash).RestoreFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileExists) {
+		t.Errorf("restoring over a live file: got %v, want ErrFileExists", err)
+	}
+	if got := MustRead(t, r, storageA, "a.txt"); got != "new" {
+		t.Errorf("live content = %q, want %q", got, "new")
+	}
+}
+
+func testRestoreStorage(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	trash := r.(repository.Trash)
+	MustSave(t, r, storageA, "a.txt", "a")
+	MustSave(t, r, storageA, "dir/b.txt", "bb")
+	MustSave(t, r, storageB, "c.txt", "c")
+
+	if err := trash.RestoreStorage(ctx, storageA); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("restoring a live storage: got %v, want ErrStorageNotFound", err)
+	}
+	if err := r.DeleteStorage(ctx, storageA); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+	if err := r.DeleteStorage(ctx, storageA); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("deleting a trashed storage: got %v, want ErrStorageNotFound", err)
+	}
+	if _, err := r.GetFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile in a trashed storage: got %v, want ErrFileNotFound", err)
+	}
+	if files, err := r.GetFilesByStorage(ctx, storageA); err != nil || len(files) != 0 {
+		t.Errorf("GetFilesByStorage of a trashed storage: got %+v, %v", files, err)
+	}
+	if _, err := r.SaveFile(ctx, storageA, "new.txt", strings.NewReader("x")); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("SaveFile in a trashed storage: got %v, want ErrStorageNotFound", err)
+	}
+	page, err := r.ListStorages(ctx, "", 0)
+	if err != nil {
+		t.Fatalf("ListStorages: %v", err)
+	}
+	if len(page.Storages) != 1 || page.Storages[0].ID != storageB {
+		t.Errorf("ListStorages with a trashed storage: got %+v, want only %s", page.Storages, storageB)
+	}
+
+	if err := trash.RestoreStorage(ctx, storageA); err != nil {
+		t.Fatalf("RestoreStorage: %v", err)
+	}
+	if got := MustRead(t, r, storageA, "dir/b.txt"); got != "bb" {
+		t.Errorf("restored content = %q, want %q", got, "bb")
+	}
+	if files, err := r.GetFilesByStorage(ctx, storageA); err != nil || len(files) != 2 {
+		t.Errorf("GetFilesByStorage after restore: got %+v, %v", files, err)
+	}
+	if err := r.DeleteStorage(ctx, storageC); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("DeleteStorage on missing storage: got %v, want ErrStorageNotFound", err)
+	}
+}
+
+func testPurgeTrash(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	trash := r.(repository.Trash)
+	MustSave(t, r, storageA, "a.txt", "a")
+	MustSave(t, r, storageA, "keep.txt", "k")
+	MustSave(t, r, storageB, "b.txt", "b")
+
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if err := r.DeleteStorage(ctx, storageB); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+
+	n, err := trash.PurgeTrash(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("PurgeTrash: got %d, %v, want 2 purged", n, err)
+	}
+	if n, err := trash.PurgeTrash(ctx); err != nil || n != 0 {
+		t.Errorf("PurgeTrash again: got %d, %v, want nothing purged", n, err)
+	}
+
+	if _, err := trash.RestoreFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("restoring a purged file: got %v, want ErrFileNotFound", err)
+	}
+	if err := trash.RestoreStorage(ctx, storageB); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("restoring a purged storage: got %v, want ErrStorageNotFound", err)
+	}
+	if got := MustRead(t, r, storageA, "keep.txt"); got != "k" {
+		t.Errorf("live content after purge = %q, want %q", got, "k")
+	}
+
+	// A purged storage can be created again
+	MustSave(t, r, storageB, "b.txt", "again")
+	if got := MustRead(t, r, storageB, "b.txt"); got != "again" {
+		t.Errorf("content of a recreated storage = %q, want %q", got, "again")
+	}
+}
+
+func testTrashUsage(t *testing.T, r repository.Repository) {
+	reporter, ok := r.(repository.UsageReporter)
+	if !ok {
+		t.Skip("repository does not report usage")
+	}
+	ctx := context.Background()
+
+	MustSave(t, r, storageA, "a.txt", "12345")
+	MustSave(t, r, storageA, "b.txt", "123")
+	MustSave(t, r, storageB, "c.txt", "12")
+	if err := r.DeleteFile(ctx, storageA, "b.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if err := r.DeleteStorage(ctx, storageB); err != nil {
+		t.Fatalf("DeleteStorage: %v", err)
+	}
+
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if usage.Storages != 1 || usage.Files != 1 || usage.LogicalBytes != 5 {
+		t.Errorf("usage: got %d storages, %d files of %d bytes, want 1 storage and 1 file of 5 bytes",
+			usage.Storages, usage.Files, usage.LogicalBytes)
+	}
+	if usage.PhysicalBytes < 5+3+2 {
+		t.Errorf("physical bytes = %d, want trashed content counted until purged", usage.PhysicalBytes)
+	}
+}
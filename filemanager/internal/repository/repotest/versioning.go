@@ -0,0 +1,298 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// VersioningFactory returns a fresh, empty repository implementing repository.Versioner
+// that keeps at most two older versions per file
+type VersioningFactory func(t *testing.T) repository.Repository
+
+// RunVersioning executes the versioning suite against repositories produced by newRepo
+func RunVersioning(t *testing.T, newRepo VersioningFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, r repository.Repository)
+	}{
+		{"KeepVersions", testKeepVersions},
+		{"GetVersion", testGetVersion},
+		{"DeleteVersion", testDeleteVersion},
+		{"DeleteCurrentVersion", testDeleteCurrentVersion},
+		{"DeleteFileVersions", testDeleteFileVersions},
+		{"PruneVersions", testPruneVersions},
+		{"VersionUsage", testVersionUsage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRepo(t)
+			t.Cleanup(r.Close)
+			if _, ok := r.(repository.Versioner); !ok {
+				t.Fatalf("repository %T does not implement Versioner", r)
+			}
+			tt.fn(t, r)
+		})
+	}
+}
+
+// MustReadVersion reads a whole version of a file and fails the test on error
+func MustReadVersion(t *testing.T, r repository.Repository, storageID, filename string, version int) string {
+	t.Helper()
+	fr, err := r.(repository.Versioner).GetFileVersionRange(context.Background(), storageID, filename, version, 0, -1)
+	if err != nil {
+		t.Fatalf("GetFileVersionRange(%s, %s, %d): %v", storageID, filename, version, err)
+	}
+	defer fr.Close()
+
+	data, err := io.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("reading %s/%s version %d: %v", storageID, filename, version, err)
+	}
+	return string(data)
+}
+
+// mustListFile returns the listing of a single file
+func mustListFile(t *testing.T, r repository.Repository, storageID, filename string) repository.FileInfo {
+	t.Helper()
+	files, err := r.GetFilesByStorage(context.Background(), storageID)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	for _, file := range files {
+		if file.Path == filename {
+			return file
+		}
+	}
+	t.Fatalf("%s missing from %+v", filename, files)
+	return repository.FileInfo{}
+}
+
+// versionNumbers returns the numbers of a file's older versions, newest first
+func versionNumbers(file repository.FileInfo) []int {
+	numbers := make([]int, 0, len(file.Versions))
+	for _, v := range file.Versions {
+		numbers = append(numbers, v.Version)
+	}
+	return numbers
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testKeepVersions(t *testing.T, r repository.Repository) {
+	MustSave(t, r, storageA, "a.txt", "one")
+	MustSave(t, r, storageA, "other.txt", "x")
+
+	file := mustListFile(t, r, storageA, "a.txt")
+	if file.Version != 1 || len(file.Versions) != 0 {
+		t.Fatalf("first upload: got %+v, want version 1 without history", file)
+	}
+
+	info, err := r.SaveFile(context.Background(), storageA, "a.txt", strings.NewReader("second"))
+	if err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	if info.Version != 2 || !equalInts(versionNumbers(info), []int{1}) {
+		t.Errorf("SaveFile: got %+v, want version 2 keeping version 1", info)
+	}
+	MustSave(t, r, storageA, "a.txt", "third!")
+	MustSave(t, r, storageA, "a.txt", "fourth")
+
+	// The suite's repositories keep two older versions
+	file = mustListFile(t, r, storageA, "a.txt")
+	if file.Version != 4 || !equalInts(versionNumbers(file), []int{3, 2}) {
+		t.Fatalf("after overwrites: got version %d with %v, want 4 with [3 2]", file.Version, versionNumbers(file))
+	}
+	if file.Versions[0].Size != int64(len("third!")) || file.Versions[1].Size != int64(len("second")) {
+		t.Errorf("version sizes: got %+v", file.Versions)
+	}
+
+	files, err := r.GetFilesByStorage(context.Background(), storageA)
+	if err != nil {
+		t.Fatalf("GetFilesByStorage: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("older versions must not be listed as files: got %+v", files)
+	}
+	if got := MustRead(t, r, storageA, "a.txt"); got != "fourth" {
+		t.Errorf("current content = %q, want %q", got, "fourth")
+	}
+}
+
+func testGetVersion(t *testing.T, r repository.Repository) {
+	MustSave(t, r, storageA, "docs/a.txt", "first")
+	MustSave(t, r, storageA, "docs/a.txt", "second")
+
+	if got := MustReadVersion(t, r, storageA, "docs/a.txt", 1); got != "first" {
+		t.Errorf("version 1 = %q, want %q", got, "first")
+	}
+	if got := MustReadVersion(t, r, storageA, "docs/a.txt", 2); got != "second" {
+		t.Errorf("version 2 = %q, want %q", got, "second")
+	}
+
+	fr, err := r.(repository.Versioner).GetFileVersionRange(context.Background(), storageA, "docs/a.txt", 1, 1, 3)
+	if err != nil {
+		t.Fatalf("ranged read of version 1: %v", err)
+	}
+	data, _ := io.ReadAll(fr)
+	fr.Close()
+	if string(data) != "irs" || fr.Size != 5 {
+		t.Errorf("ranged read of version 1: got %q of %d bytes, want %q of 5", data, fr.Size, "irs")
+	}
+
+	_, err = r.(repository.Versioner).GetFileVersionRange(context.Background(), storageA, "docs/a.txt", 7, 0, -1)
+	if !errors.Is(err, repository.ErrVersionNotFound) {
+		t.Errorf("missing version: got %v, want ErrVersionNotFound", err)
+	}
+
+	// Older versions are only reachable through the Versioner interface
+	if _, err := r.GetFile(context.Background(), storageA, ".cthulhu/versions/1/docs/a.txt"); err == nil {
+		t.Errorf("GetFile on a version path succeeded")
+	}
+}
+
+func testDeleteVersion(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	v := r.(repository.Versioner)
+	MustSave(t, r, storageA, "a.txt", "1")
+	MustSave(t, r, storageA, "a.txt", "22")
+	MustSave(t, r, storageA, "a.txt", "333")
+
+	if err := v.DeleteFileVersion(ctx, storageA, "a.txt", 1); err != nil {
+		t.Fatalf("DeleteFileVersion: %v", err)
+	}
+	file := mustListFile(t, r, storageA, "a.txt")
+	if file.Version != 3 || !equalInts(versionNumbers(file), []int{2}) {
+		t.Errorf("after delete: got version %d with %v, want 3 with [2]", file.Version, versionNumbers(file))
+	}
+	if err := v.DeleteFileVersion(ctx, storageA, "a.txt", 1); !errors.Is(err, repository.ErrVersionNotFound) {
+		t.Errorf("deleting a deleted version: got %v, want ErrVersionNotFound", err)
+	}
+	if got := MustReadVersion(t, r, storageA, "a.txt", 2); got != "22" {
+		t.Errorf("version 2 = %q, want %q", got, "22")
+	}
+}
+
+func testDeleteCurrentVersion(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	v := r.(repository.Versioner)
+	MustSave(t, r, storageA, "a.txt", "first")
+	MustSave(t, r, storageA, "a.txt", "second")
+
+	// The newest older version takes the current one's place
+	if err := v.DeleteFileVersion(ctx, storageA, "a.txt", 2); err != nil {
+		t.Fatalf("DeleteFileVersion(current): %v", err)
+	}
+	if got := MustRead(t, r, storageA, "a.txt"); got != "first" {
+		t.Errorf("content after deleting the current version = %q, want %q", got, "first")
+	}
+	file := mustListFile(t, r, storageA, "a.txt")
+	if file.Version != 1 || len(file.Versions) != 0 {
+		t.Errorf("after restore: got %+v, want version 1 without history", file)
+	}
+
+	// The only version removes the file
+	if err := v.DeleteFileVersion(ctx, storageA, "a.txt", 1); err != nil {
+		t.Fatalf("DeleteFileVersion(last): %v", err)
+	}
+	if _, err := r.GetFile(ctx, storageA, "a.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile after deleting the last version: got %v, want ErrFileNotFound", err)
+	}
+}
+
+func testDeleteFileVersions(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	MustSave(t, r, storageA, "a.txt", "first")
+	MustSave(t, r, storageA, "a.txt", "second")
+
+	if err := r.DeleteFile(ctx, storageA, "a.txt"); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	_, err := r.(repository.Versioner).GetFileVersionRange(ctx, storageA, "a.txt", 1, 0, -1)
+	if !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("version of a deleted file: got %v, want ErrFileNotFound", err)
+	}
+
+	// A new upload under the same name starts a fresh history
+	MustSave(t, r, storageA, "a.txt", "again")
+	if file := mustListFile(t, r, storageA, "a.txt"); file.Version != 1 || len(file.Versions) != 0 {
+		t.Errorf("after re-upload: got %+v, want version 1 without history", file)
+	}
+}
+
+func testPruneVersions(t *testing.T, r repository.Repository) {
+	ctx := context.Background()
+	v := r.(repository.Versioner)
+	for _, content := range []string{"a1", "a2", "a3"} {
+		MustSave(t, r, storageA, "a.txt", content)
+	}
+	MustSave(t, r, storageA, "b.txt", "b1")
+	MustSave(t, r, storageA, "b.txt", "b2")
+
+	if _, err := v.PruneVersions(ctx, storageA, -1); err == nil {
+		t.Errorf("PruneVersions with a negative count succeeded")
+	}
+
+	n, err := v.PruneVersions(ctx, storageA, 1)
+	if err != nil || n != 1 {
+		t.Fatalf("PruneVersions(1): got %d, %v, want 1 pruned", n, err)
+	}
+	if file := mustListFile(t, r, storageA, "a.txt"); !equalInts(versionNumbers(file), []int{2}) {
+		t.Errorf("a.txt after pruning to 1: got %v, want [2]", versionNumbers(file))
+	}
+
+	n, err = v.PruneVersions(ctx, storageA, 0)
+	if err != nil || n != 2 {
+		t.Fatalf("PruneVersions(0): got %d, %v, want 2 pruned", n, err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if file := mustListFile(t, r, storageA, name); len(file.Versions) != 0 {
+			t.Errorf("%s after pruning everything: got %+v", name, file.Versions)
+		}
+	}
+	if got := MustRead(t, r, storageA, "a.txt"); got != "a3" {
+		t.Errorf("current content after pruning = %q, want %q", got, "a3")
+	}
+}
+
+func testVersionUsage(t *testing.T, r repository.Repository) {
+	reporter, ok := r.(repository.UsageReporter)
+	if !ok {
+		t.Skip("repository does not report usage")
+	}
+	ctx := context.Background()
+
+	MustSave(t, r, storageA, "a.txt", "12345")
+	MustSave(t, r, storageA, "a.txt", "123")
+
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		t.Fatalf("Usage: %v", err)
+	}
+	if usage.Files != 1 || usage.LogicalBytes != 8 {
+		t.Errorf("usage: got %d files of %d bytes, want 1 file and 8 bytes with its older version", usage.Files, usage.LogicalBytes)
+	}
+
+	page, err := r.ListStorages(ctx, "", 0)
+	if err != nil {
+		t.Fatalf("ListStorages: %v", err)
+	}
+	if len(page.Storages) != 1 || page.Storages[0].Files != 1 || page.Storages[0].Size != 8 {
+		t.Errorf("ListStorages: got %+v, want 1 file and 8 bytes", page.Storages)
+	}
+}
@@ -0,0 +1,453 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal S3 REST client covering the calls the repository needs
+// Requests are signed with AWS Signature Version 4 so any S3-compatible service works
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	http      *http.Client
+}
+
+const (
+	s3Service       = "s3"
+	s3TimeFormat    = "20060102T150405Z"
+	s3DateFormat    = "20060102"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySHA256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Errors for status codes callers map to repository errors
+var (
+	errS3NotFound           = errors.New("s3: not found")
+	errS3PreconditionFailed = errors.New("s3: precondition failed")
+	errS3InvalidRange       = errors.New("s3: range not satisfiable")
+)
+
+// s3Error is the XML error body returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+	NextContinuationToken string           `xml:"NextContinuationToken"`
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// do signs and sends a request, returning the response for 2xx statuses
+// Non-2xx responses are drained, closed and converted into errors
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// Send the path exactly as it is signed
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build s3 request: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = contentLength
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	payloadHash := emptySHA256
+	if body != nil {
+		payloadHash = unsignedPayload
+	}
+	c.sign(req, u.Path, payloadHash, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s request failed: %w", method, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, errS3NotFound
+	case http.StatusPreconditionFailed:
+		return nil, errS3PreconditionFailed
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, errS3InvalidRange
+	}
+
+	var s3Err s3Error
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, s3Err.Code, s3Err.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: unexpected status %d", method, key, resp.StatusCode)
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (c *s3Client) sign(req *http.Request, canonicalPath, payloadHash string, now time.Time) {
+	amzDate := now.Format(s3TimeFormat)
+	scope := strings.Join([]string{now.Format(s3DateFormat), c.region, s3Service, "aws4_request"}, "/")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(canonicalPath, false),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, s3Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes everything except unreserved characters, as SigV4 requires
+// When encodeSlash is false, '/' is kept so object keys keep their hierarchy
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9'),
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by key, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// conditionalHeader returns an If-None-Match header when the write must not replace an existing object
+func conditionalHeader(ifNoneMatch bool) http.Header {
+	if !ifNoneMatch {
+		return nil
+	}
+	return http.Header{"If-None-Match": {"*"}}
+}
+
+// putObject uploads an object in a single request
+// With ifNoneMatch set, S3 refuses to replace an existing object (errS3PreconditionFailed)
+func (c *s3Client) putObject(ctx context.Context, key string, data []byte, ifNoneMatch bool) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, conditionalHeader(ifNoneMatch), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// getObject streams an object; the caller must close the returned body
+func (c *s3Client) getObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// getObjectRange downloads length bytes of an object from offset with a ranged GET
+// length <= 0 reads to the end. It also returns the size of the whole object.
+func (c *s3Client) getObjectRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, int64, error) {
+	spec := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		spec += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := c.do(ctx, http.MethodGet, key, nil, http.Header{"Range": {spec}}, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		// The whole object was returned, e.g. by a server ignoring Range
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("failed to skip to offset: %w", err)
+		}
+		return resp.Body, resp.ContentLength, nil
+	}
+
+	// Content-Range: bytes <first>-<last>/<size>
+	_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("invalid s3 Content-Range: %q", resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, size, nil
+}
+
+// headObject checks that an object exists and returns its size
+func (c *s3Client) headObject(ctx context.Context, key string) (int64, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// deleteObject removes an object; S3 reports success even if it did not exist
+func (c *s3Client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listObjects returns every object under prefix, following continuation tokens
+func (c *s3Client) listObjects(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode s3 listing: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// listFolders returns, in order, up to max folder names directly under prefix whose
+// keys sort after startAfter, and whether more remain. Keys outside folders are ignored.
+func (c *s3Client) listFolders(ctx context.Context, prefix, startAfter string, max int) ([]string, bool, error) {
+	var folders []string
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		query.Set("delimiter", "/")
+		query.Set("max-keys", strconv.Itoa(max-len(folders)))
+		if token != "" {
+			query.Set("continuation-token", token)
+		} else if startAfter != "" {
+			query.Set("start-after", startAfter)
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to decode s3 listing: %w", err)
+		}
+
+		for _, p := range result.CommonPrefixes {
+			folders = append(folders, strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"))
+		}
+		more := result.IsTruncated && result.NextContinuationToken != ""
+		if !more || len(folders) >= max {
+			return folders, more, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// createMultipartUpload starts a multipart upload and returns its upload ID
+func (c *s3Client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+
+	resp, err := c.do(ctx, http.MethodPost, key, query, nil, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode multipart upload response: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("s3 returned an empty upload ID")
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads one part and returns its ETag
+func (c *s3Client) uploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(partNumber))
+	query.Set("uploadId", uploadID)
+
+	resp, err := c.do(ctx, http.MethodPut, key, query, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// completeMultipartUpload assembles the uploaded parts into the final object
+// With ifNoneMatch set, S3 refuses to replace an existing object (errS3PreconditionFailed)
+func (c *s3Client) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []completedPart, ifNoneMatch bool) error {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("failed to encode multipart completion: %w", err)
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, key, query, conditionalHeader(ifNoneMatch), bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 can report a failure inside a 200 response, so check the body for an error document
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read multipart completion response: %w", err)
+	}
+	var s3Err s3Error
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3 complete multipart upload %s: %s: %s", key, s3Err.Code, s3Err.Message)
+	}
+	return nil
+}
+
+// abortMultipartUpload discards an unfinished multipart upload and its parts
+func (c *s3Client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+
+	resp, err := c.do(ctx, http.MethodDelete, key, query, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,479 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultS3PartSize is the multipart part size used when S3Config.PartSize is unset
+// Files smaller than one part are uploaded with a single PUT
+const DefaultS3PartSize = 8 * 1024 * 1024 // 8MB
+
+// S3Config holds connection settings for an S3-compatible object store
+type S3Config struct {
+	Endpoint     string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region       string
+	Bucket       string
+	Prefix       string // Optional key prefix; each storage ID lives under <prefix>/<storageID>/
+	AccessKey    string
+	SecretKey    string
+	UsePathStyle bool  // Address the bucket as /<bucket>/<key> instead of <bucket>.<host>/<key>
+	PartSize     int64 // Multipart part size in bytes (S3 requires at least 5MB)
+	HTTPClient   *http.Client
+}
+
+type s3Repository struct {
+	client   *s3Client
+	prefix   string
+	partSize int64
+	opts     options
+}
+
+// NewS3Repository creates a new S3-backed file repository instance
+// Objects are stored at <bucket>/<prefix>/<storageID>/<relative file path>
+func NewS3Repository(cfg S3Config, opts ...Option) (*s3Repository, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("s3 endpoint is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", cfg.Endpoint)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	partSize := cfg.PartSize
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+
+	r := &s3Repository{
+		client: &s3Client{
+			endpoint:  endpoint,
+			region:    region,
+			bucket:    cfg.Bucket,
+			accessKey: cfg.AccessKey,
+			secretKey: cfg.SecretKey,
+			pathStyle: cfg.UsePathStyle,
+			http:      httpClient,
+		},
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		partSize: partSize,
+		opts:     newOptions(opts),
+	}
+	return r, nil
+}
+
+// Close implements the Repository interface
+// Releases idle HTTP connections held by the client
+func (r *s3Repository) Close() {
+	r.client.http.CloseIdleConnections()
+}
+
+// storagePrefix returns the key prefix for all objects in a storage, ending in '/'
+func (r *s3Repository) storagePrefix(storageID string) string {
+	if r.prefix == "" {
+		return storageID + "/"
+	}
+	return r.prefix + "/" + storageID + "/"
+}
+
+// objectKey returns the key of a single file
+func (r *s3Repository) objectKey(storageID, filename string) string {
+	return r.storagePrefix(storageID) + filename
+}
+
+// SaveFile uploads a file to the storage ID prefix
+// Content larger than one part is sent as a multipart upload so it is never fully buffered.
+// Under the reject and rename policies the write is conditional (If-None-Match), so a
+// concurrent upload of the same name fails with ErrFileExists instead of being replaced.
+func (r *s3Repository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return FileInfo{}, err
+	}
+
+	finalName, err := resolveFilename(r.opts.conflictPolicy, filename, func(name string) (bool, error) {
+		_, err := r.client.headObject(ctx, r.objectKey(storageID, name))
+		if errors.Is(err, errS3NotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	key := r.objectKey(storageID, finalName)
+	conditional := r.opts.conflictPolicy != ConflictOverwrite
+	buf := make([]byte, r.partSize)
+
+	// Small files fit in the first part and go up in a single PUT
+	var size int64
+	n, err := io.ReadFull(content, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		size = int64(n)
+		err = r.client.putObject(ctx, key, buf[:n], conditional)
+	case err == nil:
+		size, err = r.saveMultipart(ctx, key, buf, content, conditional)
+	}
+
+	if errors.Is(err, errS3PreconditionFailed) {
+		return FileInfo{}, fmt.Errorf("%w: %s", ErrFileExists, finalName)
+	}
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to write file content: %w", err)
+	}
+
+	return newFileInfo(finalName, size), nil
+}
+
+// saveMultipart uploads first (a full part already read) followed by the rest of content
+// The upload is aborted on any error so no orphaned parts are left behind
+// Returns the total number of bytes uploaded
+func (r *s3Repository) saveMultipart(ctx context.Context, key string, first []byte, content io.Reader, conditional bool) (int64, error) {
+	uploadID, err := r.client.createMultipartUpload(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var parts []completedPart
+	var size int64
+	upload := func(data []byte) error {
+		partNumber := len(parts) + 1
+		etag, err := r.client.uploadPart(ctx, key, uploadID, partNumber, data)
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+		}
+		parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+		size += int64(len(data))
+		return nil
+	}
+
+	err = upload(first)
+	for err == nil {
+		// The buffer is reused: uploadPart has finished sending it before returning
+		n, readErr := io.ReadFull(content, first)
+		if n > 0 {
+			err = upload(first[:n])
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil && err == nil {
+			err = readErr
+		}
+	}
+	if err == nil {
+		err = r.client.completeMultipartUpload(ctx, key, uploadID, parts, conditional)
+	}
+
+	if err != nil {
+		// Use a fresh context so a cancelled upload can still be cleaned up
+		if abortErr := r.client.abortMultipartUpload(context.Background(), key, uploadID); abortErr != nil {
+			return 0, fmt.Errorf("%w (abort failed: %v)", err, abortErr)
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+// GetFile streams a file by storage ID and filename
+// Returns a ReadCloser that must be closed by the caller
+func (r *s3Repository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return nil, err
+	}
+
+	body, err := r.client.getObject(ctx, r.objectKey(storageID, filename))
+	if errors.Is(err, errS3NotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return body, nil
+}
+
+// GetFileRange downloads only the requested range with a ranged GET
+func (r *s3Repository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("%w: negative offset %d", ErrInvalidRange, offset)
+	}
+
+	key := r.objectKey(storageID, filename)
+	body, size, err := r.client.getObjectRange(ctx, key, offset, length)
+	if errors.Is(err, errS3InvalidRange) {
+		// S3 can't satisfy any range of an empty object, which still has a valid empty range
+		size, err = r.client.headObject(ctx, key)
+		if err == nil {
+			if _, err := checkRange(offset, length, size); err != nil {
+				return nil, err
+			}
+			return newFileRange(io.NopCloser(strings.NewReader("")), offset, 0, size), nil
+		}
+	}
+	if errors.Is(err, errS3NotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	length, err = checkRange(offset, length, size)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return newFileRange(body, offset, length, size), nil
+}
+
+// GetFilesByStorage retrieves all files under a storage prefix
+// Nested keys are files in folders; S3 lists keys in the same byte order as sortFileInfos
+func (r *s3Repository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+
+	prefix := r.storagePrefix(storageID)
+	objects, err := r.client.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+
+	files := []FileInfo{}
+	for _, obj := range objects {
+		name := strings.TrimPrefix(obj.Key, prefix)
+		// Skip keys written by other tools that no backend could address
+		if validateFilePath(name) != nil {
+			continue
+		}
+		files = append(files, newFileInfo(name, obj.Size))
+	}
+
+	return files, nil
+}
+
+// DeleteFile deletes a specific file from a storage prefix
+func (r *s3Repository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+	if err := validatePath(ctx, filename); err != nil {
+		return err
+	}
+
+	key := r.objectKey(storageID, filename)
+
+	// S3 deletes are idempotent, so check existence first to report missing files
+	if _, err := r.client.headObject(ctx, key); err != nil {
+		if errors.Is(err, errS3NotFound) {
+			return fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+		}
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	if err := r.client.deleteObject(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteStorage deletes every object under a storage prefix
+// Object stores have no empty folders, so a storage with no objects is reported as not found
+func (r *s3Repository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	objects, err := r.client.listObjects(ctx, r.storagePrefix(storageID))
+	if err != nil {
+		return fmt.Errorf("failed to list storage: %w", err)
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+
+	for _, obj := range objects {
+		if err := r.client.deleteObject(ctx, obj.Key); err != nil {
+			return fmt.Errorf("failed to delete storage folder: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// metadataKey returns the key of a metadata document of a storage
+func (r *s3Repository) metadataKey(storageID, name string) string {
+	return r.storagePrefix(storageID) + metaDirName + "/" + metadataFilename(name)
+}
+
+// readMetadata implements metadataStore
+func (r *s3Repository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	body, err := r.client.getObject(ctx, r.metadataKey(storageID, name))
+	if errors.Is(err, errS3NotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// writeMetadata implements metadataStore
+// A single PUT replaces the object atomically
+func (r *s3Repository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return r.client.putObject(ctx, r.metadataKey(storageID, name), data, false)
+}
+
+// listStorageIDs implements storageLister
+// Object stores have no folders, so every key under the prefix is listed
+func (r *s3Repository) listStorageIDs(ctx context.Context) ([]string, error) {
+	prefix := ""
+	if r.prefix != "" {
+		prefix = r.prefix + "/"
+	}
+	objects, err := r.client.listObjects(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	var ids []string
+	for _, obj := range objects {
+		storageID, _, found := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		// Keys are sorted, so each storage's keys are contiguous
+		if found && (len(ids) == 0 || ids[len(ids)-1] != storageID) {
+			ids = append(ids, storageID)
+		}
+	}
+	return ids, nil
+}
+
+// ListStorages lists storage folders with a delimiter, so a page never reads the keys of
+// storages outside it
+func (r *s3Repository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	limit, err := checkStoragePage(cursor, limit)
+	if err != nil {
+		return StoragePage{}, err
+	}
+
+	prefix := ""
+	if r.prefix != "" {
+		prefix = r.prefix + "/"
+	}
+
+	var ids []string
+	after := cursor
+	for {
+		startAfter := ""
+		if after != "" {
+			startAfter = prefix + after + "/"
+		}
+		// The folder at startAfter is listed again since its keys sort after it
+		folders, more, err := r.client.listFolders(ctx, prefix, startAfter, limit+2-len(ids))
+		if err != nil {
+			return StoragePage{}, fmt.Errorf("failed to list storages: %w", err)
+		}
+		for _, folder := range folders {
+			// Skip folders written by other tools that no storage ID could address
+			if folder > after && validateStorageID(folder) == nil {
+				ids = append(ids, folder)
+			}
+		}
+		if len(ids) > limit {
+			return describeStorages(ctx, ids[:limit], true, r.describeStorage)
+		}
+		if !more || len(folders) == 0 {
+			return describeStorages(ctx, ids, false, r.describeStorage)
+		}
+		after = folders[len(folders)-1]
+	}
+}
+
+// describeStorage sums a storage's files and dates it by its oldest object
+func (r *s3Repository) describeStorage(ctx context.Context, storageID string) (StorageInfo, error) {
+	prefix := r.storagePrefix(storageID)
+	objects, err := r.client.listObjects(ctx, prefix)
+	if err != nil {
+		return StorageInfo{}, fmt.Errorf("failed to list storage: %w", err)
+	}
+
+	storage := StorageInfo{ID: storageID}
+	for _, obj := range objects {
+		if storage.CreatedAt.IsZero() || obj.LastModified.Before(storage.CreatedAt) {
+			storage.CreatedAt = obj.LastModified
+		}
+		if validateFilePath(strings.TrimPrefix(obj.Key, prefix)) != nil {
+			continue // Metadata or foreign keys are not files
+		}
+		storage.Files++
+		storage.Size += obj.Size
+	}
+	return storage, nil
+}
+
+// Usage lists every object under the configured prefix and sums their sizes
+func (r *s3Repository) Usage(ctx context.Context) (Usage, error) {
+	var usage Usage
+
+	prefix := ""
+	if r.prefix != "" {
+		prefix = r.prefix + "/"
+	}
+	objects, err := r.client.listObjects(ctx, prefix)
+	if err != nil {
+		return usage, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	storages := make(map[string]bool)
+	for _, obj := range objects {
+		storageID, name, found := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+		if !found {
+			continue // Not inside a storage
+		}
+		storages[storageID] = true
+		if isReservedPath(name) {
+			usage.PhysicalBytes += obj.Size
+			continue
+		}
+		if validateFilePath(name) != nil {
+			continue // Metadata or foreign keys are not files
+		}
+		usage.Files++
+		usage.LogicalBytes += obj.Size
+	}
+	usage.Storages = len(storages)
+	usage.PhysicalBytes += usage.LogicalBytes
+
+	return usage, nil
+}
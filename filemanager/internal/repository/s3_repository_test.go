@@ -0,0 +1,166 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository/repotest"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository/s3test"
+)
+
+// newS3Repository creates an S3 repository on a fake server listing two keys per page
+// Parts are small enough that most files of the suite are uploaded in several parts.
+func newS3Repository(t *testing.T, partSize int64, opts ...repository.Option) (repository.Repository, *s3test.Server) {
+	t.Helper()
+	srv := s3test.NewServer("cthulhu")
+	srv.MaxKeys = 2
+	t.Cleanup(srv.Close)
+
+	r, err := repository.NewS3Repository(repository.S3Config{
+		Endpoint:     srv.URL,
+		Bucket:       "cthulhu",
+		Prefix:       "shares",
+		UsePathStyle: true,
+		PartSize:     partSize,
+	}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, srv
+}
+
+func TestS3Repository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, opts ...repository.Option) repository.Repository {
+		r, _ := newS3Repository(t, 8, opts...)
+		return r
+	})
+}
+
+func TestS3Multipart(t *testing.T) {
+	ctx := context.Background()
+	r, srv := newS3Repository(t, 10, repository.WithConflictPolicy(repository.ConflictRename))
+	defer r.Close()
+
+	data := strings.Repeat("0123456789", 5) + "xyz"
+	repotest.MustSave(t, r, "abcdefghij", "big file.bin", data)
+	if got := srv.Requests("UploadPart"); got != 6 {
+		t.Errorf("uploaded %d parts, want 6", got)
+	}
+
+	// A conflicting multipart upload is renamed like a single PUT
+	info, err := r.SaveFile(ctx, "abcdefghij", "big file.bin", strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != "big file (1).bin" || info.Size != int64(len(data)) {
+		t.Errorf("got %+v, want big file (1).bin of %d bytes", info, len(data))
+	}
+	if got := repotest.MustRead(t, r, "abcdefghij", "big file (1).bin"); got != data {
+		t.Errorf("read %q, want %q", got, data)
+	}
+
+	// Ranges spanning parts read across their boundary
+	fileRange, err := r.GetFileRange(ctx, "abcdefghij", "big file.bin", 8, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := io.ReadAll(fileRange)
+	fileRange.Close()
+	if err != nil || string(part) != data[8:23] {
+		t.Errorf("range read %q (%v), want %q", part, err, data[8:23])
+	}
+
+	if srv.PendingUploads() != 0 {
+		t.Errorf("%d multipart uploads left open", srv.PendingUploads())
+	}
+}
+
+// The S3 backend can't rename objects, so the trash copies deleted files instead
+func TestS3Trash(t *testing.T) {
+	repotest.RunTrash(t, func(t *testing.T) repository.Repository {
+		r, _ := newS3Repository(t, 8)
+		trash, err := repository.NewTrashRepository(r, time.Nanosecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return trash
+	})
+}
+
+// failingReader returns its data, then an error
+type failingReader struct {
+	data string
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.data == "" {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestS3MultipartAbort(t *testing.T) {
+	r, srv := newS3Repository(t, 10)
+	defer r.Close()
+
+	_, err := r.SaveFile(context.Background(), "abcdefghij", "broken.bin", &failingReader{data: strings.Repeat("x", 35)})
+	if err == nil {
+		t.Fatal("SaveFile succeeded with a failing reader")
+	}
+	if srv.PendingUploads() != 0 {
+		t.Errorf("%d multipart uploads left open after a failed write", srv.PendingUploads())
+	}
+	if keys := srv.Keys(); len(keys) != 0 {
+		t.Errorf("failed write left objects %v", keys)
+	}
+}
+
+func TestS3ListStorages(t *testing.T) {
+	ctx := context.Background()
+	r, srv := newS3Repository(t, repository.DefaultS3PartSize)
+	defer r.Close()
+
+	var want []string
+	for i := range 9 {
+		id := fmt.Sprintf("storage%03d", i)
+		want = append(want, id)
+		repotest.MustSave(t, r, id, "a.txt", strings.Repeat("x", i))
+		repotest.MustSave(t, r, id, "docs/b.txt", "y")
+	}
+
+	// Pages of the repository and of the bucket listing don't line up
+	var got []string
+	for storage, err := range repository.AllStorages(ctx, r, 4) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, storage.ID)
+		var i int
+		fmt.Sscanf(storage.ID, "storage%d", &i)
+		if storage.Files != 2 || storage.Size != int64(i+1) {
+			t.Errorf("storage %s: %d files of %d bytes, want 2 files of %d bytes", storage.ID, storage.Files, storage.Size, i+1)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+	if srv.Requests("ListObjectsV2") < 2 {
+		t.Error("listing did not follow continuation tokens")
+	}
+
+	page, err := r.ListStorages(ctx, want[6], 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Storages) != 2 || page.Next != "" {
+		t.Errorf("page after %s: %d storages, next %q; want the last 2 and no next", want[6], len(page.Storages), page.Next)
+	}
+}
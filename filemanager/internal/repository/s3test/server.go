@@ -0,0 +1,447 @@
+// Package s3test provides an in-memory, httptest-based fake of the S3 REST API
+// It implements the subset used by the S3 repository (path-style addressing):
+// PutObject, GetObject (including single byte ranges), HeadObject, DeleteObject,
+// ListObjectsV2 (including delimiters) and multipart uploads, including conditional writes with If-None-Match: *.
+package s3test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake S3 endpoint backed by memory
+type Server struct {
+	*httptest.Server
+
+	// MaxKeys caps the number of keys per listing page so pagination can be exercised
+	MaxKeys int
+
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	uploads  map[string]*multipartUpload
+	nextID   int
+	requests map[string]int
+}
+
+type multipartUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// NewServer starts a fake S3 server hosting a single bucket
+// The caller must Close it when done
+func NewServer(bucket string) *Server {
+	s := &Server{
+		MaxKeys:  1000,
+		bucket:   bucket,
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]*multipartUpload),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Object returns the stored bytes for key and whether it exists
+func (s *Server) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+// Keys returns all stored object keys in sorted order
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PendingUploads returns the number of multipart uploads neither completed nor aborted
+func (s *Server) PendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// Requests returns how many times an operation was called
+// Operations: PutObject, GetObject, HeadObject, DeleteObject, ListObjectsV2,
+// CreateMultipartUpload, UploadPart, CompleteMultipartUpload, AbortMultipartUpload
+func (s *Server) Requests(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) count(operation string) {
+	s.mu.Lock()
+	s.requests[operation]++
+	s.mu.Unlock()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") || r.Header.Get("x-amz-date") == "" {
+		writeError(w, http.StatusForbidden, "AccessDenied", "request is not signed")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "the specified bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.listObjects(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		s.abortMultipartUpload(w, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, key)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		s.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		s.deleteObject(w, key)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "operation not supported by fake")
+	}
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	s.count("PutObject")
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	_, exists := s.objects[key]
+	if exists && r.Header.Get("If-None-Match") == "*" {
+		s.mu.Unlock()
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "at least one of the preconditions did not hold")
+		return
+	}
+	s.objects[key] = data
+	s.mu.Unlock()
+
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Method == http.MethodHead {
+		s.count("HeadObject")
+	} else {
+		s.count("GetObject")
+	}
+
+	s.mu.Lock()
+	data, ok := s.objects[key]
+	s.mu.Unlock()
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+		return
+	}
+
+	w.Header().Set("ETag", etag(data))
+	if spec := r.Header.Get("Range"); spec != "" && r.Method == http.MethodGet {
+		first, last, ok := parseRange(spec, len(data))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "the requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(last-first+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[first : last+1])
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// parseRange parses a single "bytes=first-[last]" range against an object of size bytes
+// Like S3, a range starting past the last byte is not satisfiable.
+func parseRange(spec string, size int) (int, int, bool) {
+	from, to, ok := strings.Cut(strings.TrimPrefix(spec, "bytes="), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	first, err := strconv.Atoi(from)
+	if err != nil || first >= size {
+		return 0, 0, false
+	}
+	last := size - 1
+	if to != "" {
+		if last, err = strconv.Atoi(to); err != nil || last < first {
+			return 0, 0, false
+		}
+		last = min(last, size-1)
+	}
+	return first, last, true
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, key string) {
+	s.count("DeleteObject")
+	s.mu.Lock()
+	delete(s.objects, key)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type listObject struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []listObject   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+}
+
+// listObjects implements ListObjectsV2, including delimiter, start-after and max-keys
+// Keys sharing a prefix up to the delimiter are rolled up into one CommonPrefixes entry,
+// which counts as a single key towards max-keys.
+func (s *Server) listObjects(w http.ResponseWriter, query map[string][]string) {
+	s.count("ListObjectsV2")
+	prefix := first(query["prefix"])
+	delimiter := first(query["delimiter"])
+	after := first(query["continuation-token"])
+	if after == "" {
+		after = first(query["start-after"])
+	}
+	maxKeys := s.MaxKeys
+	if n, err := strconv.Atoi(first(query["max-keys"])); err == nil && n >= 0 && n < maxKeys {
+		maxKeys = n
+	}
+
+	s.mu.Lock()
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: s.bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	last := ""
+	for _, k := range keys {
+		rolled := ""
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				rolled = k[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		// Further keys of the last common prefix add nothing
+		if rolled != "" && len(result.CommonPrefixes) > 0 && result.CommonPrefixes[len(result.CommonPrefixes)-1].Prefix == rolled {
+			last = k
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if rolled != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: rolled})
+		} else {
+			result.Contents = append(result.Contents, listObject{
+				Key:          k,
+				Size:         int64(len(s.objects[k])),
+				LastModified: time.Now().UTC(),
+			})
+		}
+		result.KeyCount++
+		last = k
+	}
+	s.mu.Unlock()
+
+	writeXML(w, result)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, key string) {
+	s.count("CreateMultipartUpload")
+	s.mu.Lock()
+	s.nextID++
+	uploadID := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[uploadID] = &multipartUpload{key: key, parts: make(map[int][]byte)}
+	s.mu.Unlock()
+
+	writeXML(w, initiateMultipartUploadResult{Bucket: s.bucket, Key: key, UploadID: uploadID})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, uploadID, partNumber string) {
+	s.count("UploadPart")
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	upload, ok := s.uploads[uploadID]
+	if ok {
+		upload.parts[n] = data
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) {
+	s.count("CompleteMultipartUpload")
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[uploadID]
+	if !ok || upload.key != key {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+		return
+	}
+
+	if _, exists := s.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "at least one of the preconditions did not hold")
+		return
+	}
+
+	var data []byte
+	for i, part := range req.Parts {
+		if part.PartNumber != i+1 {
+			writeError(w, http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+			return
+		}
+		content, ok := upload.parts[part.PartNumber]
+		if !ok || etag(content) != part.ETag {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d not found", part.PartNumber))
+			return
+		}
+		data = append(data, content...)
+	}
+
+	s.objects[key] = data
+	delete(s.uploads, uploadID)
+
+	writeXML(w, completeMultipartUploadResult{Bucket: s.bucket, Key: key})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, uploadID string) {
+	s.count("AbortMultipartUpload")
+	s.mu.Lock()
+	delete(s.uploads, uploadID)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// etag mimics S3's quoted ETag; a length+checksum is enough for the fake
+func etag(data []byte) string {
+	var sum uint32
+	for _, b := range data {
+		sum = sum*31 + uint32(b)
+	}
+	return fmt.Sprintf("\"%d-%08x\"", len(data), sum)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// shardDir returns where a storage lives under base, e.g. base/ab/cd/abcd123456
+// Two levels of two-character folders keep every directory small even with
+// millions of storages. validateStorageID guarantees the ID is a safe path segment.
+func shardDir(base, storageID string) string {
+	return filepath.Join(base, storageID[:2], storageID[2:4], storageID)
+}
+
+// mkdirAll creates dir and its parents
+// A concurrent delete may prune a shard folder that just became empty, so a
+// missing parent is recreated a few times.
+func mkdirAll(dir string) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = os.MkdirAll(dir, 0755); !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// migrateFlatLayout moves storages kept directly under base into their shard folders
+// Each storage is moved with a single rename, so an interrupted migration simply
+// continues on the next start. Returns the number of storages moved.
+func migrateFlatLayout(base string) (int, error) {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read base directory: %w", err)
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		// Shard folders have two characters, so they are never mistaken for a storage
+		if !entry.IsDir() || validateStorageID(entry.Name()) != nil {
+			continue
+		}
+
+		target := shardDir(base, entry.Name())
+		if _, err := os.Stat(target); err == nil {
+			log.Printf("Not migrating storage %s: %s already exists", entry.Name(), target)
+			continue
+		}
+		if err := mkdirAll(filepath.Dir(target)); err != nil {
+			return moved, fmt.Errorf("failed to create shard directory: %w", err)
+		}
+		if err := os.Rename(filepath.Join(base, entry.Name()), target); err != nil {
+			return moved, fmt.Errorf("failed to migrate storage %s: %w", entry.Name(), err)
+		}
+		moved++
+	}
+
+	if moved > 0 {
+		syncDir(base)
+		log.Printf("Migrated %d storage(s) under %s to the sharded layout", moved, base)
+	}
+	return moved, nil
+}
+
+// shardedStorageIDs returns, in order, up to limit storage IDs under base that sort
+// after cursor, and whether more remain. limit < 0 returns every ID.
+// Shard folders before the cursor are skipped without being read.
+func shardedStorageIDs(base, cursor string, limit int) ([]string, bool, error) {
+	var ids []string
+
+	first, err := readDirNames(base)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read base directory: %w", err)
+	}
+	for _, a := range first {
+		if len(a) != 2 || (cursor != "" && a < cursor[:2]) {
+			continue
+		}
+		second, err := readDirNames(filepath.Join(base, a))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read shard directory: %w", err)
+		}
+		for _, b := range second {
+			if len(b) != 2 || (cursor != "" && a+b < cursor[:4]) {
+				continue
+			}
+			leaves, err := readDirNames(filepath.Join(base, a, b))
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to read shard directory: %w", err)
+			}
+			for _, id := range leaves {
+				if validateStorageID(id) != nil || id[:4] != a+b || id <= cursor {
+					continue
+				}
+				if limit >= 0 && len(ids) == limit {
+					return ids, true, nil
+				}
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	return ids, false, nil
+}
+
+// readDirNames returns the sorted names of the folders in dir
+// A folder removed by a concurrent delete has no entries.
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+)
+
+// stagingDir is the folder of a storage holding the files of uploads that haven't committed yet,
+// each stored as stagingDir/<number>/<path> with a number derived from the upload's transaction ID
+const stagingDir = metaDirName + "/staging"
+
+// StagingPath returns where a file of a multi-file upload is kept until the upload commits
+// The transaction ID is hashed into a number, so any ID yields a valid path.
+func StagingPath(transactionID, filename string) string {
+	sum := sha256.Sum256([]byte(transactionID))
+	number := binary.BigEndian.Uint64(sum[:8]) >> 1 // Fits an int, as reserved paths require
+	return stagingDir + "/" + strconv.FormatUint(number, 10) + "/" + filename
+}
+
+// WithStagedPaths lets the repository store, read and delete the paths returned by StagingPath
+// with the returned context. Like the files decorators keep, staged files are never listed,
+// but count as stored bytes.
+func WithStagedPaths(ctx context.Context) context.Context {
+	return withReservedPaths(ctx)
+}
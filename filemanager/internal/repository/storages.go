@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"iter"
+	"sort"
+	"time"
+)
+
+// DefaultStoragePageSize is the number of storages ListStorages returns when no limit is given
+const DefaultStoragePageSize = 100
+
+// maxStoragePageSize caps a single ListStorages page
+const maxStoragePageSize = 1000
+
+// StorageInfo summarizes one storage for maintenance jobs and admin tooling
+type StorageInfo struct {
+	ID string
+	// CreatedAt comes from the manifest; backends without one approximate it
+	// with the oldest file's modification time. Zero if unknown.
+	CreatedAt time.Time
+	ExpiresAt *time.Time // nil if the storage never expires or has no manifest
+	Files     int
+	Size      int64 // Sum of the file sizes as uploaded
+}
+
+// StoragePage is one page of storages returned by ListStorages
+type StoragePage struct {
+	Storages []StorageInfo
+	Next     string // Cursor of the following page, empty after the last one
+}
+
+// AllStorages iterates over every storage of r, fetching pageSize storages at a time
+// Iteration stops at the first error, which is yielded with an empty StorageInfo.
+// Storages created or deleted while iterating may or may not be seen.
+func AllStorages(ctx context.Context, r Repository, pageSize int) iter.Seq2[StorageInfo, error] {
+	return func(yield func(StorageInfo, error) bool) {
+		cursor := ""
+		for {
+			page, err := r.ListStorages(ctx, cursor, pageSize)
+			if err != nil {
+				yield(StorageInfo{}, err)
+				return
+			}
+			for _, storage := range page.Storages {
+				if !yield(storage, nil) {
+					return
+				}
+			}
+			if page.Next == "" {
+				return
+			}
+			cursor = page.Next
+		}
+	}
+}
+
+// checkStoragePage validates a ListStorages cursor and returns the limit to use
+func checkStoragePage(cursor string, limit int) (int, error) {
+	if cursor != "" {
+		if err := validateStorageID(cursor); err != nil {
+			return 0, err
+		}
+	}
+	if limit <= 0 {
+		return DefaultStoragePageSize, nil
+	}
+	return min(limit, maxStoragePageSize), nil
+}
+
+// pageStorageIDs returns up to limit of ids that sort after cursor, and whether more remain
+func pageStorageIDs(ids []string, cursor string, limit int) ([]string, bool) {
+	sort.Strings(ids)
+	start := sort.SearchStrings(ids, cursor)
+	if start < len(ids) && ids[start] == cursor {
+		start++
+	}
+	ids = ids[start:]
+	if len(ids) > limit {
+		return ids[:limit], true
+	}
+	return ids, false
+}
+
+// describeStorages builds a page by describing each of ids
+// more reports whether storages remain after the last ID.
+func describeStorages(ctx context.Context, ids []string, more bool, describe func(ctx context.Context, storageID string) (StorageInfo, error)) (StoragePage, error) {
+	page := StoragePage{Storages: make([]StorageInfo, 0, len(ids))}
+	for _, id := range ids {
+		info, err := describe(ctx, id)
+		if err != nil {
+			return StoragePage{}, err
+		}
+		page.Storages = append(page.Storages, info)
+	}
+	if more && len(ids) > 0 {
+		page.Next = ids[len(ids)-1]
+	}
+	return page, nil
+}
+
+// summarizeFiles fills the file count and total size of info from a listing
+func summarizeFiles(info *StorageInfo, files []FileInfo) {
+	info.Files = len(files)
+	info.Size = 0
+	for _, file := range files {
+		info.Size += file.Size
+	}
+}
+
+// withLogicalSizes recounts a page's files and sizes from the listings of r,
+// for decorators whose stored sizes differ from the logical ones
+func withLogicalSizes(ctx context.Context, r Repository, page StoragePage, err error) (StoragePage, error) {
+	if err != nil {
+		return page, err
+	}
+	for i, storage := range page.Storages {
+		files, err := r.GetFilesByStorage(ctx, storage.ID)
+		if err != nil {
+			return StoragePage{}, err
+		}
+		summarizeFiles(&page.Storages[i], files)
+	}
+	return page, nil
+}
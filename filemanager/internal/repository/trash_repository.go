@@ -0,0 +1,616 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// trashName is the metadata document recording what a storage holds in its trash
+const trashName = "trash"
+
+// trashDir is the folder of a storage holding deleted files, each stored as trashDir/<id>/<path>
+const trashDir = metaDirName + "/" + trashName
+
+// trashPath returns where a deleted file is kept
+func trashPath(filename string, id int) string {
+	return trashDir + "/" + strconv.Itoa(id) + "/" + filename
+}
+
+// bypassTrashKey marks a context whose deletes skip the trash
+type bypassTrashKey struct{}
+
+// WithoutTrash makes repositories that keep a trash delete the files and storages deleted with
+// the returned context for good, for content that was never meant to be kept
+func WithoutTrash(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassTrashKey{}, true)
+}
+
+// bypassesTrash reports whether ctx was returned by WithoutTrash
+func bypassesTrash(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassTrashKey{}).(bool)
+	return bypass
+}
+
+// Trash is implemented by repositories that keep deleted files and storages for a grace period
+type Trash interface {
+	// RestoreFile brings back the most recently deleted file stored under filename
+	// Fails with ErrFileExists if a file was stored under the same name since.
+	RestoreFile(ctx context.Context, storageID string, filename string) (FileInfo, error)
+	// RestoreStorage brings back a deleted storage with all its files
+	RestoreStorage(ctx context.Context, storageID string) error
+	// PurgeTrash permanently removes the files and storages deleted longer ago than the
+	// grace period and returns how many were removed
+	PurgeTrash(ctx context.Context) (int, error)
+}
+
+// trashIndex records the deleted content of a storage
+type trashIndex struct {
+	DeletedAt *time.Time    `json:"deleted_at,omitempty"` // Set while the whole storage is in the trash
+	Files     []trashedFile `json:"files,omitempty"`      // Oldest first
+}
+
+// trashedFile is a deleted file waiting in the trash
+type trashedFile struct {
+	ID        int       `json:"id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// trashRepository turns deletes into moves to a trash area that is purged after a grace period
+// A deleted storage is only flagged, so deleting and restoring it is cheap on every backend.
+// A deleted file is moved through the wrapped repository into the storage's trash folder,
+// so it keeps being compressed and encrypted and the decorators' indexes stay accurate.
+// Backends that can rename files (local, CAS, memory) move it without touching its content;
+// on the others it is copied and the original deleted.
+// Older versions of a file are not kept in the trash.
+type trashRepository struct {
+	Repository
+	store     metadataStore
+	retention time.Duration
+	now       func() time.Time
+	locks     storageLocks
+}
+
+// NewTrashRepository wraps inner so deleted files and storages can be restored for retention
+// inner must be one of the repositories of this package.
+func NewTrashRepository(inner Repository, retention time.Duration) (*trashRepository, error) {
+	store, ok := inner.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot keep a trash", inner)
+	}
+	if retention <= 0 {
+		return nil, fmt.Errorf("invalid trash retention: %s", retention)
+	}
+
+	r := &trashRepository{
+		Repository: inner,
+		store:      store,
+		retention:  retention,
+		now:        time.Now,
+	}
+	return r, nil
+}
+
+// loadIndex reads the trash of a storage; a missing trash is empty
+func (r *trashRepository) loadIndex(ctx context.Context, storageID string) (trashIndex, error) {
+	var index trashIndex
+	data, err := r.store.readMetadata(ctx, storageID, trashName)
+	if errors.Is(err, ErrFileNotFound) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("failed to read trash: %w", err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("invalid trash: %w", err)
+	}
+	return index, nil
+}
+
+func (r *trashRepository) saveIndex(ctx context.Context, storageID string, index trashIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode trash: %w", err)
+	}
+	if err := r.store.writeMetadata(ctx, storageID, trashName, data); err != nil {
+		return fmt.Errorf("failed to write trash: %w", err)
+	}
+	return nil
+}
+
+// trashed reports whether a storage is in the trash
+func (r *trashRepository) trashed(ctx context.Context, storageID string) (bool, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return false, err
+	}
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return false, err
+	}
+	return index.DeletedAt != nil, nil
+}
+
+// checkFile fails with ErrFileNotFound when the storage of filename is in the trash
+// Files kept by decorators in reservedDirs are always reachable.
+func (r *trashRepository) checkFile(ctx context.Context, storageID, filename string) error {
+	if isReservedPath(filename) {
+		return nil
+	}
+	trashed, err := r.trashed(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if trashed {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+	return nil
+}
+
+// exists reports whether a storage holds anything
+// Every storage written through New has a manifest; older ones are found by their files.
+func (r *trashRepository) exists(ctx context.Context, storageID string) (bool, error) {
+	if _, err := r.store.readMetadata(ctx, storageID, manifestName); err == nil {
+		return true, nil
+	}
+	files, err := r.Repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return false, err
+	}
+	return len(files) > 0, nil
+}
+
+// expired reports whether something deleted at deletedAt is past the grace period
+func (r *trashRepository) expired(deletedAt time.Time) bool {
+	return r.now().Sub(deletedAt) >= r.retention
+}
+
+// SaveFile stores the file unless its storage is in the trash
+func (r *trashRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if isReservedPath(filename) {
+		return r.Repository.SaveFile(ctx, storageID, filename, content)
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	trashed, err := r.trashed(ctx, storageID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if trashed {
+		return FileInfo{}, fmt.Errorf("%w: %s is in the trash", ErrStorageNotFound, storageID)
+	}
+	return r.Repository.SaveFile(ctx, storageID, filename, content)
+}
+
+// GetFile retrieves the file unless its storage is in the trash
+func (r *trashRepository) GetFile(ctx context.Context, storageID string, filename string) (io.ReadCloser, error) {
+	if err := r.checkFile(ctx, storageID, filename); err != nil {
+		return nil, err
+	}
+	return r.Repository.GetFile(ctx, storageID, filename)
+}
+
+// GetFileRange retrieves part of the file unless its storage is in the trash
+func (r *trashRepository) GetFileRange(ctx context.Context, storageID string, filename string, offset, length int64) (*FileRange, error) {
+	if err := r.checkFile(ctx, storageID, filename); err != nil {
+		return nil, err
+	}
+	return r.Repository.GetFileRange(ctx, storageID, filename, offset, length)
+}
+
+// GetFilesByStorage lists the storage; a storage in the trash has no files
+func (r *trashRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	trashed, err := r.trashed(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	if trashed {
+		return []FileInfo{}, nil
+	}
+	return r.Repository.GetFilesByStorage(ctx, storageID)
+}
+
+// DeleteFile moves the file to the storage's trash, or removes it with a context returned by WithoutTrash
+func (r *trashRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if isReservedPath(filename) {
+		return r.Repository.DeleteFile(ctx, storageID, filename)
+	}
+	if bypassesTrash(ctx) {
+		if err := r.checkFile(ctx, storageID, filename); err != nil {
+			return err
+		}
+		return r.Repository.DeleteFile(ctx, storageID, filename)
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+	if err := validateFilePath(filename); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if index.DeletedAt != nil {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, filename)
+	}
+
+	id := 1
+	if n := len(index.Files); n > 0 {
+		id = index.Files[n-1].ID + 1
+	}
+	ctx = withReservedPaths(ctx)
+	moved, err := r.moveFile(ctx, storageID, filename, trashPath(filename, id))
+	if errors.Is(err, ErrFileCorrupted) {
+		// There is nothing worth restoring
+		return r.Repository.DeleteFile(ctx, storageID, filename)
+	}
+	if err != nil {
+		return err
+	}
+	if moved.Corrupted {
+		return r.Repository.DeleteFile(ctx, storageID, moved.Path)
+	}
+
+	index.Files = append(index.Files, trashedFile{
+		ID:        id,
+		Path:      filename,
+		Size:      moved.Size,
+		DeletedAt: r.now().UTC(),
+	})
+	return r.saveIndex(ctx, storageID, index)
+}
+
+// DeleteStorage moves the storage to the trash, or removes it with a context returned by WithoutTrash
+func (r *trashRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	if bypassesTrash(ctx) {
+		// The trash document goes with the storage
+		return r.Repository.DeleteStorage(ctx, storageID)
+	}
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if index.DeletedAt != nil {
+		return fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+	// Writing the trash document would create a missing storage
+	exists, err := r.exists(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+
+	deletedAt := r.now().UTC()
+	index.DeletedAt = &deletedAt
+	return r.saveIndex(ctx, storageID, index)
+}
+
+// RestoreFile implements Trash
+func (r *trashRepository) RestoreFile(ctx context.Context, storageID string, filename string) (FileInfo, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validateFilePath(filename); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if index.DeletedAt != nil {
+		return FileInfo{}, fmt.Errorf("%w: %s is in the trash, restore it first", ErrStorageNotFound, storageID)
+	}
+
+	i := len(index.Files) - 1
+	for i >= 0 && index.Files[i].Path != filename {
+		i--
+	}
+	if i < 0 {
+		return FileInfo{}, fmt.Errorf("%w: %s is not in the trash", ErrFileNotFound, filename)
+	}
+	entry := index.Files[i]
+
+	ctx = withReservedPaths(ctx)
+	if current, err := r.Repository.GetFile(ctx, storageID, filename); err == nil {
+		current.Close()
+		return FileInfo{}, fmt.Errorf("%w: %s", ErrFileExists, filename)
+	}
+
+	info, err := r.moveFile(ctx, storageID, trashPath(filename, entry.ID), filename)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to restore trashed file: %w", err)
+	}
+
+	index.Files = append(index.Files[:i], index.Files[i+1:]...)
+	if err := r.saveIndex(ctx, storageID, index); err != nil {
+		return FileInfo{}, err
+	}
+
+	return info, nil
+}
+
+// moveFile moves a file within the storage, by renaming it when the wrapped repository can
+// Otherwise the file is copied and the original deleted once the copy is stored.
+func (r *trashRepository) moveFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	info, err := forwardMove(ctx, r.Repository, storageID, from, to)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		return info, err
+	}
+
+	content, err := r.Repository.GetFile(ctx, storageID, from)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	copied, err := r.Repository.SaveFile(ctx, storageID, to, content)
+	content.Close()
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to copy %s: %w", from, err)
+	}
+
+	if err := r.Repository.DeleteFile(ctx, storageID, from); err != nil {
+		if err := r.Repository.DeleteFile(ctx, storageID, copied.Path); err != nil {
+			log.Printf("Failed to remove copy %s of %s in storage %s: %v", copied.Path, from, storageID, err)
+		}
+		return FileInfo{}, err
+	}
+	return copied, nil
+}
+
+// RestoreStorage implements Trash
+func (r *trashRepository) RestoreStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if index.DeletedAt == nil {
+		return fmt.Errorf("%w: %s is not in the trash", ErrStorageNotFound, storageID)
+	}
+
+	index.DeletedAt = nil
+	return r.saveIndex(ctx, storageID, index)
+}
+
+// PurgeTrash implements Trash
+// Failures are logged and the storage is retried on the next purge.
+func (r *trashRepository) PurgeTrash(ctx context.Context) (int, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return 0, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	ids, err := lister.listStorageIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		n, err := r.purgeStorage(ctx, id)
+		if err != nil {
+			log.Printf("Failed to purge the trash of storage %s: %v", id, err)
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// purgeStorage removes the expired trash of one storage
+func (r *trashRepository) purgeStorage(ctx context.Context, storageID string) (int, error) {
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return 0, err
+	}
+
+	if index.DeletedAt != nil && r.expired(*index.DeletedAt) {
+		if err := r.Repository.DeleteStorage(ctx, storageID); err != nil && !errors.Is(err, ErrStorageNotFound) {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	ctx = withReservedPaths(ctx)
+	kept := index.Files[:0]
+	for _, entry := range index.Files {
+		if !r.expired(entry.DeletedAt) {
+			kept = append(kept, entry)
+			continue
+		}
+		err := r.Repository.DeleteFile(ctx, storageID, trashPath(entry.Path, entry.ID))
+		if err != nil && !errors.Is(err, ErrFileNotFound) {
+			kept = append(kept, entry)
+			log.Printf("Failed to purge %s from the trash of storage %s: %v", entry.Path, storageID, err)
+		}
+	}
+	purged := len(index.Files) - len(kept)
+	if purged == 0 {
+		return 0, nil
+	}
+
+	index.Files = kept
+	return purged, r.saveIndex(ctx, storageID, index)
+}
+
+// ListStorages leaves out the storages in the trash
+// A page may hold fewer storages than the limit; Next still continues the listing.
+func (r *trashRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	page, err := r.Repository.ListStorages(ctx, cursor, limit)
+	if err != nil {
+		return page, err
+	}
+
+	live := page.Storages[:0]
+	for _, storage := range page.Storages {
+		trashed, err := r.trashed(ctx, storage.ID)
+		if err != nil {
+			return StoragePage{}, err
+		}
+		if !trashed {
+			live = append(live, storage)
+		}
+	}
+	page.Storages = live
+	return page, nil
+}
+
+// Usage reports the wrapped repository's usage without the storages in the trash
+// Trashed content still counts as physical bytes until it is purged.
+func (r *trashRepository) Usage(ctx context.Context) (Usage, error) {
+	reporter, ok := r.Repository.(UsageReporter)
+	if !ok {
+		return Usage{}, fmt.Errorf("repository %T does not report usage", r.Repository)
+	}
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return usage, nil
+	}
+	ids, err := lister.listStorageIDs(ctx)
+	if err != nil {
+		return usage, err
+	}
+	for _, id := range ids {
+		if trashed, err := r.trashed(ctx, id); err != nil || !trashed {
+			continue
+		}
+		files, err := r.Repository.GetFilesByStorage(ctx, id)
+		if err != nil {
+			continue // Skip storages we can't read
+		}
+		usage.Storages--
+		for _, file := range files {
+			usage.Files--
+			usage.LogicalBytes -= file.Size
+		}
+	}
+
+	return usage, nil
+}
+
+// Manifest forwards to the wrapped repository; storages in the trash have none
+func (r *trashRepository) Manifest(ctx context.Context, storageID string) (Manifest, error) {
+	reader, ok := r.Repository.(ManifestReader)
+	if !ok {
+		return Manifest{}, fmt.Errorf("repository %T does not keep manifests", r.Repository)
+	}
+	trashed, err := r.trashed(ctx, storageID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	if trashed {
+		return Manifest{}, fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+	return reader.Manifest(ctx, storageID)
+}
+
+// MarkCorrupted forwards to the wrapped repository when it can mark corrupted files
+func (r *trashRepository) MarkCorrupted(ctx context.Context, storageID string, filename string, sha256 string) (bool, error) {
+	marker, ok := r.Repository.(IntegrityMarker)
+	if !ok {
+		return false, fmt.Errorf("repository %T cannot mark corrupted files", r.Repository)
+	}
+	return marker.MarkCorrupted(ctx, storageID, filename, sha256)
+}
+
+// Storage forwards to the wrapped repository's metadata index; storages in the trash are not found
+func (r *trashRepository) Storage(ctx context.Context, storageID string) (StorageInfo, error) {
+	index, err := forwardIndex(r.Repository)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	trashed, err := r.trashed(ctx, storageID)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	if trashed {
+		return StorageInfo{}, fmt.Errorf("%w: %s", ErrStorageNotFound, storageID)
+	}
+	return index.Storage(ctx, storageID)
+}
+
+// RecordDownload forwards to the wrapped repository's metadata index
+func (r *trashRepository) RecordDownload(ctx context.Context, storageID string, filename string) error {
+	index, err := forwardIndex(r.Repository)
+	if err != nil {
+		return err
+	}
+	return index.RecordDownload(ctx, storageID, filename)
+}
+
+// DiskSpace forwards to the wrapped repository when it stores files on a local filesystem
+func (r *trashRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return forwardDiskSpace(ctx, r.Repository)
+}
+
+// readMetadata implements metadataStore so other decorators can be stacked on top
+func (r *trashRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	return r.store.readMetadata(ctx, storageID, name)
+}
+
+// writeMetadata implements metadataStore so other decorators can be stacked on top
+func (r *trashRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return r.store.writeMetadata(ctx, storageID, name, data)
+}
+
+// listStorageIDs implements storageLister so other decorators can be stacked on top
+// Storages in the trash are left out.
+func (r *trashRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	ids, err := lister.listStorageIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	live := ids[:0]
+	for _, id := range ids {
+		if trashed, err := r.trashed(ctx, id); err == nil && !trashed {
+			live = append(live, id)
+		}
+	}
+	return live, nil
+}
@@ -0,0 +1,613 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+)
+
+// versionsName is the metadata document holding the version history of a storage's files
+const versionsName = "versions"
+
+// versionsDir is the folder of a storage holding older versions of its files,
+// each stored as versionsDir/<version>/<path>
+const versionsDir = metaDirName + "/" + versionsName
+
+// versionPath returns where an older version of filename is stored
+func versionPath(filename string, version int) string {
+	return versionsDir + "/" + strconv.Itoa(version) + "/" + filename
+}
+
+// FileVersion describes an older version of a file
+type FileVersion struct {
+	Version     int       `json:"version"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"` // Empty if unknown
+	SHA256      string    `json:"sha256,omitempty"`       // Empty if unknown
+	UploadedAt  time.Time `json:"uploaded_at"`            // Zero if unknown
+}
+
+// Versioner is implemented by repositories that keep older versions of overwritten files
+type Versioner interface {
+	// GetFileVersionRange returns a range of one version of a file, the current one included
+	// Returns an error wrapping ErrVersionNotFound if the version isn't kept.
+	GetFileVersionRange(ctx context.Context, storageID string, filename string, version int, offset, length int64) (*FileRange, error)
+	// DeleteFileVersion removes one version of a file
+	// Deleting the current version restores the newest older one, or removes the file if there is none.
+	DeleteFileVersion(ctx context.Context, storageID string, filename string, version int) error
+	// PruneVersions drops all but the keep newest older versions of every file in a storage
+	// and returns how many versions were removed
+	PruneVersions(ctx context.Context, storageID string, keep int) (int, error)
+}
+
+// versionIndex records the version history of every versioned file of a storage
+type versionIndex struct {
+	Files map[string]*versionHistory `json:"files"` // Keyed by relative path
+}
+
+// versionHistory is the history of one file
+type versionHistory struct {
+	Current    int           `json:"current"`     // Number of the version stored under the file's path
+	UploadedAt time.Time     `json:"uploaded_at"` // When the current version was stored
+	Versions   []FileVersion `json:"versions"`    // Older versions, oldest first
+}
+
+// current returns the number of the current version
+// Files stored before versioning was enabled have no history and are version 1.
+func (h *versionHistory) current() int {
+	if h == nil || h.Current == 0 {
+		return 1
+	}
+	return h.Current
+}
+
+// find returns the index of an older version in h.Versions, or -1
+func (h *versionHistory) find(version int) int {
+	if h == nil {
+		return -1
+	}
+	for i, v := range h.Versions {
+		if v.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// size returns the bytes held by the older versions
+func (h *versionHistory) size() int64 {
+	var size int64
+	for _, v := range h.Versions {
+		size += v.Size
+	}
+	return size
+}
+
+// versioningRepository keeps the previous content of every overwritten file as a numbered version
+// Older versions are stored through the wrapped repository under versionsDir, so they
+// are compressed, encrypted and deduplicated like any other file.
+type versioningRepository struct {
+	Repository
+	store       metadataStore
+	maxVersions int
+	now         func() time.Time
+	locks       storageLocks
+}
+
+// NewVersioningRepository wraps inner so overwritten files keep their previous versions
+// maxVersions caps the older versions kept per file, dropping the oldest; 0 means unlimited.
+// inner must be one of the repositories of this package.
+func NewVersioningRepository(inner Repository, maxVersions int) (*versioningRepository, error) {
+	store, ok := inner.(metadataStore)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot store version history", inner)
+	}
+	if maxVersions < 0 {
+		return nil, fmt.Errorf("invalid maximum number of versions: %d", maxVersions)
+	}
+
+	r := &versioningRepository{
+		Repository:  inner,
+		store:       store,
+		maxVersions: maxVersions,
+		now:         time.Now,
+	}
+	return r, nil
+}
+
+// loadIndex reads the version history of a storage; a missing history is empty
+func (r *versioningRepository) loadIndex(ctx context.Context, storageID string) (versionIndex, error) {
+	index := versionIndex{Files: make(map[string]*versionHistory)}
+	data, err := r.store.readMetadata(ctx, storageID, versionsName)
+	if errors.Is(err, ErrFileNotFound) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("failed to read version history: %w", err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("invalid version history: %w", err)
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]*versionHistory)
+	}
+	return index, nil
+}
+
+func (r *versioningRepository) saveIndex(ctx context.Context, storageID string, index versionIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to encode version history: %w", err)
+	}
+	if err := r.store.writeMetadata(ctx, storageID, versionsName, data); err != nil {
+		return fmt.Errorf("failed to write version history: %w", err)
+	}
+	return nil
+}
+
+// withHistory copies the version history of a file into info
+func withHistory(info FileInfo, h *versionHistory) FileInfo {
+	info.Version = h.current()
+	info.Versions = nil
+	if h == nil {
+		return info
+	}
+	for i := len(h.Versions) - 1; i >= 0; i-- {
+		info.Versions = append(info.Versions, h.Versions[i])
+	}
+	return info
+}
+
+// copyFile copies the content of one path of a storage to another through the wrapped repository
+func (r *versioningRepository) copyFile(ctx context.Context, storageID, from, to string) (FileInfo, error) {
+	content, err := r.Repository.GetFile(ctx, storageID, from)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer content.Close()
+
+	return r.Repository.SaveFile(ctx, storageID, to, content)
+}
+
+// deleteVersions removes the stored copies of versions, logging the ones that can't be removed
+func (r *versioningRepository) deleteVersions(ctx context.Context, storageID, filename string, versions []FileVersion) {
+	ctx = withReservedPaths(ctx)
+	for _, v := range versions {
+		err := r.Repository.DeleteFile(ctx, storageID, versionPath(filename, v.Version))
+		if err != nil && !errors.Is(err, ErrFileNotFound) {
+			log.Printf("Failed to delete version %d of %s in storage %s: %v", v.Version, filename, storageID, err)
+		}
+	}
+}
+
+// SaveFile keeps the file currently stored under filename as an older version, then stores content
+func (r *versioningRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (FileInfo, error) {
+	if isReservedPath(filename) {
+		// Staged uploads get their history once they are committed under their own name
+		return r.Repository.SaveFile(ctx, storageID, filename, content)
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+	if err := validateFilePath(filename); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	h := index.Files[filename]
+
+	// Copy the current content aside before it is replaced
+	var kept *FileVersion
+	previous := h.current()
+	copied, err := r.copyFile(withReservedPaths(ctx), storageID, filename, versionPath(filename, previous))
+	switch {
+	case err == nil:
+		kept = &FileVersion{Version: previous, Size: copied.Size, ContentType: copied.ContentType, SHA256: copied.SHA256}
+		if h != nil {
+			kept.UploadedAt = h.UploadedAt
+		}
+	case errors.Is(err, ErrFileCorrupted):
+		// Replacing a corrupted file is how it gets repaired; its content isn't worth keeping
+		log.Printf("Not keeping corrupted version %d of %s in storage %s", previous, filename, storageID)
+	case !errors.Is(err, ErrFileNotFound):
+		return FileInfo{}, fmt.Errorf("failed to keep previous version: %w", err)
+	}
+
+	info, err := r.Repository.SaveFile(ctx, storageID, filename, content)
+	if err != nil {
+		if kept != nil {
+			r.deleteVersions(ctx, storageID, filename, []FileVersion{*kept})
+		}
+		return FileInfo{}, err
+	}
+	if info.Path != filename {
+		// Stored under a new name by the conflict policy, so nothing was replaced
+		if kept != nil {
+			r.deleteVersions(ctx, storageID, filename, []FileVersion{*kept})
+			kept = nil
+		}
+		filename, h = info.Path, index.Files[info.Path]
+	}
+
+	if h == nil {
+		h = &versionHistory{}
+		index.Files[filename] = h
+	}
+	if kept != nil {
+		h.Versions = append(h.Versions, *kept)
+	}
+	h.Current = 1
+	if n := len(h.Versions); n > 0 {
+		h.Current = h.Versions[n-1].Version + 1
+	}
+	h.UploadedAt = r.now().UTC()
+
+	if r.maxVersions > 0 && len(h.Versions) > r.maxVersions {
+		excess := len(h.Versions) - r.maxVersions
+		r.deleteVersions(ctx, storageID, filename, h.Versions[:excess])
+		h.Versions = append([]FileVersion(nil), h.Versions[excess:]...)
+	}
+
+	if err := r.saveIndex(ctx, storageID, index); err != nil {
+		return FileInfo{}, err
+	}
+
+	return withHistory(info, h), nil
+}
+
+// GetFilesByStorage lists the wrapped repository and adds each file's version history
+func (r *versioningRepository) GetFilesByStorage(ctx context.Context, storageID string) ([]FileInfo, error) {
+	files, err := r.Repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		files[i] = withHistory(file, index.Files[file.Path])
+	}
+
+	return files, nil
+}
+
+// GetFileVersionRange implements Versioner
+func (r *versioningRepository) GetFileVersionRange(ctx context.Context, storageID string, filename string, version int, offset, length int64) (*FileRange, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return nil, err
+	}
+	if err := validateFilePath(filename); err != nil {
+		return nil, err
+	}
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	h := index.Files[filename]
+
+	if version == h.current() {
+		return r.Repository.GetFileRange(ctx, storageID, filename, offset, length)
+	}
+	if h.find(version) < 0 {
+		return nil, fmt.Errorf("%w: %s version %d", ErrVersionNotFound, filename, version)
+	}
+	return r.Repository.GetFileRange(withReservedPaths(ctx), storageID, versionPath(filename, version), offset, length)
+}
+
+// DeleteFile removes the file together with all its older versions
+func (r *versioningRepository) DeleteFile(ctx context.Context, storageID string, filename string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	return r.deleteFile(ctx, storageID, filename)
+}
+
+// deleteFile removes a file and its history; the caller holds the storage lock
+func (r *versioningRepository) deleteFile(ctx context.Context, storageID, filename string) error {
+	if err := r.Repository.DeleteFile(ctx, storageID, filename); err != nil {
+		return err
+	}
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	h, ok := index.Files[filename]
+	if !ok {
+		return nil
+	}
+	r.deleteVersions(ctx, storageID, filename, h.Versions)
+	delete(index.Files, filename)
+
+	return r.saveIndex(ctx, storageID, index)
+}
+
+// DeleteFileVersion implements Versioner
+func (r *versioningRepository) DeleteFileVersion(ctx context.Context, storageID string, filename string, version int) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+	if err := validateFilePath(filename); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	h := index.Files[filename]
+
+	if version == h.current() {
+		if h == nil || len(h.Versions) == 0 {
+			return r.deleteFile(ctx, storageID, filename)
+		}
+
+		// Put the newest older version back in place
+		restored := h.Versions[len(h.Versions)-1]
+		if _, err := r.copyFile(withReservedPaths(ctx), storageID, versionPath(filename, restored.Version), filename); err != nil {
+			return fmt.Errorf("failed to restore version %d: %w", restored.Version, err)
+		}
+		h.Versions = h.Versions[:len(h.Versions)-1]
+		h.Current = restored.Version
+		h.UploadedAt = restored.UploadedAt
+		if err := r.saveIndex(ctx, storageID, index); err != nil {
+			return err
+		}
+		r.deleteVersions(ctx, storageID, filename, []FileVersion{restored})
+		return nil
+	}
+
+	i := h.find(version)
+	if i < 0 {
+		return fmt.Errorf("%w: %s version %d", ErrVersionNotFound, filename, version)
+	}
+	removed := h.Versions[i]
+	h.Versions = append(h.Versions[:i], h.Versions[i+1:]...)
+	if err := r.saveIndex(ctx, storageID, index); err != nil {
+		return err
+	}
+	r.deleteVersions(ctx, storageID, filename, []FileVersion{removed})
+	return nil
+}
+
+// PruneVersions implements Versioner
+func (r *versioningRepository) PruneVersions(ctx context.Context, storageID string, keep int) (int, error) {
+	if err := validateStorageID(storageID); err != nil {
+		return 0, err
+	}
+	if keep < 0 {
+		return 0, fmt.Errorf("invalid number of versions to keep: %d", keep)
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	index, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for filename, h := range index.Files {
+		if len(h.Versions) <= keep {
+			continue
+		}
+		excess := len(h.Versions) - keep
+		r.deleteVersions(ctx, storageID, filename, h.Versions[:excess])
+		h.Versions = append([]FileVersion(nil), h.Versions[excess:]...)
+		pruned += excess
+	}
+	if pruned == 0 {
+		return 0, nil
+	}
+
+	if err := r.saveIndex(ctx, storageID, index); err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
+
+// DeleteStorage removes the storage; its older versions go with it
+func (r *versioningRepository) DeleteStorage(ctx context.Context, storageID string) error {
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	return r.Repository.DeleteStorage(ctx, storageID)
+}
+
+// ListStorages counts older versions in each storage's size
+func (r *versioningRepository) ListStorages(ctx context.Context, cursor string, limit int) (StoragePage, error) {
+	page, err := r.Repository.ListStorages(ctx, cursor, limit)
+	if err != nil {
+		return page, err
+	}
+
+	for i, storage := range page.Storages {
+		index, err := r.loadIndex(ctx, storage.ID)
+		if err != nil {
+			return StoragePage{}, err
+		}
+		for _, h := range index.Files {
+			page.Storages[i].Size += h.size()
+		}
+	}
+	return page, nil
+}
+
+// Usage adds the older versions of every storage to the logical bytes of the wrapped repository
+// Backends already count their stored copies in the physical bytes.
+func (r *versioningRepository) Usage(ctx context.Context) (Usage, error) {
+	reporter, ok := r.Repository.(UsageReporter)
+	if !ok {
+		return Usage{}, fmt.Errorf("repository %T does not report usage", r.Repository)
+	}
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	ids, err := r.listStorageIDs(ctx)
+	if err != nil {
+		return usage, err
+	}
+	for _, id := range ids {
+		index, err := r.loadIndex(ctx, id)
+		if err != nil {
+			continue // Skip storages we can't read
+		}
+		for _, h := range index.Files {
+			usage.LogicalBytes += h.size()
+		}
+	}
+
+	return usage, nil
+}
+
+// Manifest forwards to the wrapped repository when it keeps manifests
+func (r *versioningRepository) Manifest(ctx context.Context, storageID string) (Manifest, error) {
+	reader, ok := r.Repository.(ManifestReader)
+	if !ok {
+		return Manifest{}, fmt.Errorf("repository %T does not keep manifests", r.Repository)
+	}
+	return reader.Manifest(ctx, storageID)
+}
+
+// MarkCorrupted forwards to the wrapped repository when it can mark corrupted files
+func (r *versioningRepository) MarkCorrupted(ctx context.Context, storageID string, filename string, sha256 string) (bool, error) {
+	marker, ok := r.Repository.(IntegrityMarker)
+	if !ok {
+		return false, fmt.Errorf("repository %T cannot mark corrupted files", r.Repository)
+	}
+	return marker.MarkCorrupted(ctx, storageID, filename, sha256)
+}
+
+// Storage forwards to the wrapped repository's metadata index, counting older versions in the size
+func (r *versioningRepository) Storage(ctx context.Context, storageID string) (StorageInfo, error) {
+	index, err := forwardIndex(r.Repository)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	info, err := index.Storage(ctx, storageID)
+	if err != nil {
+		return info, err
+	}
+
+	versions, err := r.loadIndex(ctx, storageID)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	for _, h := range versions.Files {
+		info.Size += h.size()
+	}
+	return info, nil
+}
+
+// RecordDownload forwards to the wrapped repository's metadata index
+func (r *versioningRepository) RecordDownload(ctx context.Context, storageID string, filename string) error {
+	index, err := forwardIndex(r.Repository)
+	if err != nil {
+		return err
+	}
+	return index.RecordDownload(ctx, storageID, filename)
+}
+
+// trash returns the wrapped repository's trash
+func (r *versioningRepository) trash() (Trash, error) {
+	trash, ok := r.Repository.(Trash)
+	if !ok {
+		return nil, fmt.Errorf("repository %T does not keep a trash", r.Repository)
+	}
+	return trash, nil
+}
+
+// RestoreFile forwards to the wrapped repository's trash
+// The restored file starts a fresh history; its older versions were deleted with it.
+func (r *versioningRepository) RestoreFile(ctx context.Context, storageID string, filename string) (FileInfo, error) {
+	trash, err := r.trash()
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return FileInfo{}, err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	return trash.RestoreFile(ctx, storageID, filename)
+}
+
+// RestoreStorage forwards to the wrapped repository's trash
+func (r *versioningRepository) RestoreStorage(ctx context.Context, storageID string) error {
+	trash, err := r.trash()
+	if err != nil {
+		return err
+	}
+	if err := validateStorageID(storageID); err != nil {
+		return err
+	}
+
+	unlock := r.locks.lock(storageID)
+	defer unlock()
+
+	return trash.RestoreStorage(ctx, storageID)
+}
+
+// PurgeTrash forwards to the wrapped repository's trash
+func (r *versioningRepository) PurgeTrash(ctx context.Context) (int, error) {
+	trash, err := r.trash()
+	if err != nil {
+		return 0, err
+	}
+	return trash.PurgeTrash(ctx)
+}
+
+// DiskSpace forwards to the wrapped repository when it stores files on a local filesystem
+func (r *versioningRepository) DiskSpace(ctx context.Context) (DiskSpace, error) {
+	return forwardDiskSpace(ctx, r.Repository)
+}
+
+// readMetadata implements metadataStore so other decorators can be stacked on top
+func (r *versioningRepository) readMetadata(ctx context.Context, storageID, name string) ([]byte, error) {
+	return r.store.readMetadata(ctx, storageID, name)
+}
+
+// writeMetadata implements metadataStore so other decorators can be stacked on top
+func (r *versioningRepository) writeMetadata(ctx context.Context, storageID, name string, data []byte) error {
+	return r.store.writeMetadata(ctx, storageID, name, data)
+}
+
+// listStorageIDs implements storageLister so other decorators can be stacked on top
+func (r *versioningRepository) listStorageIDs(ctx context.Context) ([]string, error) {
+	lister, ok := r.Repository.(storageLister)
+	if !ok {
+		return nil, fmt.Errorf("repository %T cannot list storages", r.Repository)
+	}
+	return lister.listStorageIDs(ctx)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
 	"github.com/edgarcoime/Cthulhu-common/pkg/rabbitmq/manager"
@@ -25,6 +26,9 @@ type RMQServerConfig struct {
 	Port           string
 	VHost          string
 	ConnectionName string
+
+	// IdempotencyWindow is how long responses are replayed to duplicate transactions
+	IdempotencyWindow time.Duration
 }
 
 type rmqServer struct {
@@ -55,7 +59,7 @@ func ListenRMQ(s service.Service, cfg *RMQServerConfig) {
 	rmqManager.StartHeartbeat(ctx)
 
 	// Create handler instance
-	handler := handlers.NewHandler(s, rmqManager, ctx)
+	handler := handlers.NewHandler(s, rmqManager, ctx, handlers.WithIdempotencyWindow(cfg.IdempotencyWindow))
 
 	// Create server instance
 	server := &rmqServer{
@@ -112,6 +116,18 @@ func (s *rmqServer) setupExchangesAndQueues() error {
 		return fmt.Errorf("failed to declare filemanager exchange: %w", err)
 	}
 
+	// Declare events exchange; consumers bind their own queues to it
+	if err := s.manager.DeclareExchange(
+		messages.EventsExchange,
+		"topic",
+		true,  // durable
+		false, // auto-delete
+		false, // internal
+		false, // no-wait
+	); err != nil {
+		return fmt.Errorf("failed to declare events exchange: %w", err)
+	}
+
 	// Create queue for diagnose messages (bind to all diagnose operations)
 	diagnoseQueue, err := s.manager.DeclareQueue(
 		fmt.Sprintf("%s.diagnose", ServiceName),
@@ -146,6 +162,12 @@ func (s *rmqServer) setupExchangesAndQueues() error {
 		{"filemanager.get.files", messages.TopicFileManagerGetFiles},
 		{"filemanager.delete.file", messages.TopicFileManagerDeleteFile},
 		{"filemanager.delete.folder", messages.TopicFileManagerDeleteFolder},
+		{"filemanager.prune.versions", messages.TopicFileManagerPruneVersions},
+		{"filemanager.restore.file", messages.TopicFileManagerRestoreFile},
+		{"filemanager.restore.folder", messages.TopicFileManagerRestoreFolder},
+		{"filemanager.copy.files", messages.TopicFileManagerCopyFiles},
+		{"filemanager.commit.upload", messages.TopicFileManagerCommitUpload},
+		{"filemanager.abort.upload", messages.TopicFileManagerAbortUpload},
 	}
 
 	for _, q := range fileManagerQueues {
@@ -200,6 +222,12 @@ func (s *rmqServer) startConsumers() error {
 		"filemanager.get.files",
 		"filemanager.delete.file",
 		"filemanager.delete.folder",
+		"filemanager.prune.versions",
+		"filemanager.restore.file",
+		"filemanager.restore.folder",
+		"filemanager.copy.files",
+		"filemanager.commit.upload",
+		"filemanager.abort.upload",
 	}
 
 	for _, queueName := range fileManagerQueues {
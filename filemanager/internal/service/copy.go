@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// CopyFiles copies files of one storage into another, creating a new storage if dstStorageID is empty
+// An empty filenames list copies every file. The bytes are copied inside the repository, so the
+// copies count toward quotas and get fresh manifest entries; the cas backend stores each copy as
+// a reference to the same content instead of duplicating it.
+// If a new storage was created and a copy fails, the new storage is deleted again.
+func (s *fileManagerService) CopyFiles(ctx context.Context, transactionID string, srcStorageID string, filenames []string, dstStorageID string) (*UploadResult, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return nil, fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(srcStorageID); err != nil {
+		return nil, err
+	}
+	if dstStorageID != "" {
+		if err := s.ids.Validate(dstStorageID); err != nil {
+			return nil, fmt.Errorf("destination: %w", err)
+		}
+	}
+	if dstStorageID == srcStorageID {
+		return nil, fmt.Errorf("cannot copy files into their own storage")
+	}
+
+	files, err := s.copySelection(ctx, srcStorageID, filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	created := dstStorageID == ""
+	if created {
+		dstStorageID, err = s.ids.Generate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var totalSize int64
+	fileInfos := make([]repository.FileInfo, 0, len(files))
+	for _, file := range files {
+		info, err := s.copyFile(ctx, srcStorageID, dstStorageID, file)
+		if err != nil {
+			if created {
+				s.DeleteFolder(ctx, transactionID, dstStorageID)
+			}
+			return nil, fmt.Errorf("failed to copy file %s: %w", file.Path, err)
+		}
+		fileInfos = append(fileInfos, info)
+		totalSize += info.Size
+	}
+
+	return &UploadResult{
+		TransactionID: transactionID,
+		StorageID:     dstStorageID,
+		Files:         fileInfos,
+		TotalSize:     totalSize,
+		Created:       created,
+	}, nil
+}
+
+// copySelection lists the files of a storage named in filenames, or all of them if it is empty
+// It fails before anything is copied if a named file doesn't exist.
+func (s *fileManagerService) copySelection(ctx context.Context, storageID string, filenames []string) ([]repository.FileInfo, error) {
+	files, err := s.repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: %s", repository.ErrStorageNotFound, storageID)
+	}
+	if len(filenames) == 0 {
+		return files, nil
+	}
+
+	byPath := make(map[string]repository.FileInfo, len(files))
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+	selected := make([]repository.FileInfo, 0, len(filenames))
+	seen := make(map[string]bool, len(filenames))
+	for _, name := range filenames {
+		file, ok := byPath[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", repository.ErrFileNotFound, name)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		selected = append(selected, file)
+	}
+	return selected, nil
+}
+
+// copyFile streams one file into another storage through saveFile, so quotas and the disk reserve apply
+func (s *fileManagerService) copyFile(ctx context.Context, srcStorageID, dstStorageID string, file repository.FileInfo) (repository.FileInfo, error) {
+	content, err := s.repository.GetFile(ctx, srcStorageID, file.Path)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	defer content.Close()
+
+	return s.saveFile(ctx, dstStorageID, FileUpload{
+		Filename:     file.Path,
+		Content:      content,
+		Size:         file.Size,
+		OriginalName: file.OriginalName,
+	})
+}
@@ -0,0 +1,181 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository/repotest"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// storedPaths lists the paths of the files in a storage, joined by commas
+func storedPaths(t *testing.T, r repository.Repository, storageID string) string {
+	t.Helper()
+	files, err := r.GetFilesByStorage(context.Background(), storageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+// storageCount returns how many storages r holds
+func storageCount(t *testing.T, r repository.Repository) int {
+	t.Helper()
+	page, err := r.ListStorages(context.Background(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(page.Storages)
+}
+
+// upload stores files, given as alternating names and contents, in a new storage and returns its ID
+func upload(t *testing.T, s service.Service, files ...string) string {
+	t.Helper()
+	var uploads []service.FileUpload
+	for i := 0; i+1 < len(files); i += 2 {
+		uploads = append(uploads, service.FileUpload{Filename: files[i], Content: strings.NewReader(files[i+1])})
+	}
+	result, err := s.PostFiles(context.Background(), "upload", "", uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result.StorageID
+}
+
+func TestCopyFiles(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		filenames []string
+		want      string
+	}{
+		{"subset", []string{"docs/b.txt", "a.txt", "a.txt"}, "a.txt,docs/b.txt"},
+		{"all", nil, "a.txt,c.txt,docs/b.txt"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := repository.NewMemoryRepository()
+			s := service.NewFileManagerService(r)
+			src := upload(t, s, "a.txt", "alpha", "docs/b.txt", "beta", "c.txt", "gamma")
+
+			result, err := s.CopyFiles(ctx, "copy", src, tc.filenames, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Created || result.StorageID == src {
+				t.Fatalf("copied into %s (created %v), want a new storage", result.StorageID, result.Created)
+			}
+			if got := storedPaths(t, r, result.StorageID); got != tc.want {
+				t.Errorf("new storage holds %s, want %s", got, tc.want)
+			}
+			if got := repotest.MustRead(t, r, result.StorageID, "docs/b.txt"); got != "beta" {
+				t.Errorf("copied docs/b.txt holds %q, want beta", got)
+			}
+			if got := storedPaths(t, r, src); got != "a.txt,c.txt,docs/b.txt" {
+				t.Errorf("source holds %s after the copy, want every file still there", got)
+			}
+		})
+	}
+}
+
+func TestCopyIntoExistingStorage(t *testing.T) {
+	ctx := context.Background()
+	r := repository.NewMemoryRepository()
+	s := service.NewFileManagerService(r)
+	src := upload(t, s, "a.txt", "alpha", "b.txt", "beta")
+	dst := upload(t, s, "z.txt", "zeta")
+
+	// A name missing from the source fails the copy before any file is copied
+	if _, err := s.CopyFiles(ctx, "copy", src, []string{"a.txt", "missing.txt"}, dst); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("copy of a missing file: got %v, want ErrFileNotFound", err)
+	}
+	if got := storedPaths(t, r, dst); got != "z.txt" {
+		t.Errorf("destination holds %s after the failed copy, want only z.txt", got)
+	}
+	if _, err := s.CopyFiles(ctx, "copy", src, []string{"missing.txt"}, ""); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("copy of a missing file into a new storage: got %v, want ErrFileNotFound", err)
+	}
+	if n := storageCount(t, r); n != 2 {
+		t.Errorf("%d storages after the failed copies, want 2", n)
+	}
+
+	result, err := s.CopyFiles(ctx, "copy", src, []string{"b.txt"}, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created || result.StorageID != dst {
+		t.Errorf("copied into %s (created %v), want the existing %s", result.StorageID, result.Created, dst)
+	}
+	if got := storedPaths(t, r, dst); got != "b.txt,z.txt" {
+		t.Errorf("destination holds %s, want b.txt,z.txt", got)
+	}
+}
+
+func TestCopyIntoSourceRefused(t *testing.T) {
+	r := repository.NewMemoryRepository()
+	s := service.NewFileManagerService(r)
+	src := upload(t, s, "a.txt", "alpha")
+
+	if _, err := s.CopyFiles(context.Background(), "copy", src, nil, src); err == nil {
+		t.Fatal("copy of a storage into itself succeeded")
+	}
+	if got := storedPaths(t, r, src); got != "a.txt" {
+		t.Errorf("storage holds %s after the refused copy, want only a.txt", got)
+	}
+}
+
+func TestFailedCopyRemovesNewStorage(t *testing.T) {
+	r := &failingRepository{Repository: repository.NewMemoryRepository()}
+	s := service.NewFileManagerService(r)
+	src := upload(t, s, "a.txt", "alpha", "b.txt", "beta")
+
+	// a.txt is copied before b.txt fails
+	r.fail = "b.txt"
+	if _, err := s.CopyFiles(context.Background(), "copy", src, nil, ""); err == nil {
+		t.Fatal("copy succeeded although b.txt can't be stored")
+	}
+	if n := storageCount(t, r); n != 1 {
+		t.Errorf("%d storages after the failed copy, want only the source", n)
+	}
+}
+
+// The cas backend stores a copy as one more reference to the content it already holds
+func TestCopyOnCASSharesContent(t *testing.T) {
+	ctx := context.Background()
+	r, err := repository.NewCASRepository(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := service.NewFileManagerService(r)
+	src := upload(t, s, "a.txt", "alpha", "b.txt", "beta")
+
+	before, err := r.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.CopyFiles(ctx, "copy", src, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := r.Usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.LogicalBytes != 2*before.LogicalBytes || after.Files != 4 {
+		t.Errorf("%d files of %d bytes after the copy, want 4 files of %d", after.Files, after.LogicalBytes, 2*before.LogicalBytes)
+	}
+	if after.PhysicalBytes != before.PhysicalBytes {
+		t.Errorf("copy grew the stored content from %d to %d bytes", before.PhysicalBytes, after.PhysicalBytes)
+	}
+	if got := repotest.MustRead(t, r, result.StorageID, "a.txt"); got != "alpha" {
+		t.Errorf("copied a.txt holds %q, want alpha", got)
+	}
+}
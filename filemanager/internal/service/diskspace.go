@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// DiskStatus reports the space left for uploads on the repository's filesystem
+type DiskStatus struct {
+	TotalBytes   int64
+	FreeBytes    int64
+	ReserveBytes int64 // Kept free for the host; uploads are refused once FreeBytes reaches it
+}
+
+// WithDiskReserve refuses uploads that would leave less than reserve bytes free on the
+// repository's filesystem. Repositories not stored on a local filesystem are not checked.
+func WithDiskReserve(reserve int64) Option {
+	return func(s *fileManagerService) {
+		s.diskReserve = reserve
+	}
+}
+
+// DiskStatus implements Service
+func (s *fileManagerService) DiskStatus(ctx context.Context) (*DiskStatus, error) {
+	reporter, ok := s.repository.(repository.SpaceReporter)
+	if !ok {
+		return nil, nil
+	}
+	space, err := reporter.DiskSpace(ctx)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check free disk space: %w", err)
+	}
+
+	return &DiskStatus{
+		TotalBytes:   space.TotalBytes,
+		FreeBytes:    space.FreeBytes,
+		ReserveBytes: s.diskReserve,
+	}, nil
+}
+
+// diskRoom returns how many bytes can be written before the disk reserve is reached, not
+// counting the bytes claimed by uploads in progress, or -1 if the repository's disk isn't
+// checked. It fails with ErrInsufficientStorage if size bytes, or any bytes when size is
+// unknown, don't fit next to the claimed ones.
+func (s *fileManagerService) diskRoom(ctx context.Context, size int64) (int64, error) {
+	status, err := s.DiskStatus(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if status == nil {
+		return -1, nil
+	}
+
+	room := status.FreeBytes - status.ReserveBytes
+	if claimed := s.disk.used(); room-claimed <= 0 || size > room-claimed {
+		return 0, fmt.Errorf("%w: %d bytes free on disk with %d reserved and %d claimed by uploads in progress, %d requested",
+			ErrInsufficientStorage, status.FreeBytes, status.ReserveBytes, claimed, size)
+	}
+	return room, nil
+}
+
+// diskTracker counts the bytes claimed by uploads in progress, so concurrent uploads share
+// the room above the disk reserve instead of each getting all of it. An upload claims its
+// declared size up front and more as it reads past it, and gives its claim back once stored,
+// when its bytes show up in the disk's free space instead.
+type diskTracker struct {
+	mu      sync.Mutex
+	claimed int64
+}
+
+// used returns the bytes currently claimed
+func (d *diskTracker) used() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.claimed
+}
+
+// claim takes n more bytes, failing if the claims would exceed room
+func (d *diskTracker) claim(room, n int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.claimed+n > room {
+		return fmt.Errorf("%w: disk reserve reached", ErrInsufficientStorage)
+	}
+	d.claimed += n
+	return nil
+}
+
+// release gives back n claimed bytes
+func (d *diskTracker) release(n int64) {
+	d.mu.Lock()
+	d.claimed -= n
+	d.mu.Unlock()
+}
+
+// diskReader fails the upload once it reads more than it could claim of the room the disk
+// had when it started. The caller releases claimed once the upload is done.
+type diskReader struct {
+	r       io.Reader
+	d       *diskTracker
+	room    int64 // Bytes free above the reserve when the upload started
+	claimed int64 // Bytes claimed so far, starting with the declared size
+	n       int64 // Bytes read so far
+	err     error // Sticky once the room is used up
+}
+
+func (dr *diskReader) Read(p []byte) (int, error) {
+	if dr.err != nil {
+		return 0, dr.err
+	}
+	n, err := dr.r.Read(p)
+	if more := dr.n + int64(n) - dr.claimed; more > 0 {
+		if dr.err = dr.d.claim(dr.room, more); dr.err != nil {
+			return 0, dr.err
+		}
+		dr.claimed += more
+	}
+	dr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,93 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// diskRepository reports a filesystem with a fixed amount of free space
+type diskRepository struct {
+	repository.Repository
+	free int64
+}
+
+func (r *diskRepository) DiskSpace(ctx context.Context) (repository.DiskSpace, error) {
+	return repository.DiskSpace{TotalBytes: 1000, FreeBytes: r.free}, nil
+}
+
+// pausedReader returns its data, then waits for resume before reporting EOF
+type pausedReader struct {
+	data    string
+	read    chan struct{} // Closed once the data was read
+	resume  chan struct{}
+	drained bool
+}
+
+func newPausedReader(data string) *pausedReader {
+	return &pausedReader{data: data, read: make(chan struct{}), resume: make(chan struct{})}
+}
+
+func (p *pausedReader) Read(b []byte) (int, error) {
+	if p.data != "" {
+		n := copy(b, p.data)
+		p.data = p.data[n:]
+		return n, nil
+	}
+	if !p.drained {
+		p.drained = true
+		close(p.read)
+	}
+	<-p.resume
+	return 0, io.EOF
+}
+
+// TestDiskReserveParallelUploads checks that two uploads in progress can't both use the
+// room above the reserve: 50 bytes are free above it and each upload writes 30
+func TestDiskReserveParallelUploads(t *testing.T) {
+	for _, declared := range []bool{true, false} {
+		name := "undeclared"
+		if declared {
+			name = "declared"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r := &diskRepository{Repository: repository.NewMemoryRepository(), free: 150}
+			s := service.NewFileManagerService(r, service.WithDiskReserve(100))
+
+			upload := func(content io.Reader) error {
+				file := service.FileUpload{Filename: "a.bin", Content: content}
+				if declared {
+					file.Size = 30
+				}
+				_, err := s.PostFile(ctx, "tx", file)
+				return err
+			}
+
+			first := newPausedReader(strings.Repeat("x", 30))
+			done := make(chan error)
+			go func() { done <- upload(first) }()
+			<-first.read
+
+			err := upload(strings.NewReader(strings.Repeat("y", 30)))
+			if !errors.Is(err, service.ErrInsufficientStorage) {
+				t.Errorf("second upload: got %v, want ErrInsufficientStorage", err)
+			}
+
+			close(first.resume)
+			if err := <-done; err != nil {
+				t.Fatalf("first upload: %v", err)
+			}
+
+			// The finished upload gave its claim back
+			if err := upload(strings.NewReader(strings.Repeat("z", 30))); err != nil {
+				t.Errorf("upload after the first finished: %v", err)
+			}
+		})
+	}
+}
@@ -4,42 +4,44 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"strings"
+	"log"
+	"sync"
+	"time"
 
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
-	"github.com/google/uuid"
 )
 
 type fileManagerService struct {
 	repository repository.Repository
+	ids        storageid.Format
+	quota      quotaTracker
+	scrub      scrubTracker
+	uploads    uploadTracker
+	disk       diskTracker
+	usage      usageCache
+
+	diskReserve int64 // Bytes kept free on the repository's filesystem
 }
 
 // NewFileManagerService creates a new file manager service instance
-func NewFileManagerService(r repository.Repository) Service {
-	return &fileManagerService{
+func NewFileManagerService(r repository.Repository, opts ...Option) Service {
+	s := &fileManagerService{
 		repository: r,
+		ids:        storageid.Default,
 	}
-}
-
-// generateStorageID creates a 10-character alphanumeric storage ID
-// Uses Google's UUID package and extracts the first 10 alphanumeric characters
-// The ID is URL-safe and case-sensitive (preserves hex case)
-func generateStorageID() (string, error) {
-	id, err := uuid.NewRandom()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate storage ID: %w", err)
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
+}
 
-	// Remove hyphens and take first 10 characters
-	// UUID format: xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx
-	// After removing hyphens: 32 hex characters (0-9, a-f)
-	// Taking first 10 gives us a 10-character alphanumeric string
-	storageID := strings.ReplaceAll(id.String(), "-", "")
-	if len(storageID) < 10 {
-		return "", fmt.Errorf("generated UUID too short")
+// WithStorageIDFormat sets the format of generated and accepted storage IDs
+// It must match the gateway's; storageid.Default is used otherwise.
+func WithStorageIDFormat(f storageid.Format) Option {
+	return func(s *fileManagerService) {
+		s.ids = f
 	}
-
-	return storageID[:10], nil
 }
 
 // PostFile uploads a single file and creates a new storage location
@@ -50,32 +52,30 @@ func (s *fileManagerService) PostFile(ctx context.Context, transactionID string,
 	}
 
 	// Generate new storage ID
-	storageID, err := generateStorageID()
+	storageID, err := s.ids.Generate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate storage ID: %w", err)
+		return nil, err
 	}
 
 	// Save the file
-	if err := s.repository.SaveFile(ctx, storageID, file.Filename, file.Content); err != nil {
-		return nil, fmt.Errorf("failed to save file: %w", err)
-	}
-
-	// Get file info
-	files, err := s.repository.GetFilesByStorage(ctx, storageID)
+	info, err := s.saveFile(ctx, storageID, file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve file info: %w", err)
+		return nil, fmt.Errorf("failed to save file: %w", err)
 	}
 
 	return &UploadResult{
 		TransactionID: transactionID,
 		StorageID:     storageID,
-		Files:         files,
-		TotalSize:     file.Size,
+		Files:         []repository.FileInfo{info},
+		TotalSize:     info.Size,
+		Created:       true,
 	}, nil
 }
 
 // PostFiles uploads multiple files to a storage location
 // If storageID is empty, a new storage location is created
+// Either every file is stored or none is: the files are staged under transactionID and
+// only committed once all of them were received.
 func (s *fileManagerService) PostFiles(ctx context.Context, transactionID string, storageID string, files []FileUpload) (*UploadResult, error) {
 	// Validate transaction ID
 	if transactionID == "" {
@@ -87,37 +87,46 @@ func (s *fileManagerService) PostFiles(ctx context.Context, transactionID string
 	}
 
 	// Generate new storage ID if not provided
-	if storageID == "" {
+	created := storageID == ""
+	if created {
 		var err error
-		storageID, err = generateStorageID()
+		storageID, err = s.ids.Generate()
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate storage ID: %w", err)
+			return nil, err
 		}
-	} else if len(storageID) != 10 {
-		return nil, fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	} else if err := s.ids.Validate(storageID); err != nil {
+		return nil, err
 	}
 
-	var totalSize int64
-	// Save all files
+	if len(files) == 1 {
+		info, err := s.saveFile(ctx, storageID, files[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to save file %s: %w", files[0].Filename, err)
+		}
+		return &UploadResult{
+			TransactionID: transactionID,
+			StorageID:     storageID,
+			Files:         []repository.FileInfo{info},
+			TotalSize:     info.Size,
+			Created:       created,
+		}, nil
+	}
+
+	// Stage every file before storing any, so a failure leaves the storage as it was
 	for _, file := range files {
-		if err := s.repository.SaveFile(ctx, storageID, file.Filename, file.Content); err != nil {
+		if _, err := s.StageFile(ctx, transactionID, storageID, file); err != nil {
+			if abortErr := s.AbortUpload(ctx, transactionID); abortErr != nil {
+				log.Printf("Failed to abort upload %s: %v", transactionID, abortErr)
+			}
 			return nil, fmt.Errorf("failed to save file %s: %w", file.Filename, err)
 		}
-		totalSize += file.Size
 	}
-
-	// Get all file info
-	fileInfos, err := s.repository.GetFilesByStorage(ctx, storageID)
+	result, err := s.CommitUpload(ctx, transactionID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve file info: %w", err)
+		return nil, err
 	}
-
-	return &UploadResult{
-		TransactionID: transactionID,
-		StorageID:     storageID,
-		Files:         fileInfos,
-		TotalSize:     totalSize,
-	}, nil
+	result.Created = created
+	return result, nil
 }
 
 // GetFile retrieves a file by storage ID and filename
@@ -127,45 +136,126 @@ func (s *fileManagerService) GetFile(ctx context.Context, transactionID string,
 		return nil, fmt.Errorf("transaction ID is required")
 	}
 
-	if len(storageID) != 10 {
-		return nil, fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := s.ids.Validate(storageID); err != nil {
+		return nil, err
 	}
 	if filename == "" {
 		return nil, fmt.Errorf("filename cannot be empty")
 	}
 
-	return s.repository.GetFile(ctx, storageID, filename)
+	content, err := s.repository.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return nil, err
+	}
+	s.recordDownload(ctx, storageID, filename)
+	return content, nil
 }
 
-// GetFiles retrieves all files in a storage location
-func (s *fileManagerService) GetFiles(ctx context.Context, transactionID string, storageID string) ([]repository.FileInfo, error) {
+// GetFileRange retrieves part of a file by storage ID and filename
+func (s *fileManagerService) GetFileRange(ctx context.Context, transactionID string, storageID string, filename string, offset, length int64) (*repository.FileRange, error) {
 	// Validate transaction ID
 	if transactionID == "" {
 		return nil, fmt.Errorf("transaction ID is required")
 	}
 
-	if len(storageID) != 10 {
-		return nil, fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := s.ids.Validate(storageID); err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return nil, fmt.Errorf("filename cannot be empty")
+	}
+
+	fileRange, err := s.repository.GetFileRange(ctx, storageID, filename, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	// Only the first range counts, so resumed and chunked downloads count once
+	if offset == 0 {
+		s.recordDownload(ctx, storageID, filename)
+	}
+	return fileRange, nil
+}
+
+// GetFiles retrieves all files in a storage location with their manifest metadata
+func (s *fileManagerService) GetFiles(ctx context.Context, transactionID string, storageID string) (*StorageListing, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return nil, fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(storageID); err != nil {
+		return nil, err
+	}
+
+	files, err := s.repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &StorageListing{
+		StorageID: storageID,
+		Files:     files,
+	}
+	for _, file := range files {
+		listing.TotalSize += file.Size
 	}
 
-	return s.repository.GetFilesByStorage(ctx, storageID)
+	listing.CreatedAt, listing.ExpiresAt, err = s.storageTimes(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return listing, nil
 }
 
 // DeleteFile deletes a specific file from a storage location
-func (s *fileManagerService) DeleteFile(ctx context.Context, transactionID string, storageID string, filename string) error {
+func (s *fileManagerService) DeleteFile(ctx context.Context, transactionID string, storageID string, filename string) (repository.FileInfo, error) {
 	// Validate transaction ID
 	if transactionID == "" {
-		return fmt.Errorf("transaction ID is required")
+		return repository.FileInfo{}, fmt.Errorf("transaction ID is required")
 	}
 
-	if len(storageID) != 10 {
-		return fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := s.ids.Validate(storageID); err != nil {
+		return repository.FileInfo{}, err
 	}
 	if filename == "" {
-		return fmt.Errorf("filename cannot be empty")
+		return repository.FileInfo{}, fmt.Errorf("filename cannot be empty")
+	}
+
+	if s.quota.limits.CapacityBytes > 0 {
+		if err := s.quota.load(ctx, s.repository); err != nil {
+			return repository.FileInfo{}, err
+		}
+		unlock := s.quota.lock(storageID)
+		defer unlock()
 	}
 
-	return s.repository.DeleteFile(ctx, storageID, filename)
+	// Once deleted, the file can no longer be described
+	file, err := s.findFile(ctx, storageID, filename)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	if err := s.repository.DeleteFile(ctx, storageID, filename); err != nil {
+		return repository.FileInfo{}, err
+	}
+
+	// Give the file's bytes back to the global capacity
+	s.quota.release(storedSize(file))
+	return file, nil
+}
+
+// findFile returns the listing of one file of a storage
+func (s *fileManagerService) findFile(ctx context.Context, storageID, filename string) (repository.FileInfo, error) {
+	files, err := s.repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	for _, file := range files {
+		if file.Path == filename {
+			return file, nil
+		}
+	}
+	return repository.FileInfo{}, fmt.Errorf("%w: %s", repository.ErrFileNotFound, filename)
 }
 
 // DeleteFolder deletes an entire storage folder and all its files
@@ -175,9 +265,63 @@ func (s *fileManagerService) DeleteFolder(ctx context.Context, transactionID str
 		return fmt.Errorf("transaction ID is required")
 	}
 
-	if len(storageID) != 10 {
-		return fmt.Errorf("invalid storage ID: must be exactly 10 characters")
+	if err := s.ids.Validate(storageID); err != nil {
+		return err
+	}
+
+	if s.quota.limits.CapacityBytes <= 0 {
+		return s.repository.DeleteStorage(ctx, storageID)
+	}
+
+	// Give the storage's bytes back to the global capacity
+	if err := s.quota.load(ctx, s.repository); err != nil {
+		return err
+	}
+	unlock := s.quota.lock(storageID)
+	defer unlock()
+
+	size, _, err := s.storageUsage(ctx, storageID, "")
+	if err != nil {
+		return err
+	}
+	if err := s.repository.DeleteStorage(ctx, storageID); err != nil {
+		return err
+	}
+	s.quota.release(size)
+	return nil
+}
+
+// usageMaxAge is how long a usage report is reused, since computing one walks every storage
+const usageMaxAge = time.Minute
+
+// usageCache keeps the last usage report
+// Requests wait on mu while a report is computed, so they share one walk of the repository.
+type usageCache struct {
+	mu         sync.Mutex
+	usage      repository.Usage
+	measuredAt time.Time // Zero before the first report
+}
+
+// Usage reports logical and physical bytes held by the underlying repository
+// A report is reused for usageMaxAge.
+func (s *fileManagerService) Usage(ctx context.Context) (*repository.Usage, error) {
+	reporter, ok := s.repository.(repository.UsageReporter)
+	if !ok {
+		return nil, fmt.Errorf("repository does not support usage reporting")
+	}
+
+	s.usage.mu.Lock()
+	defer s.usage.mu.Unlock()
+	if !s.usage.measuredAt.IsZero() && time.Since(s.usage.measuredAt) < usageMaxAge {
+		usage := s.usage.usage
+		return &usage, nil
+	}
+
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute usage: %w", err)
 	}
+	s.usage.usage, s.usage.measuredAt = usage, time.Now()
 
-	return s.repository.DeleteStorage(ctx, storageID)
+	return &usage, nil
 }
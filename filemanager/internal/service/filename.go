@@ -0,0 +1,106 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrUnsafeFilename is returned for uploaded paths that try to leave their storage
+// It wraps repository.ErrInvalidFilename.
+var ErrUnsafeFilename = fmt.Errorf("%w: path leaves its storage", repository.ErrInvalidFilename)
+
+// maxSegmentBytes is the longest file or folder name most filesystems accept
+const maxSegmentBytes = 255
+
+// windowsReserved lists names Windows won't open as files, with or without an extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// safeFilename maps an uploaded path to the path it is stored under and the name shown to users
+// Both are NFC-normalized. The display name only loses control characters; the stored path also
+// replaces characters Windows forbids, trims trailing dots and spaces, escapes reserved device
+// names and shortens overlong names, so it can be stored and downloaded anywhere. Absolute paths
+// and ".." segments fail with ErrUnsafeFilename instead of being rewritten.
+func safeFilename(name string) (string, string, error) {
+	if !utf8.ValidString(name) {
+		name = strings.ToValidUTF8(name, "�")
+	}
+	display := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, norm.NFC.String(name))
+
+	// Windows clients may use backslashes
+	raw := strings.ReplaceAll(display, "\\", "/")
+	if strings.HasPrefix(raw, "/") || hasDriveLetter(raw) {
+		return "", "", fmt.Errorf("%w: %q is absolute", ErrUnsafeFilename, name)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(raw, "/") {
+		switch strings.TrimSpace(segment) {
+		case "", ".":
+			continue
+		case "..":
+			return "", "", fmt.Errorf("%w: %q contains ..", ErrUnsafeFilename, name)
+		}
+		segments = append(segments, safeSegment(segment))
+	}
+	if len(segments) == 0 {
+		return "", "", fmt.Errorf("%w: filename cannot be empty", repository.ErrInvalidFilename)
+	}
+
+	return strings.Join(segments, "/"), strings.TrimSpace(display), nil
+}
+
+// safeSegment makes one file or folder name safe on every filesystem
+func safeSegment(segment string) string {
+	segment = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, segment)
+	segment = strings.TrimLeft(segment, " ")
+	segment = strings.TrimRight(segment, ". ")
+	if segment == "" {
+		return "_"
+	}
+
+	base, _, _ := strings.Cut(segment, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(base))] {
+		segment = "_" + segment
+	}
+	return truncateSegment(segment)
+}
+
+// truncateSegment shortens a name to maxSegmentBytes on a character boundary, keeping its extension
+func truncateSegment(segment string) string {
+	if len(segment) <= maxSegmentBytes {
+		return segment
+	}
+	ext := ""
+	if i := strings.LastIndexByte(segment, '.'); i > 0 && len(segment)-i <= 16 {
+		ext = segment[i:]
+	}
+	stem := segment[:maxSegmentBytes-len(ext)]
+	for !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// hasDriveLetter reports whether a path starts with a Windows drive such as "C:"
+func hasDriveLetter(p string) bool {
+	return len(p) >= 2 && p[1] == ':' && (p[0] >= 'a' && p[0] <= 'z' || p[0] >= 'A' && p[0] <= 'Z')
+}
@@ -0,0 +1,128 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// stagedNames stages a file uploaded as name and returns the path it is stored under
+// and the name shown to users
+func stagedNames(t *testing.T, name string) (string, string, error) {
+	t.Helper()
+	s := service.NewFileManagerService(repository.NewMemoryRepository())
+	result, err := s.StageFile(context.Background(), "tx", "", service.FileUpload{
+		Filename: name,
+		Content:  strings.NewReader("x"),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return result.Files[0].Path, result.Files[0].OriginalName, nil
+}
+
+func TestUploadedNames(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		path, display string
+	}{
+		{"docs/a.txt", "docs/a.txt", "docs/a.txt"},
+		{`docs\sub\a.txt`, "docs/sub/a.txt", `docs\sub\a.txt`},
+		{"./docs//a.txt", "docs/a.txt", "./docs//a.txt"},
+
+		// Control characters are dropped from both names
+		{"a\x00b\x1f\x7f.txt", "ab.txt", "ab.txt"},
+		{"a\tb\n.txt", "ab.txt", "ab.txt"},
+
+		// Characters Windows forbids are only replaced in the stored path
+		{`a<b>c:d"e|f?g*h.txt`, "a_b_c_d_e_f_g_h.txt", `a<b>c:d"e|f?g*h.txt`},
+
+		// Trailing dots and spaces, which Windows drops
+		{"notes. . ", "notes", "notes. ."},
+		{"docs./a.txt", "docs/a.txt", "docs./a.txt"},
+		{" a.txt", "a.txt", "a.txt"},
+		{"...", "_", "..."},
+
+		// Reserved device names, with or without an extension and in any case
+		{"CON", "_CON", "CON"},
+		{"con.txt", "_con.txt", "con.txt"},
+		{"docs/COM1.tar.gz", "docs/_COM1.tar.gz", "docs/COM1.tar.gz"},
+		{"lpt9", "_lpt9", "lpt9"},
+		{"CONSOLE.txt", "CONSOLE.txt", "CONSOLE.txt"},
+		{"COM10", "COM10", "COM10"},
+
+		// Both names are NFC-normalized, so an é typed either way is the same file
+		{"cafe\u0301.txt", "caf\u00e9.txt", "caf\u00e9.txt"},
+	} {
+		path, display, err := stagedNames(t, tc.name)
+		if err != nil {
+			t.Errorf("%q: %v", tc.name, err)
+			continue
+		}
+		if path != tc.path || display != tc.display {
+			t.Errorf("%q stored as %q shown as %q, want %q and %q", tc.name, path, display, tc.path, tc.display)
+		}
+	}
+}
+
+func TestUnsafeUploadedNames(t *testing.T) {
+	for _, name := range []string{
+		"..",
+		"../a.txt",
+		"docs/../../a.txt",
+		"docs/..",
+		"docs/ .. /a.txt",
+		`..\a.txt`,
+		`docs\..\..\a.txt`,
+		"/etc/passwd",
+		"//server/share/a.txt",
+		`\Windows\a.txt`,
+		`C:\Windows\a.txt`,
+		"c:a.txt",
+	} {
+		if _, _, err := stagedNames(t, name); !errors.Is(err, service.ErrUnsafeFilename) {
+			t.Errorf("%q: got %v, want ErrUnsafeFilename", name, err)
+		}
+	}
+
+	for _, name := range []string{"", ".", "./", "\x00"} {
+		if _, _, err := stagedNames(t, name); !errors.Is(err, repository.ErrInvalidFilename) {
+			t.Errorf("%q: got %v, want ErrInvalidFilename", name, err)
+		}
+	}
+}
+
+func TestLongUploadedNames(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ext  string
+	}{
+		{strings.Repeat("a", 300) + ".txt", ".txt"},
+		{strings.Repeat("é", 200) + ".txt", ".txt"}, // The cut falls inside a two-byte é
+		{strings.Repeat("日", 100), ""},
+		{"docs/" + strings.Repeat("b", 300), ""},
+	} {
+		path, display, err := stagedNames(t, tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment := path[strings.LastIndexByte(path, '/')+1:]
+		if len(segment) > 255 || len(segment) < 250 {
+			t.Errorf("%.20q... stored under a name of %d bytes, want at most 255", tc.name, len(segment))
+		}
+		if !utf8.ValidString(path) {
+			t.Errorf("%.20q... truncated inside a character: %q", tc.name, path)
+		}
+		if !strings.HasSuffix(path, tc.ext) {
+			t.Errorf("%.20q... lost its extension: %q", tc.name, path)
+		}
+		if display != tc.name {
+			t.Errorf("display name %.20q... was shortened too", display)
+		}
+	}
+}
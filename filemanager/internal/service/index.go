@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// recordDownload counts a download in the repository's metadata index, if it keeps one
+// A failure is only logged, so it never fails the download itself.
+func (s *fileManagerService) recordDownload(ctx context.Context, storageID, filename string) {
+	index, ok := s.repository.(repository.MetadataIndex)
+	if !ok {
+		return
+	}
+	err := index.RecordDownload(ctx, storageID, filename)
+	if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		log.Printf("Failed to record download of %s in storage %s: %v", filename, storageID, err)
+	}
+}
+
+// storageTimes returns when a storage was created and expires, from the metadata index
+// when the repository keeps one and from the manifest otherwise. Both are zero if unknown.
+func (s *fileManagerService) storageTimes(ctx context.Context, storageID string) (time.Time, *time.Time, error) {
+	if index, ok := s.repository.(repository.MetadataIndex); ok {
+		info, err := index.Storage(ctx, storageID)
+		if err == nil {
+			return info.CreatedAt, info.ExpiresAt, nil
+		}
+		if errors.Is(err, repository.ErrStorageNotFound) {
+			return time.Time{}, nil, nil
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return time.Time{}, nil, err
+		}
+	}
+
+	// Storage-level fields are only available when the repository keeps manifests
+	if reader, ok := s.repository.(repository.ManifestReader); ok {
+		manifest, err := reader.Manifest(ctx, storageID)
+		if err != nil && !errors.Is(err, repository.ErrStorageNotFound) {
+			return time.Time{}, nil, err
+		}
+		return manifest.CreatedAt, manifest.ExpiresAt, nil
+	}
+	return time.Time{}, nil, nil
+}
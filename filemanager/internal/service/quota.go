@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// Errors returned when an upload does not fit
+// Callers can match them with errors.Is
+var (
+	ErrQuotaExceeded       = errors.New("storage quota exceeded")
+	ErrInsufficientStorage = errors.New("insufficient storage")
+)
+
+// Quota limits how many bytes the service accepts, counted as uploaded
+// Zero values mean unlimited.
+type Quota struct {
+	StorageBytes  int64 // Per storage ID
+	CapacityBytes int64 // Across every storage of the repository
+}
+
+// Option configures the file manager service
+type Option func(*fileManagerService)
+
+// WithQuota rejects uploads that would push a storage or the whole repository past q
+func WithQuota(q Quota) Option {
+	return func(s *fileManagerService) {
+		s.quota.limits = q
+	}
+}
+
+// quotaTracker enforces a Quota
+// Uploads to the same storage are serialized so its usage can't change between the
+// check and the write. Global usage is loaded from the repository once and then kept
+// up to date by the service, so it is only exact while this service is the only writer.
+type quotaTracker struct {
+	limits Quota
+
+	mu       sync.Mutex
+	used     int64 // Bytes held across all storages, valid once loaded
+	loaded   bool
+	storages map[string]*storageLock
+}
+
+type storageLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (q *quotaTracker) enabled() bool {
+	return q.limits.StorageBytes > 0 || q.limits.CapacityBytes > 0
+}
+
+// lock serializes uploads and deletes of one storage and returns the unlock function
+func (q *quotaTracker) lock(storageID string) func() {
+	q.mu.Lock()
+	if q.storages == nil {
+		q.storages = make(map[string]*storageLock)
+	}
+	entry, ok := q.storages[storageID]
+	if !ok {
+		entry = &storageLock{}
+		q.storages[storageID] = entry
+	}
+	entry.refs++
+	q.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		q.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(q.storages, storageID)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// load reads global usage from the repository the first time it is needed
+func (q *quotaTracker) load(ctx context.Context, r repository.Repository) error {
+	if q.limits.CapacityBytes <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.loaded {
+		return nil
+	}
+
+	reporter, ok := r.(repository.UsageReporter)
+	if !ok {
+		return fmt.Errorf("capacity limit requires a repository that reports usage")
+	}
+	usage, err := reporter.Usage(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to compute usage: %w", err)
+	}
+	q.used = usage.LogicalBytes
+	q.loaded = true
+	return nil
+}
+
+// check reports whether size more bytes fit in a storage currently holding storageUsed bytes
+func (q *quotaTracker) check(storageUsed, size int64) error {
+	if q.limits.StorageBytes > 0 && storageUsed+size > q.limits.StorageBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more requested", ErrQuotaExceeded, storageUsed, q.limits.StorageBytes, size)
+	}
+	if q.limits.CapacityBytes > 0 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.used+size > q.limits.CapacityBytes {
+			return fmt.Errorf("%w: %d of %d bytes used, %d more requested", ErrInsufficientStorage, q.used, q.limits.CapacityBytes, size)
+		}
+	}
+	return nil
+}
+
+// reserve accounts for n more bytes, failing if they don't fit the global capacity
+func (q *quotaTracker) reserve(n int64) error {
+	if q.limits.CapacityBytes <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used+n > q.limits.CapacityBytes {
+		return fmt.Errorf("%w: capacity of %d bytes reached", ErrInsufficientStorage, q.limits.CapacityBytes)
+	}
+	q.used += n
+	return nil
+}
+
+// release gives back n bytes of global capacity
+func (q *quotaTracker) release(n int64) {
+	if q.limits.CapacityBytes <= 0 {
+		return
+	}
+	q.mu.Lock()
+	q.used -= n
+	q.mu.Unlock()
+}
+
+// quotaReader fails the upload as soon as it reads more than fits
+// Bytes are reserved against the global capacity as they are read, so concurrent
+// uploads to different storages can't overshoot it together.
+type quotaReader struct {
+	r         io.Reader
+	q         *quotaTracker
+	remaining int64 // Bytes left in the storage quota, or -1 if unlimited
+	n         int64 // Bytes read and reserved so far
+	err       error // Sticky once the limit is hit
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	if qr.err != nil {
+		return 0, qr.err
+	}
+	n, err := qr.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	if qr.remaining >= 0 && qr.n+int64(n) > qr.remaining {
+		qr.err = fmt.Errorf("%w: limit of %d bytes per storage", ErrQuotaExceeded, qr.q.limits.StorageBytes)
+		return 0, qr.err
+	}
+	if qr.err = qr.q.reserve(int64(n)); qr.err != nil {
+		return 0, qr.err
+	}
+	qr.n += int64(n)
+	return n, err
+}
+
+// storageUsage returns the bytes a storage holds and those held by the file at filename, if any
+// Older versions of files count toward both.
+func (s *fileManagerService) storageUsage(ctx context.Context, storageID, filename string) (int64, int64, error) {
+	files, err := s.repository.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to compute storage usage: %w", err)
+	}
+
+	var used, existing int64
+	for _, file := range files {
+		size := storedSize(file)
+		used += size
+		if file.Path == filename {
+			existing = size
+		}
+	}
+	return used, existing, nil
+}
+
+// storedSize returns the bytes a file holds, its older versions included
+func storedSize(file repository.FileInfo) int64 {
+	size := file.Size
+	for _, version := range file.Versions {
+		size += version.Size
+	}
+	return size
+}
+
+// freeing runs fn, which removes content from a storage, and gives the bytes it
+// freed back to the global capacity; content fn restores is taken from it instead
+func (s *fileManagerService) freeing(ctx context.Context, storageID string, fn func() error) error {
+	if s.quota.limits.CapacityBytes <= 0 {
+		return fn()
+	}
+
+	if err := s.quota.load(ctx, s.repository); err != nil {
+		return err
+	}
+	unlock := s.quota.lock(storageID)
+	defer unlock()
+
+	before, _, err := s.storageUsage(ctx, storageID, "")
+	if err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	after, _, err := s.storageUsage(ctx, storageID, "")
+	if err != nil {
+		return err
+	}
+	s.quota.release(before - after)
+	return nil
+}
+
+// saveFile stores one file, enforcing the quota when one is configured and the disk reserve
+// The file is stored under a sanitized path, keeping the name it was uploaded as for display.
+func (s *fileManagerService) saveFile(ctx context.Context, storageID string, file FileUpload) (repository.FileInfo, error) {
+	stored, display, err := uploadNames(file)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	return s.storeFile(repository.WithOriginalName(ctx, display), storageID, stored, file, nil)
+}
+
+// uploadNames returns the sanitized path a file is stored under and the name recorded for display
+func uploadNames(file FileUpload) (string, string, error) {
+	stored, display, err := safeFilename(file.Filename)
+	if err != nil {
+		return "", "", err
+	}
+	if file.OriginalName != "" {
+		display = file.OriginalName
+	}
+	return stored, display, nil
+}
+
+// storeFile writes the content of file under path, enforcing the quota when one is configured
+// and the disk reserve. tx is set when the file is staged by a multi-file upload: the bytes the
+// upload already staged count toward the storage's quota, and a staged file replaces nothing.
+func (s *fileManagerService) storeFile(ctx context.Context, storageID string, path string, file FileUpload, tx *uploadTransaction) (repository.FileInfo, error) {
+	room, err := s.diskRoom(ctx, file.Size)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	if room >= 0 {
+		if err := s.disk.claim(room, file.Size); err != nil {
+			return repository.FileInfo{}, err
+		}
+		content := &diskReader{r: file.Content, d: &s.disk, room: room, claimed: file.Size}
+		defer func() { s.disk.release(content.claimed) }()
+		file.Content = content
+	}
+
+	if !s.quota.enabled() {
+		return s.repository.SaveFile(ctx, storageID, path, file.Content)
+	}
+
+	if err := s.quota.load(ctx, s.repository); err != nil {
+		return repository.FileInfo{}, err
+	}
+	unlock := s.quota.lock(storageID)
+	defer unlock()
+
+	// A file stored under the same name is replaced, so its bytes don't count,
+	// unless the repository keeps it as an older version
+	used, existing, err := s.storageUsage(ctx, storageID, path)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	_, versioned := s.repository.(repository.Versioner)
+	if versioned {
+		existing = 0
+	}
+	// Staged files aren't listed, and aren't versioned until they are committed
+	var pending int64
+	if tx != nil {
+		pending, versioned = tx.size, false
+	}
+	// Fail fast on the declared size before reading any content
+	if err := s.quota.check(used+pending-existing, file.Size); err != nil {
+		return repository.FileInfo{}, err
+	}
+
+	content := &quotaReader{r: file.Content, q: &s.quota, remaining: -1}
+	if s.quota.limits.StorageBytes > 0 {
+		content.remaining = s.quota.limits.StorageBytes - used - pending + existing
+	}
+	info, err := s.repository.SaveFile(ctx, storageID, path, content)
+	if err != nil {
+		s.quota.release(content.n)
+		return repository.FileInfo{}, err
+	}
+
+	if info.Path != path {
+		// Stored under a new name by the conflict policy, so nothing was replaced
+		if s.quota.limits.StorageBytes > 0 && used+content.n > s.quota.limits.StorageBytes {
+			s.repository.DeleteFile(ctx, storageID, info.Path)
+			s.quota.release(content.n)
+			return repository.FileInfo{}, fmt.Errorf("%w: limit of %d bytes per storage", ErrQuotaExceeded, s.quota.limits.StorageBytes)
+		}
+		existing = 0
+	}
+	s.quota.release(existing)
+
+	if versioned {
+		// Older versions dropped past the repository's limit give their bytes back
+		if after, _, err := s.storageUsage(ctx, storageID, ""); err == nil && used+content.n > after {
+			s.quota.release(used + content.n - after)
+		}
+	}
+
+	return info, nil
+}
+
+// CheckQuota reports whether size more bytes fit in a storage, in the repository and on its disk
+func (s *fileManagerService) CheckQuota(ctx context.Context, storageID string, size int64) error {
+	if _, err := s.diskRoom(ctx, size); err != nil {
+		return err
+	}
+	if !s.quota.enabled() {
+		return nil
+	}
+	if err := s.quota.load(ctx, s.repository); err != nil {
+		return err
+	}
+
+	var used int64
+	if storageID != "" {
+		var err error
+		if used, _, err = s.storageUsage(ctx, storageID, ""); err != nil {
+			return err
+		}
+	}
+	return s.quota.check(used, size)
+}
@@ -0,0 +1,147 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// post uploads content as a.txt to a new storage, declaring size, and returns the storage ID
+// The content is read one byte at a time, so a limit can be hit partway through.
+func post(s service.Service, content string, size int64) (string, error) {
+	result, err := s.PostFile(context.Background(), "upload", service.FileUpload{
+		Filename: "a.txt",
+		Content:  iotest.OneByteReader(strings.NewReader(content)),
+		Size:     size,
+	})
+	if err != nil {
+		return "", err
+	}
+	return result.StorageID, nil
+}
+
+func TestQuotaErrors(t *testing.T) {
+	ctx := context.Background()
+	s := service.NewFileManagerService(repository.NewMemoryRepository(),
+		service.WithQuota(service.Quota{StorageBytes: 5, CapacityBytes: 8}))
+
+	// Past the limit of one storage
+	_, err := post(s, "123456", 6)
+	if !errors.Is(err, service.ErrQuotaExceeded) || errors.Is(err, service.ErrInsufficientStorage) {
+		t.Errorf("upload over the storage quota: got %v, want only ErrQuotaExceeded", err)
+	}
+
+	// Past the capacity of the whole repository, while each storage is within its limit
+	if _, err := post(s, "1234", 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := post(s, "1234", 4); err != nil {
+		t.Fatal(err)
+	}
+	_, err = post(s, "1", 1)
+	if !errors.Is(err, service.ErrInsufficientStorage) || errors.Is(err, service.ErrQuotaExceeded) {
+		t.Errorf("upload over the capacity: got %v, want only ErrInsufficientStorage", err)
+	}
+
+	if err := s.CheckQuota(ctx, "", 6); !errors.Is(err, service.ErrQuotaExceeded) {
+		t.Errorf("CheckQuota over the storage quota: got %v, want ErrQuotaExceeded", err)
+	}
+	if err := s.CheckQuota(ctx, "", 1); !errors.Is(err, service.ErrInsufficientStorage) {
+		t.Errorf("CheckQuota over the capacity: got %v, want ErrInsufficientStorage", err)
+	}
+}
+
+// An upload that sends more than it declared is cut off as its content is read
+func TestQuotaReaderCutsOff(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		quota service.Quota
+		want  error
+	}{
+		{"storage quota", service.Quota{StorageBytes: 10}, service.ErrQuotaExceeded},
+		{"capacity", service.Quota{CapacityBytes: 10}, service.ErrInsufficientStorage},
+	} {
+		for _, size := range []int64{3, 0} { // Lying and undeclared lengths
+			r := repository.NewMemoryRepository()
+			s := service.NewFileManagerService(r, service.WithQuota(tc.quota))
+
+			if _, err := post(s, strings.Repeat("x", 20), size); !errors.Is(err, tc.want) {
+				t.Errorf("%s, %d bytes declared: got %v, want %v", tc.name, size, err, tc.want)
+			}
+			if n := storageCount(t, r); n != 0 {
+				t.Errorf("%s, %d bytes declared: %d storages kept after the cut-off upload", tc.name, size, n)
+			}
+			// The bytes read before the cut-off were given back
+			if _, err := post(s, strings.Repeat("x", 10), 0); err != nil {
+				t.Errorf("%s, %d bytes declared: upload up to the limit after the cut-off: %v", tc.name, size, err)
+			}
+		}
+	}
+}
+
+// Deleting, pruning and aborting give their bytes back to the capacity
+func TestQuotaReleased(t *testing.T) {
+	ctx := context.Background()
+	full := func(t *testing.T, s service.Service) {
+		t.Helper()
+		if _, err := post(s, "1234", 4); !errors.Is(err, service.ErrInsufficientStorage) {
+			t.Fatalf("upload while the capacity is used up: got %v, want ErrInsufficientStorage", err)
+		}
+	}
+	fits := func(t *testing.T, s service.Service) {
+		t.Helper()
+		if _, err := post(s, "1234", 4); err != nil {
+			t.Errorf("upload once bytes were given back: %v", err)
+		}
+	}
+	quota := service.WithQuota(service.Quota{CapacityBytes: 10})
+
+	t.Run("delete", func(t *testing.T) {
+		s := service.NewFileManagerService(repository.NewMemoryRepository(), quota)
+		storageID, err := post(s, "12345678", 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full(t, s)
+		if _, err := s.DeleteFile(ctx, "delete", storageID, "a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		fits(t, s)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		r, err := repository.NewVersioningRepository(repository.NewMemoryRepository(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := service.NewFileManagerService(r, quota)
+		storageID, err := post(s, "1234", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first version is kept, so the storage holds 8 bytes
+		if _, err := s.PostFiles(ctx, "upload", storageID, []service.FileUpload{{Filename: "a.txt", Content: strings.NewReader("5678")}}); err != nil {
+			t.Fatal(err)
+		}
+		full(t, s)
+		if pruned, err := s.PruneVersions(ctx, "prune", storageID, 0); err != nil || pruned != 1 {
+			t.Fatalf("PruneVersions: pruned %d, %v; want 1", pruned, err)
+		}
+		fits(t, s)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		s := service.NewFileManagerService(repository.NewMemoryRepository(), quota)
+		stage(t, s, "tx", "", "a.txt", "12345678")
+		full(t, s)
+		if err := s.AbortUpload(ctx, "tx"); err != nil {
+			t.Fatal(err)
+		}
+		fits(t, s)
+	})
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// ErrScrubRunning is returned by Scrub while another pass is in progress
+var ErrScrubRunning = errors.New("integrity scrub already running")
+
+// errUnreadable wraps failures reading a file that could be opened, e.g. content
+// that no longer decompresses, which the scrubber counts as corruption
+var errUnreadable = errors.New("unreadable content")
+
+// ScrubReport describes one pass of the integrity scrubber
+type ScrubReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time // Zero while the pass is running
+	Checked    int       // Files re-hashed
+	Bytes      int64     // Bytes re-hashed
+	Corrupted  int       // Files found corrupted by this pass
+	Known      int       // Files skipped because an earlier pass marked them corrupted
+	Failed     int       // Files or storages that could not be checked
+}
+
+// ScrubStatus reports what the integrity scrubber has done since the service started
+type ScrubStatus struct {
+	Running        bool
+	Passes         int          // Completed passes
+	CorruptedFiles int          // Files marked corrupted across all passes
+	Last           *ScrubReport // Current pass while running, otherwise the last one; nil before the first
+}
+
+// WithScrubRate caps how fast the integrity scrubber reads stored files; 0 means unlimited
+func WithScrubRate(bytesPerSecond int64) Option {
+	return func(s *fileManagerService) {
+		s.scrub.rate = bytesPerSecond
+	}
+}
+
+// scrubTracker holds the scrubber's configuration and progress
+type scrubTracker struct {
+	rate int64 // Bytes per second, 0 for unlimited
+
+	mu     sync.Mutex
+	status ScrubStatus
+}
+
+// update applies fn to the status under the lock
+func (t *scrubTracker) update(fn func(status *ScrubStatus)) {
+	t.mu.Lock()
+	fn(&t.status)
+	t.mu.Unlock()
+}
+
+// ScrubStatus implements Service
+func (s *fileManagerService) ScrubStatus() ScrubStatus {
+	s.scrub.mu.Lock()
+	defer s.scrub.mu.Unlock()
+
+	status := s.scrub.status
+	if status.Last != nil {
+		last := *status.Last
+		status.Last = &last
+	}
+	return status
+}
+
+// Scrub re-hashes every file of every storage and compares it with the SHA-256
+// recorded at upload, marking mismatches so they can't be downloaded.
+// Files are read at most at the configured rate; older versions and files uploaded
+// before checksums were recorded are not checked.
+func (s *fileManagerService) Scrub(ctx context.Context) (ScrubReport, error) {
+	reader, ok := s.repository.(repository.ManifestReader)
+	if !ok {
+		return ScrubReport{}, fmt.Errorf("integrity scrub requires a repository that keeps manifests")
+	}
+	marker, ok := s.repository.(repository.IntegrityMarker)
+	if !ok {
+		return ScrubReport{}, fmt.Errorf("integrity scrub requires a repository that can mark corrupted files")
+	}
+
+	report := &ScrubReport{StartedAt: time.Now().UTC()}
+	var running bool
+	s.scrub.update(func(status *ScrubStatus) {
+		running = status.Running
+		if !running {
+			status.Running = true
+			status.Last = report
+		}
+	})
+	if running {
+		return ScrubReport{}, ErrScrubRunning
+	}
+
+	err := s.scrubStorages(ctx, reader, marker, report)
+
+	var result ScrubReport
+	s.scrub.update(func(status *ScrubStatus) {
+		status.Running = false
+		if err == nil {
+			status.Passes++
+		}
+		report.FinishedAt = time.Now().UTC()
+		result = *report
+	})
+	return result, err
+}
+
+// scrubStorages checks every storage, page by page
+func (s *fileManagerService) scrubStorages(ctx context.Context, reader repository.ManifestReader, marker repository.IntegrityMarker, report *ScrubReport) error {
+	cursor := ""
+	for {
+		page, err := s.repository.ListStorages(ctx, cursor, 0)
+		if err != nil {
+			return fmt.Errorf("failed to list storages: %w", err)
+		}
+		for _, storage := range page.Storages {
+			if err := s.scrubStorage(ctx, reader, marker, storage.ID, report); err != nil {
+				return err
+			}
+		}
+		if page.Next == "" {
+			return nil
+		}
+		cursor = page.Next
+	}
+}
+
+// scrubStorage checks the files of one storage, failing only if ctx is done
+func (s *fileManagerService) scrubStorage(ctx context.Context, reader repository.ManifestReader, marker repository.IntegrityMarker, storageID string, report *ScrubReport) error {
+	manifest, err := reader.Manifest(ctx, storageID)
+	if errors.Is(err, repository.ErrStorageNotFound) {
+		return nil // Deleted since it was listed, or stored before manifests existed
+	}
+	if err != nil {
+		log.Printf("Integrity scrub skipped storage %s: %v", storageID, err)
+		s.scrub.update(func(*ScrubStatus) { report.Failed++ })
+		return nil
+	}
+
+	for filename, entry := range manifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.SHA256 == "" {
+			continue
+		}
+		if entry.CorruptedAt != nil {
+			s.scrub.update(func(*ScrubStatus) { report.Known++ })
+			continue
+		}
+
+		sum, n, err := s.hashFile(ctx, storageID, filename)
+		if errors.Is(err, repository.ErrFileNotFound) {
+			continue // Deleted since the manifest was read
+		}
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errUnreadable) || errors.Is(err, repository.ErrFileCorrupted) {
+			sum = err.Error()
+		} else if err != nil {
+			log.Printf("Integrity scrub could not read %s in storage %s: %v", filename, storageID, err)
+			s.scrub.update(func(*ScrubStatus) { report.Failed++ })
+			continue
+		}
+		s.scrub.update(func(*ScrubStatus) {
+			report.Checked++
+			report.Bytes += n
+		})
+		if sum == entry.SHA256 {
+			continue
+		}
+
+		// The file may have been replaced while it was read; only the recorded content is marked
+		marked, err := marker.MarkCorrupted(ctx, storageID, filename, entry.SHA256)
+		if err != nil {
+			log.Printf("Failed to mark %s in storage %s as corrupted: %v", filename, storageID, err)
+			s.scrub.update(func(*ScrubStatus) { report.Failed++ })
+			continue
+		}
+		if marked {
+			log.Printf("Integrity check failed for %s in storage %s: expected sha256 %s, got %s", filename, storageID, entry.SHA256, sum)
+			s.scrub.update(func(status *ScrubStatus) {
+				report.Corrupted++
+				status.CorruptedFiles++
+			})
+		}
+	}
+	return nil
+}
+
+// hashFile returns the hex-encoded SHA-256 and size of a stored file, read at the scrub rate
+func (s *fileManagerService) hashFile(ctx context.Context, storageID, filename string) (string, int64, error) {
+	content, err := s.repository.GetFile(ctx, storageID, filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer content.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, &throttledReader{ctx: ctx, r: content, rate: s.scrub.rate, start: time.Now()})
+	if err != nil {
+		return "", n, fmt.Errorf("%w: %v", errUnreadable, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// throttledReader slows reads down to rate bytes per second on average
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64 // 0 for unlimited
+	start time.Time
+	n     int64
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if tr.rate > 0 && int64(len(p)) > tr.rate {
+		p = p[:tr.rate]
+	}
+	n, err := tr.r.Read(p)
+	tr.n += int64(n)
+	if tr.rate <= 0 || n == 0 {
+		return n, err
+	}
+
+	due := time.Duration(float64(tr.n) / float64(tr.rate) * float64(time.Second))
+	if wait := due - time.Since(tr.start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-tr.ctx.Done():
+			return n, tr.ctx.Err()
+		}
+	}
+	return n, err
+}
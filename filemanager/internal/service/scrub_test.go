@@ -0,0 +1,134 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// newScrubbedService returns a service over a local repository in dir that keeps manifests
+func newScrubbedService(t *testing.T, dir string, opts ...service.Option) service.Service {
+	t.Helper()
+	local, err := repository.NewLocalRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := repository.NewManifestRepository(local, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.NewFileManagerService(r, opts...)
+}
+
+// flipByte changes the first byte of the file named name somewhere under dir
+func flipByte(t *testing.T, dir, name string) {
+	t.Helper()
+	var found string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() == name {
+			found = path
+		}
+		return err
+	})
+	if found == "" {
+		t.Fatalf("%s not found under %s", name, dir)
+	}
+	content, err := os.ReadFile(found)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0xff
+	if err := os.WriteFile(found, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubMarksFlippedByte(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := newScrubbedService(t, dir)
+	storageID := upload(t, s, "a.txt", "alpha", "b.txt", "beta")
+
+	flipByte(t, dir, "a.txt")
+	report, err := s.Scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 2 || report.Corrupted != 1 || report.Failed != 0 {
+		t.Errorf("scrub checked %d files and found %d corrupted (%d failed), want 2 and 1", report.Checked, report.Corrupted, report.Failed)
+	}
+
+	// The corrupted file is no longer served; the intact one still is
+	if _, err := s.GetFile(ctx, "download", storageID, "a.txt"); !errors.Is(err, repository.ErrFileCorrupted) {
+		t.Errorf("download of the corrupted file: got %v, want ErrFileCorrupted", err)
+	}
+	content, err := s.GetFile(ctx, "download", storageID, "b.txt")
+	if err != nil {
+		t.Fatalf("download of the intact file: %v", err)
+	}
+	content.Close()
+
+	// A later pass counts the file as known instead of marking it again
+	report, err = s.Scrub(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 1 || report.Corrupted != 0 || report.Known != 1 {
+		t.Errorf("second scrub checked %d, found %d corrupted and %d known; want 1, 0 and 1", report.Checked, report.Corrupted, report.Known)
+	}
+	if status := s.ScrubStatus(); status.Passes != 2 || status.CorruptedFiles != 1 || status.Running {
+		t.Errorf("scrub status %+v, want 2 passes that found 1 corrupted file", status)
+	}
+}
+
+func TestScrubRate(t *testing.T) {
+	dir := t.TempDir()
+	s := newScrubbedService(t, dir, service.WithScrubRate(8000))
+	upload(t, s, "a.txt", strings.Repeat("a", 2000))
+
+	// 2000 bytes at 8000 bytes per second take a quarter of a second
+	start := time.Now()
+	if _, err := s.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("scrub of 2000 bytes at 8000 bytes/s took %v, want about 250ms", elapsed)
+	}
+}
+
+func TestScrubRunsOnce(t *testing.T) {
+	dir := t.TempDir()
+	s := newScrubbedService(t, dir, service.WithScrubRate(100))
+	upload(t, s, "a.txt", strings.Repeat("a", 1000))
+
+	// The first pass takes ten seconds unless it is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Scrub(ctx)
+		done <- err
+	}()
+	for !s.ScrubStatus().Running {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := s.Scrub(context.Background()); !errors.Is(err, service.ErrScrubRunning) {
+		t.Errorf("scrub while another runs: got %v, want ErrScrubRunning", err)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled scrub: got %v, want context.Canceled", err)
+	}
+	if status := s.ScrubStatus(); status.Running || status.Passes != 0 {
+		t.Errorf("scrub status %+v after the cancelled pass, want no completed pass", status)
+	}
+}
@@ -3,23 +3,38 @@ package service
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
 )
 
 // FileUpload represents a file to be uploaded
+// Filename is sanitized into the path the file is stored under (see safeFilename)
 type FileUpload struct {
 	Filename string
 	Content  io.Reader
 	Size     int64
+
+	OriginalName string // Name recorded for display; defaults to the normalized Filename
 }
 
 // UploadResult represents the result of a file upload operation
+// Files lists only the files uploaded by this operation, under the names they were stored as
 type UploadResult struct {
 	TransactionID string
 	StorageID     string
 	Files         []repository.FileInfo
 	TotalSize     int64
+	Created       bool // The storage was created for these files
+}
+
+// StorageListing represents the files of a storage location along with its manifest
+type StorageListing struct {
+	StorageID string
+	CreatedAt time.Time  // Zero if the storage has no manifest
+	ExpiresAt *time.Time // nil if the storage never expires
+	Files     []repository.FileInfo
+	TotalSize int64
 }
 
 // Service interface defines the business logic layer for file management
@@ -29,22 +44,96 @@ type Service interface {
 	PostFile(ctx context.Context, transactionID string, file FileUpload) (*UploadResult, error)
 
 	// PostFiles uploads multiple files to a storage location (creates new storage if storageID is empty)
+	// Either every file is stored or none is.
 	// transactionID uniquely identifies this transaction in the saga pattern
 	PostFiles(ctx context.Context, transactionID string, storageID string, files []FileUpload) (*UploadResult, error)
 
-	// GetFile retrieves a file by storage ID and filename
+	// StageFile adds a file to the multi-file upload transactionID without making it visible
+	// The first file starts the upload in storageID, or in a new storage if it is empty;
+	// later files may leave storageID empty. The result lists the file under the name it will be committed as.
+	StageFile(ctx context.Context, transactionID string, storageID string, file FileUpload) (*UploadResult, error)
+
+	// CommitUpload stores every file staged by the upload transactionID under its own name
+	// If a file can't be committed, the whole upload is aborted.
+	CommitUpload(ctx context.Context, transactionID string) (*UploadResult, error)
+
+	// AbortUpload discards the files staged by the upload transactionID, and its storage if the upload created it
+	AbortUpload(ctx context.Context, transactionID string) error
+
+	// AbortStaleUploads aborts the uploads that received no file for the upload timeout
+	// and returns how many were aborted
+	AbortStaleUploads(ctx context.Context) (int, error)
+
+	// GetFile retrieves a file by storage ID and filename, counting the download when the repository keeps an index
 	// transactionID uniquely identifies this transaction in the saga pattern
 	GetFile(ctx context.Context, transactionID string, storageID string, filename string) (io.ReadCloser, error)
 
-	// GetFiles retrieves all files in a storage location
+	// GetFileRange retrieves length bytes of a file starting at offset; length <= 0 reads to the end
+	// A range starting at offset 0 counts as a download, like GetFile.
 	// transactionID uniquely identifies this transaction in the saga pattern
-	GetFiles(ctx context.Context, transactionID string, storageID string) ([]repository.FileInfo, error)
+	GetFileRange(ctx context.Context, transactionID string, storageID string, filename string, offset, length int64) (*repository.FileRange, error)
 
-	// DeleteFile deletes a specific file from a storage location
+	// GetFiles retrieves all files in a storage location with their manifest metadata
+	// The listing is read from the repository's metadata index when it keeps one.
 	// transactionID uniquely identifies this transaction in the saga pattern
-	DeleteFile(ctx context.Context, transactionID string, storageID string, filename string) error
+	GetFiles(ctx context.Context, transactionID string, storageID string) (*StorageListing, error)
+
+	// CopyFiles copies files of srcStorageID (all of them if filenames is empty) into dstStorageID,
+	// creating a new storage location if dstStorageID is empty
+	// transactionID uniquely identifies this transaction in the saga pattern
+	CopyFiles(ctx context.Context, transactionID string, srcStorageID string, filenames []string, dstStorageID string) (*UploadResult, error)
+
+	// DeleteFile deletes a specific file from a storage location and returns the file as it was listed
+	// transactionID uniquely identifies this transaction in the saga pattern
+	DeleteFile(ctx context.Context, transactionID string, storageID string, filename string) (repository.FileInfo, error)
+
+	// GetFileVersion retrieves length bytes of one version of a file starting at offset,
+	// failing with ErrVersioningDisabled if the repository keeps no versions
+	// transactionID uniquely identifies this transaction in the saga pattern
+	GetFileVersion(ctx context.Context, transactionID string, storageID string, filename string, version int, offset, length int64) (*repository.FileRange, error)
+
+	// DeleteFileVersion deletes one version of a file; deleting the current version restores the newest older one
+	// It returns the file as that version was stored.
+	// transactionID uniquely identifies this transaction in the saga pattern
+	DeleteFileVersion(ctx context.Context, transactionID string, storageID string, filename string, version int) (repository.FileInfo, error)
+
+	// PruneVersions drops all but the keep newest older versions of every file in a storage
+	// and returns how many versions were removed
+	// transactionID uniquely identifies this transaction in the saga pattern
+	PruneVersions(ctx context.Context, transactionID string, storageID string, keep int) (int, error)
 
 	// DeleteFolder deletes an entire storage folder and all its files
 	// transactionID uniquely identifies this transaction in the saga pattern
 	DeleteFolder(ctx context.Context, transactionID string, storageID string) error
+
+	// RestoreFile brings back the most recently deleted file stored under filename,
+	// failing with ErrTrashDisabled if the repository deletes immediately
+	// transactionID uniquely identifies this transaction in the saga pattern
+	RestoreFile(ctx context.Context, transactionID string, storageID string, filename string) (repository.FileInfo, error)
+
+	// RestoreFolder brings back a deleted storage folder with all its files
+	// transactionID uniquely identifies this transaction in the saga pattern
+	RestoreFolder(ctx context.Context, transactionID string, storageID string) error
+
+	// PurgeTrash permanently removes what was deleted longer ago than the trash retention
+	// and returns how many files and storages were removed
+	PurgeTrash(ctx context.Context) (int, error)
+
+	// Usage reports logical and physical bytes held by the underlying repository
+	// Computing a report walks every storage, so one is reused for up to a minute.
+	Usage(ctx context.Context) (*repository.Usage, error)
+
+	// DiskStatus reports the free space of the repository's filesystem, or nil if it isn't stored on one
+	DiskStatus(ctx context.Context) (*DiskStatus, error)
+
+	// Scrub re-hashes every stored file and marks the ones whose SHA-256 no longer matches
+	// the upload's, so downloading them fails with repository.ErrFileCorrupted
+	Scrub(ctx context.Context) (ScrubReport, error)
+
+	// ScrubStatus reports the progress and findings of the integrity scrubber
+	ScrubStatus() ScrubStatus
+
+	// CheckQuota reports whether size more bytes fit in a storage (a new one if storageID is empty),
+	// in the repository and on its disk, failing with ErrQuotaExceeded or ErrInsufficientStorage otherwise
+	CheckQuota(ctx context.Context, storageID string, size int64) error
 }
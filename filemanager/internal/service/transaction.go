@@ -0,0 +1,444 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// Errors returned for multi-file uploads that can no longer take files
+// Callers can match them with errors.Is
+var (
+	ErrUploadNotFound = errors.New("upload transaction not found")
+	ErrUploadAborted  = errors.New("upload transaction was aborted")
+)
+
+// DefaultUploadTimeout is how long a multi-file upload may go without a new file before it is aborted
+const DefaultUploadTimeout = 15 * time.Minute
+
+// WithUploadTimeout sets how long a multi-file upload may go without a new file
+// before AbortStaleUploads discards it
+func WithUploadTimeout(timeout time.Duration) Option {
+	return func(s *fileManagerService) {
+		s.uploads.timeout = timeout
+	}
+}
+
+// uploadTransaction is a multi-file upload whose files are staged in the storage's staging
+// folder, out of its listing, until the upload commits
+type uploadTransaction struct {
+	mu        sync.Mutex
+	id        string
+	storageID string
+	generated bool // The storage ID was generated for the upload, so the storage holds only its files
+	files     []stagedFile
+	size      int64 // Bytes currently staged
+	aborted   bool  // Kept until it goes stale, so files arriving late are refused
+	updatedAt time.Time
+}
+
+// stagedFile is a file of an upload waiting for the commit
+type stagedFile struct {
+	staged string // Path the file is staged under
+	path   string // Sanitized path it is committed under
+	name   string // Name recorded for display
+	size   int64
+}
+
+// uploadTracker holds the open multi-file uploads
+// Uploads live in memory, so files staged before a restart stay in their storage's
+// staging folder: they count as stored bytes but are never listed.
+type uploadTracker struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	open map[string]*uploadTransaction
+}
+
+// get returns the upload transactionID, or nil
+func (t *uploadTracker) get(transactionID string) *uploadTransaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.open[transactionID]
+}
+
+// start returns the upload transactionID, calling create to start it if it isn't open
+func (t *uploadTracker) start(transactionID string, create func() (*uploadTransaction, error)) (*uploadTransaction, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tx, ok := t.open[transactionID]; ok {
+		return tx, nil
+	}
+	tx, err := create()
+	if err != nil {
+		return nil, err
+	}
+	if t.open == nil {
+		t.open = make(map[string]*uploadTransaction)
+	}
+	t.open[transactionID] = tx
+	return tx, nil
+}
+
+// remove forgets an upload
+func (t *uploadTracker) remove(transactionID string) {
+	t.mu.Lock()
+	delete(t.open, transactionID)
+	t.mu.Unlock()
+}
+
+// all returns the open uploads
+func (t *uploadTracker) all() []*uploadTransaction {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	txs := make([]*uploadTransaction, 0, len(t.open))
+	for _, tx := range t.open {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// StageFile adds a file to a multi-file upload without making it visible
+// The first file starts the upload in storageID, or in a new storage if it is empty.
+func (s *fileManagerService) StageFile(ctx context.Context, transactionID string, storageID string, file FileUpload) (*UploadResult, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return nil, fmt.Errorf("transaction ID is required")
+	}
+	if storageID != "" {
+		if err := s.ids.Validate(storageID); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.uploads.start(transactionID, func() (*uploadTransaction, error) {
+		return s.newUpload(transactionID, storageID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.aborted {
+		return nil, fmt.Errorf("%w: %s", ErrUploadAborted, transactionID)
+	}
+	if storageID != "" && storageID != tx.storageID {
+		return nil, fmt.Errorf("upload %s goes to storage %s, not %s", transactionID, tx.storageID, storageID)
+	}
+
+	stored, display, err := uploadNames(file)
+	if err != nil {
+		return nil, err
+	}
+	// Files are staged under their position, so two files with the same name don't collide
+	staged := repository.StagingPath(transactionID, strconv.Itoa(len(tx.files))+"/"+stored)
+	info, err := s.storeFile(repository.WithStagedPaths(ctx), tx.storageID, staged, file, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx.files = append(tx.files, stagedFile{staged: info.Path, path: stored, name: display, size: info.Size})
+	tx.size += info.Size
+	tx.updatedAt = time.Now()
+
+	return &UploadResult{
+		TransactionID: transactionID,
+		StorageID:     tx.storageID,
+		Files: []repository.FileInfo{{
+			Path:         stored,
+			Size:         info.Size,
+			OriginalName: display,
+			ContentType:  info.ContentType,
+			SHA256:       info.SHA256,
+		}},
+		TotalSize: info.Size,
+	}, nil
+}
+
+// newUpload starts an upload into storageID, or into a new storage if it is empty
+// A storage the caller names is never removed by the upload, even if it holds no files:
+// its deleted files may wait in the trash, and other uploads may commit into it.
+func (s *fileManagerService) newUpload(transactionID, storageID string) (*uploadTransaction, error) {
+	tx := &uploadTransaction{id: transactionID, storageID: storageID, updatedAt: time.Now()}
+	if storageID == "" {
+		id, err := s.ids.Generate()
+		if err != nil {
+			return nil, err
+		}
+		tx.storageID, tx.generated = id, true
+	}
+	return tx, nil
+}
+
+// CommitUpload stores every file staged by an upload under its own name, replacing files
+// stored under the same names. If a file can't be committed, the upload is aborted: the files
+// it committed so far are removed again and the files they replaced are put back.
+func (s *fileManagerService) CommitUpload(ctx context.Context, transactionID string) (*UploadResult, error) {
+	tx := s.uploads.get(transactionID)
+	if tx == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUploadNotFound, transactionID)
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.aborted {
+		return nil, fmt.Errorf("%w: %s", ErrUploadAborted, transactionID)
+	}
+	if len(tx.files) == 0 {
+		return nil, fmt.Errorf("upload %s has no files", transactionID)
+	}
+
+	var committed []repository.FileInfo
+	err := s.settling(ctx, tx, func() error {
+		existing, err := s.repository.GetFilesByStorage(ctx, tx.storageID)
+		if err != nil {
+			return fmt.Errorf("failed to list files: %w", err)
+		}
+		originals := make(map[string]repository.FileInfo, len(existing))
+		for _, file := range existing {
+			originals[file.Path] = file
+		}
+		backups := make(map[string]replacedFile)
+
+		for len(tx.files) > 0 {
+			file := tx.files[0]
+			original, replaces := originals[file.path]
+			if _, done := backups[file.path]; replaces && !done {
+				backup, err := s.backUpFile(ctx, tx, original)
+				if err != nil {
+					s.undoCommit(ctx, tx, committed, backups)
+					return fmt.Errorf("failed to back up file %s: %w", file.path, err)
+				}
+				backups[file.path] = backup
+			}
+
+			info, err := s.commitFile(ctx, tx, file)
+			if err != nil {
+				s.undoCommit(ctx, tx, committed, backups)
+				return fmt.Errorf("failed to commit file %s: %w", file.path, err)
+			}
+			committed = append(committed, info)
+			tx.files = tx.files[1:]
+			tx.size -= file.size
+		}
+
+		staged := repository.WithStagedPaths(ctx)
+		for _, backup := range backups {
+			if err := s.repository.DeleteFile(staged, tx.storageID, backup.staged); err != nil {
+				log.Printf("Failed to remove backup of %s in storage %s: %v", backup.path, tx.storageID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if abortErr := s.abort(ctx, tx); abortErr != nil {
+			log.Printf("Failed to abort upload %s: %v", transactionID, abortErr)
+		}
+		return nil, err
+	}
+	s.uploads.remove(transactionID)
+
+	var totalSize int64
+	for _, info := range committed {
+		totalSize += info.Size
+	}
+	return &UploadResult{
+		TransactionID: transactionID,
+		StorageID:     tx.storageID,
+		Files:         committed,
+		TotalSize:     totalSize,
+		Created:       tx.generated,
+	}, nil
+}
+
+// replacedFile is a file an upload is about to replace, copied to the staging folder
+// so a failed commit can put it back
+type replacedFile struct {
+	staged string // Path the copy is staged under
+	path   string
+	name   string // Name recorded for display
+}
+
+// copyWithin copies a file of tx's storage from one path to another
+func (s *fileManagerService) copyWithin(ctx context.Context, tx *uploadTransaction, from, to string) error {
+	content, err := s.repository.GetFile(ctx, tx.storageID, from)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = s.repository.SaveFile(ctx, tx.storageID, to, content)
+	return err
+}
+
+// backUpFile copies a file an upload replaces to the upload's staging folder
+func (s *fileManagerService) backUpFile(ctx context.Context, tx *uploadTransaction, original repository.FileInfo) (replacedFile, error) {
+	backup := replacedFile{
+		// Staged files are numbered, so this can't collide with them
+		staged: repository.StagingPath(tx.id, "replaced/"+original.Path),
+		path:   original.Path,
+		name:   original.OriginalName,
+	}
+	return backup, s.copyWithin(repository.WithStagedPaths(ctx), tx, original.Path, backup.staged)
+}
+
+// undoCommit removes the files a failed commit stored and puts back the files they replaced
+// A new storage is removed as a whole by abort instead. Files that can't be put back are
+// logged and their copy is kept in the staging folder.
+func (s *fileManagerService) undoCommit(ctx context.Context, tx *uploadTransaction, committed []repository.FileInfo, backups map[string]replacedFile) {
+	if tx.generated {
+		return
+	}
+
+	// Uploaded files never go to the trash
+	remove := repository.WithoutTrash(ctx)
+	for _, done := range committed {
+		if _, replaced := backups[done.Path]; replaced {
+			continue
+		}
+		err := s.repository.DeleteFile(remove, tx.storageID, done.Path)
+		if err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+			log.Printf("Failed to remove %s from storage %s after a failed commit: %v", done.Path, tx.storageID, err)
+		}
+	}
+
+	staged := repository.WithStagedPaths(ctx)
+	for _, backup := range backups {
+		restore := repository.WithOriginalName(staged, backup.name)
+		if err := s.copyWithin(restore, tx, backup.staged, backup.path); err != nil {
+			log.Printf("Failed to put back %s in storage %s, a copy is kept as %s: %v", backup.path, tx.storageID, backup.staged, err)
+			continue
+		}
+		if err := s.repository.DeleteFile(staged, tx.storageID, backup.staged); err != nil {
+			log.Printf("Failed to remove backup of %s in storage %s: %v", backup.path, tx.storageID, err)
+		}
+	}
+}
+
+// commitFile copies a staged file to its own name and drops the staged copy
+func (s *fileManagerService) commitFile(ctx context.Context, tx *uploadTransaction, file stagedFile) (repository.FileInfo, error) {
+	staged := repository.WithStagedPaths(ctx)
+	content, err := s.repository.GetFile(staged, tx.storageID, file.staged)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	defer content.Close()
+
+	info, err := s.repository.SaveFile(repository.WithOriginalName(ctx, file.name), tx.storageID, file.path, content)
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	if err := s.repository.DeleteFile(staged, tx.storageID, file.staged); err != nil {
+		log.Printf("Failed to remove staged copy of %s in storage %s: %v", file.path, tx.storageID, err)
+	}
+	return info, nil
+}
+
+// AbortUpload discards the files staged by an upload, and its storage if the upload created it
+// Files sent for the upload afterwards are refused.
+func (s *fileManagerService) AbortUpload(ctx context.Context, transactionID string) error {
+	tx := s.uploads.get(transactionID)
+	if tx == nil {
+		return fmt.Errorf("%w: %s", ErrUploadNotFound, transactionID)
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.aborted {
+		return nil
+	}
+	return s.abort(ctx, tx)
+}
+
+// abort discards what an upload staged and marks it aborted; the caller holds tx.mu
+func (s *fileManagerService) abort(ctx context.Context, tx *uploadTransaction) error {
+	tx.aborted = true
+	tx.updatedAt = time.Now()
+
+	return s.settling(ctx, tx, func() error {
+		if tx.generated {
+			// No one else knows the generated ID, so the storage only holds the upload's files
+			// and skips the trash
+			err := s.repository.DeleteStorage(repository.WithoutTrash(ctx), tx.storageID)
+			if err != nil && !errors.Is(err, repository.ErrStorageNotFound) {
+				return fmt.Errorf("failed to remove storage %s: %w", tx.storageID, err)
+			}
+			tx.files, tx.size = nil, 0
+			return nil
+		}
+
+		staged := repository.WithStagedPaths(ctx)
+		for len(tx.files) > 0 {
+			file := tx.files[0]
+			if err := s.repository.DeleteFile(staged, tx.storageID, file.staged); err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+				return fmt.Errorf("failed to remove staged file %s: %w", file.path, err)
+			}
+			tx.files = tx.files[1:]
+			tx.size -= file.size
+		}
+		return nil
+	})
+}
+
+// settling runs fn, which commits or discards files staged by tx, and gives the bytes it
+// freed back to the global capacity; staged bytes were taken from it when they were uploaded
+func (s *fileManagerService) settling(ctx context.Context, tx *uploadTransaction, fn func() error) error {
+	if s.quota.limits.CapacityBytes <= 0 {
+		return fn()
+	}
+
+	if err := s.quota.load(ctx, s.repository); err != nil {
+		return err
+	}
+	unlock := s.quota.lock(tx.storageID)
+	defer unlock()
+
+	before, _, err := s.storageUsage(ctx, tx.storageID, "")
+	if err != nil {
+		return err
+	}
+	before += tx.size
+	fnErr := fn()
+	after, _, err := s.storageUsage(ctx, tx.storageID, "")
+	if err == nil {
+		s.quota.release(before - after - tx.size)
+	}
+	return fnErr
+}
+
+// AbortStaleUploads aborts the uploads that received no file for the upload timeout and
+// forgets aborted ones after the same time. It returns how many uploads were aborted.
+func (s *fileManagerService) AbortStaleUploads(ctx context.Context) (int, error) {
+	timeout := s.uploads.timeout
+	if timeout <= 0 {
+		timeout = DefaultUploadTimeout
+	}
+
+	aborted := 0
+	var firstErr error
+	for _, tx := range s.uploads.all() {
+		tx.mu.Lock()
+		switch {
+		case time.Since(tx.updatedAt) < timeout:
+		case tx.aborted:
+			s.uploads.remove(tx.id)
+		default:
+			if err := s.abort(ctx, tx); err != nil {
+				log.Printf("Failed to abort stale upload %s: %v", tx.id, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				aborted++
+			}
+		}
+		tx.mu.Unlock()
+	}
+	return aborted, firstErr
+}
@@ -0,0 +1,144 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository/repotest"
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/service"
+)
+
+// failingRepository fails to store one path
+type failingRepository struct {
+	repository.Repository
+	fail string
+}
+
+func (r *failingRepository) SaveFile(ctx context.Context, storageID string, filename string, content io.Reader) (repository.FileInfo, error) {
+	if filename == r.fail {
+		return repository.FileInfo{}, errors.New("disk failure")
+	}
+	return r.Repository.SaveFile(ctx, storageID, filename, content)
+}
+
+// newTrashRepository returns a repository keeping deleted files for an hour
+func newTrashRepository(t *testing.T) repository.Repository {
+	t.Helper()
+	r, err := repository.NewTrashRepository(repository.NewMemoryRepository(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// stage adds files, given as alternating names and contents, to the upload transactionID
+func stage(t *testing.T, s service.Service, transactionID, storageID string, files ...string) string {
+	t.Helper()
+	for i := 0; i+1 < len(files); i += 2 {
+		result, err := s.StageFile(context.Background(), transactionID, storageID, service.FileUpload{
+			Filename: files[i],
+			Content:  strings.NewReader(files[i+1]),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storageID = result.StorageID
+	}
+	return storageID
+}
+
+func TestFailedCommitRestoresReplacedFiles(t *testing.T) {
+	ctx := context.Background()
+	trash := newTrashRepository(t)
+	r := &failingRepository{Repository: trash}
+	s := service.NewFileManagerService(r)
+
+	storageID := stage(t, s, "tx1", "", "a.txt", "old", "keep.txt", "kept")
+	if _, err := s.CommitUpload(ctx, "tx1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.txt replaces a file and c.txt is new, then b.txt fails
+	stage(t, s, "tx2", storageID, "a.txt", "new", "c.txt", "new", "b.txt", "new")
+	r.fail = "b.txt"
+	if _, err := s.CommitUpload(ctx, "tx2"); err == nil {
+		t.Fatal("commit succeeded although b.txt can't be stored")
+	}
+
+	if got := repotest.MustRead(t, r, storageID, "a.txt"); got != "old" {
+		t.Errorf("a.txt holds %q after the failed commit, want the replaced content", got)
+	}
+	files, err := r.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Path)
+	}
+	if strings.Join(names, ",") != "a.txt,keep.txt" {
+		t.Errorf("storage holds %v after the failed commit, want a.txt,keep.txt", names)
+	}
+	// The files of the failed upload were never shared, so they aren't kept in the trash
+	if _, err := trash.(repository.Trash).RestoreFile(ctx, storageID, "c.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("RestoreFile of a file removed by the failed commit: got %v, want ErrFileNotFound", err)
+	}
+}
+
+func TestFailedCommitRemovesCreatedStorage(t *testing.T) {
+	ctx := context.Background()
+	trash := newTrashRepository(t)
+	s := service.NewFileManagerService(&failingRepository{Repository: trash, fail: "b.txt"})
+
+	storageID := stage(t, s, "tx", "", "a.txt", "new", "b.txt", "new")
+	if _, err := s.CommitUpload(ctx, "tx"); err == nil {
+		t.Fatal("commit succeeded although b.txt can't be stored")
+	}
+
+	files, err := trash.GetFilesByStorage(ctx, storageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("storage created by the failed commit still holds %d files", len(files))
+	}
+	if err := trash.(repository.Trash).RestoreStorage(ctx, storageID); !errors.Is(err, repository.ErrStorageNotFound) {
+		t.Errorf("RestoreStorage of the storage created by the failed commit: got %v, want ErrStorageNotFound", err)
+	}
+}
+
+// A storage whose files are all in the trash is still the caller's: an upload into it
+// removes only its own files when it ends without committing
+func TestAbortKeepsNamedStorage(t *testing.T) {
+	ctx := context.Background()
+	trash := newTrashRepository(t)
+	s := service.NewFileManagerService(trash)
+
+	storageID := stage(t, s, "tx1", "", "a.txt", "old")
+	if _, err := s.CommitUpload(ctx, "tx1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteFile(ctx, "delete", storageID, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	stage(t, s, "tx2", storageID, "b.txt", "new")
+	if err := s.AbortUpload(ctx, "tx2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.RestoreFile(ctx, "restore", storageID, "a.txt"); err != nil {
+		t.Fatalf("RestoreFile after an aborted upload into the storage: %v", err)
+	}
+	if got := repotest.MustRead(t, trash, storageID, "a.txt"); got != "old" {
+		t.Errorf("restored a.txt holds %q, want old", got)
+	}
+	if _, err := trash.GetFile(ctx, storageID, "b.txt"); !errors.Is(err, repository.ErrFileNotFound) {
+		t.Errorf("GetFile of the aborted upload's file: got %v, want ErrFileNotFound", err)
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// ErrTrashDisabled is returned by restore operations when the repository deletes immediately
+var ErrTrashDisabled = errors.New("trash is not enabled")
+
+// trash returns the repository's trash operations
+func (s *fileManagerService) trash() (repository.Trash, error) {
+	trash, ok := s.repository.(repository.Trash)
+	if !ok {
+		return nil, ErrTrashDisabled
+	}
+	return trash, nil
+}
+
+// RestoreFile brings back the most recently deleted file stored under filename
+// Restored bytes count toward the global capacity again but are not checked against it.
+func (s *fileManagerService) RestoreFile(ctx context.Context, transactionID string, storageID string, filename string) (repository.FileInfo, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return repository.FileInfo{}, fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(storageID); err != nil {
+		return repository.FileInfo{}, err
+	}
+	if filename == "" {
+		return repository.FileInfo{}, fmt.Errorf("filename cannot be empty")
+	}
+
+	trash, err := s.trash()
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+
+	var info repository.FileInfo
+	err = s.freeing(ctx, storageID, func() error {
+		var err error
+		info, err = trash.RestoreFile(ctx, storageID, filename)
+		return err
+	})
+	return info, err
+}
+
+// RestoreFolder brings back a deleted storage folder with all its files
+func (s *fileManagerService) RestoreFolder(ctx context.Context, transactionID string, storageID string) error {
+	// Validate transaction ID
+	if transactionID == "" {
+		return fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(storageID); err != nil {
+		return err
+	}
+
+	trash, err := s.trash()
+	if err != nil {
+		return err
+	}
+	return s.freeing(ctx, storageID, func() error {
+		return trash.RestoreStorage(ctx, storageID)
+	})
+}
+
+// PurgeTrash permanently removes what was deleted longer ago than the trash retention
+func (s *fileManagerService) PurgeTrash(ctx context.Context) (int, error) {
+	trash, err := s.trash()
+	if err != nil {
+		return 0, err
+	}
+	return trash.PurgeTrash(ctx)
+}
@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/edgarcoime/Cthulhu-filemanager/internal/repository"
+)
+
+// ErrVersioningDisabled is returned by version operations when the repository keeps no versions
+var ErrVersioningDisabled = errors.New("file versioning is not enabled")
+
+// versioner returns the repository's version operations
+func (s *fileManagerService) versioner() (repository.Versioner, error) {
+	versioner, ok := s.repository.(repository.Versioner)
+	if !ok {
+		return nil, ErrVersioningDisabled
+	}
+	return versioner, nil
+}
+
+// GetFileVersion retrieves part of one version of a file
+func (s *fileManagerService) GetFileVersion(ctx context.Context, transactionID string, storageID string, filename string, version int, offset, length int64) (*repository.FileRange, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return nil, fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(storageID); err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return nil, fmt.Errorf("filename cannot be empty")
+	}
+	if version <= 0 {
+		return nil, fmt.Errorf("invalid version: %d", version)
+	}
+
+	versioner, err := s.versioner()
+	if err != nil {
+		return nil, err
+	}
+	return versioner.GetFileVersionRange(ctx, storageID, filename, version, offset, length)
+}
+
+// DeleteFileVersion deletes one version of a file
+// Deleting the current version restores the newest older one
+func (s *fileManagerService) DeleteFileVersion(ctx context.Context, transactionID string, storageID string, filename string, version int) (repository.FileInfo, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return repository.FileInfo{}, fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(storageID); err != nil {
+		return repository.FileInfo{}, err
+	}
+	if filename == "" {
+		return repository.FileInfo{}, fmt.Errorf("filename cannot be empty")
+	}
+	if version <= 0 {
+		return repository.FileInfo{}, fmt.Errorf("invalid version: %d", version)
+	}
+
+	versioner, err := s.versioner()
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	var deleted repository.FileInfo
+	err = s.freeing(ctx, storageID, func() error {
+		file, err := s.findFile(ctx, storageID, filename)
+		if err != nil {
+			return err
+		}
+		if deleted, err = fileVersion(file, version); err != nil {
+			return err
+		}
+		return versioner.DeleteFileVersion(ctx, storageID, filename, version)
+	})
+	if err != nil {
+		return repository.FileInfo{}, err
+	}
+	return deleted, nil
+}
+
+// fileVersion describes one version of a listed file as it was stored
+func fileVersion(file repository.FileInfo, version int) (repository.FileInfo, error) {
+	versions := file.Versions
+	file.Versions = nil
+	if version == file.Version {
+		return file, nil
+	}
+	for _, v := range versions {
+		if v.Version == version {
+			file.Version = v.Version
+			file.Size = v.Size
+			file.ContentType = v.ContentType
+			file.SHA256 = v.SHA256
+			file.UploadedAt = v.UploadedAt
+			file.Corrupted = false
+			return file, nil
+		}
+	}
+	return repository.FileInfo{}, fmt.Errorf("%w: %s version %d", repository.ErrVersionNotFound, file.Path, version)
+}
+
+// PruneVersions drops all but the keep newest older versions of every file in a storage
+func (s *fileManagerService) PruneVersions(ctx context.Context, transactionID string, storageID string, keep int) (int, error) {
+	// Validate transaction ID
+	if transactionID == "" {
+		return 0, fmt.Errorf("transaction ID is required")
+	}
+
+	if err := s.ids.Validate(storageID); err != nil {
+		return 0, err
+	}
+	if keep < 0 {
+		return 0, fmt.Errorf("invalid number of versions to keep: %d", keep)
+	}
+
+	versioner, err := s.versioner()
+	if err != nil {
+		return 0, err
+	}
+
+	var pruned int
+	err = s.freeing(ctx, storageID, func() error {
+		var err error
+		pruned, err = versioner.PruneVersions(ctx, storageID, keep)
+		return err
+	})
+	return pruned, err
+}
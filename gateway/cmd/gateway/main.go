@@ -5,11 +5,15 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/edgarcoime/Cthulhu-gateway/internal/handlers"
 	"github.com/edgarcoime/Cthulhu-gateway/internal/pkg"
 	"github.com/edgarcoime/Cthulhu-gateway/internal/routes"
 	"github.com/edgarcoime/Cthulhu-gateway/internal/services"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/tus"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -21,8 +25,10 @@ func main() {
 	ctx := context.Background()
 	corsSettings := cors.New(cors.Config{
 		AllowOrigins: pkg.CORS_ORIGIN,
-		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
+		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS,HEAD,PATCH",
+		// Resumable uploads send and read the tus headers
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, " + strings.Join(handlers.TusHeaders, ", "),
+		ExposeHeaders: strings.Join(handlers.TusHeaders, ", "),
 	})
 	customLogger := logger.New(logger.Config{
 		// 2005-03-19 15:10:26,618 - simple_example - DEBUG - debug mess
@@ -40,6 +46,9 @@ func main() {
 	}()
 	serviceContainer.StartListeners()
 
+	// Remove resumable uploads abandoned past their expiry
+	go purgeUploads(serviceContainer.Uploads, time.Hour)
+
 	// ===== START FIBER =====
 	// Configure Fiber with increased body size limit for file uploads
 	// Set to 100MB to allow for large file uploads
@@ -73,3 +82,20 @@ func main() {
 		log.Fatalf("Failed to strart server: %v\n", err)
 	}
 }
+
+// purgeUploads removes expired resumable uploads every interval
+func purgeUploads(uploads *tus.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := uploads.PurgeExpired()
+		if err != nil {
+			log.Printf("Failed to purge expired uploads: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired upload(s)", purged)
+		}
+	}
+}
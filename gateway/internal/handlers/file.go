@@ -8,6 +8,7 @@ import (
 
 	"github.com/edgarcoime/Cthulhu-gateway/internal/pkg"
 	"github.com/edgarcoime/Cthulhu-gateway/internal/presenter"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/services"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -28,26 +29,20 @@ func FileAccess() fiber.Handler {
 		id := c.Params("id")
 		var fileList []presenter.FileInfo
 
-		res := presenter.FileAccessSuccessResponse(id, &fileList)
+		res := presenter.FileAccessSuccessResponse(id, nil, nil, &fileList)
 		return c.JSON(res)
 	}
 }
 
-func FileDownload() fiber.Handler {
+func FileDownload(s *services.Container) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// Get the ID and filename from URL parameters
 		id := c.Params("id")
 		filename := c.Params("filename")
 
 		// Validate the ID format (same validation as FileAccess)
-		if len(id) != 10 {
-			return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Invalid ID format. Must be exactly 10 characters."))
-		}
-
-		for _, char := range id {
-			if !((char >= 'a' && char <= 'z') || (char >= '0' && char <= '9')) {
-				return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Invalid ID format. Only lowercase letters and numbers are allowed."))
-			}
+		if err := s.StorageIDs.Validate(id); err != nil {
+			return c.Status(400).JSON(presenter.FileDownloadErrorResponse(err.Error()))
 		}
 
 		// Check if the session folder exists
@@ -0,0 +1,191 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/services"
+	svchandlers "github.com/edgarcoime/Cthulhu-gateway/internal/services/handlers"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/tus"
+	"github.com/gofiber/fiber/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// reply is what the fake filemanager answers a request with
+// A successful download sends content as a single chunk.
+type reply struct {
+	response messages.FileManagerResponse
+	content  []byte
+}
+
+// fakeFilemanager is a Broker answering each request topic with the function set for it,
+// the way the filemanager answers the gateway through the exchange
+type fakeFilemanager struct {
+	mu       sync.Mutex
+	queues   map[string]chan amqp.Delivery // By queue name
+	bindings map[string]chan amqp.Delivery // By routing key
+	requests map[string][][]byte           // Request bodies by topic
+	answers  map[string]func(body []byte) reply
+}
+
+func newFakeFilemanager() *fakeFilemanager {
+	return &fakeFilemanager{
+		queues:   make(map[string]chan amqp.Delivery),
+		bindings: make(map[string]chan amqp.Delivery),
+		requests: make(map[string][][]byte),
+		answers:  make(map[string]func(body []byte) reply),
+	}
+}
+
+// answer sets how requests published under topic are answered
+func (f *fakeFilemanager) answer(topic string, fn func(body []byte) reply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers[topic] = fn
+}
+
+func (f *fakeFilemanager) DeclareExchange(name, kind string, durable, autoDelete, internal, noWait bool) error {
+	return nil
+}
+
+func (f *fakeFilemanager) DeclareQueue(name string, durable, autoDelete, exclusive, noWait bool) (amqp.Queue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name = fmt.Sprintf("queue-%d", len(f.queues))
+	f.queues[name] = make(chan amqp.Delivery, 1)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (f *fakeFilemanager) QueueBind(queue, routingKey, exchange string, noWait bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bindings[routingKey] = f.queues[queue]
+	return nil
+}
+
+func (f *fakeFilemanager) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool) (<-chan amqp.Delivery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queues[queue], nil
+}
+
+func (f *fakeFilemanager) PublishMessage(ctx context.Context, exchange, routingKey string, contentType string, message []byte) error {
+	var request struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.Unmarshal(message, &request); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[routingKey] = append(f.requests[routingKey], message)
+	fn, ok := f.answers[routingKey]
+	if !ok {
+		return fmt.Errorf("unexpected request to %s", routingKey)
+	}
+
+	r := fn(message)
+	r.response.TransactionID = request.TransactionID
+	if r.response.Success && r.content != nil {
+		if r.response.Data == nil {
+			r.response.Data = map[string]interface{}{}
+		}
+		r.response.Data["total_chunks"] = 1
+		r.response.Data["total_size"] = len(r.content)
+	}
+	body, err := json.Marshal(r.response)
+	if err != nil {
+		return err
+	}
+	operation := strings.TrimPrefix(routingKey, "filemanager.")
+	f.bindings[fmt.Sprintf("%s.%s.%s", messages.TopicFileManagerResponse, operation, request.TransactionID)] <- amqp.Delivery{Body: body}
+
+	if r.response.Success && r.content != nil {
+		chunk, err := json.Marshal(messages.FileChunkResponse{
+			TransactionID: request.TransactionID,
+			TotalChunks:   1,
+			Content:       base64.StdEncoding.EncodeToString(r.content),
+			IsLastChunk:   true,
+		})
+		if err != nil {
+			return err
+		}
+		f.bindings[fmt.Sprintf("%s.%s", messages.TopicFileManagerGetFileChunk, request.TransactionID)] <- amqp.Delivery{Body: chunk}
+	}
+	return nil
+}
+
+// uploads decodes the single-message uploads the filemanager received
+func (f *fakeFilemanager) uploads(t *testing.T) []messages.FileUploadRequest {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var uploads []messages.FileUploadRequest
+	for _, body := range f.requests[messages.TopicFileManagerPostFile] {
+		var upload messages.FileUploadRequest
+		if err := json.Unmarshal(body, &upload); err != nil {
+			t.Fatal(err)
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads
+}
+
+// storeUploads answers uploads like the filemanager storing them in abcdefghij
+// An upload fails with insufficient storage while failures is above 0, counting down.
+func storeUploads(failures int) func(body []byte) reply {
+	var mu sync.Mutex
+	return func(body []byte) reply {
+		var upload messages.FileUploadRequest
+		json.Unmarshal(body, &upload)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return reply{response: messages.FileManagerResponse{Error: "disk full", ErrorCode: messages.ErrorCodeInsufficientStorage}}
+		}
+		return reply{response: messages.FileManagerResponse{Success: true, StorageID: "abcdefghij", TotalSize: upload.Size,
+			Files: []messages.FileInfo{{Filename: upload.Filename, Path: upload.Filename, Size: upload.Size, OriginalName: upload.Filename}}}}
+	}
+}
+
+// newServices returns the services of a gateway talking to fm, keeping resumable uploads in dir
+func newServices(t *testing.T, fm *fakeFilemanager, dir string, maxSize int64) *services.Container {
+	t.Helper()
+	store, err := tus.NewStore(dir, time.Hour, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &services.Container{
+		FileHandler: svchandlers.NewFileHandler(fm, context.Background()),
+		StorageIDs:  storageid.Default,
+		Uploads:     store,
+	}
+}
+
+// do serves req on app and returns the response with its body
+func do(t *testing.T, app *fiber.App, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
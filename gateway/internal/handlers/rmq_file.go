@@ -2,6 +2,13 @@ package handlers
 
 import (
 	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,6 +16,7 @@ import (
 	"github.com/edgarcoime/Cthulhu-gateway/internal/presenter"
 	"github.com/edgarcoime/Cthulhu-gateway/internal/services"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 func RMQFileUpload(s *services.Container) fiber.Handler {
@@ -31,32 +39,44 @@ func RMQFileUpload(s *services.Container) fiber.Handler {
 
 		// Get storage ID from query parameter (optional)
 		storageID := c.Query("storage_id", "")
+		if storageID != "" {
+			if err := s.StorageIDs.Validate(storageID); err != nil {
+				return c.Status(400).JSON(presenter.FileUploadErrorResponse(err))
+			}
+		}
+
+		// Several files are staged in one upload and only stored once all of them arrived,
+		// so a failure part way leaves nothing behind; a single file is stored directly
+		uploadTransactionID := ""
+		if len(files) > 1 {
+			uploadTransactionID = uuid.New().String()
+		}
+		fail := func(status int, err error) error {
+			if uploadTransactionID != "" {
+				go abortUpload(s, uploadTransactionID)
+			}
+			return c.Status(status).JSON(presenter.FileUploadErrorResponse(err))
+		}
 
 		var uploadedFiles []presenter.File
 		var finalStorageID string
-		uploadedFileNames := make(map[string]bool) // Track uploaded files to avoid duplicates
-		var lastResponse *messages.FileManagerResponse
+		var totalSize int64
 
 		// Upload files sequentially, reusing storageID from first file
 		for i, file := range files {
+			// Folder uploads keep their relative path, e.g. "docs/a.txt"
+			filePath := uploadPath(file)
+
 			// Open the uploaded file
 			fileHeader, err := file.Open()
 			if err != nil {
-				return c.Status(400).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("failed to open file %s: %w", file.Filename, err)))
+				return fail(400, fmt.Errorf("failed to open file %s: %w", filePath, err))
 			}
 
 			// Get file size from the multipart file header
 			fileSize := file.Size
 
-			// Calculate timeout based on file size: 10 seconds per MB, minimum 30 seconds, maximum 5 minutes
-			timeoutSeconds := int64(fileSize/(1024*1024))*10 + 30
-			if timeoutSeconds < 30 {
-				timeoutSeconds = 30
-			}
-			if timeoutSeconds > 300 {
-				timeoutSeconds = 300 // 5 minutes max
-			}
-			timeout := time.Duration(timeoutSeconds) * time.Second
+			timeout := uploadTimeout(fileSize)
 
 			// Use storageID from first file for subsequent files
 			currentStorageID := storageID
@@ -66,21 +86,22 @@ func RMQFileUpload(s *services.Container) fiber.Handler {
 
 			// Upload file via RabbitMQ and wait for response
 			response, err := s.FileHandler.UploadFileAndWait(
-				file.Filename,
+				filePath,
 				fileHeader,
 				fileSize,
 				currentStorageID,
+				uploadTransactionID,
 				timeout,
 			)
 			fileHeader.Close() // Close file after upload
 
 			if err != nil {
-				return c.Status(500).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("failed to upload file %s: %w", file.Filename, err)))
+				return fail(500, fmt.Errorf("failed to upload file %s: %w", filePath, err))
 			}
 
 			// Check if upload was successful
 			if !response.Success {
-				return c.Status(500).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("file upload failed for %s: %s", file.Filename, response.Error)))
+				return fail(uploadErrorStatus(response), fmt.Errorf("file upload failed for %s: %s", filePath, response.Error))
 			}
 
 			// Store storageID from first file to reuse for subsequent files
@@ -88,51 +109,112 @@ func RMQFileUpload(s *services.Container) fiber.Handler {
 				finalStorageID = response.StorageID
 			}
 
-			// Store last response to get final total size
-			lastResponse = response
+			// Aggregate file information; the response lists the uploaded file under
+			// the name it was stored as, which may differ from the submitted name
+			totalSize += response.TotalSize
+			for _, fileInfo := range response.Files {
+				uploadedFiles = append(uploadedFiles, uploadedFile(response.StorageID, fileInfo, filePath))
+			}
+		}
+
+		if uploadTransactionID != "" {
+			// Committing copies every staged file once more
+			response, err := s.FileHandler.CommitUploadAndWait(uploadTransactionID, uploadTimeout(totalSize))
+			if err != nil {
+				return fail(500, fmt.Errorf("failed to store files: %w", err))
+			}
+			if !response.Success {
+				return fail(uploadErrorStatus(response), fmt.Errorf("failed to store files: %s", response.Error))
+			}
 
-			// Aggregate file information (avoid duplicates since response includes all files in storage)
+			// Names may have changed at commit, e.g. by the conflict policy
+			uploadedFiles, totalSize = nil, response.TotalSize
 			for _, fileInfo := range response.Files {
-				if !uploadedFileNames[fileInfo.Filename] {
-					uploadedFileNames[fileInfo.Filename] = true
-					uploadedFiles = append(uploadedFiles, presenter.File{
-						OriginalName: fileInfo.Filename,
-						FileName:     fileInfo.Filename,
-						Size:         int(fileInfo.Size),
-						Path:         fmt.Sprintf("/files/s/%s/d/%s", response.StorageID, fileInfo.Filename),
-					})
-				}
+				uploadedFiles = append(uploadedFiles, uploadedFile(response.StorageID, fileInfo, fileInfo.OriginalName))
 			}
 		}
 
 		// Generate URL
 		urlString := fmt.Sprintf("/files/s/%s", finalStorageID)
 
-		// Use total size from last response (includes all files in storage)
-		totalSize := int64(0)
-		if lastResponse != nil {
-			totalSize = lastResponse.TotalSize
-		}
-
 		// Return success response
 		res := presenter.FileUploadSuccessResponse(urlString, int(totalSize), &uploadedFiles)
 		return c.JSON(res)
 	}
 }
 
+// uploadedFile describes a file the filemanager stored in storageID, uploaded as originalName
+func uploadedFile(storageID string, fileInfo messages.FileInfo, originalName string) presenter.File {
+	storedPath := filePathOf(fileInfo)
+	if originalName == "" {
+		originalName = storedPath
+	}
+	return presenter.File{
+		OriginalName: originalName,
+		FileName:     storedPath,
+		Size:         int(fileInfo.Size),
+		Path:         downloadURL(storageID, storedPath),
+	}
+}
+
+// abortUpload discards the files staged by a failed multi-file upload
+// The filemanager aborts uploads that stop receiving files on its own, so failures are only logged.
+func abortUpload(s *services.Container, uploadTransactionID string) {
+	response, err := s.FileHandler.AbortUploadAndWait(uploadTransactionID, 30*time.Second)
+	if err != nil {
+		log.Printf("Failed to abort upload %s: %v", uploadTransactionID, err)
+		return
+	}
+	if !response.Success {
+		log.Printf("Failed to abort upload %s: %s", uploadTransactionID, response.Error)
+	}
+}
+
+// uploadTimeout allows 10 seconds per MB of an upload, minimum 30 seconds, maximum 5 minutes
+func uploadTimeout(fileSize int64) time.Duration {
+	timeoutSeconds := int64(fileSize/(1024*1024))*10 + 30
+	if timeoutSeconds < 30 {
+		timeoutSeconds = 30
+	}
+	if timeoutSeconds > 300 {
+		timeoutSeconds = 300 // 5 minutes max
+	}
+	return time.Duration(timeoutSeconds) * time.Second
+}
+
+// uploadErrorStatus maps a failed upload response to its HTTP status
+func uploadErrorStatus(response *messages.FileManagerResponse) int {
+	switch response.ErrorCode {
+	case messages.ErrorCodeQuotaExceeded:
+		return fiber.StatusRequestEntityTooLarge
+	case messages.ErrorCodeInsufficientStorage:
+		return fiber.StatusInsufficientStorage
+	case messages.ErrorCodeInvalidFilename:
+		return fiber.StatusBadRequest
+	case messages.ErrorCodeUploadAborted:
+		return fiber.StatusConflict
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+// downloadErrorStatus maps a failed download response to its HTTP status
+func downloadErrorStatus(response *messages.FileManagerResponse) int {
+	switch response.ErrorCode {
+	case messages.ErrorCodeFileCorrupted:
+		return fiber.StatusInternalServerError
+	default:
+		return fiber.StatusNotFound
+	}
+}
+
 func RMQFileAccess(s *services.Container) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		id := c.Params("id")
 
-		// Validate the ID format
-		if len(id) != 10 {
-			return c.Status(400).JSON(presenter.FileAccessErrorResponse("Invalid ID format. Must be exactly 10 characters."))
-		}
-
-		for _, char := range id {
-			if !((char >= 'a' && char <= 'z') || (char >= '0' && char <= '9')) {
-				return c.Status(400).JSON(presenter.FileAccessErrorResponse("Invalid ID format. Only lowercase letters and numbers are allowed."))
-			}
+		// Validate the ID format, catching mistyped links without asking the filemanager
+		if err := s.StorageIDs.Validate(id); err != nil {
+			return c.Status(400).JSON(presenter.FileAccessErrorResponse(err.Error()))
 		}
 
 		// Get files via RabbitMQ with a reasonable timeout (30 seconds)
@@ -148,36 +230,68 @@ func RMQFileAccess(s *services.Container) fiber.Handler {
 		}
 
 		// Convert response files to FileInfo format
+		// Path lets the share page rebuild the folder tree
 		var fileList []presenter.FileInfo
 		for _, fileInfo := range response.Files {
+			storedPath := filePathOf(fileInfo)
+			var versions []presenter.FileVersion
+			for _, v := range fileInfo.Versions {
+				versions = append(versions, presenter.FileVersion{
+					Version:    v.Version,
+					Size:       v.Size,
+					URL:        fmt.Sprintf("%s?version=%d", downloadURL(id, storedPath), v.Version),
+					UploadedAt: v.UploadedAt,
+				})
+			}
 			fileList = append(fileList, presenter.FileInfo{
-				Name:     fileInfo.Filename,
-				Filename: fileInfo.Filename,
-				Size:     fileInfo.Size,
-				URL:      fmt.Sprintf("/files/s/%s/d/%s", id, fileInfo.Filename),
+				Name:         fileInfo.Filename,
+				Filename:     fileInfo.Filename,
+				Path:         storedPath,
+				Size:         fileInfo.Size,
+				URL:          downloadURL(id, storedPath),
+				OriginalName: fileInfo.OriginalName,
+				ContentType:  fileInfo.ContentType,
+				SHA256:       fileInfo.SHA256,
+				UploadedAt:   fileInfo.UploadedAt,
+				Corrupted:    fileInfo.Corrupted,
+				Downloads:    fileInfo.Downloads,
+				Version:      fileInfo.Version,
+				Versions:     versions,
 			})
 		}
 
-		res := presenter.FileAccessSuccessResponse(id, &fileList)
+		res := presenter.FileAccessSuccessResponse(id, response.CreatedAt, response.ExpiresAt, &fileList)
 		return c.JSON(res)
 	}
 }
 
+// RMQFileDownload serves a file as an attachment, whatever its type
 func RMQFileDownload(s *services.Container) fiber.Handler {
+	return serveFile(s, false)
+}
+
+// RMQFilePreview serves a file for viewing in the browser
+// Only the types in inlineTypes are shown inline, under previewCSP; anything else, notably HTML
+// and SVG which could run scripts on the gateway's origin, is downloaded as by RMQFileDownload.
+func RMQFilePreview(s *services.Container) fiber.Handler {
+	return serveFile(s, true)
+}
+
+// serveFile retrieves a file from the filemanager and sends it, inline when preview is set
+// and its type is safe to render
+func serveFile(s *services.Container, preview bool) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// Get the ID and filename from URL parameters
+		// Get the ID and file path from URL parameters
+		// The wildcard captures nested paths such as "docs/a.txt"
 		id := c.Params("id")
-		filename := c.Params("filename")
-
-		// Validate the ID format
-		if len(id) != 10 {
-			return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Invalid ID format. Must be exactly 10 characters."))
+		filename, err := url.PathUnescape(c.Params("*"))
+		if err != nil {
+			return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Invalid file path."))
 		}
 
-		for _, char := range id {
-			if !((char >= 'a' && char <= 'z') || (char >= '0' && char <= '9')) {
-				return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Invalid ID format. Only lowercase letters and numbers are allowed."))
-			}
+		// Validate the ID format, catching mistyped links without asking the filemanager
+		if err := s.StorageIDs.Validate(id); err != nil {
+			return c.Status(400).JSON(presenter.FileDownloadErrorResponse(err.Error()))
 		}
 
 		// Validate filename is not empty
@@ -185,19 +299,28 @@ func RMQFileDownload(s *services.Container) fiber.Handler {
 			return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Filename cannot be empty."))
 		}
 
+		// An optional ?version=N downloads an older version of the file
+		version := 0
+		if raw := c.Query("version"); raw != "" {
+			version, err = strconv.Atoi(raw)
+			if err != nil || version <= 0 {
+				return c.Status(400).JSON(presenter.FileDownloadErrorResponse("Invalid version. Must be a positive number."))
+			}
+		}
+
 		// Calculate timeout based on expected file size (estimate: 1 second per MB, minimum 30 seconds)
 		// Since we don't know the size yet, use a reasonable default
 		timeout := 60 * time.Second
 
 		// Retrieve file content via RabbitMQ
-		response, fileContent, err := s.FileHandler.GetFileAndWait(id, filename, timeout)
+		response, fileContent, err := s.FileHandler.GetFileAndWait(id, filename, version, timeout)
 		if err != nil {
 			return c.Status(500).JSON(presenter.FileDownloadErrorResponse(fmt.Sprintf("Failed to retrieve file: %v", err)))
 		}
 
 		// Check if request was successful
 		if !response.Success {
-			return c.Status(404).JSON(presenter.FileDownloadErrorResponse(response.Error))
+			return c.Status(downloadErrorStatus(response)).JSON(presenter.FileDownloadErrorResponse(response.Error))
 		}
 
 		// Check if we received file content
@@ -205,17 +328,199 @@ func RMQFileDownload(s *services.Container) fiber.Handler {
 			return c.Status(500).JSON(presenter.FileDownloadErrorResponse("No file content received"))
 		}
 
-		// Extract original filename for download (if filename has timestamp prefix)
-		originalName := filename
-		if parts := strings.SplitN(filename, "_", 3); len(parts) >= 3 {
-			originalName = parts[2] // Get everything after timestamp_XX_
+		// Save the file under the name it was uploaded as, which the filemanager records
+		// next to the sanitized path it is stored under
+		name := downloadName(response, filename)
+		c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+		contentType := storedContentType(response, fileContent)
+		if preview && inlineType(contentType) {
+			c.Set(fiber.HeaderContentDisposition, disposition("inline", name))
+			c.Set(fiber.HeaderContentType, contentType)
+			c.Set(fiber.HeaderContentSecurityPolicy, previewCSP(contentType))
+			return c.Send(fileContent)
 		}
 
-		// Set the Content-Disposition header to use the original filename
-		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", originalName))
-		c.Set("Content-Type", "application/octet-stream")
+		c.Set(fiber.HeaderContentDisposition, disposition("attachment", name))
+		c.Set(fiber.HeaderContentType, "application/octet-stream")
 
 		// Send the file content
 		return c.Send(fileContent)
 	}
 }
+
+// inlineTypes lists the media types a preview shows in the browser
+// Browsers render them without running scripts; every other type is downloaded.
+var inlineTypes = map[string]bool{
+	"text/plain":      true,
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"image/avif":      true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wave":      true,
+	"audio/wav":       true,
+	"audio/webm":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+}
+
+// inlineType reports whether a file of contentType may be shown inline
+func inlineType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && inlineTypes[mediaType]
+}
+
+// previewCSP returns the Content-Security-Policy of a preview, which allows no scripts,
+// connections or frames. Everything but PDFs is also sandboxed; browsers refuse to
+// start their PDF viewer in a sandboxed document.
+func previewCSP(contentType string) string {
+	csp := "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/pdf" {
+		csp += "; sandbox"
+	}
+	return csp
+}
+
+// storedContentType returns the MIME type the filemanager sniffed at upload time,
+// sniffing the content itself for files stored without one
+func storedContentType(response *messages.FileManagerResponse, content []byte) string {
+	if contentType, ok := response.Data["content_type"].(string); ok && contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(content)
+}
+
+// downloadName returns the base name a downloaded file is saved as: the name it was uploaded
+// as when the filemanager recorded one, its stored path otherwise
+func downloadName(response *messages.FileManagerResponse, filename string) string {
+	if original, ok := response.Data["original_name"].(string); ok && original != "" {
+		return path.Base(original)
+	}
+	return path.Base(filename)
+}
+
+// disposition builds a Content-Disposition header of the given type for a file named name,
+// encoding names that aren't plain ASCII as RFC 2231 requires
+func disposition(dispositionType, name string) string {
+	if header := mime.FormatMediaType(dispositionType, map[string]string{"filename": name}); header != "" {
+		return header
+	}
+	return dispositionType
+}
+
+// copyRequest is the body of a copy request
+type copyRequest struct {
+	Files     []string `json:"files"`      // Paths of the files to copy; empty copies every file
+	StorageID string   `json:"storage_id"` // Share to copy into; empty creates a new share
+}
+
+// RMQFileCopy re-shares files of a share under a new link, copying them inside the filemanager
+// The new share gets its own expiry. The response has the same shape as an upload's.
+func RMQFileCopy(s *services.Container) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+
+		// Validate the ID format
+		if err := s.StorageIDs.Validate(id); err != nil {
+			return c.Status(400).JSON(presenter.FileUploadErrorResponse(err))
+		}
+
+		// The body is optional: without one the whole share is copied
+		var request copyRequest
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&request); err != nil {
+				return c.Status(400).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("failed to parse copy request: %w", err)))
+			}
+		}
+		if request.StorageID != "" {
+			if err := s.StorageIDs.Validate(request.StorageID); err != nil {
+				return c.Status(400).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("destination: %w", err)))
+			}
+		}
+
+		// Copies stay inside the filemanager, but large shares still take a while
+		timeout := 5 * time.Minute
+		response, err := s.FileHandler.CopyFilesAndWait(id, request.Files, request.StorageID, timeout)
+		if err != nil {
+			return c.Status(500).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("failed to copy files: %w", err)))
+		}
+
+		if !response.Success {
+			return c.Status(copyErrorStatus(response)).JSON(presenter.FileUploadErrorResponse(fmt.Errorf("file copy failed: %s", response.Error)))
+		}
+
+		var copiedFiles []presenter.File
+		for _, fileInfo := range response.Files {
+			// A copy keeps the name its source was uploaded as
+			copiedFiles = append(copiedFiles, uploadedFile(response.StorageID, fileInfo, fileInfo.OriginalName))
+		}
+
+		// Generate URL of the new share
+		urlString := fmt.Sprintf("/files/s/%s", response.StorageID)
+
+		res := presenter.FileUploadSuccessResponse(urlString, int(response.TotalSize), &copiedFiles)
+		return c.JSON(res)
+	}
+}
+
+// copyErrorStatus maps a failed copy response to its HTTP status
+func copyErrorStatus(response *messages.FileManagerResponse) int {
+	switch response.ErrorCode {
+	case messages.ErrorCodeNotFound:
+		return fiber.StatusNotFound
+	case messages.ErrorCodeQuotaExceeded:
+		return fiber.StatusRequestEntityTooLarge
+	case messages.ErrorCodeInsufficientStorage:
+		return fiber.StatusInsufficientStorage
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+// uploadPath returns the relative path a multipart file was submitted with
+// Browsers send folder uploads as filename="docs/a.txt", but the multipart parser
+// strips everything up to the last slash, so the raw Content-Disposition is read instead.
+// The path is forwarded as sent: the filemanager rejects absolute paths and ".." segments.
+func uploadPath(file *multipart.FileHeader) string {
+	_, params, err := mime.ParseMediaType(file.Header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return file.Filename
+	}
+	return params["filename"]
+}
+
+// cleanUploadPath normalizes a relative path sent by a client, returning "" for
+// paths that are absolute or climb out with ".."
+func cleanUploadPath(raw string) string {
+	// Windows clients may use backslashes
+	raw = strings.ReplaceAll(raw, "\\", "/")
+	cleaned := path.Clean(raw)
+	if strings.HasPrefix(raw, "/") || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return ""
+	}
+	return cleaned
+}
+
+// filePathOf returns the relative path of a file, falling back to its name for
+// responses from services that don't report paths
+func filePathOf(fileInfo messages.FileInfo) string {
+	if fileInfo.Path != "" {
+		return fileInfo.Path
+	}
+	return fileInfo.Filename
+}
+
+// downloadURL builds the download route for a file, escaping each path segment
+func downloadURL(storageID, filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return fmt.Sprintf("/files/s/%s/d/%s", storageID, strings.Join(segments, "/"))
+}
@@ -0,0 +1,213 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/handlers"
+	"github.com/gofiber/fiber/v2"
+)
+
+// newFileApp serves the share routes with the services of a gateway talking to fm
+func newFileApp(t *testing.T, fm *fakeFilemanager) *fiber.App {
+	t.Helper()
+	s := newServices(t, fm, t.TempDir(), 0)
+	app := fiber.New()
+	app.Post("/files/upload", handlers.RMQFileUpload(s))
+	app.Get("/files/s/:id/d/*", handlers.RMQFileDownload(s))
+	app.Get("/files/s/:id/p/*", handlers.RMQFilePreview(s))
+	app.Post("/files/s/:id/copy", handlers.RMQFileCopy(s))
+	return app
+}
+
+// uploadRequest builds a multipart upload of one file whose Content-Disposition names it filename
+func uploadRequest(t *testing.T, filename, content string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+	header.Set("Content-Type", "application/octet-stream")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/files/upload", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+// rejectUnsafePaths answers uploads like the filemanager, which refuses absolute paths
+// and ".." segments and stores everything else
+func rejectUnsafePaths(body []byte) reply {
+	var upload messages.FileUploadRequest
+	json.Unmarshal(body, &upload)
+	name := strings.ReplaceAll(upload.Filename, "\\", "/")
+	if strings.HasPrefix(name, "/") || strings.Contains("/"+name+"/", "/../") {
+		return reply{response: messages.FileManagerResponse{
+			Error:     fmt.Sprintf("invalid filename: path leaves its storage: %q", upload.Filename),
+			ErrorCode: messages.ErrorCodeInvalidFilename,
+		}}
+	}
+	return storeUploads(0)(body)
+}
+
+func TestUploadRejectsUnsafePaths(t *testing.T) {
+	for _, name := range []string{
+		"../../etc/passwd",
+		"/etc/passwd",
+		"docs/../../secret.txt",
+		`..\..\boot.ini`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			fm := newFakeFilemanager()
+			fm.answer(messages.TopicFileManagerPostFile, rejectUnsafePaths)
+			app := newFileApp(t, fm)
+
+			res, body := do(t, app, uploadRequest(t, name, "secret"))
+			if res.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("status %d, want 400", res.StatusCode)
+			}
+			if !strings.Contains(body, "path leaves its storage") {
+				t.Errorf("error %s doesn't say why the path was refused", body)
+			}
+			// The path reaches the filemanager as sent, not rewritten to its base name
+			uploads := fm.uploads(t)
+			if len(uploads) != 1 || uploads[0].Filename != name {
+				t.Errorf("filemanager received %+v, want one upload named %q", uploads, name)
+			}
+		})
+	}
+}
+
+func TestUploadKeepsFolders(t *testing.T) {
+	fm := newFakeFilemanager()
+	fm.answer(messages.TopicFileManagerPostFile, rejectUnsafePaths)
+	app := newFileApp(t, fm)
+
+	res, body := do(t, app, uploadRequest(t, "docs/a.txt", "hello"))
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d (%s), want 200", res.StatusCode, body)
+	}
+	if uploads := fm.uploads(t); len(uploads) != 1 || uploads[0].Filename != "docs/a.txt" {
+		t.Errorf("filemanager received %+v, want docs/a.txt", uploads)
+	}
+}
+
+func TestCopyKeepsOriginalNames(t *testing.T) {
+	fm := newFakeFilemanager()
+	fm.answer(messages.TopicFileManagerCopyFiles, func(body []byte) reply {
+		return reply{response: messages.FileManagerResponse{Success: true, StorageID: "klmnopqrst", TotalSize: 5,
+			Files: []messages.FileInfo{{Filename: "a.txt", Path: "docs/a.txt", Size: 5, OriginalName: "docs/a?.txt"}}}}
+	})
+	app := newFileApp(t, fm)
+
+	res, body := do(t, app, httptest.NewRequest(http.MethodPost, "/files/s/abcdefghij/copy", nil))
+	if res.StatusCode != fiber.StatusOK {
+		t.Fatalf("status %d (%s), want 200", res.StatusCode, body)
+	}
+	var copied struct {
+		Data struct {
+			URL   string `json:"url"`
+			Files []struct {
+				OriginalName string `json:"original_name"`
+				FileName     string `json:"file_name"`
+			} `json:"files"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(body), &copied); err != nil {
+		t.Fatal(err)
+	}
+	if copied.Data.URL != "/files/s/klmnopqrst" || len(copied.Data.Files) != 1 {
+		t.Fatalf("copy response %s, want the one file of the new share", body)
+	}
+	// The copy is stored under a safe path but keeps the name its source was uploaded as
+	if file := copied.Data.Files[0]; file.OriginalName != "docs/a?.txt" || file.FileName != "docs/a.txt" {
+		t.Errorf("copied file named %q stored as %q, want docs/a?.txt stored as docs/a.txt", file.OriginalName, file.FileName)
+	}
+}
+
+// serveContent answers downloads with content, recorded by the filemanager as contentType
+func serveContent(content, contentType string) func(body []byte) reply {
+	return func(body []byte) reply {
+		data := map[string]interface{}{}
+		if contentType != "" {
+			data["content_type"] = contentType
+		}
+		return reply{response: messages.FileManagerResponse{Success: true, StorageID: "abcdefghij", Data: data}, content: []byte(content)}
+	}
+}
+
+func TestPreviewHeaders(t *testing.T) {
+	const page = "<!DOCTYPE html><html><script>alert(document.cookie)</script></html>"
+
+	for _, tc := range []struct {
+		name        string
+		url         string
+		content     string
+		contentType string // As recorded by the filemanager
+		inline      bool
+		sandboxed   bool
+	}{
+		{"image", "/files/s/abcdefghij/p/a.png", "\x89PNG\r\n\x1a\n", "image/png", true, true},
+		{"text", "/files/s/abcdefghij/p/a.txt", "hello", "text/plain; charset=utf-8", true, true},
+		{"pdf", "/files/s/abcdefghij/p/a.pdf", "%PDF-1.4", "application/pdf", true, false},
+		{"download of an image", "/files/s/abcdefghij/d/a.png", "\x89PNG\r\n\x1a\n", "image/png", false, false},
+
+		// Scripts in these would run on the gateway's origin
+		{"html", "/files/s/abcdefghij/p/a.html", page, "text/html; charset=utf-8", false, false},
+		{"svg", "/files/s/abcdefghij/p/a.svg", "<svg onload=\"alert(1)\"/>", "image/svg+xml", false, false},
+		{"xhtml", "/files/s/abcdefghij/p/a.xhtml", page, "application/xhtml+xml", false, false},
+
+		// Stored without a type, the content is sniffed rather than trusting the name
+		{"html named as an image", "/files/s/abcdefghij/p/a.png", page, "", false, false},
+		{"image stored without a type", "/files/s/abcdefghij/p/a.bin", "\x89PNG\r\n\x1a\n", "", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := newFakeFilemanager()
+			fm.answer(messages.TopicFileManagerGetFile, serveContent(tc.content, tc.contentType))
+			app := newFileApp(t, fm)
+
+			res, body := do(t, app, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if res.StatusCode != fiber.StatusOK || body != tc.content {
+				t.Fatalf("status %d with %q, want 200 with the content", res.StatusCode, body)
+			}
+			if got := res.Header.Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options %q, want nosniff", got)
+			}
+
+			disposition := res.Header.Get("Content-Disposition")
+			csp := res.Header.Get("Content-Security-Policy")
+			if !tc.inline {
+				if !strings.HasPrefix(disposition, "attachment") || res.Header.Get("Content-Type") != "application/octet-stream" {
+					t.Errorf("served as %s (%s), want an octet-stream attachment", res.Header.Get("Content-Type"), disposition)
+				}
+				return
+			}
+
+			if !strings.HasPrefix(disposition, "inline") {
+				t.Errorf("Content-Disposition %q, want inline", disposition)
+			}
+			if want := tc.contentType; want != "" && res.Header.Get("Content-Type") != want {
+				t.Errorf("Content-Type %q, want %q", res.Header.Get("Content-Type"), want)
+			}
+			if !strings.Contains(csp, "default-src 'none'") || strings.Contains(csp, "script-src") {
+				t.Errorf("Content-Security-Policy %q doesn't forbid scripts", csp)
+			}
+			if strings.Contains(csp, "sandbox") != tc.sandboxed {
+				t.Errorf("Content-Security-Policy %q, want sandboxed %v", csp, tc.sandboxed)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/edgarcoime/Cthulhu-gateway/internal/presenter"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/services"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/tus"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Headers of the tus 1.0 protocol
+const (
+	headerTusResumable  = "Tus-Resumable"
+	headerTusVersion    = "Tus-Version"
+	headerTusExtension  = "Tus-Extension"
+	headerTusMaxSize    = "Tus-Max-Size"
+	headerUploadLength  = "Upload-Length"
+	headerUploadOffset  = "Upload-Offset"
+	headerUploadMeta    = "Upload-Metadata"
+	headerUploadExpires = "Upload-Expires"
+	headerUploadDefer   = "Upload-Defer-Length"
+
+	// headerShareURL carries the share a completed upload was stored in
+	headerShareURL = "X-Share-Url"
+
+	tusContentType = "application/offset+octet-stream"
+	tusExtensions  = "creation,expiration,termination"
+)
+
+// TusHeaders lists the request and response headers the CORS configuration must allow and expose
+var TusHeaders = []string{
+	headerTusResumable, headerTusVersion, headerTusExtension, headerTusMaxSize, headerUploadLength,
+	headerUploadOffset, headerUploadMeta, headerUploadExpires, headerUploadDefer, headerShareURL, fiber.HeaderLocation,
+}
+
+// TusOptions reports the protocol version and extensions the gateway supports, and the largest upload it accepts
+func TusOptions(s *services.Container) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set(headerTusResumable, tus.Version)
+		c.Set(headerTusVersion, tus.Version)
+		c.Set(headerTusExtension, tusExtensions)
+		if maxSize := s.Uploads.MaxSize(); maxSize > 0 {
+			c.Set(headerTusMaxSize, strconv.FormatInt(maxSize, 10))
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// TusCreate starts a resumable upload
+// Upload-Metadata must carry the filename; an optional storage_id adds the file to an existing share.
+func TusCreate(s *services.Container) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !supportedTusVersion(c) {
+			return tusError(c, fiber.StatusPreconditionFailed, "unsupported tus version")
+		}
+
+		if c.Get(headerUploadDefer) != "" {
+			return tusError(c, fiber.StatusBadRequest, "Upload-Defer-Length is not supported; send Upload-Length")
+		}
+		length, err := strconv.ParseInt(c.Get(headerUploadLength), 10, 64)
+		if err != nil || length < 0 {
+			return tusError(c, fiber.StatusBadRequest, "Upload-Length must be a non-negative number")
+		}
+		if maxSize := s.Uploads.MaxSize(); maxSize > 0 && length > maxSize {
+			c.Set(headerTusMaxSize, strconv.FormatInt(maxSize, 10))
+			return tusError(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("Upload-Length exceeds the maximum of %d bytes", maxSize))
+		}
+
+		metadata, err := tus.ParseMetadata(c.Get(headerUploadMeta))
+		if err != nil {
+			return tusError(c, fiber.StatusBadRequest, err.Error())
+		}
+		if tusFilename(metadata) == "" {
+			return tusError(c, fiber.StatusBadRequest, "Upload-Metadata must include a relative filename")
+		}
+		if storageID := metadata["storage_id"]; storageID != "" {
+			if err := s.StorageIDs.Validate(storageID); err != nil {
+				return tusError(c, fiber.StatusBadRequest, err.Error())
+			}
+		}
+
+		upload, err := s.Uploads.Create(length, c.Get(headerUploadMeta))
+		if err != nil {
+			return tusStoreError(c, fmt.Errorf("failed to create upload: %w", err))
+		}
+
+		// An empty file is complete as soon as it exists
+		if upload.Length == 0 {
+			unlock := s.Uploads.Lock(upload.ID)
+			defer unlock()
+			if err := forwardUpload(s, upload); err != nil {
+				return tusForwardError(c, err)
+			}
+			setShareURL(c, upload)
+		}
+
+		c.Location(fmt.Sprintf("%s/%s", c.Path(), upload.ID))
+		setExpires(c, upload)
+		return c.SendStatus(fiber.StatusCreated)
+	}
+}
+
+// TusHead reports how many bytes of an upload were received, so the client knows where to resume
+func TusHead(s *services.Container) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !supportedTusVersion(c) {
+			return tusError(c, fiber.StatusPreconditionFailed, "unsupported tus version")
+		}
+
+		upload, err := s.Uploads.Get(c.Params("id"))
+		if err != nil {
+			return tusStoreError(c, err)
+		}
+
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		c.Set(headerUploadOffset, strconv.FormatInt(upload.Offset, 10))
+		c.Set(headerUploadLength, strconv.FormatInt(upload.Length, 10))
+		if upload.RawMeta != "" {
+			c.Set(headerUploadMeta, upload.RawMeta)
+		}
+		setExpires(c, upload)
+		setShareURL(c, upload)
+		return c.SendStatus(fiber.StatusOK)
+	}
+}
+
+// TusPatch appends bytes to an upload at Upload-Offset
+// Once every byte is received the upload is forwarded to the filemanager like a multipart upload,
+// in FileChunkRequests for files over ChunkSize, and X-Share-Url points to its share. If forwarding fails, a PATCH at the final offset with
+// an empty body retries it.
+func TusPatch(s *services.Container) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !supportedTusVersion(c) {
+			return tusError(c, fiber.StatusPreconditionFailed, "unsupported tus version")
+		}
+		if c.Get(fiber.HeaderContentType) != tusContentType {
+			return tusError(c, fiber.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+		}
+		offset, err := strconv.ParseInt(c.Get(headerUploadOffset), 10, 64)
+		if err != nil || offset < 0 {
+			return tusError(c, fiber.StatusBadRequest, "Upload-Offset must be a non-negative number")
+		}
+
+		id := c.Params("id")
+		unlock := s.Uploads.Lock(id)
+		defer unlock()
+
+		upload, err := s.Uploads.Append(id, offset, bytes.NewReader(c.Body()))
+		if errors.Is(err, tus.ErrCompleted) && offset == upload.Length {
+			// A retry of the request that completed the upload
+			err = nil
+		}
+		if err != nil {
+			return tusStoreError(c, err)
+		}
+
+		c.Set(headerUploadOffset, strconv.FormatInt(upload.Offset, 10))
+		setExpires(c, upload)
+
+		if upload.Offset == upload.Length && !upload.Forwarded() {
+			if err := forwardUpload(s, upload); err != nil {
+				return tusForwardError(c, err)
+			}
+		}
+		setShareURL(c, upload)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// TusDelete terminates an upload and discards the bytes received
+func TusDelete(s *services.Container) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !supportedTusVersion(c) {
+			return tusError(c, fiber.StatusPreconditionFailed, "unsupported tus version")
+		}
+
+		id := c.Params("id")
+		unlock := s.Uploads.Lock(id)
+		defer unlock()
+
+		if err := s.Uploads.Delete(id); err != nil {
+			return tusStoreError(c, err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// forwardError is a failed response from the filemanager, with the HTTP status it maps to
+type forwardError struct {
+	status int
+	err    error
+}
+
+func (e *forwardError) Error() string {
+	return e.err.Error()
+}
+
+// forwardUpload streams a complete upload from disk to the filemanager and records
+// the share it was stored in. The caller must hold the upload's lock.
+func forwardUpload(s *services.Container, upload *tus.Upload) error {
+	data, err := s.Uploads.Open(upload.ID)
+	if err != nil {
+		return fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer data.Close()
+
+	filename := tusFilename(upload.Metadata)
+	response, err := s.FileHandler.UploadFileAndWait(filename, data, upload.Length, upload.Metadata["storage_id"], "", uploadTimeout(upload.Length))
+	if err != nil {
+		return fmt.Errorf("failed to upload file %s: %w", filename, err)
+	}
+	if !response.Success {
+		return &forwardError{
+			status: uploadErrorStatus(response),
+			err:    fmt.Errorf("file upload failed for %s: %s", filename, response.Error),
+		}
+	}
+
+	storedPath := filename
+	if len(response.Files) > 0 {
+		storedPath = filePathOf(response.Files[0])
+	}
+	if err := s.Uploads.Finish(upload, response.StorageID, storedPath); err != nil {
+		// The file is stored; only the bookkeeping failed, so don't make the client retry
+		log.Printf("Failed to record finished upload %s: %v", upload.ID, err)
+	}
+	return nil
+}
+
+// tusFilename returns the cleaned relative path from an upload's metadata
+// Clients commonly send it as "filename", some as "name".
+func tusFilename(metadata map[string]string) string {
+	name := metadata["filename"]
+	if name == "" {
+		name = metadata["name"]
+	}
+	return cleanUploadPath(name)
+}
+
+// supportedTusVersion reports whether a request speaks the gateway's protocol version
+func supportedTusVersion(c *fiber.Ctx) bool {
+	c.Set(headerTusResumable, tus.Version)
+	if c.Get(headerTusResumable) != tus.Version {
+		c.Set(headerTusVersion, tus.Version)
+		return false
+	}
+	return true
+}
+
+// setExpires sets Upload-Expires for uploads that expire
+func setExpires(c *fiber.Ctx, upload *tus.Upload) {
+	if !upload.ExpiresAt.IsZero() {
+		c.Set(headerUploadExpires, upload.ExpiresAt.Format(http.TimeFormat))
+	}
+}
+
+// setShareURL points finished uploads to their share
+func setShareURL(c *fiber.Ctx, upload *tus.Upload) {
+	if upload.Forwarded() {
+		c.Set(headerShareURL, fmt.Sprintf("/files/s/%s", upload.StorageID))
+	}
+}
+
+// tusStoreError maps upload store errors to their HTTP status
+func tusStoreError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, tus.ErrNotFound):
+		return tusError(c, fiber.StatusNotFound, err.Error())
+	case errors.Is(err, tus.ErrOffsetMismatch), errors.Is(err, tus.ErrCompleted):
+		return tusError(c, fiber.StatusConflict, err.Error())
+	case errors.Is(err, tus.ErrTooLarge):
+		return tusError(c, fiber.StatusRequestEntityTooLarge, err.Error())
+	default:
+		return tusError(c, fiber.StatusInternalServerError, err.Error())
+	}
+}
+
+// tusForwardError reports an upload the filemanager didn't accept
+func tusForwardError(c *fiber.Ctx, err error) error {
+	var fe *forwardError
+	if errors.As(err, &fe) {
+		return tusError(c, fe.status, fe.Error())
+	}
+	return tusError(c, fiber.StatusInternalServerError, err.Error())
+}
+
+func tusError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(presenter.FileUploadErrorResponse(errors.New(message)))
+}
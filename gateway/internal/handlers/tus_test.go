@@ -0,0 +1,155 @@
+package handlers_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/handlers"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/tus"
+	"github.com/gofiber/fiber/v2"
+)
+
+// received returns the content of every upload the filemanager received
+func received(t *testing.T, fm *fakeFilemanager) []string {
+	t.Helper()
+	var contents []string
+	for _, upload := range fm.uploads(t) {
+		content, _ := base64.StdEncoding.DecodeString(upload.Content)
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+// newTusApp serves the tus routes on an upload store in dir
+// The filemanager stores every upload.
+func newTusApp(t *testing.T, dir string, maxSize int64, fm *fakeFilemanager) *fiber.App {
+	t.Helper()
+	fm.answer(messages.TopicFileManagerPostFile, storeUploads(0))
+	s := newServices(t, fm, dir, maxSize)
+
+	app := fiber.New()
+	app.Options("/files/tus", handlers.TusOptions(s))
+	app.Post("/files/tus", handlers.TusCreate(s))
+	app.Head("/files/tus/:id", handlers.TusHead(s))
+	app.Patch("/files/tus/:id", handlers.TusPatch(s))
+	app.Delete("/files/tus/:id", handlers.TusDelete(s))
+	return app
+}
+
+// tusRequest sends a tus request with the given headers and returns the response
+func tusRequest(t *testing.T, app *fiber.App, method, url, body string, headers ...string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tus.Version)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, _ := do(t, app, req)
+	return res
+}
+
+// createUpload starts an upload of docs/a.txt and returns its URL
+func createUpload(t *testing.T, app *fiber.App, length int) string {
+	t.Helper()
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("docs/a.txt"))
+	res := tusRequest(t, app, http.MethodPost, "/files/tus", "",
+		"Upload-Length", fmt.Sprint(length), "Upload-Metadata", meta)
+	if res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("create: status %d, want 201", res.StatusCode)
+	}
+	return res.Header.Get("Location")
+}
+
+// patch appends body to the upload at url from offset
+func patch(t *testing.T, app *fiber.App, url string, offset int, body string) *http.Response {
+	t.Helper()
+	return tusRequest(t, app, http.MethodPatch, url, body,
+		"Content-Type", "application/offset+octet-stream", "Upload-Offset", fmt.Sprint(offset))
+}
+
+func TestTusOffsetMismatch(t *testing.T) {
+	app := newTusApp(t, t.TempDir(), 0, newFakeFilemanager())
+	url := createUpload(t, app, 10)
+
+	if res := patch(t, app, url, 0, "0123"); res.StatusCode != fiber.StatusNoContent || res.Header.Get("Upload-Offset") != "4" {
+		t.Fatalf("first patch: status %d at offset %s, want 204 at 4", res.StatusCode, res.Header.Get("Upload-Offset"))
+	}
+	// A client that lost track of the offset is told to look it up again
+	if res := patch(t, app, url, 0, "0123"); res.StatusCode != fiber.StatusConflict {
+		t.Errorf("patch at a stale offset: status %d, want 409", res.StatusCode)
+	}
+	if res := tusRequest(t, app, http.MethodHead, url, ""); res.Header.Get("Upload-Offset") != "4" {
+		t.Errorf("HEAD after the conflict reports offset %s, want 4", res.Header.Get("Upload-Offset"))
+	}
+}
+
+func TestTusResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	fm := newFakeFilemanager()
+	app := newTusApp(t, dir, 0, fm)
+	url := createUpload(t, app, 10)
+	patch(t, app, url, 0, "0123")
+
+	// A new gateway process opens the same upload directory
+	app = newTusApp(t, dir, 0, fm)
+	res := tusRequest(t, app, http.MethodHead, url, "")
+	if res.StatusCode != fiber.StatusOK || res.Header.Get("Upload-Offset") != "4" || res.Header.Get("Upload-Length") != "10" {
+		t.Fatalf("HEAD after restart: status %d, offset %s of %s; want 200, 4 of 10",
+			res.StatusCode, res.Header.Get("Upload-Offset"), res.Header.Get("Upload-Length"))
+	}
+
+	res = patch(t, app, url, 4, "456789")
+	if res.StatusCode != fiber.StatusNoContent || res.Header.Get("X-Share-Url") != "/files/s/abcdefghij" {
+		t.Fatalf("final patch: status %d, share %q; want 204 and the share", res.StatusCode, res.Header.Get("X-Share-Url"))
+	}
+	if got := received(t, fm); len(got) != 1 || got[0] != "0123456789" {
+		t.Errorf("filemanager received %q, want the whole file once", got)
+	}
+}
+
+func TestTusRetryForward(t *testing.T) {
+	fm := newFakeFilemanager()
+	app := newTusApp(t, t.TempDir(), 0, fm)
+	fm.answer(messages.TopicFileManagerPostFile, storeUploads(1))
+	url := createUpload(t, app, 10)
+
+	if res := patch(t, app, url, 0, "0123456789"); res.StatusCode != fiber.StatusInsufficientStorage {
+		t.Fatalf("patch completing the upload: status %d, want 507 from the failed forward", res.StatusCode)
+	}
+	res := tusRequest(t, app, http.MethodHead, url, "")
+	if res.Header.Get("Upload-Offset") != "10" || res.Header.Get("X-Share-Url") != "" {
+		t.Errorf("HEAD after the failed forward: offset %s, share %q; want 10 and no share",
+			res.Header.Get("Upload-Offset"), res.Header.Get("X-Share-Url"))
+	}
+
+	// An empty PATCH at the final offset forwards the upload again
+	res = patch(t, app, url, 10, "")
+	if res.StatusCode != fiber.StatusNoContent || res.Header.Get("X-Share-Url") != "/files/s/abcdefghij" {
+		t.Fatalf("retry: status %d, share %q; want 204 and the share", res.StatusCode, res.Header.Get("X-Share-Url"))
+	}
+	// Once forwarded, repeating it only reports the share
+	if res := patch(t, app, url, 10, ""); res.StatusCode != fiber.StatusNoContent || res.Header.Get("X-Share-Url") == "" {
+		t.Errorf("repeated retry: status %d, want 204 with the share", res.StatusCode)
+	}
+	if got := received(t, fm); len(got) != 2 || got[1] != "0123456789" {
+		t.Errorf("filemanager received %q, want the failed forward and one retry", got)
+	}
+}
+
+func TestTusMaxSize(t *testing.T) {
+	app := newTusApp(t, t.TempDir(), 8, newFakeFilemanager())
+
+	if res := tusRequest(t, app, http.MethodOptions, "/files/tus", ""); res.Header.Get("Tus-Max-Size") != "8" {
+		t.Errorf("OPTIONS advertises Tus-Max-Size %q, want 8", res.Header.Get("Tus-Max-Size"))
+	}
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	if res := tusRequest(t, app, http.MethodPost, "/files/tus", "", "Upload-Length", "9", "Upload-Metadata", meta); res.StatusCode != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("create over the maximum: status %d, want 413", res.StatusCode)
+	}
+	createUpload(t, app, 8)
+}
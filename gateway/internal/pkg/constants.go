@@ -9,6 +9,15 @@ var (
 	PORT        = env.GetEnv("PORT", "4000")
 	CORS_ORIGIN = env.GetEnv("CORS_ORIGIN", "http://localhost:3000")
 
+	// Resumable (tus) uploads: where received bytes are kept, and how long an unfinished
+	// upload survives after its last write (Go duration, 0 keeps it until deleted)
+	TUS_UPLOAD_DIR = env.GetEnv("TUS_UPLOAD_DIR", "./app/tus")
+	TUS_UPLOAD_TTL = env.GetEnv("TUS_UPLOAD_TTL", "24h")
+
+	// Largest resumable upload accepted, in MB (0 means unlimited); advertised as Tus-Max-Size
+	// The default matches the filemanager's default STORAGE_QUOTA_MB, which no larger upload could fit.
+	TUS_MAX_SIZE_MB = env.GetEnv("TUS_MAX_SIZE_MB", "1024")
+
 	// AMQP config
 	AMPQ_USER  = env.GetEnv("AMQP_USER", "guest")
 	AMPQ_PASS  = env.GetEnv("AMQP_PASS", "guest")
@@ -1,6 +1,8 @@
 package presenter
 
 import (
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -21,10 +23,29 @@ type File struct {
 }
 
 type FileInfo struct {
-	Name     string `json:"name"`
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	URL      string `json:"url"`
+	Name         string     `json:"name"`
+	Filename     string     `json:"filename"`
+	Path         string     `json:"path"` // Relative path inside the share, e.g. "docs/a.txt"
+	Size         int64      `json:"size"`
+	URL          string     `json:"url"`
+	OriginalName string     `json:"original_name,omitempty"`
+	ContentType  string     `json:"content_type,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+	UploadedAt   *time.Time `json:"uploaded_at,omitempty"`
+	Corrupted    bool       `json:"corrupted,omitempty"` // Failed its integrity check, so it can't be downloaded
+	Downloads    int64      `json:"downloads,omitempty"`
+
+	// Set when the filemanager keeps versions of overwritten files
+	Version  int           `json:"version,omitempty"`
+	Versions []FileVersion `json:"versions,omitempty"` // Newest first
+}
+
+// FileVersion is an older version of a shared file, downloadable from URL
+type FileVersion struct {
+	Version    int        `json:"version"`
+	Size       int64      `json:"size"`
+	URL        string     `json:"url"`
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
 }
 
 func FileUploadSuccessResponse(url string, totalSize int, files *[]File) *fiber.Map {
@@ -52,11 +73,14 @@ func FileUploadErrorResponse(err error) *fiber.Map {
 	}
 }
 
-func FileAccessSuccessResponse(sessionID string, files *[]FileInfo) *fiber.Map {
+// FileAccessSuccessResponse lists a share's files; createdAt and expiresAt are nil when unknown
+func FileAccessSuccessResponse(sessionID string, createdAt, expiresAt *time.Time, files *[]FileInfo) *fiber.Map {
 	return &fiber.Map{
 		"status": true,
 		"data": fiber.Map{
 			"session_id": sessionID,
+			"created_at": createdAt,
+			"expires_at": expiresAt,
 			"files":      files,
 			"count":      len(*files),
 		},
@@ -10,10 +10,22 @@ func FileRouter(app fiber.Router, services *services.Container) {
 	// OLD version
 	// app.Post("/files/upload", handlers.UploadFile())
 	// app.Get("/files/s/:id", handlers.FileAccess())
-	// app.Get("/files/s/:id/d/:filename", handlers.FileDownload())
+	// app.Get("/files/s/:id/d/:filename", handlers.FileDownload(services))
 
 	// new
 	app.Post("/files/upload", handlers.RMQFileUpload(services))
 	app.Get("/files/s/:id", handlers.RMQFileAccess(services))
-	app.Get("/files/s/:id/d/:filename", handlers.RMQFileDownload(services))
+	// Wildcard so files inside folders can be downloaded: /files/s/:id/d/docs/a.txt
+	app.Get("/files/s/:id/d/*", handlers.RMQFileDownload(services))
+	// Shows images, PDFs, media and plain text in the browser; other files are downloaded
+	app.Get("/files/s/:id/p/*", handlers.RMQFilePreview(services))
+	// Re-share some or all files of a share under a new link
+	app.Post("/files/s/:id/copy", handlers.RMQFileCopy(services))
+
+	// Resumable uploads with the tus 1.0 protocol
+	app.Options("/files/tus", handlers.TusOptions(services))
+	app.Post("/files/tus", handlers.TusCreate(services))
+	app.Head("/files/tus/:id", handlers.TusHead(services))
+	app.Patch("/files/tus/:id", handlers.TusPatch(services))
+	app.Delete("/files/tus/:id", handlers.TusDelete(services))
 }
@@ -3,9 +3,14 @@ package services
 import (
 	"context"
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/edgarcoime/Cthulhu-common/pkg/rabbitmq/manager"
+	"github.com/edgarcoime/Cthulhu-common/pkg/storageid"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/pkg"
 	"github.com/edgarcoime/Cthulhu-gateway/internal/services/handlers"
+	"github.com/edgarcoime/Cthulhu-gateway/internal/tus"
 )
 
 // TODO: create interface to fetch handlers
@@ -15,6 +20,8 @@ type Container struct {
 	Ctx             context.Context
 	DiagnoseHandler *handlers.DiagnoseHandler
 	FileHandler     *handlers.FileHandler
+	StorageIDs      storageid.Format // Format of the share IDs the filemanager hands out
+	Uploads         *tus.Store       // Resumable uploads in progress
 }
 
 func NewContainer(ctx context.Context) *Container {
@@ -41,6 +48,12 @@ func NewContainer(ctx context.Context) *Container {
 	diagnoseHandler := handlers.NewDiagnoseHandler(rmqManager, ctx)
 	fileHandler := handlers.NewFileHandler(rmqManager, ctx)
 
+	// Resumable uploads are kept on disk so they survive restarts
+	uploads, err := tus.NewStore(pkg.TUS_UPLOAD_DIR, tusUploadTTL(), tusMaxSize())
+	if err != nil {
+		log.Fatalf("Failed to open upload store: %v", err)
+	}
+
 	// setup queues and bindings
 	if err := diagnoseHandler.SetupQueuesAndBindings(); err != nil {
 		log.Fatalf("Failed to setup queues and bindings: %v", err)
@@ -54,7 +67,36 @@ func NewContainer(ctx context.Context) *Container {
 		Ctx:             ctx,
 		DiagnoseHandler: diagnoseHandler,
 		FileHandler:     fileHandler,
+		StorageIDs:      storageIDFormat(),
+		Uploads:         uploads,
+	}
+}
+
+// storageIDFormat builds the share ID format from environment variables
+func storageIDFormat() storageid.Format {
+	format, err := storageid.FormatFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid storage ID format: %v", err)
+	}
+	return format
+}
+
+// tusUploadTTL parses how long an unfinished resumable upload is kept after its last write
+func tusUploadTTL() time.Duration {
+	ttl, err := time.ParseDuration(pkg.TUS_UPLOAD_TTL)
+	if err != nil || ttl < 0 {
+		log.Fatalf("Invalid TUS_UPLOAD_TTL: %q", pkg.TUS_UPLOAD_TTL)
+	}
+	return ttl
+}
+
+// tusMaxSize parses the largest resumable upload accepted, in bytes
+func tusMaxSize() int64 {
+	maxMB, err := strconv.ParseInt(pkg.TUS_MAX_SIZE_MB, 10, 64)
+	if err != nil || maxMB < 0 {
+		log.Fatalf("Invalid TUS_MAX_SIZE_MB: %q", pkg.TUS_MAX_SIZE_MB)
 	}
+	return maxMB * 1024 * 1024
 }
 
 // Start listeners for each service
@@ -9,21 +9,31 @@ import (
 	"time"
 
 	"github.com/edgarcoime/Cthulhu-common/pkg/messages"
-	"github.com/edgarcoime/Cthulhu-common/pkg/rabbitmq/manager"
 	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // ChunkSize is the maximum size of a chunk in bytes (1MB)
 // This ensures messages stay well under RabbitMQ's practical limits
 const ChunkSize = 1024 * 1024 // 1MB
 
+// Broker declares the queues a request needs, publishes it and consumes its responses
+// Satisfied by *manager.Manager; tests can substitute an in-memory filemanager
+type Broker interface {
+	DeclareExchange(name, kind string, durable, autoDelete, internal, noWait bool) error
+	DeclareQueue(name string, durable, autoDelete, exclusive, noWait bool) (amqp.Queue, error)
+	QueueBind(queue, routingKey, exchange string, noWait bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool) (<-chan amqp.Delivery, error)
+	PublishMessage(ctx context.Context, exchange, routingKey string, contentType string, message []byte) error
+}
+
 // FileHandler handles file operations via RabbitMQ
 type FileHandler struct {
-	manager *manager.Manager
+	manager Broker
 	ctx     context.Context
 }
 
-func NewFileHandler(rmqManager *manager.Manager, ctx context.Context) *FileHandler {
+func NewFileHandler(rmqManager Broker, ctx context.Context) *FileHandler {
 	return &FileHandler{
 		manager: rmqManager,
 		ctx:     ctx,
@@ -57,7 +67,7 @@ func (h *FileHandler) UploadFile(filename string, fileContent io.Reader, fileSiz
 	// Generate transaction ID
 	transactionID := uuid.New().String()
 
-	err := h.UploadFileWithTransactionID(transactionID, filename, fileContent, fileSize, storageID)
+	err := h.UploadFileWithTransactionID(transactionID, filename, fileContent, fileSize, storageID, "")
 	if err != nil {
 		return "", err
 	}
@@ -67,7 +77,7 @@ func (h *FileHandler) UploadFile(filename string, fileContent io.Reader, fileSiz
 
 // uploadFileChunkedStreaming sends a file in chunks by streaming from the reader
 // This avoids loading the entire file into memory
-func (h *FileHandler) uploadFileChunkedStreaming(transactionID, filename string, fileContent io.Reader, storageID string, totalSize int64) (string, error) {
+func (h *FileHandler) uploadFileChunkedStreaming(transactionID, filename string, fileContent io.Reader, storageID, uploadTransactionID string, totalSize int64) (string, error) {
 	// Calculate number of chunks
 	totalChunks := int((totalSize + ChunkSize - 1) / ChunkSize) // Ceiling division
 
@@ -98,14 +108,15 @@ func (h *FileHandler) uploadFileChunkedStreaming(transactionID, filename string,
 		encodedChunk := base64.StdEncoding.EncodeToString(chunkData)
 
 		chunkRequest := messages.FileChunkRequest{
-			TransactionID: transactionID,
-			StorageID:     storageID,
-			Filename:      filename,
-			ChunkIndex:    chunkIndex,
-			TotalChunks:   totalChunks,
-			ChunkSize:     int64(n),
-			TotalSize:     totalSize,
-			Content:       encodedChunk,
+			TransactionID:       transactionID,
+			StorageID:           storageID,
+			Filename:            filename,
+			ChunkIndex:          chunkIndex,
+			TotalChunks:         totalChunks,
+			ChunkSize:           int64(n),
+			TotalSize:           totalSize,
+			Content:             encodedChunk,
+			UploadTransactionID: uploadTransactionID,
 		}
 
 		messageBody, err := json.Marshal(chunkRequest)
@@ -196,7 +207,8 @@ func (h *FileHandler) WaitForResponse(transactionID string, timeout time.Duratio
 }
 
 // UploadFileAndWait uploads a file and waits for the response
-func (h *FileHandler) UploadFileAndWait(filename string, fileContent io.Reader, fileSize int64, storageID string, timeout time.Duration) (*messages.FileManagerResponse, error) {
+// A non-empty uploadTransactionID stages the file in that multi-file upload until CommitUploadAndWait.
+func (h *FileHandler) UploadFileAndWait(filename string, fileContent io.Reader, fileSize int64, storageID, uploadTransactionID string, timeout time.Duration) (*messages.FileManagerResponse, error) {
 	// Set up response queue BEFORE sending the file to avoid race conditions
 	transactionID := uuid.New().String()
 
@@ -237,7 +249,7 @@ func (h *FileHandler) UploadFileAndWait(filename string, fileContent io.Reader,
 	}
 
 	// Now send the file upload request
-	err = h.UploadFileWithTransactionID(transactionID, filename, fileContent, fileSize, storageID)
+	err = h.UploadFileWithTransactionID(transactionID, filename, fileContent, fileSize, storageID, uploadTransactionID)
 	if err != nil {
 		return nil, err
 	}
@@ -265,7 +277,7 @@ func (h *FileHandler) UploadFileAndWait(filename string, fileContent io.Reader,
 }
 
 // UploadFileWithTransactionID sends a file upload request with a pre-generated transaction ID
-func (h *FileHandler) UploadFileWithTransactionID(transactionID, filename string, fileContent io.Reader, fileSize int64, storageID string) error {
+func (h *FileHandler) UploadFileWithTransactionID(transactionID, filename string, fileContent io.Reader, fileSize int64, storageID, uploadTransactionID string) error {
 	// Ensure exchange is declared (idempotent)
 	if err := h.manager.DeclareExchange(
 		messages.FileManagerExchange,
@@ -281,7 +293,7 @@ func (h *FileHandler) UploadFileWithTransactionID(transactionID, filename string
 	// Determine if we need to chunk the file
 	// Chunk if file is larger than ChunkSize
 	if fileSize > ChunkSize {
-		_, err := h.uploadFileChunkedStreaming(transactionID, filename, fileContent, storageID, fileSize)
+		_, err := h.uploadFileChunkedStreaming(transactionID, filename, fileContent, storageID, uploadTransactionID, fileSize)
 		return err
 	}
 
@@ -293,12 +305,13 @@ func (h *FileHandler) UploadFileWithTransactionID(transactionID, filename string
 
 	encodedContent := base64.StdEncoding.EncodeToString(contentBytes)
 	uploadRequest := messages.FileUploadRequest{
-		TransactionID: transactionID,
-		StorageID:     storageID,
-		Filename:      filename,
-		Content:       encodedContent,
-		Size:          fileSize,
-		IsChunked:     false,
+		TransactionID:       transactionID,
+		StorageID:           storageID,
+		Filename:            filename,
+		Content:             encodedContent,
+		Size:                fileSize,
+		IsChunked:           false,
+		UploadTransactionID: uploadTransactionID,
 	}
 
 	messageBody, err := json.Marshal(uploadRequest)
@@ -405,8 +418,9 @@ func (h *FileHandler) GetFilesAndWait(storageID string, timeout time.Duration) (
 }
 
 // GetFileAndWait retrieves a specific file and waits for the response
+// version selects an older version of the file; 0 retrieves the current one
 // Returns the file content in the response Data field as []byte
-func (h *FileHandler) GetFileAndWait(storageID, filename string, timeout time.Duration) (*messages.FileManagerResponse, []byte, error) {
+func (h *FileHandler) GetFileAndWait(storageID, filename string, version int, timeout time.Duration) (*messages.FileManagerResponse, []byte, error) {
 	// Generate transaction ID
 	transactionID := uuid.New().String()
 
@@ -487,6 +501,7 @@ func (h *FileHandler) GetFileAndWait(storageID, filename string, timeout time.Du
 		TransactionID: transactionID,
 		StorageID:     storageID,
 		Filename:      filename,
+		Version:       version,
 	}
 
 	messageBody, err := json.Marshal(request)
@@ -615,3 +630,107 @@ chunkLoop:
 
 	return initialResponse, fileContent, nil
 }
+
+// CopyFilesAndWait copies files of a storage into another inside the filemanager and waits for the response
+// An empty filenames list copies every file and an empty dstStorageID creates a new storage;
+// the response's StorageID is the storage the files were copied into.
+func (h *FileHandler) CopyFilesAndWait(storageID string, filenames []string, dstStorageID string, timeout time.Duration) (*messages.FileManagerResponse, error) {
+	return h.requestAndWait(messages.TopicFileManagerCopyFiles, "copy.files", messages.FileManagerRequest{
+		TransactionID:        uuid.New().String(),
+		StorageID:            storageID,
+		Filenames:            filenames,
+		DestinationStorageID: dstStorageID,
+	}, timeout)
+}
+
+// CommitUploadAndWait stores the files staged by a multi-file upload and waits for the response
+// The response lists every file under the name it was stored as.
+func (h *FileHandler) CommitUploadAndWait(uploadTransactionID string, timeout time.Duration) (*messages.FileManagerResponse, error) {
+	// The filemanager answers under the upload's transaction ID
+	request := messages.FileManagerRequest{TransactionID: uploadTransactionID}
+	return h.requestAndWait(messages.TopicFileManagerCommitUpload, "commit.upload", request, timeout)
+}
+
+// AbortUploadAndWait discards the files staged by a multi-file upload and waits for the response
+func (h *FileHandler) AbortUploadAndWait(uploadTransactionID string, timeout time.Duration) (*messages.FileManagerResponse, error) {
+	request := messages.FileManagerRequest{TransactionID: uploadTransactionID}
+	return h.requestAndWait(messages.TopicFileManagerAbortUpload, "abort.upload", request, timeout)
+}
+
+// requestAndWait publishes request to topic and waits for its single response
+// The filemanager answers under <response topic>.<operation>.<transaction ID>.
+func (h *FileHandler) requestAndWait(topic, operation string, request messages.FileManagerRequest, timeout time.Duration) (*messages.FileManagerResponse, error) {
+	// Create response queue first
+	responseQueue, err := h.manager.DeclareQueue(
+		"",    // let RabbitMQ generate a unique queue name
+		false, // not durable
+		true,  // auto-delete
+		true,  // exclusive
+		false, // no-wait
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare response queue: %w", err)
+	}
+
+	// Bind queue to receive responses for this transaction
+	responseRoutingKey := fmt.Sprintf("%s.%s.%s", messages.TopicFileManagerResponse, operation, request.TransactionID)
+	if err := h.manager.QueueBind(
+		responseQueue.Name,
+		responseRoutingKey,
+		messages.FileManagerExchange,
+		false,
+	); err != nil {
+		return nil, fmt.Errorf("failed to bind response queue: %w", err)
+	}
+
+	// Start consuming BEFORE sending the request
+	msgs, err := h.manager.Consume(
+		responseQueue.Name,
+		"",    // consumer tag (empty = auto-generated)
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start consuming: %w", err)
+	}
+
+	// Encode the request
+	messageBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Publish the request
+	if err := h.manager.PublishMessage(
+		h.ctx,
+		messages.FileManagerExchange,
+		topic,
+		"application/json",
+		messageBody,
+	); err != nil {
+		return nil, fmt.Errorf("failed to publish request: %w", err)
+	}
+
+	// Set up timeout
+	ctx, cancel := context.WithTimeout(h.ctx, timeout)
+	defer cancel()
+
+	// Wait for response
+	select {
+	case msg := <-msgs:
+		var response messages.FileManagerResponse
+		if err := json.Unmarshal(msg.Body, &response); err != nil {
+			msg.Nack(false, false)
+			return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+
+		// Acknowledge the message
+		msg.Ack(false)
+
+		return &response, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("timeout waiting for response: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,336 @@
+// Package tus keeps the state of resumable uploads made with the tus 1.0 protocol
+// Each upload is a pair of files in the store's directory: <id>.bin holds the bytes received
+// so far and <id>.json its length, metadata and result, so uploads survive gateway restarts.
+package tus
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Version is the protocol version spoken by the gateway
+const Version = "1.0.0"
+
+var (
+	ErrNotFound       = errors.New("upload not found")
+	ErrOffsetMismatch = errors.New("upload offset doesn't match the bytes received")
+	ErrCompleted      = errors.New("upload is already complete")
+	ErrTooLarge       = errors.New("upload is larger than the maximum size")
+)
+
+// Upload is the persisted state of one resumable upload
+type Upload struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	RawMeta   string            `json:"raw_metadata,omitempty"` // Upload-Metadata header as sent, echoed back by HEAD
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+
+	// Set once the upload was forwarded to the filemanager
+	StorageID  string `json:"storage_id,omitempty"`
+	StoredPath string `json:"stored_path,omitempty"`
+
+	// Offset is the number of bytes received, read from the data file
+	Offset int64 `json:"-"`
+}
+
+// Forwarded reports whether the upload was handed to the filemanager
+func (u *Upload) Forwarded() bool {
+	return u.StorageID != ""
+}
+
+// Store persists uploads in a directory
+type Store struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+// uploadLock serializes requests to one upload
+type uploadLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// NewStore opens the store in dir, creating it if needed
+// Uploads expire ttl after their last write; 0 keeps them until deleted.
+// Uploads longer than maxSize bytes are refused; 0 accepts any length.
+func NewStore(dir string, ttl time.Duration, maxSize int64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	return &Store{dir: dir, ttl: ttl, maxSize: maxSize, locks: make(map[string]*uploadLock)}, nil
+}
+
+// MaxSize returns the largest upload accepted in bytes, or 0 if there is no limit
+func (s *Store) MaxSize() int64 {
+	return s.maxSize
+}
+
+// Lock serializes requests to the upload id and returns the function releasing it
+func (s *Store) Lock(id string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &uploadLock{}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Create starts an upload of length bytes with the metadata from the Upload-Metadata header
+func (s *Store) Create(length int64, rawMetadata string) (*Upload, error) {
+	if s.maxSize > 0 && length > s.maxSize {
+		return nil, fmt.Errorf("%w: %d bytes requested, %d allowed", ErrTooLarge, length, s.maxSize)
+	}
+	metadata, err := ParseMetadata(rawMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	upload := &Upload{
+		ID:        strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Length:    length,
+		Metadata:  metadata,
+		RawMeta:   rawMetadata,
+		CreatedAt: now,
+	}
+	s.touch(upload, now)
+
+	data, err := os.OpenFile(s.dataPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload: %w", err)
+	}
+	data.Close()
+	if err := s.save(upload); err != nil {
+		os.Remove(s.dataPath(upload.ID))
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Get loads an upload with its current offset
+func (s *Store) Get(id string) (*Upload, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	raw, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	var upload Upload
+	if err := json.Unmarshal(raw, &upload); err != nil {
+		return nil, fmt.Errorf("failed to decode upload %s: %w", id, err)
+	}
+
+	if upload.Forwarded() {
+		upload.Offset = upload.Length
+		return &upload, nil
+	}
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload data: %w", err)
+	}
+	upload.Offset = stat.Size()
+	return &upload, nil
+}
+
+// Append writes the bytes of r at offset, stopping at the upload's length
+// Bytes written before r fails are kept, so the client can resume from the returned offset.
+// The caller must hold the upload's lock.
+func (s *Store) Append(id string, offset int64, r io.Reader) (*Upload, error) {
+	upload, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Forwarded() {
+		return upload, ErrCompleted
+	}
+	if offset != upload.Offset {
+		return upload, ErrOffsetMismatch
+	}
+
+	data, err := os.OpenFile(s.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return upload, fmt.Errorf("failed to open upload data: %w", err)
+	}
+	n, copyErr := io.Copy(data, io.LimitReader(r, upload.Length-upload.Offset))
+	if err := data.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	upload.Offset += n
+
+	s.touch(upload, time.Now().UTC())
+	if err := s.save(upload); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		return upload, fmt.Errorf("failed to write upload data: %w", copyErr)
+	}
+	return upload, nil
+}
+
+// Open returns the bytes received for an upload
+func (s *Store) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	return os.Open(s.dataPath(id))
+}
+
+// Finish records where the filemanager stored a complete upload and drops its data
+// The state is kept until it expires so clients can still look up the result.
+func (s *Store) Finish(upload *Upload, storageID, storedPath string) error {
+	upload.StorageID = storageID
+	upload.StoredPath = storedPath
+	if err := s.save(upload); err != nil {
+		return err
+	}
+	if err := os.Remove(s.dataPath(upload.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove upload data: %w", err)
+	}
+	return nil
+}
+
+// Delete removes an upload and its data
+func (s *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(s.infoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	if err := os.Remove(s.dataPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete upload data: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpired deletes the uploads past their expiry and returns how many were removed
+func (s *Store) PurgeExpired() (int, error) {
+	if s.ttl <= 0 {
+		return 0, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list uploads: %w", err)
+	}
+
+	now := time.Now()
+	purged := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		unlock := s.Lock(id)
+		upload, err := s.Get(id)
+		if err == nil && now.After(upload.ExpiresAt) {
+			if err := s.Delete(id); err == nil {
+				purged++
+			}
+		}
+		unlock()
+	}
+	return purged, nil
+}
+
+// touch moves an upload's expiry to ttl after now
+func (s *Store) touch(upload *Upload, now time.Time) {
+	if s.ttl > 0 {
+		upload.ExpiresAt = now.Add(s.ttl)
+	}
+}
+
+// save atomically writes an upload's state
+func (s *Store) save(upload *Upload) error {
+	raw, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload: %w", err)
+	}
+	tmp := s.infoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return fmt.Errorf("failed to save upload: %w", err)
+	}
+	if err := os.Rename(tmp, s.infoPath(upload.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save upload: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+// validID reports whether id could have been handed out by Create, so it is safe in a path
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseMetadata decodes an Upload-Metadata header: comma-separated keys, each followed
+// by a space and its base64-encoded value unless the value is empty
+func ParseMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata: empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,160 @@
+package tus_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgarcoime/Cthulhu-gateway/internal/tus"
+)
+
+func newStore(t *testing.T, dir string, maxSize int64) *tus.Store {
+	t.Helper()
+	s, err := tus.NewStore(dir, time.Hour, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustAppend(t *testing.T, s *tus.Store, id string, offset int64, data string) *tus.Upload {
+	t.Helper()
+	upload, err := s.Append(id, offset, strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Append at %d: %v", offset, err)
+	}
+	return upload
+}
+
+func TestOffsetMismatch(t *testing.T) {
+	s := newStore(t, t.TempDir(), 0)
+	upload, err := s.Create(10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, upload.ID, 0, "0123")
+
+	for _, offset := range []int64{0, 2, 5} {
+		got, err := s.Append(upload.ID, offset, strings.NewReader("xx"))
+		if !errors.Is(err, tus.ErrOffsetMismatch) {
+			t.Errorf("Append at %d: got %v, want ErrOffsetMismatch", offset, err)
+		}
+		if got == nil || got.Offset != 4 {
+			t.Errorf("Append at %d: got %+v, want the upload at offset 4", offset, got)
+		}
+	}
+}
+
+func TestAppendStopsAtLength(t *testing.T) {
+	s := newStore(t, t.TempDir(), 0)
+	upload, err := s.Create(6, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustAppend(t, s, upload.ID, 0, "0123456789"); got.Offset != 6 {
+		t.Errorf("offset %d after appending past the length, want 6", got.Offset)
+	}
+}
+
+// Uploads live on disk, so a store opened on the same directory resumes them
+func TestResumeAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir, 0)
+	upload, err := s.Create(10, "filename ZG9jcy9hLnR4dA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, s, upload.ID, 0, "0123")
+
+	s = newStore(t, dir, 0)
+	resumed, err := s.Get(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Offset != 4 || resumed.Length != 10 || resumed.Metadata["filename"] != "docs/a.txt" {
+		t.Errorf("reopened upload %+v, want docs/a.txt at offset 4 of 10", resumed)
+	}
+	if got := mustAppend(t, s, upload.ID, 4, "456789"); got.Offset != 10 {
+		t.Errorf("offset %d after resuming, want 10", got.Offset)
+	}
+
+	data, err := s.Open(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	if content, _ := io.ReadAll(data); string(content) != "0123456789" {
+		t.Errorf("received %q, want 0123456789", content)
+	}
+}
+
+func TestFinish(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir, 0)
+	upload, err := s.Create(3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload = mustAppend(t, s, upload.ID, 0, "abc")
+	if err := s.Finish(upload, "abcdefghij", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	finished, err := newStore(t, dir, 0).Get(upload.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !finished.Forwarded() || finished.StorageID != "abcdefghij" || finished.Offset != 3 {
+		t.Errorf("finished upload %+v, want it forwarded to abcdefghij at offset 3", finished)
+	}
+	if _, err := s.Append(upload.ID, 3, strings.NewReader("")); !errors.Is(err, tus.ErrCompleted) {
+		t.Errorf("Append to a finished upload: got %v, want ErrCompleted", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	s := newStore(t, t.TempDir(), 8)
+	if s.MaxSize() != 8 {
+		t.Errorf("MaxSize() = %d, want 8", s.MaxSize())
+	}
+	if _, err := s.Create(9, ""); !errors.Is(err, tus.ErrTooLarge) {
+		t.Errorf("Create over the maximum: got %v, want ErrTooLarge", err)
+	}
+	if _, err := s.Create(8, ""); err != nil {
+		t.Errorf("Create at the maximum: %v", err)
+	}
+}
+
+func TestDeleteAndPurge(t *testing.T) {
+	s, err := tus.NewStore(t.TempDir(), time.Nanosecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := s.Create(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := s.Create(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(deleted.ID); !errors.Is(err, tus.ErrNotFound) {
+		t.Errorf("Get of a deleted upload: got %v, want ErrNotFound", err)
+	}
+
+	time.Sleep(time.Millisecond)
+	if n, err := s.PurgeExpired(); err != nil || n != 1 {
+		t.Errorf("PurgeExpired() = %d, %v; want 1 expired upload", n, err)
+	}
+	if _, err := s.Get(kept.ID); !errors.Is(err, tus.ErrNotFound) {
+		t.Errorf("Get of a purged upload: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get("../../etc/passwd"); !errors.Is(err, tus.ErrNotFound) {
+		t.Errorf("Get of an invalid ID: got %v, want ErrNotFound", err)
+	}
+}